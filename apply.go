@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// runApply implements `archive_tool apply --use <candidate-id>`, swapping a
+// replaced link for another candidate recorded in the run history, and
+// `archive_tool apply --pending`, making the ticked replacements in the
+// review checklist.
+func runApply(args []string) {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	use := fs.String("use", "", "`id` of the candidate snapshot to switch to")
+	pending := fs.Bool("pending", false, "apply the ticked items in "+pendingFileName)
+	pr := fs.Int("pr", 0, "first follow the /archive use and /archive skip commands in the comments on pull request `number`")
+	repo := fs.String("repo", os.Getenv("GITHUB_REPOSITORY"), "GitHub repository of --pr, as `owner/name`")
+	gitCommit := fs.Bool("git-commit", false, "commit the rewritten bookmarks, authored by your [identity]")
+	fs.BoolVar(&console.ASCII, "ascii", false, "plain ASCII output without unicode symbols")
+	fs.Parse(args)
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		os.Exit(1)
+	}
+	dir := defaultBookmarksDir()
+	if cfg.Dir != "" {
+		dir = cfg.Dir
+	}
+	if fs.NArg() > 0 {
+		dir = fs.Arg(0)
+	}
+	if err := cfg.loadCollectionConfig(dir); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if policy := cfg.applyIdentity(dir); policy != nil && policy.Queue {
+		fmt.Fprintf(os.Stderr, "Error: %s may only propose replacements in this collection; someone else applies them\n", defaultString(identity.String(), "everyone"))
+		os.Exit(1)
+	}
+	*gitCommit = *gitCommit || cfg.GitCommit
+
+	if *pending || *pr > 0 {
+		list, err := loadPendingList(dir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error %v\n", err)
+			os.Exit(1)
+		}
+		if *pr > 0 {
+			var opts runOptions
+			opts.finishClient(cfg)
+			if err := followPRComments(opts.httpClient(), cfg, list, *repo, *pr); err != nil {
+				fmt.Fprintf(os.Stderr, "Error reading pull request #%d: %v\n", *pr, err)
+				os.Exit(1)
+			}
+		}
+		if err := applyPending(dir, list, *gitCommit); err != nil {
+			fmt.Fprintf(os.Stderr, "Error %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *use == "" {
+		fmt.Fprintln(os.Stderr, "Usage: archive_tool apply --use <candidate-id>")
+		fmt.Fprintln(os.Stderr, "       archive_tool apply --pending [--pr number] [directory]")
+		os.Exit(2)
+	}
+
+	lock, err := loadLockFile(false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading lock file: %v\n", err)
+		os.Exit(1)
+	}
+
+	replacement, candidate := lock.findCandidate(*use)
+	if candidate == nil {
+		fmt.Fprintf(os.Stderr, "Error: candidate %s not found in run history\n", *use)
+		os.Exit(1)
+	}
+
+	if replacement.Chosen == candidate.ID {
+		fmt.Printf("%s already uses %s\n", replacement.File, candidate.URL)
+		return
+	}
+
+	bookmark, err := parseBookmarkFile(replacement.File)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error parsing %s: %v\n", replacement.File, err)
+		os.Exit(1)
+	}
+	if bookmark.Link != replacement.URL {
+		fmt.Fprintf(os.Stderr, "Error: %s now links to %s, not the recorded %s; refusing to overwrite\n",
+			replacement.File, bookmark.Link, replacement.URL)
+		os.Exit(1)
+	}
+
+	if err := lock.rewriteBookmark(bookmark, candidate.URL); err != nil {
+		fmt.Fprintf(os.Stderr, "Error updating %s: %v\n", replacement.File, err)
+		os.Exit(1)
+	}
+
+	lock.journalOrWarn(journalEntry{Op: "applied", File: replacement.File, Candidate: candidate.ID})
+	replacement.URL = candidate.URL
+	replacement.Chosen = candidate.ID
+	markFileProcessed(lock, replacement.File)
+
+	if err := saveLockFile(lock); err != nil {
+		fmt.Fprintf(os.Stderr, "Error saving lock file: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("%s Updated: %s\n  -> %s (%s)\n", console.mark(), replacement.File, candidate.URL, candidate.Provider)
+	if *gitCommit {
+		run := &RunRecord{ID: newRunID(time.Now()), User: identity.String(), Replaced: 1, Replacements: []*Replacement{replacement}}
+		if err := commitRewrites(dir, lock.rewritten, run); err != nil {
+			fmt.Fprintf(os.Stderr, "Error committing %s: %v\n", replacement.File, err)
+			os.Exit(1)
+		}
+	}
+}
+
+// findCandidate searches the run history, newest first, for a candidate ID.
+func (lock *LockFile) findCandidate(id string) (*Replacement, *snapshotCandidate) {
+	for i := len(lock.Runs) - 1; i >= 0; i-- {
+		for _, replacement := range lock.Runs[i].Replacements {
+			for _, candidate := range replacement.Candidates {
+				if candidate.ID == id {
+					return replacement, candidate
+				}
+			}
+		}
+	}
+	return nil, nil
+}
+
+// writeRunReport saves a run record, including every replacement and its
+// candidates, as a standalone JSON report.
+func writeRunReport(path string, run *RunRecord) error {
+	data, err := json.MarshalIndent(run, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'), 0644)
+}
@@ -2,14 +2,17 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"crypto/sha256"
-	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"net/http"
 	"os"
 	"path/filepath"
-	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -28,19 +31,227 @@ func defaultBookmarksDir() string {
 }
 
 type BookmarkFile struct {
-	Path    string
-	Link    string
+	Path string
+	Link string
+	// Written is the link as it appears in the file, when tidyLink changed it
+	Written string
 	Date    string
 	Content string
+	Tags    []string
 	Headers map[string]string
+
+	// Provenance holds the fields of the archive_tool block, if any
+	Provenance map[string]string
 }
 
 type LockFile struct {
+	// Version is the format the state file was written in
+	Version int `json:"archive_tool_version,omitempty"`
+
+	// Root is the collection the paths below are relative to, itself
+	// relative to the state file's directory; see encodeLockFile
+	Root string `json:"root,omitempty"`
+
 	ProcessedFiles map[string]string `json:"processed_files"` // path -> hash
 	LastRun        time.Time         `json:"last_run"`
+	Runs           []*RunRecord      `json:"runs,omitempty"`
+
+	// URLHistory keeps the most recent check results per URL
+	URLHistory map[string][]StatusEntry `json:"url_history,omitempty"`
+
+	// URLLives keeps each URL's first check and death date for survival
+	// analysis
+	URLLives map[string]URLLife `json:"url_lives,omitempty"`
+
+	// Validators holds the ETag/Last-Modified of alive URLs for conditional
+	// rechecks
+	Validators map[string]linkValidators `json:"validators,omitempty"`
+
+	// RecheckAfter is when --recheck next checks each alive URL, from its
+	// caching headers
+	RecheckAfter map[string]time.Time `json:"recheck_after,omitempty"`
+
+	LastDigest time.Time      `json:"last_digest,omitempty"`
+	Digests    []notification `json:"digests,omitempty"`
+
+	// SaveJobs is the Save Page Now queue, by bookmarked URL
+	SaveJobs map[string]*saveJob `json:"save_jobs,omitempty"`
+
+	// Blobs are the stored copies of downloaded content by content key, and
+	// BlobIndex the key of each downloaded URL's copy
+	Blobs     map[string]*blobRecord `json:"blobs,omitempty"`
+	BlobIndex map[string]string      `json:"blob_index,omitempty"`
+
+	// Audits are the latest full censuses of the collection's links, the
+	// last one possibly still in progress
+	Audits []*auditCensus `json:"audits,omitempty"`
+
+	// Watches are the hosts watch-domains watches for signs of life
+	Watches map[string]*DomainWatch `json:"domain_watches,omitempty"`
+
+	journal *journal
+
+	// root is Root resolved, for the next save when no collection is given
+	root string
+
+	// processedHashes maps content hashes to a path processed with that
+	// content, built on first use, and moved counts the bookmarks it
+	// recognized at a new path
+	processedHashes map[string]string
+	moved           int
+
+	// rewritten lists the files rewritten since the lock file was loaded,
+	// for --git-commit
+	rewritten []string
+
+	// dryRun makes rewrites and journal entries no-ops, for --dry-run
+	dryRun bool
+	// clock is the run's, for the times of journal entries and saves; nil
+	// means the system clock
+	clock Clock
+}
+
+func (lock *LockFile) now() time.Time {
+	if lock.clock == nil {
+		return time.Now()
+	}
+	return lock.clock.Now()
+}
+
+// maxRunHistory bounds how many run records are kept in the lock file.
+const maxRunHistory = 500
+
+type RunRecord struct {
+	ID       string    `json:"id"`
+	Trigger  string    `json:"trigger"` // manual or schedule
+	Status   string    `json:"status"`  // completed or skipped-overlap
+	User     string    `json:"user,omitempty"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Checked  int       `json:"checked"`
+	Replaced int       `json:"replaced"`
+	Errors   int       `json:"errors"`
+	Skipped  int       `json:"skipped"`
+	Filtered int       `json:"filtered,omitempty"`
+	Flaky    int       `json:"flaky,omitempty"`
+	Pending  int       `json:"pending,omitempty"`
+	Queued   int       `json:"queued,omitempty"`
+	Saving   int       `json:"saving,omitempty"` // alive links queued for Save Page Now
+	Expanded int       `json:"expanded,omitempty"`
+	Invalid  int       `json:"invalid,omitempty"`
+	Fixed    int       `json:"fixed,omitempty"`
+
+	// Canonical counts dead AMP pages and mirrors pointed at the live
+	// article instead
+	Canonical int `json:"canonical,omitempty"`
+
+	// Sensitive counts dead sensitive links, annotated instead of replaced
+	Sensitive int `json:"sensitive,omitempty"`
+
+	// AssetsChecked, DeadAssets and AssetsReplaced count embedded assets
+	AssetsChecked  int `json:"assets_checked,omitempty"`
+	DeadAssets     int `json:"dead_assets,omitempty"`
+	AssetsReplaced int `json:"assets_replaced,omitempty"`
+
+	// BodyLinksChecked, DeadBodyLinks and BodyLinksReplaced count the links
+	// in bookmark bodies
+	BodyLinksChecked  int `json:"body_links_checked,omitempty"`
+	DeadBodyLinks     int `json:"dead_body_links,omitempty"`
+	BodyLinksReplaced int `json:"body_links_replaced,omitempty"`
+
+	// NotModified counts conditional rechecks answered with 304
+	NotModified int    `json:"not_modified,omitempty"`
+	Shard       string `json:"shard,omitempty"`
+	Profile     string `json:"profile,omitempty"`
+
+	// ErrorKinds counts errors by category (dns, timeout, rate_limited, ...)
+	ErrorKinds map[string]int `json:"error_kinds,omitempty"`
+
+	// Failed are the files that had errors; RetryOf is the run a retry
+	// run took its files from
+	Failed  []string `json:"failed,omitempty"`
+	RetryOf string   `json:"retry_of,omitempty"`
+
+	// Panics are the files whose processing panicked, with the stack
+	Panics []*PanicRecord `json:"panics,omitempty"`
+
+	Sample       *SampleEstimate   `json:"sample,omitempty"`
+	Coverage     *CoverageStats    `json:"coverage,omitempty"`
+	SlowHosts    []*HostLatency    `json:"slow_hosts,omitempty"`
+	Redirects    []*RedirectRecord `json:"redirects,omitempty"`
+	DeadDomains  []*DeadDomain     `json:"dead_domains,omitempty"`
+	RDAP         []*RDAPRecord     `json:"rdap,omitempty"`
+	Secrets      []*SecretRecord   `json:"secrets,omitempty"`
+	BodyLinks    []*BodyLinkRecord `json:"body_links,omitempty"`
+	Replacements []*Replacement    `json:"replacements,omitempty"`
+
+	// Restored are the replaced links watch-domains put back
+	Restored []*Restoration `json:"restored,omitempty"`
+}
+
+// recordError counts a failed file under its error category, and lists it
+// for `archive_tool retry`.
+func (run *RunRecord) recordError(file string, err error) {
+	run.Errors++
+	if run.ErrorKinds == nil {
+		run.ErrorKinds = make(map[string]int)
+	}
+	run.ErrorKinds[errorKind(err)]++
+	if file != "" && !containsString(run.Failed, file) {
+		run.Failed = append(run.Failed, file)
+	}
+	e := event{Event: "error", Run: run.ID, File: file, Kind: errorKind(err), Error: err.Error()}
+	var linkErr *LinkError
+	if errors.As(err, &linkErr) {
+		e.URL = linkErr.URL
+	}
+	events.emit(e)
+}
+
+// Replacement records a rewritten link together with every candidate
+// snapshot that was considered, so a human can review the choice.
+type Replacement struct {
+	File       string               `json:"file"`
+	Original   string               `json:"original"`
+	URL        string               `json:"url"`
+	Chosen     string               `json:"chosen"`
+	Candidates []*snapshotCandidate `json:"candidates"`
+	// Redirects is the redirect chain the dead link's check followed
+	Redirects []string `json:"redirects,omitempty"`
+
+	// Language is the snapshot's detected language; Suspicious says why it
+	// may be the wrong page, e.g. another locale's
+	Language   string `json:"language,omitempty"`
+	Suspicious string `json:"suspicious,omitempty"`
+
+	// TextMatch is the share of the bookmark's saved text the snapshot has
+	TextMatch float64 `json:"text_match,omitempty"`
+
+	// Pages are the captures of the article's further pages, with
+	// --follow-pages
+	Pages []string `json:"pages,omitempty"`
 }
 
+func newRunID(now time.Time) string {
+	return now.UTC().Format("20060102T150405.000Z")
+}
+
+func (lock *LockFile) addRun(run *RunRecord) {
+	if run.User == "" {
+		run.User = identity.String()
+	}
+	lock.Runs = append(lock.Runs, run)
+	if len(lock.Runs) > maxRunHistory {
+		lock.Runs = lock.Runs[len(lock.Runs)-maxRunHistory:]
+	}
+}
+
+// getLockFilePath returns the state file, ~/.archive_tool.lock unless
+// ARCHIVE_TOOL_LOCK names another.
 func getLockFilePath() string {
+	if path := os.Getenv("ARCHIVE_TOOL_LOCK"); path != "" {
+		return path
+	}
 	home, err := os.UserHomeDir()
 	if err != nil {
 		return ".archive_tool.lock"
@@ -48,44 +259,88 @@ func getLockFilePath() string {
 	return filepath.Join(home, ".archive_tool.lock")
 }
 
-func loadLockFile() (*LockFile, error) {
+// loadLockFile reads the state file. With dryRun nothing is written while
+// loading: a corrupt file is left in place, a restored backup is not written
+// back and replayed journals are applied in memory only, and the returned
+// lock's rewrites and journal entries are no-ops.
+func loadLockFile(dryRun bool) (*LockFile, error) {
 	lockPath := getLockFilePath()
 	data, err := os.ReadFile(lockPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return &LockFile{
-				ProcessedFiles: make(map[string]string),
-				LastRun:        time.Now(),
-			}, nil
+	var lock *LockFile
+	switch {
+	case os.IsNotExist(err):
+		lock = &LockFile{
+			ProcessedFiles: make(map[string]string),
+			LastRun:        time.Now(),
 		}
+	case err != nil:
 		return nil, err
+	default:
+		lock, err = decodeLockFile(data)
+		if err != nil {
+			lock = recoverLockFile(lockPath, err, dryRun)
+		}
+		if lock.Version > formatVersion {
+			return nil, fmt.Errorf("%s: %w", lockPath, newerFormatError{lock.Version})
+		}
+		lock.resolvePaths(lockPath)
 	}
 
-	var lock LockFile
-	if err := json.Unmarshal(data, &lock); err != nil {
-		return &LockFile{
-			ProcessedFiles: make(map[string]string),
-			LastRun:        time.Now(),
-		}, nil
+	lock.dryRun = dryRun
+	lock.replayJournals(lockPath)
+	return lock, nil
+}
+
+func saveLockFile(lock *LockFile) error {
+	lockPath := getLockFilePath()
+	lock.LastRun = lock.now()
+	lock.Version = formatVersion
+
+	data, err := encodeLockFile(lock, lockPath)
+	if err != nil {
+		return err
 	}
 
-	if lock.ProcessedFiles == nil {
-		lock.ProcessedFiles = make(map[string]string)
+	if err := rotateStateBackups(lockPath); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: could not back up state file: %v\n", err)
 	}
 
-	return &lock, nil
+	if err := writeFileAtomic(lockPath, data, 0644); err != nil {
+		return err
+	}
+	lock.checkpointJournal()
+	return nil
 }
 
-func saveLockFile(lock *LockFile) error {
-	lockPath := getLockFilePath()
-	lock.LastRun = time.Now()
-
-	data, err := json.MarshalIndent(lock, "", "  ")
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// into place, so an interrupted write never leaves a truncated file behind.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
 	if err != nil {
 		return err
 	}
+	tmpPath := tmp.Name()
 
-	return os.WriteFile(lockPath, data, 0644)
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Chmod(tmpPath, perm); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
 }
 
 func computeFileHash(filePath string) (string, error) {
@@ -93,10 +348,17 @@ func computeFileHash(filePath string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	hash := sha256.Sum256(data)
-	return fmt.Sprintf("%x", hash), nil
+	return contentHash(data), nil
+}
+
+func contentHash(data []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(data))
 }
 
+// isFileProcessed reports whether a file's current content was processed,
+// at this path or another one. A bookmark moved or copied to a new path is
+// recorded there, and a moved one no longer at its old path, so that
+// reorganizing the collection does not make every file look new.
 func isFileProcessed(lock *LockFile, filePath string) bool {
 	currentHash, err := computeFileHash(filePath)
 	if err != nil {
@@ -104,7 +366,27 @@ func isFileProcessed(lock *LockFile, filePath string) bool {
 	}
 
 	storedHash, exists := lock.ProcessedFiles[filePath]
-	return exists && storedHash == currentHash
+	if exists && storedHash == currentHash {
+		return true
+	}
+	if lock.processedHashes == nil {
+		lock.processedHashes = make(map[string]string, len(lock.ProcessedFiles))
+		for path, hash := range lock.ProcessedFiles {
+			lock.processedHashes[hash] = path
+		}
+	}
+	oldPath, ok := lock.processedHashes[currentHash]
+	if !ok || lock.ProcessedFiles[oldPath] != currentHash {
+		return false
+	}
+	if _, err := os.Stat(oldPath); os.IsNotExist(err) {
+		delete(lock.ProcessedFiles, oldPath)
+	}
+	lock.journalOrWarn(journalEntry{Op: "processed", File: filePath, Hash: currentHash})
+	lock.ProcessedFiles[filePath] = currentHash
+	lock.processedHashes[currentHash] = filePath
+	lock.moved++
+	return true
 }
 
 func markFileProcessed(lock *LockFile, filePath string) error {
@@ -112,13 +394,128 @@ func markFileProcessed(lock *LockFile, filePath string) error {
 	if err != nil {
 		return err
 	}
+	lock.journalOrWarn(journalEntry{Op: "processed", File: filePath, Hash: hash})
 	lock.ProcessedFiles[filePath] = hash
+	if lock.processedHashes != nil {
+		lock.processedHashes[hash] = filePath
+	}
 	return nil
 }
 
 func main() {
-	if len(os.Args) > 1 && (os.Args[1] == "-h" || os.Args[1] == "--help") {
-		fmt.Println("Usage: archive_tool [directory]")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "systemd":
+			runSystemd(os.Args[2:])
+			return
+		case "daemon":
+			runDaemon(os.Args[2:])
+			return
+		case "ctl":
+			runCtl(os.Args[2:])
+			return
+		case "apply":
+			runApply(os.Args[2:])
+			return
+		case "history":
+			runHistory(os.Args[2:])
+			return
+		case "digest":
+			runDigest(os.Args[2:])
+			return
+		case "report":
+			runReport(os.Args[2:])
+			return
+		case "check-one":
+			runCheckOne(os.Args[2:])
+			return
+		case "rpc":
+			runRPC(os.Args[2:])
+			return
+		case "coverage":
+			runCoverage(os.Args[2:])
+			return
+		case "save":
+			runSave(os.Args[2:])
+			return
+		case "doctor":
+			runDoctor(os.Args[2:])
+			return
+		case "index":
+			runIndex(os.Args[2:])
+			return
+		case "query":
+			runQuery(os.Args[2:])
+			return
+		case "site":
+			runSite(os.Args[2:])
+			return
+		case "mirror-assets":
+			runMirrorAssets(os.Args[2:])
+			return
+		case "gc":
+			runGC(os.Args[2:])
+			return
+		case "export-state":
+			runExportState(os.Args[2:])
+			return
+		case "decrypt":
+			runDecrypt(os.Args[2:])
+			return
+		case "verify-archived":
+			runVerifyArchived(os.Args[2:])
+			return
+		case "migrate":
+			runMigrate(os.Args[2:])
+			return
+		case "audit":
+			runAudit(os.Args[2:])
+			return
+		case "audit-diff":
+			runAuditDiff(os.Args[2:])
+			return
+		case "import":
+			runImport(os.Args[2:])
+			return
+		case "watch-domains":
+			runWatchDomains(os.Args[2:])
+			return
+		case "retry":
+			runRetry(os.Args[2:])
+			return
+		}
+	}
+
+	fs := flag.NewFlagSet("archive_tool", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Println("Usage: archive_tool [options] [directory]")
+		fmt.Println("       archive_tool daemon [--schedule \"0 3 * * *\"] [--jitter 10m] [directory]")
+		fmt.Println("       archive_tool ctl pause|resume|status|stop|check <file-or-url>")
+		fmt.Println("       archive_tool apply --use <candidate-id>")
+		fmt.Println("       archive_tool apply --pending [--pr number] [directory]")
+		fmt.Println("       archive_tool history <url>")
+		fmt.Println("       archive_tool retry [--run id] [options] [directory]")
+		fmt.Println("       archive_tool digest [--period daily|weekly] [--force]")
+		fmt.Println("       archive_tool report [--format text|markdown|html] [--template file] [--output file]")
+		fmt.Println("       archive_tool systemd install [--system] [--on-calendar daily] [directory]")
+		fmt.Println("       archive_tool coverage [--output file] [--concurrency 4] [directory]")
+		fmt.Println("       archive_tool save [--urls file] [--bookmarks] [--wait] [--status] [directory]")
+		fmt.Println("       archive_tool check-one [options] <file-or-url>")
+		fmt.Println("       archive_tool rpc [directory]")
+		fmt.Println("       archive_tool doctor [--offline] [directory]")
+		fmt.Println("       archive_tool site [--url https://example.org/bookmarks/] [directory]")
+		fmt.Println("       archive_tool mirror-assets [--max-size 20] [directory]")
+		fmt.Println("       archive_tool gc [--dry-run] [--grace 24h] [directory]")
+		fmt.Println("       archive_tool export-state [--encrypt] [--output file]")
+		fmt.Println("       archive_tool decrypt [--output file] <file>")
+		fmt.Println("       archive_tool verify-archived [--check-only] [--concurrency 4] [directory]")
+		fmt.Println("       archive_tool migrate [--rename old=new] [--date-format layout] [--tags-list] [--retag old=new] [--upgrade] [--dry-run] [directory]")
+		fmt.Println("       archive_tool audit [--interval 15s] [--restart] [--loop] [--every 720h] [--status] [directory]")
+		fmt.Println("       archive_tool audit-diff [--min-host 3] [from-id [to-id]]")
+		fmt.Println("       archive_tool import pinboard [--dry-run] [directory]")
+		fmt.Println("       archive_tool watch-domains [--host host] [--every 6h] [--once] [--no-ct] [--dry-run] [directory]")
+		fmt.Println("       archive_tool index [--output file] [--sql] [directory]")
+		fmt.Println("       archive_tool query [--refresh] [--mode csv] \"SELECT ...\" | <canned query> | --list")
 		fmt.Println("")
 		fmt.Println("A tool to check bookmark files for dead links and replace them with archived versions.")
 		fmt.Println("")
@@ -126,120 +523,1271 @@ func main() {
 		fmt.Println("  directory   Path to directory containing bookmark markdown files")
 		fmt.Println("              (default: ~/pinboard-bookmarks)")
 		fmt.Println("")
+		fmt.Println("Options:")
+		fs.SetOutput(os.Stdout)
+		fs.PrintDefaults()
+		fmt.Println("")
 		fmt.Println("Examples:")
 		fmt.Println("  archive_tool                    # Use default ~/pinboard-bookmarks")
 		fmt.Println("  archive_tool ./my-bookmarks     # Use custom directory")
-		os.Exit(0)
+		fmt.Println("  archive_tool --shard 2/8        # Process the second of eight slices")
+		fmt.Println("  archive_tool --sample 500       # Estimate link rot from 500 random bookmarks")
+		fmt.Println("  archive_tool --measure          # Count dead links each archive could restore")
+		fmt.Println("  archive_tool daemon             # Run on the schedule from the config file")
+		fmt.Println("  archive_tool systemd install    # Write a service + timer for daily runs")
 	}
+	opts := runOptions{Trigger: "manual", Profile: runProfiles["fast"]}
+	opts.register(fs)
+	fs.IntVar(&opts.Concurrency, "concurrency", 0, "check `N` files at once (default 4)")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "check links and look up archives, but only report the replacements; no file is written")
+	fs.Parse(os.Args[1:])
 
-	dir := defaultBookmarksDir()
-	if len(os.Args) > 1 {
-		dir = os.Args[1]
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		os.Exit(1)
 	}
 
-	fmt.Printf("Scanning directory: %s\n", dir)
+	if err := opts.finish(cfg, fs.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "Error %v\n", err)
+		os.Exit(1)
+	}
 
-	files, err := findMarkdownFiles(dir)
+	ctl := newController()
+	ctl.stopOnSignal()
+	if listener, err := ctl.listen(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: control socket unavailable: %v\n", err)
+	} else {
+		defer listener.Close()
+	}
+
+	sdNotify("READY=1")
+	defer sdNotify("STOPPING=1")
+
+	run := runCheck
+	if opts.Sample > 0 {
+		run = runSample
+	}
+	if opts.Measure {
+		run = runMeasure
+	}
+	record, err := run(opts, ctl)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading directory: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Error %v\n", err)
 		os.Exit(1)
 	}
+	// Samples and measurements change nothing worth a notification
+	if run := record; opts.Sample == 0 && !opts.Measure && !opts.DryRun {
+		notifyRunDone(opts.httpClient(), cfg, run)
+	}
+}
+
+// runOptions controls a single pass over the collection.
+type runOptions struct {
+	Dir     string
+	Trigger string // manual, schedule, request or retry
+	Shard   shardSpec
+	Profile runProfile
+	Sample  int
+	Measure bool
+
+	// Queue writes replacements to the PENDING_REPLACEMENTS.md checklist
+	// in Pending instead of rewriting bookmarks
+	Queue   bool
+	Pending *pendingList
+
+	// Explain prints the decision trace for every file, ExplainFiles for
+	// the named ones only
+	Explain      bool
+	ExplainFiles stringList
+
+	BlocklistPath string
+	AllowlistPath string
+	Filter        *urlFilter
+
+	Tags        tagSelection
+	TagPolicies tagPolicies
+
+	ProviderNames string
+	FallbackNames string
+	Providers     *providerChain
+
+	ReportPath string
+	Locale     *locale
+
+	// Transport and Clock replace the network and the system clock, e.g. to
+	// run the pipeline against a fake archive. Nil means the real ones.
+	Transport http.RoundTripper
+	Clock     Clock
+
+	Flaky     flakyPolicy
+	Redirects redirectPolicy
+
+	Shorteners       shortenerSet
+	ExpandShorteners bool
+	MediumDomains    hostSet
+
+	FixLinks bool
+
+	// CheckAssets also checks the images and other assets a bookmark body
+	// embeds and replaces dead ones
+	CheckAssets bool
+
+	// NoBodyLinks leaves the links in bookmark bodies unchecked
+	NoBodyLinks bool
+
+	// DetectLanguage records the language of archived copies in the
+	// frontmatter and flags replacements in another language
+	DetectLanguage bool
+
+	// FollowPages follows the rel=next chain of replaced multi-page
+	// articles, or links their single-page view
+	FollowPages bool
+
+	// Provenance records the original link, its status, the chosen copy,
+	// the run and the tool's version in the frontmatter of replacements
+	Provenance bool
+
+	// SnapshotDir is where the HTML of live pages and of the archived
+	// copies replacing dead ones is kept, recorded in the frontmatter
+	SnapshotDir string
+
+	// WARC writes the same pages as WARC records; WARCs holds the run's
+	WARC  warcPolicy
+	WARCs *warcArchive
+
+	// ReadingCopy appends the article of the same pages to the bookmark's
+	// body in markdown
+	ReadingCopy bool
+
+	// PDF prints the same pages to a PDF next to the bookmark with the
+	// Chrome at Chrome
+	PDF    bool
+	Chrome string
+
+	// EventLog is the file or FIFO to stream the run's events to as JSON
+	// lines
+	EventLog string
+
+	// Privacy strips credentials, session IDs and tokens from links before
+	// they are sent to archive services and reports the bookmarks carrying
+	// them; SanitizeLinks also rewrites those bookmarks without them
+	Privacy       bool
+	SanitizeLinks bool
+
+	// Pinboard consults the Pinboard account's archive before the public ones
+	Pinboard bool
+
+	// ArchiveLive queues alive links without a snapshot for Save Page Now
+	// and makes a pass over the queue after the run, with SaveKeys and the
+	// Save policy
+	ArchiveLive bool
+	SaveKeys    string
+	Save        savePolicy
+
+	// DryRun checks and looks up archives as usual but writes neither
+	// bookmarks nor the lock file, and lists the proposed replacements
+	DryRun bool
+
+	// GitCommit commits the bookmarks the run rewrote to the collection's
+	// git repository, authored by the identity
+	GitCommit bool
+
+	// Worker is this worker's line on the live progress display, if any
+	Worker *workerStatus
+
+	// Concurrency is the number of files checked at once. Shared guards the
+	// lock file, the run record and the pending list between the workers;
+	// processFile holds it except while it waits on the network
+	Concurrency int
+	Shared      *sync.Mutex
+
+	// RequestCeiling aborts any single request taking longer, Timeout a
+	// request with all its redirects; Latency collects per-host timings for
+	// the slow-host report
+	RequestCeiling time.Duration
+	Timeout        time.Duration
+	Latency        *latencyTracker
+
+	// Only limits the run to these files, those of the run RetryOf
+	Only    fileSet
+	RetryOf string
+
+	// RetryPolicy retries transient check failures; the zero value, in
+	// options built without a config, does not retry. Retries overrides its
+	// max and NoRetries turns retries off
+	RetryPolicy retryPolicy
+	Retries     int
+	NoRetries   bool
+
+	// Stop is closed when the run is asked to stop, which ends waits such
+	// as a retry's backoff early; nil never is
+	Stop <-chan struct{}
+
+	// UserAgent overrides the site agents of UserAgents, which picks the
+	// User-Agent of every request; nil sends the built-in defaults
+	UserAgent  string
+	UserAgents *userAgentPolicy
+
+	// RateLimits paces requests to archive services and bookmarked hosts
+	// under their budgets; nil sends them unpaced. HostRate overrides
+	// [host_rates] per_second
+	RateLimits *rateScheduler
+	HostRate   float64
+
+	// Storage names the storage profile Store was opened from; a nil Store
+	// is the collection's assets/ directory
+	Storage string
+	Store   blobStore
+
+	// Coordination splits the run with other runners through leases kept
+	// in Leases, the store of its storage profile; Coordinate overrides
+	// [coordination] storage
+	Coordination coordinationPolicy
+	Coordinate   string
+	Leases       blobStore
+
+	// Recheck also checks processed links that were alive, as conditional
+	// requests where validators are stored
+	Recheck  bool
+	Rechecks recheckPolicy
+
+	// Site regenerates the sitemap and tag pages after the run, when the
+	// [site] section is configured
+	Site sitePolicy
+
+	// DomainDeath decides when a host looks gone; Domains tracks the hosts
+	// of the run under it
+	DomainDeath domainDeathPolicy
+	Domains     *domainTracker
+
+	// RDAPPolicy looks up the domains of hosts that do not resolve, through
+	// RDAP, which is set for the run when it is enabled
+	RDAPPolicy rdapPolicy
+	RDAP       *rdapResolver
+}
+
+// clock is opts.Clock, or the system clock without one.
+func (opts *runOptions) clock() Clock {
+	if opts.Clock == nil {
+		return systemClock{}
+	}
+	return opts.Clock
+}
+
+func (opts *runOptions) now() time.Time {
+	return opts.clock().Now()
+}
+
+// register adds the flags shared by one-off runs and the daemon.
+func (opts *runOptions) register(fs *flag.FlagSet) {
+	fs.Var(&opts.Tags.Include, "tag", "only process bookmarks with this `tag` (repeatable)")
+	fs.Var(&opts.Tags.Exclude, "not-tag", "skip bookmarks with this `tag` (repeatable)")
+	fs.StringVar(&opts.ProviderNames, "providers", "", "comma-separated archive `providers` in order of preference (default: wayback)")
+	fs.StringVar(&opts.FallbackNames, "fallback-archives", "", "comma-separated archive `providers` to ask when none of --providers has a copy, e.g. archive_today")
+	fs.IntVar(&opts.Flaky.DeadAfter, "dead-after", 0, "replace links only after `N` consecutive failed checks across runs (default 1)")
+	fs.StringVar(&opts.ReportPath, "report", "", "write a JSON report of the run, with all candidate snapshots, to `file`")
+	fs.StringVar(&opts.BlocklistPath, "blocklist", "", "`file` of URLs/domains never to check or rewrite")
+	fs.StringVar(&opts.AllowlistPath, "allowlist", "", "`file` of URLs/domains; when set, only these are processed")
+	fs.Var(&opts.Profile, "profile", "`fast` (HEAD only) or thorough (GET bodies, soft-404 detection, snapshot and rewrite verification)")
+	fs.BoolVar(&opts.Queue, "queue", false, "propose replacements in "+pendingFileName+" for review instead of rewriting files")
+	fs.BoolVar(&opts.Explain, "explain", false, "print the reasoning behind every check, classification and snapshot choice")
+	fs.Var(&opts.ExplainFiles, "explain-file", "print the reasoning for this bookmark `file` only (repeatable)")
+	fs.BoolVar(&opts.ExpandShorteners, "expand-shorteners", false, "rewrite live short links (bit.ly, t.co, ...) to the URL they point to")
+	fs.BoolVar(&opts.Recheck, "recheck", false, "also re-verify links already found alive, with conditional requests where possible")
+	fs.StringVar(&opts.Storage, "storage", "", "keep downloaded content in this [storage.<`name`>] profile (default: the assets/ directory)")
+	fs.StringVar(&opts.Coordinate, "coordinate", "", "split the run with other runners through leases in this [storage.<`name`>] profile")
+	fs.StringVar(&opts.UserAgent, "user-agent", "", "send this `User-Agent` to bookmarked sites (default: [user_agents] site)")
+	fs.DurationVar(&opts.Timeout, "timeout", 0, "give up on a request, with all its redirects, after this `duration` (default 30s)")
+	fs.IntVar(&opts.Redirects.MaxHops, "max-redirects", 0, "follow at most `N` redirects per link (default: [redirects] max_hops)")
+	fs.Float64Var(&opts.HostRate, "host-rate", 0, "send at most `N` requests a second to any one bookmarked host (default: [host_rates] per_second, 2)")
+	fs.IntVar(&opts.Retries, "retries", 0, "retry a check that timed out, did not resolve or got a server error up to `N` times with backoff (default: [retries] max, 2)")
+	fs.BoolVar(&opts.NoRetries, "no-retries", false, "judge every link on its first check, without retrying transient failures")
+	fs.DurationVar(&opts.RequestCeiling, "request-ceiling", 0, "abort any single request taking longer than this `duration` (default 15s)")
+	fs.BoolVar(&opts.CheckAssets, "check-assets", false, "also check images and other assets embedded in bookmark bodies, replacing dead ones with local or archived copies")
+	fs.BoolVar(&opts.NoBodyLinks, "no-body-links", false, "leave the links in bookmark bodies unchecked; by default dead ones are rewritten to archived copies")
+	fs.BoolVar(&opts.DetectLanguage, "detect-language", false, "record the language of archived copies in the frontmatter and flag replacements in another language")
+	fs.BoolVar(&opts.FollowPages, "follow-pages", false, "link the single-page view of replaced multi-page articles, or list the captures of their further pages in the frontmatter")
+	fs.BoolVar(&opts.Provenance, "provenance", false, "record the original link, its status, the chosen copy and the run in an archive_tool block in the frontmatter of replaced bookmarks")
+	fs.BoolVar(&opts.ReadingCopy, "reading-copy", false, "append the article of live pages and of the archived copies replacing dead ones to the bookmark in markdown")
+	fs.BoolVar(&opts.PDF, "pdf", false, "print live pages and the archived copies replacing dead ones to a PDF next to the bookmark, with headless Chrome")
+	fs.StringVar(&opts.EventLog, "event-log", "", "append every check, classification, replacement and error to `file` (or FIFO) as JSON lines")
+	fs.StringVar(&opts.Chrome, "chrome", "", "the Chrome or Chromium `command` --pdf prints with (default: found on the PATH)")
+	fs.StringVar(&opts.SnapshotDir, "snapshot-dir", "", "keep a copy of the HTML of live pages and of the archived copies replacing dead ones in `directory`, recorded in the frontmatter")
+	fs.StringVar(&opts.WARC.Dir, "warc", "", "write live pages and the archived copies replacing dead ones to WARC files in `directory`, with a CDXJ index")
+	fs.StringVar(&opts.WARC.Split, "warc-split", "", "with --warc, write one WARC per `run` or per run and domain (default: [warc] split)")
+	fs.BoolVar(&opts.WARC.Assets, "warc-assets", false, "with --warc, also write the images, stylesheets and scripts of the pages")
+	fs.BoolVar(&opts.Privacy, "privacy", false, "strip credentials, session IDs and tokens from links before sending them to archive services")
+	fs.BoolVar(&opts.SanitizeLinks, "sanitize-links", false, "with --privacy, also remove them from the bookmarks")
+	fs.BoolVar(&opts.GitCommit, "git-commit", false, "commit rewritten bookmarks to the collection's git repository, authored by your [identity]")
+	fs.BoolVar(&opts.ArchiveLive, "archive-live", false, "submit alive links without a snapshot to Save Page Now (archive_org_keys secret), recording captures in the frontmatter")
+	fs.BoolVar(&opts.Pinboard, "pinboard", false, "look dead links up in your Pinboard archive (pinboard_token secret) before public archives")
+	fs.BoolVar(&opts.FixLinks, "fix-links", false, "write normalized links back to bookmarks whose link lacks a scheme, is wrapped in <> or has stray whitespace")
+	fs.BoolVar(&opts.Measure, "measure", false, "only measure: count dead links and which archive providers have copies, without changing files")
+	fs.IntVar(&opts.Sample, "sample", 0, "check a random sample of `N` bookmarks and estimate the dead-link rate, without changing files")
+	fs.BoolVar(&console.ASCII, "ascii", false, "plain ASCII output without unicode symbols or in-place progress, for screen readers and dumb terminals")
+	fs.BoolVar(&opts.RDAPPolicy.Enabled, "rdap", false, "look up the domains of hosts that do not resolve by RDAP, rechecking instead of replacing links of registered ones")
+	fs.StringVar(&opts.DomainDeath.Decision, "domain-decision", "", "what to do with the dead links of a host that looks gone: ask, replace, queue or keep (default: [domain_death] decision)")
+	fs.Var(&opts.Shard, "shard", "only process slice `K/N` of the collection (e.g. 2/8), for splitting a crawl across machines")
+}
+
+// finish fills in settings not given on the command line from the config
+// file and loads the URL filter lists.
+// finishClient merges in the config that opts.httpClient() is built from:
+// timeouts, User-Agents and rate budgets. Commands that make requests
+// without running over the collection, such as apply --pr and digest, call
+// it alone.
+func (opts *runOptions) finishClient(cfg *Config) {
+	if opts.RequestCeiling == 0 {
+		opts.RequestCeiling = cfg.RequestCeiling
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = cfg.Timeout
+	}
+	agents := cfg.UserAgents
+	if opts.UserAgent != "" {
+		agents.Sites = []string{opts.UserAgent}
+	}
+	agents.next = new(atomic.Uint64)
+	opts.UserAgents = &agents
+	hostRates := cfg.HostRates
+	if opts.HostRate > 0 {
+		hostRates.PerSecond = opts.HostRate
+	}
+	opts.RateLimits = newRateScheduler(cfg.RateLimits, hostRates, opts.clock())
+}
+
+func (opts *runOptions) finish(cfg *Config, args []string) error {
+	opts.Dir = defaultBookmarksDir()
+	if cfg.Dir != "" {
+		opts.Dir = cfg.Dir
+	}
+	if len(args) > 0 {
+		opts.Dir = args[0]
+	}
+	collectionRoot = opts.Dir
+	if err := cfg.loadCollectionConfig(opts.Dir); err != nil {
+		return err
+	}
+	bookmarkKeys = cfg.Fields
+	excludePatterns = cfg.Exclude
+	policy := cfg.applyIdentity(opts.Dir)
+
+	opts.TagPolicies = cfg.TagPolicies
+	maxHops := opts.Redirects.MaxHops
+	opts.Redirects = cfg.Redirects
+	if maxHops > 0 {
+		opts.Redirects.MaxHops = maxHops
+	}
+	opts.Rechecks = cfg.Rechecks
+	opts.Site = cfg.Site
+	opts.Recheck = opts.Recheck || cfg.Recheck
+	opts.Shorteners = cfg.Shorteners
+	opts.ExpandShorteners = opts.ExpandShorteners || cfg.ExpandShorteners
+	opts.MediumDomains = cfg.MediumDomains
+	opts.Queue = opts.Queue || cfg.Queue
+	opts.GitCommit = opts.GitCommit || cfg.GitCommit
+	opts.restrict(policy)
+	opts.FixLinks = opts.FixLinks || cfg.FixLinks
+	opts.CheckAssets = opts.CheckAssets || cfg.CheckAssets
+	opts.NoBodyLinks = opts.NoBodyLinks || cfg.NoBodyLinks
+	opts.DetectLanguage = opts.DetectLanguage || cfg.DetectLanguage
+	opts.FollowPages = opts.FollowPages || cfg.FollowPages
+	opts.Provenance = opts.Provenance || cfg.Provenance
+	opts.ReadingCopy = opts.ReadingCopy || cfg.ReadingCopy
+	opts.PDF = opts.PDF || cfg.PDF
+	if opts.PDF {
+		if opts.Chrome == "" {
+			opts.Chrome = cfg.Chrome
+		}
+		chrome, err := chromeCommand(opts.Chrome)
+		if err != nil {
+			return err
+		}
+		opts.Chrome = chrome
+	}
+	if opts.EventLog == "" {
+		opts.EventLog = cfg.EventLog
+	}
+	events = newEventLog(opts.EventLog, opts.clock())
+	if opts.SnapshotDir == "" && cfg.SnapshotDir != "" {
+		opts.SnapshotDir = cfg.SnapshotDir
+		if !filepath.IsAbs(opts.SnapshotDir) {
+			opts.SnapshotDir = filepath.Join(opts.Dir, opts.SnapshotDir)
+		}
+	}
+	warc := opts.WARC
+	opts.WARC = cfg.WARC
+	if warc.Dir != "" {
+		opts.WARC.Dir = warc.Dir
+	} else if opts.WARC.Dir != "" && !filepath.IsAbs(opts.WARC.Dir) {
+		opts.WARC.Dir = filepath.Join(opts.Dir, opts.WARC.Dir)
+	}
+	if warc.Split != "" {
+		if err := opts.WARC.set("split", warc.Split); err != nil {
+			return err
+		}
+	}
+	opts.WARC.Assets = opts.WARC.Assets || warc.Assets
+	opts.SanitizeLinks = opts.SanitizeLinks || cfg.SanitizeLinks
+	opts.Privacy = opts.Privacy || cfg.Privacy || opts.SanitizeLinks
+	if opts.Concurrency == 0 {
+		opts.Concurrency = cfg.Concurrency
+	}
+	opts.finishClient(cfg)
+	console.detect(cfg)
+	opts.Locale = loadLocale(detectLocale(cfg.Locale))
+
+	rdapEnabled := opts.RDAPPolicy.Enabled
+	opts.RDAPPolicy = cfg.RDAP
+	opts.RDAPPolicy.Enabled = opts.RDAPPolicy.Enabled || rdapEnabled
+
+	decision := opts.DomainDeath.Decision
+	opts.DomainDeath = cfg.DomainDeath
+	if decision != "" {
+		if err := opts.DomainDeath.set("decision", decision); err != nil {
+			return fmt.Errorf("--domain-decision: %w", err)
+		}
+	}
 
-	lock, err := loadLockFile()
+	deadAfter := opts.Flaky.DeadAfter
+	opts.Flaky = cfg.Flaky
+	if deadAfter > 0 {
+		opts.Flaky.DeadAfter = deadAfter
+	}
+
+	if opts.ProviderNames == "" {
+		opts.ProviderNames = cfg.Providers
+	}
+	providers, err := newProviderChain(opts.ProviderNames, cfg.ProviderTimeouts)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error loading lock file: %v\n", err)
-		os.Exit(1)
+		return err
+	}
+	if opts.FallbackNames == "" {
+		opts.FallbackNames = cfg.FallbackArchives
+	}
+	if providers.fallbacks, err = parseProviders(opts.FallbackNames); err != nil {
+		return fmt.Errorf("fallback archives: %w", err)
+	}
+	archiveTodaySettings = cfg.ArchiveToday
+	mementoSettings = cfg.Memento
+	paywallSettings = cfg.Paywalls
+	opts.RetryPolicy = cfg.Retries
+	if opts.Retries > 0 {
+		opts.RetryPolicy.Max = opts.Retries
+	}
+	if opts.NoRetries {
+		opts.RetryPolicy.Max = 0
+	}
+	if providers.sensitive, err = newSensitivePolicy(cfg.Sensitive, cfg.TagPolicies); err != nil {
+		return err
+	}
+	providers.privacy = opts.Privacy
+	if opts.Pinboard || cfg.Pinboard {
+		if providers.preferred, err = newPinboardProvider(&cfg.Secrets); err != nil {
+			return err
+		}
+	}
+	opts.Providers = providers
+
+	opts.ArchiveLive = opts.ArchiveLive || cfg.ArchiveLive
+	opts.Save = cfg.Save
+	if opts.ArchiveLive {
+		if opts.SaveKeys, err = cfg.Secrets.get("archive_org_keys"); err != nil {
+			return fmt.Errorf("--archive-live needs archive.org keys for Save Page Now: %w", err)
+		}
+	}
+
+	if opts.Storage == "" {
+		opts.Storage = cfg.Storage
+	}
+	if opts.Storage != "" {
+		if opts.Store, err = openBlobStore(cfg, opts.Storage, opts.Dir, opts.httpClient()); err != nil {
+			return err
+		}
+	}
+	opts.Coordination = cfg.Coordination
+	if opts.Coordinate != "" {
+		opts.Coordination.Storage = opts.Coordinate
+	}
+	if opts.Coordination.Storage != "" {
+		if opts.Coordination.Runner == "" {
+			if opts.Coordination.Runner, err = os.Hostname(); err != nil {
+				return fmt.Errorf("naming this runner for coordination: %w", err)
+			}
+		}
+		if opts.Leases, err = openBlobStore(cfg, opts.Coordination.Storage, opts.Dir, opts.httpClient()); err != nil {
+			return fmt.Errorf("coordination: %w", err)
+		}
+	}
+
+	if opts.BlocklistPath == "" {
+		opts.BlocklistPath = cfg.Blocklist
+	}
+	if opts.AllowlistPath == "" {
+		opts.AllowlistPath = cfg.Allowlist
+	}
+	if opts.BlocklistPath != "" || opts.AllowlistPath != "" {
+		filter, err := newURLFilter(opts.BlocklistPath, opts.AllowlistPath)
+		if err != nil {
+			return err
+		}
+		opts.Filter = filter
+	}
+
+	return nil
+}
+
+// runCheck performs one pass over the bookmarks in dir and records it in the
+// run history under opts.Trigger. The controller
+// can pause the run between files or stop it early; files not reached yet stay
+// unprocessed and are picked up by the next run. Items injected with
+// `ctl check` are processed before the next regular file.
+func runCheck(opts runOptions, ctl *controller) (*RunRecord, error) {
+	opts.Stop = ctl.stopCh
+	ctl.setPhase("scanning")
+	defer ctl.setPhase("idle")
+
+	fmt.Printf("Scanning directory: %s\n", opts.Dir)
+
+	files, err := findMarkdownFiles(opts.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading directory: %w", err)
 	}
 
+	allFiles := files
+	if opts.Only != nil {
+		files = opts.Only.filter(files)
+	}
+	if opts.Shard.Count > 1 && opts.Leases != nil {
+		return nil, fmt.Errorf("--shard and coordination both split the collection; use one")
+	}
+	if opts.Shard.Count > 1 {
+		files = opts.Shard.filter(opts.Dir, files)
+		fmt.Printf("Shard %s: %d of %d files\n", opts.Shard.String(), len(files), len(allFiles))
+	}
+
+	lock, err := loadLockFile(opts.DryRun)
+	if err != nil {
+		return nil, fmt.Errorf("loading lock file: %w", err)
+	}
+	lock.clock = opts.clock()
+	// Captures finished since the last run, by `archive_tool save`
+	if n, err := reconcileSaveJobs(lock, opts.Dir); err != nil {
+		fmt.Fprintf(os.Stderr, "Error recording Save Page Now captures: %v\n", err)
+	} else if n > 0 {
+		fmt.Printf("Recorded %d Save Page Now captures in bookmark frontmatter\n", n)
+	}
+
+	if err := opts.Filter.refresh(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error reloading URL lists, keeping previous rules: %v\n", err)
+	}
+	if err := opts.Providers.sensitive.refresh(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error reloading the sensitive list, keeping previous rules: %v\n", err)
+	}
+	opts.Providers.sensitive.scan(allFiles)
+
+	if opts.Queue {
+		if opts.Pending, err = loadPendingList(opts.Dir); err != nil {
+			return nil, err
+		}
+	}
+
+	run := &RunRecord{
+		ID:      newRunID(opts.now()),
+		Trigger: opts.Trigger,
+		Shard:   opts.Shard.String(),
+		Profile: opts.Profile.Name,
+		Started: opts.now(),
+		Status:  "completed",
+		RetryOf: opts.RetryOf,
+	}
+	events.emit(event{Event: "run_started", Run: run.ID, Trigger: run.Trigger, Dir: opts.Dir})
+
 	var unprocessedFiles []string
+	rechecks := 0
 	for _, filePath := range files {
-		if !isFileProcessed(lock, filePath) {
+		switch {
+		case !isFileProcessed(lock, filePath):
+			unprocessedFiles = append(unprocessedFiles, filePath)
+		case opts.Recheck && needsRecheck(lock, filePath, opts.now()):
 			unprocessedFiles = append(unprocessedFiles, filePath)
+			rechecks++
 		}
 	}
 
-	skipped := len(files) - len(unprocessedFiles)
-	fmt.Printf("Found %d markdown files (%d already processed, %d new)\n", len(files), skipped, len(unprocessedFiles))
+	run.Skipped = len(files) - len(unprocessedFiles)
+	fmt.Printf("Found %d markdown files (%d already processed, %d new)\n", len(files), run.Skipped+rechecks, len(unprocessedFiles)-rechecks)
+	if lock.moved > 0 {
+		fmt.Printf("Recognized %d moved or copied bookmarks by their content\n", lock.moved)
+	}
+	if opts.Recheck {
+		fmt.Printf("Rechecking %d processed links that are due and have not been replaced\n", rechecks)
+	}
 
-	if len(unprocessedFiles) == 0 {
+	if len(unprocessedFiles) == 0 && !ctl.hasPriority() {
 		fmt.Println("All files have been processed. Nothing to do.")
-		os.Exit(0)
 	}
 
-	client := &http.Client{
-		Timeout: 30 * time.Second,
+	// Coordinated, the files come in parts, as they are claimed
+	var coord *coordinator
+	if opts.Leases != nil {
+		if coord, err = newCoordinator(&opts, unprocessedFiles); err != nil {
+			return nil, fmt.Errorf("coordination: %w", err)
+		}
+		fmt.Printf("Coordinating through %s as %s, in %d parts\n", opts.Coordination.Storage, opts.Coordination.Runner, opts.Coordination.Parts)
+		unprocessedFiles = nil
+	}
+
+	opts.Latency = newLatencyTracker()
+	if opts.WARC.Dir != "" && !opts.DryRun {
+		opts.WARCs = newWARCArchive(opts.WARC, run.ID, opts.clock())
+	}
+	client := opts.httpClient()
+	wd := newWatchdog()
+	ctl.setPhase("checking")
+	board := startProgressBoard()
+
+	// Workers take files from jobs and hand them back on results once
+	// processed, so the progress line counts finished files, not started ones
+	workers := max(opts.Concurrency, 1)
+	opts.Shared = new(sync.Mutex)
+	opts.Domains = newDomainTracker(opts.DomainDeath)
+	if opts.RDAPPolicy.Enabled {
+		opts.RDAP = newRDAPResolver()
+	}
+	jobs := make(chan string)
+	results := make(chan string, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		workerOpts := opts
+		workerOpts.Worker = board.worker()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for filePath := range jobs {
+				processFile(client, lock, filePath, run, workerOpts)
+				results <- filePath
+			}
+		}()
+	}
+
+	done := make(map[string]bool)
+	inFlight := make(map[string]bool) // file -> counts towards the progress
+	scheduled := make(map[string]bool)
+	for _, filePath := range unprocessedFiles {
+		scheduled[filePath] = true
+	}
+	var requested []string
+	i, finished, stopped := 0, 0, false
+	claiming := coord != nil
+	for {
+		wd.ping()
+		if coord != nil {
+			coord.renew()
+		}
+		if !stopped && !ctl.checkpoint() {
+			fmt.Printf("\nStopping, %d files left for the next run\n", len(unprocessedFiles)-i)
+			opts.Shared.Lock()
+			run.Status = "stopped"
+			opts.Shared.Unlock()
+			stopped = true
+		}
+
+		next, isRequested := "", false
+		if !stopped {
+			for {
+				item, ok := ctl.popPriority()
+				if !ok {
+					break
+				}
+				requested = append(requested, resolvePriorityItem(allFiles, item)...)
+			}
+			// A requested file already being checked needs no second check
+			for len(requested) > 0 {
+				if _, busy := inFlight[requested[0]]; !busy {
+					break
+				}
+				requested = requested[1:]
+			}
+			for i < len(unprocessedFiles) && done[unprocessedFiles[i]] {
+				i++
+			}
+			for claiming && i == len(unprocessedFiles) {
+				claimed, err := coord.claim()
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "\nError coordinating, claiming no more parts: %v\n", err)
+				}
+				if len(claimed) == 0 {
+					claiming = false
+					break
+				}
+				for _, filePath := range claimed {
+					scheduled[filePath] = true
+					if _, busy := inFlight[filePath]; done[filePath] && !busy {
+						// Checked already, on request
+						coord.finished(filePath)
+					}
+				}
+				unprocessedFiles = append(unprocessedFiles, claimed...)
+				for i < len(unprocessedFiles) && done[unprocessedFiles[i]] {
+					i++
+				}
+			}
+			switch {
+			case len(requested) > 0:
+				next, isRequested = requested[0], true
+			case i < len(unprocessedFiles):
+				next = unprocessedFiles[i]
+			}
+		}
+		if next == "" && len(inFlight) == 0 {
+			break
+		}
+
+		// With nothing to hand out, dispatch stays nil and only results
+		// are waited for
+		var dispatch chan<- string
+		if next != "" {
+			dispatch = jobs
+		}
+		select {
+		case dispatch <- next:
+			// A requested file due in this run counts as one of its files
+			inFlight[next] = scheduled[next] && !done[next]
+			done[next] = true
+			if isRequested {
+				requested = requested[1:]
+				fmt.Printf("\nChecking now (requested): %s\n", next)
+			} else {
+				i++
+				sdNotify(fmt.Sprintf("STATUS=Processing %d/%d", i, len(unprocessedFiles)))
+			}
+			ctl.setProgress(finished, len(unprocessedFiles), next)
+
+		case filePath := <-results:
+			counted := inFlight[filePath]
+			delete(inFlight, filePath)
+			if coord != nil {
+				coord.finished(filePath)
+			}
+			if !counted {
+				continue
+			}
+			finished++
+			opts.Shared.Lock()
+			console.progress(finished, len(unprocessedFiles), "Processing [%d/%d] - Checked: %d, 404s found: %d, Replaced: %d, Errors: %d",
+				finished, len(unprocessedFiles), run.Checked, run.Replaced, run.Replaced, run.Errors)
+			opts.Shared.Unlock()
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	board.finish()
+	if coord != nil {
+		coord.release()
+	}
+	if opts.WARCs != nil {
+		written, err := opts.WARCs.close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "\nError writing WARC files: %v\n", err)
+		}
+		if len(written) > 0 {
+			fmt.Printf("\nWrote %s to %s\n", strings.Join(written, ", "), opts.WARC.Dir)
+		}
+	}
+	if !stopped {
+		settleDeadDomains(client, lock, run, &opts)
+	}
+	if opts.ArchiveLive && !opts.DryRun {
+		saveLiveCaptures(client, lock, opts)
+	}
+
+	run.Finished = opts.now()
+	run.SlowHosts = opts.Latency.slowest(slowHostsReported)
+	lock.addRun(run)
+	events.emit(event{Event: "run_finished", Run: run.ID, Result: run.Status, Checked: run.Checked, Replaced: run.Replaced, Errors: run.Errors})
+
+	if opts.DryRun {
+		printProposedReplacements(run)
+	} else if err := saveLockFile(lock); err != nil {
+		fmt.Fprintf(os.Stderr, "\nError saving lock file: %v\n", err)
+	}
+
+	if opts.Queue && !opts.DryRun {
+		if err := opts.Pending.save(); err != nil {
+			fmt.Fprintf(os.Stderr, "\nError writing %s: %v\n", opts.Pending.path, err)
+		}
+	}
+	if opts.GitCommit && !opts.DryRun {
+		committed := lock.rewritten
+		if opts.Queue && run.Queued > 0 {
+			committed = append(committed, opts.Pending.path)
+		}
+		if err := commitRewrites(opts.Dir, committed, run); err != nil {
+			fmt.Fprintf(os.Stderr, "\nError committing the rewritten bookmarks: %v\n", err)
+		}
+	}
+
+	if opts.ReportPath != "" {
+		if err := writeRunReport(opts.ReportPath, run); err != nil {
+			fmt.Fprintf(os.Stderr, "\nError writing report: %v\n", err)
+		}
+	}
+
+	if opts.Site.configured && !opts.DryRun {
+		if err := generateSite(opts.Dir, lock, opts.Site); err != nil {
+			fmt.Fprintf(os.Stderr, "\nError updating sitemap and tag pages: %v\n", err)
+		}
+	}
+
+	loc := opts.Locale
+	fmt.Printf("\n\n%s\n", loc.T("done.summary", loc.Num(run.Checked), loc.Num(run.Replaced), loc.Num(run.Errors), loc.Num(run.Skipped)))
+	if run.Filtered > 0 {
+		fmt.Printf("Filtered by blocklist/allowlist: %d\n", run.Filtered)
+	}
+	if run.Invalid > 0 || run.Fixed > 0 {
+		fmt.Printf("Invalid links skipped: %d, links fixed: %d\n", run.Invalid, run.Fixed)
+	}
+	if run.Flaky > 0 || run.Pending > 0 {
+		fmt.Printf("Not replaced yet: %d flaky, %d failing\n", run.Flaky, run.Pending)
+	}
+	if opts.Queue {
+		fmt.Printf("Queued for review: %d new, %d in %s\n", run.Queued, len(opts.Pending.items), opts.Pending.path)
+	}
+	if opts.ArchiveLive {
+		counts := lock.saveCounts()
+		fmt.Printf("Alive links queued for Save Page Now: %d new; queue: %d queued, %d pending, %d captured\n",
+			run.Saving, counts[saveQueued], counts[savePending], counts[saveDone])
+	}
+	if run.NotModified > 0 {
+		fmt.Printf("Unchanged since the last check (304): %d\n", run.NotModified)
+	}
+	if traps := run.redirectTraps(); len(traps) > 0 {
+		fmt.Printf("Redirect chains that never end: %d %v\n", len(traps), trapKinds(traps))
+	}
+	if len(run.Secrets) > 0 {
+		fmt.Printf("Links carrying credentials or tokens: %d (stripped before archive requests)\n", len(run.Secrets))
+	}
+	if run.Sensitive > 0 {
+		fmt.Printf("Dead sensitive links annotated, not sent to archive services: %d\n", run.Sensitive)
+	}
+	if run.AssetsChecked > 0 {
+		fmt.Printf("Embedded assets checked: %d, dead: %d, replaced: %d\n", run.AssetsChecked, run.DeadAssets, run.AssetsReplaced)
+	}
+	if run.BodyLinksChecked > 0 {
+		fmt.Printf("Links in bodies checked: %d, dead: %d, replaced: %d\n", run.BodyLinksChecked, run.DeadBodyLinks, run.BodyLinksReplaced)
+	}
+	if len(run.Panics) > 0 {
+		fmt.Printf("Files that hit a bug and were skipped: %d (stack traces under panics in the lock file)\n", len(run.Panics))
+	}
+	printDeadDomains(run.DeadDomains)
+	printRDAPRecords(run.RDAP)
+	printSlowHosts(run.SlowHosts)
+	printRateWaits(opts.RateLimits.takeWaits())
+
+	return run, nil
+}
+
+// printProposedReplacements lists what a dry run would have replaced.
+func printProposedReplacements(run *RunRecord) {
+	fmt.Printf("\n\nDry run: %d replacement(s) proposed, no file or state written\n", len(run.Replacements))
+	for _, r := range run.Replacements {
+		fmt.Printf("  %s\n    %s\n    -> %s (%s)\n", r.File, r.Original, r.URL, r.Chosen)
+	}
+}
+
+// defaultClientTimeout bounds a request together with its redirects.
+const defaultClientTimeout = 30 * time.Second
+
+// newHTTPClient returns the client used for checks and archive lookups. A nil
+// transport means http.DefaultTransport.
+func newHTTPClient(transport http.RoundTripper, maxHops int, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			if len(via) >= 5 {
+			if err := redirectTrap(req, via); err != nil {
+				return err
+			}
+			if len(via) > maxHops {
 				return fmt.Errorf("too many redirects")
 			}
 			return nil
 		},
 	}
+}
 
-	replaced := 0
-	checked := 0
-	errors := 0
+// unlocked runs fn, which waits on the network, without holding opts.Shared,
+// so other workers can record their results meanwhile.
+func (opts *runOptions) unlocked(fn func()) {
+	if opts.Shared == nil {
+		fn()
+		return
+	}
+	opts.Shared.Unlock()
+	defer opts.Shared.Lock()
+	fn()
+}
 
-	for i, filePath := range unprocessedFiles {
-		fmt.Printf("\rProcessing [%d/%d] - Checked: %d, 404s found: %d, Replaced: %d, Errors: %d",
-			i+1, len(unprocessedFiles), checked, replaced, replaced, errors)
+// processFile checks a single bookmark file, replaces a dead link with an
+// archived version and updates the run counters.
+func processFile(client *http.Client, lock *LockFile, filePath string, run *RunRecord, opts runOptions) {
+	if opts.Shared != nil {
+		opts.Shared.Lock()
+		defer opts.Shared.Unlock()
+	}
+	defer run.recoverFile(filePath)
 
-		bookmark, err := parseBookmarkFile(filePath)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "\nError parsing %s: %v\n", filePath, err)
-			errors++
-			continue
-		}
+	bookmark, err := parseBookmarkFile(filePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nError parsing %s: %v\n", filePath, err)
+		run.recordError(filePath, err)
+		return
+	}
 
-		if bookmark.Link == "" {
-			markFileProcessed(lock, filePath)
-			continue
+	ex := opts.explainerFor(filePath)
+	if bookmark.Link == "" {
+		ex.logf("no link in the frontmatter; marked processed")
+		markFileProcessed(lock, filePath)
+		return
+	}
+	ex.logf("link %s, date %q, tags %v", bookmark.Link, bookmark.Date, bookmark.Tags)
+	opts.Worker.start(bookmark.Link)
+	defer opts.Worker.idle()
+
+	// Not an error: the file is fine, its link just can't be checked
+	if err := validateLink(bookmark.Link); err != nil {
+		ex.logf("link cannot be checked: %v", err)
+		fmt.Fprintf(os.Stderr, "\nSkipping %s: %v\n", filePath, err)
+		run.Invalid++
+		return
+	}
+	// A newer archive_tool wrote annotations this one may not know
+	if err := bookmark.checkFormat(); err != nil {
+		ex.logf("not checked: %v", err)
+		fmt.Fprintf(os.Stderr, "\nSkipping %s: %v\n", filePath, err)
+		return
+	}
+	if bookmark.Written != "" {
+		ex.logf("link %q normalized to %s", bookmark.Written, bookmark.Link)
+		if opts.FixLinks {
+			fixLinkInFile(lock, bookmark, run, ex)
 		}
+	}
+
+	// Already proposed and waiting for review
+	if opts.Queue && opts.Pending.has(relativeTo(opts.Dir, filePath)) {
+		ex.logf("already in %s; not checked until it is applied or removed", pendingFileName)
+		return
+	}
+
+	// A replaced link says so itself, whatever the lock file remembers
+	if bookmark.replacedHere() {
+		ex.logf("replaced with a %s copy of %s in run %s; marked processed", bookmark.Provenance["provider"], bookmark.Provenance["original"], bookmark.Provenance["run"])
+		markFileProcessed(lock, filePath)
+		return
+	}
+
+	// Filtered files are not marked processed so rule changes take effect
+	if !opts.Filter.allows(bookmark.Link) || !opts.Tags.matches(bookmark.Tags) {
+		ex.logf("excluded by the blocklist/allowlist or --tag/--not-tag")
+		run.Filtered++
+		return
+	}
 
-		checked++
+	profile, skip := opts.TagPolicies.apply(bookmark.Tags, opts.Profile)
+	if skip {
+		ex.logf("skipped by a tag policy")
+		run.Filtered++
+		return
+	}
+	if profile.Name != opts.Profile.Name {
+		ex.logf("tag policy switches the profile from %s to %s", opts.Profile.Name, profile.Name)
+	}
+	opts.Profile = profile
+	sensitive := opts.Providers.sensitive.markBookmark(bookmark)
+	if sensitive {
+		ex.logf("sensitive: nothing about this bookmark is sent to archive services")
+	}
+	if opts.Privacy {
+		checkSecrets(lock, bookmark, run, opts, ex)
+	}
 
-		is404, err := checkURL(client, bookmark.Link)
+	run.Checked++
+	if opts.CheckAssets {
+		checkAssets(client, lock, bookmark, run, opts, ex)
+	}
+	if !opts.NoBodyLinks {
+		checkBodyLinks(client, lock, bookmark, run, opts, ex, sensitive)
+	}
+
+	// A short link is judged by where it leads
+	target := bookmark.Link
+	if opts.Shorteners.matches(bookmark.Link) {
+		opts.Worker.setPhase("resolving")
+		var dest string
+		opts.unlocked(func() { dest, err = resolveShortener(client, bookmark.Link, opts.Shorteners, opts.maxRedirects()) })
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "\nError checking %s: %v\n", bookmark.Link, err)
-			errors++
-			continue
+			ex.logf("short link did not resolve: %v", err)
+			// The shortener may be gone; its redirect may have been archived
+			var outbound string
+			if outbound, err = opts.Providers.outbound(bookmark.Link); err == nil {
+				opts.unlocked(func() { dest, err = recoverShortLink(client, outbound) })
+			}
+			if err != nil {
+				ex.logf("no archived redirect either, checking the short link as is: %v", err)
+			} else {
+				ex.logf("archived redirect of the short link points to %s", dest)
+				fmt.Printf("\nRecovered destination of dead short link: %s\n  -> %s\n", bookmark.Link, dest)
+			}
 		}
+		if err == nil {
+			ex.logf("short link resolves to %s", dest)
+			target = dest
+			if sensitive {
+				opts.Providers.sensitive.mark(target)
+			}
+		}
+	}
 
-		if !is404 {
-			markFileProcessed(lock, filePath)
-			continue
+	opts.Worker.setPhase("checking")
+	var verdict linkVerdict
+	validators := lock.validatorsFor(target)
+	opts.unlocked(func() { verdict, err = opts.diagnoseLinkSince(client, target, opts.Profile, validators) })
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nError checking %s: %v\n", bookmark.Link, err)
+		run.recordError(filePath, err)
+		return
+	}
+	is404, status := verdict.Dead, verdict.Status
+	lock.recordStatus(bookmark.Link, status, is404, opts.now())
+	events.emit(checkEvent(run, filePath, bookmark.Link, "link", verdict))
+	opts.Domains.observe(bookmark.Link, is404)
+	lock.storeValidators(target, verdict)
+	lock.scheduleRecheck(bookmark.Link, verdict, opts.Rechecks, opts.now())
+	if verdict.NotModified {
+		run.NotModified++
+	}
+	if opts.Redirects.flagged(verdict) {
+		if verdict.Trap != "" {
+			ex.logf("redirect chain never ends (%s): %s", verdict.Trap, strings.Join(verdict.Chain, " -> "))
+			fmt.Printf("\nRedirect %s, chain recorded for inspection: %s\n", strings.ReplaceAll(verdict.Trap, "_", " "), bookmark.Link)
+		} else {
+			ex.logf("flagged redirect chain (cross-host %v, downgrade %v): %s", verdict.CrossHost, verdict.Downgrade, strings.Join(verdict.Chain, " -> "))
 		}
+		run.Redirects = append(run.Redirects, &RedirectRecord{
+			File:      filePath,
+			Chain:     verdict.Chain,
+			Status:    status,
+			CrossHost: verdict.CrossHost,
+			Downgrade: verdict.Downgrade,
+			Trap:      verdict.Trap,
+		})
+	}
+	if is404 {
+		ex.logf("%s check (profile %s): %s -> dead", verdict.Method, opts.Profile.Name, verdict.Reason)
+	} else {
+		ex.logf("%s check (profile %s): %s -> alive, marked processed", verdict.Method, opts.Profile.Name, verdict.Reason)
+	}
 
-		archivedURL, err := findArchivedVersion(client, bookmark.Link, bookmark.Date)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "\nError finding archive for %s: %v\n", bookmark.Link, err)
-			errors++
-			continue
+	if !is404 {
+		if target != bookmark.Link {
+			expandShortLink(client, lock, bookmark, target, run, opts, ex)
 		}
+		if opts.ArchiveLive {
+			queueLiveCapture(lock, bookmark, run, opts, ex)
+		}
+		if opts.keepsPages() {
+			keepLiveCopy(client, lock, bookmark, target, run, opts, ex)
+		}
+		markFileProcessed(lock, filePath)
+		return
+	}
 
-		if archivedURL == "" {
-			fmt.Printf("\nNo archive found for: %s\n", bookmark.Link)
-			markFileProcessed(lock, filePath)
-			continue
+	// A dead AMP page or mirror usually still has its article
+	var done bool
+	if target, done = checkCanonical(client, lock, bookmark, target, run, opts, ex); done {
+		return
+	}
+
+	// Not marked processed, so the link is checked again next run
+	classification := opts.Flaky.classify(lock.statusHistory(bookmark.Link))
+	ex.history(lock.statusHistory(bookmark.Link), opts.Flaky, classification)
+	events.emit(event{Event: "classified", Run: run.ID, File: filePath, URL: bookmark.Link, Result: classification})
+	switch classification {
+	case linkFlaky:
+		fmt.Printf("\nFlaky, not replacing: %s\n", bookmark.Link)
+		run.Flaky++
+		return
+	case linkFailing:
+		fmt.Printf("\nFailing, waiting for more failed checks before replacing: %s\n", bookmark.Link)
+		run.Pending++
+		return
+	}
+	if verdict.Unresolved && opts.RDAP != nil && !sensitive && deferUnresolved(client, lock, bookmark, target, run, opts, ex) {
+		return
+	}
+	if opts.Domains.hold(heldLink{bookmark: bookmark, target: target, verdict: verdict, profile: opts.Profile, ex: ex}) {
+		ex.logf("%s looks gone; held for a decision on all its bookmarks at the end of the run", coverageHost(bookmark.Link))
+		return
+	}
+	archiveDeadLink(client, lock, bookmark, target, verdict, run, opts, ex)
+}
+
+// archiveDeadLink replaces the dead link of a bookmark, checked at target,
+// with the best archived copy, or queues the replacement for review.
+func archiveDeadLink(client *http.Client, lock *LockFile, bookmark *BookmarkFile, target string, verdict linkVerdict, run *RunRecord, opts runOptions, ex *explainer) {
+	filePath := bookmark.Path
+
+	// The destination of a short link, or the article behind an AMP page,
+	// is far more likely to be archived
+	opts.Worker.setPhase("looking up")
+	var candidates []*snapshotCandidate
+	var err error
+	opts.unlocked(func() { candidates, err = opts.Providers.lookup(client, target, bookmark.Date, opts.now()) })
+	if errors.Is(err, ErrNoSnapshot) && target != bookmark.Link {
+		ex.logf("no copy of %s; trying the link itself", target)
+		opts.unlocked(func() { candidates, err = opts.Providers.lookup(client, bookmark.Link, bookmark.Date, opts.now()) })
+	}
+	if errors.Is(err, ErrSensitive) {
+		ex.logf("sensitive link; annotated as dead instead of looked up")
+		if err := annotateDead(lock, bookmark, opts.now()); err != nil {
+			fmt.Fprintf(os.Stderr, "\nError updating %s: %v\n", filePath, err)
+			run.recordError(filePath, err)
+			return
 		}
+		fmt.Printf("\nDead sensitive link, annotated and not sent to archive services: %s\n", bookmark.Link)
+		run.Sensitive++
+		markFileProcessed(lock, filePath)
+		return
+	}
+	if errors.Is(err, ErrNoSnapshot) {
+		ex.logf("no provider has a copy: %v", err)
+		fmt.Printf("\nNo archive found for: %s\n", bookmark.Link)
+		markFileProcessed(lock, filePath)
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nError finding archive for %s: %v\n", bookmark.Link, err)
+		run.recordError(filePath, err)
+		return
+	}
+
+	opts.Worker.setPhase("scoring")
+	var chosen *snapshotCandidate
+	providerCount := opts.Providers.count(bookmark.Link)
+	opts.unlocked(func() { chosen = selectCandidate(client, candidates, bookmark, providerCount) })
+	ex.candidates(candidates, chosen, bookmark, providerCount)
 
-		err = updateBookmarkFile(bookmark, archivedURL)
+	archivedURL := chosen.URL
+	if opts.Profile.VerifySnapshot {
+		opts.Worker.setPhase("verifying")
+		opts.unlocked(func() { err = verifySnapshot(client, archivedURL) })
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "\nError updating %s: %v\n", filePath, err)
-			errors++
-			continue
+			ex.logf("chosen snapshot does not replay; link left alone")
+			fmt.Fprintf(os.Stderr, "\nError verifying archive for %s: %v\n", bookmark.Link, err)
+			run.recordError(filePath, err)
+			return
 		}
+		ex.logf("chosen snapshot replays with 200 OK")
+	}
 
-		markFileProcessed(lock, filePath)
-		replaced++
-		fmt.Printf("\n✓ Replaced: %s\n  -> %s\n", bookmark.Link, archivedURL)
+	if opts.Queue {
+		queueReplacement(opts, bookmark, chosen, candidates)
+		run.Queued++
+		events.emit(event{Event: "queued", Run: run.ID, File: filePath, URL: bookmark.Link, Scope: "link", Archived: archivedURL, Provider: chosen.Provider})
+		fmt.Printf("\nQueued for review: %s\n  -> %s (%s)\n", bookmark.Link, archivedURL, chosen.Provider)
+		return
 	}
 
-	if err := saveLockFile(lock); err != nil {
-		fmt.Fprintf(os.Stderr, "\nError saving lock file: %v\n", err)
+	var fields []frontmatterField
+	var pages []string
+	if opts.FollowPages {
+		opts.Worker.setPhase("pages")
+		var single string
+		opts.unlocked(func() { single, pages = followPages(client, archivedURL, ex) })
+		if single != "" {
+			archivedURL = single
+		}
+		if len(pages) > 0 {
+			fields = append(fields, frontmatterField{Key: pagesField, List: pages})
+		}
+	}
+
+	if opts.keepsPages() && !opts.DryRun {
+		opts.Worker.setPhase("copying")
+		fields = append(fields, keepPage(client, bookmark, archivedURL, opts, ex)...)
+	}
+
+	language, suspicious := "", ""
+	if opts.DetectLanguage {
+		opts.Worker.setPhase("language")
+		opts.unlocked(func() { language, suspicious = detectLanguage(client, bookmark, archivedURL, ex) })
+		if language != "" {
+			fields = append(fields, frontmatterField{Key: languageField, Value: language})
+		}
+	}
+
+	if opts.Provenance {
+		fields = append(fields, provenanceBlock(bookmark.Link, verdict, archivedURL, chosen, run))
 	}
 
-	fmt.Printf("\n\nDone! Checked: %d, Replaced: %d, Errors: %d, Skipped: %d\n", checked, replaced, errors, skipped)
+	opts.Worker.setPhase("rewriting")
+	err = lock.rewriteBookmark(bookmark, archivedURL, fields...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nError updating %s: %v\n", filePath, err)
+		run.recordError(filePath, err)
+		return
+	}
+
+	// A dry run has not written anything to verify
+	if opts.Profile.VerifyReplacement && !opts.DryRun {
+		if err := verifyReplacement(filePath, archivedURL); err != nil {
+			fmt.Fprintf(os.Stderr, "\nError verifying rewrite of %s: %v\n", filePath, err)
+			run.recordError(filePath, err)
+			return
+		}
+	}
+
+	markFileProcessed(lock, filePath)
+	replacement := &Replacement{
+		File:       filePath,
+		Original:   bookmark.Link,
+		URL:        archivedURL,
+		Chosen:     chosen.ID,
+		Candidates: candidates,
+		Language:   language,
+		Suspicious: suspicious,
+		TextMatch:  chosen.TextMatch,
+		Pages:      pages,
+	}
+	if len(verdict.Chain) > 1 {
+		replacement.Redirects = verdict.Chain
+	}
+	lock.journalOrWarn(journalEntry{Op: "replacement", RunID: run.ID, Replacement: replacement})
+	run.Replaced++
+	run.Replacements = append(run.Replacements, replacement)
+	events.emit(event{Event: "replaced", Run: run.ID, File: filePath, URL: bookmark.Link, Scope: "link", Archived: archivedURL, Provider: chosen.Provider, DryRun: opts.DryRun})
+	if opts.DryRun {
+		fmt.Printf("\nWould replace: %s\n  -> %s (%s)\n", bookmark.Link, archivedURL, chosen.Provider)
+	} else {
+		fmt.Printf("\n%s Replaced: %s\n  -> %s (%s)\n", console.mark(), bookmark.Link, archivedURL, chosen.Provider)
+	}
+	if suspicious != "" {
+		fmt.Printf("    suspicious: %s\n", suspicious)
+	}
+	if len(pages) > 0 {
+		fmt.Printf("    continues on %d more page(s)\n", len(pages))
+	}
+	if chosen.TextMatch > 0 {
+		fmt.Printf("    matches %.0f%% of the saved text\n", chosen.TextMatch*100)
+	}
+	for _, candidate := range candidates {
+		if candidate != chosen {
+			fmt.Printf("    alternative %s: %s (score %.2f)\n", candidate.ID, candidate.URL, candidate.Score)
+		}
+	}
 }
 
 func findMarkdownFiles(dir string) ([]string, error) {
@@ -249,7 +1797,20 @@ func findMarkdownFiles(dir string) ([]string, error) {
 		if err != nil {
 			return err
 		}
-		if !info.IsDir() && strings.HasSuffix(strings.ToLower(path), ".md") {
+		if rel, err := filepath.Rel(dir, path); err == nil && rel != "." && excluded(rel, excludePatterns) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			// Generated tag pages are not bookmarks
+			if _, err := os.Stat(filepath.Join(path, generatedMarker)); err == nil {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasSuffix(strings.ToLower(path), ".md") && info.Name() != pendingFileName {
 			files = append(files, path)
 		}
 		return nil
@@ -264,7 +1825,7 @@ func parseBookmarkFile(filePath string) (*BookmarkFile, error) {
 		return nil, err
 	}
 
-	content := string(data)
+	content := strings.TrimPrefix(string(data), "\ufeff")
 	bookmark := &BookmarkFile{
 		Path:    filePath,
 		Content: content,
@@ -273,132 +1834,253 @@ func parseBookmarkFile(filePath string) (*BookmarkFile, error) {
 
 	// Parse YAML frontmatter
 	lines := strings.Split(content, "\n")
-	inFrontmatter := false
-	frontmatterEnd := 0
+	start, end, ok := frontmatterBounds(lines)
+	if !ok {
+		return bookmark, nil
+	}
+	inTagList, inProvenance := false, false
 
-	for i, line := range lines {
+	for i, line := range lines[start+1 : end] {
+		line = strings.TrimSuffix(line, "\r")
 		trimmed := strings.TrimSpace(line)
 
-		if trimmed == "---" {
-			if !inFrontmatter {
-				inFrontmatter = true
-				continue
-			} else {
-				frontmatterEnd = i
-				break
-			}
+		if inTagList && strings.HasPrefix(trimmed, "- ") {
+			bookmark.Tags = append(bookmark.Tags, strings.Trim(strings.TrimSpace(trimmed[2:]), `"'`))
+			continue
+		}
+		inTagList = false
+		// The block's fields are not headers of the bookmark
+		if inProvenance && line != trimmed {
+			continue
+		}
+		inProvenance = false
+		if strings.HasPrefix(line, provenanceField+":") {
+			bookmark.Provenance = parseProvenance(lines[start+2+i : end])
+			inProvenance = true
 		}
 
-		if inFrontmatter {
-			if strings.HasPrefix(line, "link:") {
-				bookmark.Link = extractYAMLValue(line)
-			} else if strings.HasPrefix(line, "date:") {
-				bookmark.Date = extractYAMLValue(line)
+		if strings.HasPrefix(line, bookmarkKeys.Link+":") && bookmark.Link == "" {
+			raw := extractYAMLValue(line)
+			bookmark.Link = tidyLink(raw)
+			if bookmark.Link != raw {
+				bookmark.Written = raw
 			}
+		} else if strings.HasPrefix(line, bookmarkKeys.Date+":") {
+			bookmark.Date = extractYAMLValue(line)
+		} else if strings.HasPrefix(line, bookmarkKeys.Tags+":") {
+			value := extractYAMLValue(line)
+			bookmark.Tags = parseTagList(value)
+			inTagList = value == ""
+		}
 
-			// Store all headers for reconstruction
-			if idx := strings.Index(line, ":"); idx > 0 {
-				key := strings.TrimSpace(line[:idx])
-				bookmark.Headers[key] = line
-			}
+		// Store all headers for reconstruction
+		if idx := strings.Index(line, ":"); idx > 0 {
+			key := strings.TrimSpace(line[:idx])
+			bookmark.Headers[key] = line
 		}
 	}
 
-	bookmark.Content = strings.Join(lines[frontmatterEnd+1:], "\n")
+	bookmark.Content = strings.Join(lines[end+1:], "\n")
 
 	return bookmark, nil
 }
 
+// frontmatterBounds returns the indexes of the opening and closing "---"
+// lines. The frontmatter must open on the first non-blank line, so a
+// horizontal rule further down a file without frontmatter is not mistaken for
+// one.
+func frontmatterBounds(lines []string) (int, int, bool) {
+	start := -1
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(strings.TrimPrefix(line, "\ufeff"))
+		if start == -1 {
+			if trimmed == "" {
+				continue
+			}
+			if trimmed != "---" {
+				return 0, 0, false
+			}
+			start = i
+			continue
+		}
+		if trimmed == "---" {
+			return start, i, true
+		}
+	}
+	return 0, 0, false
+}
+
+// extractYAMLValue returns the scalar value of a `key: value` line. Quoted
+// values are unquoted (with YAML's escapes for double and single quotes);
+// plain values lose a trailing " # comment".
 func extractYAMLValue(line string) string {
+	_, _, value := splitYAMLLine(line)
+	return value
+}
+
+// splitYAMLLine returns the byte range of the raw value in line, quotes
+// included and any comment excluded, and the decoded value.
+func splitYAMLLine(line string) (int, int, string) {
 	idx := strings.Index(line, ":")
 	if idx == -1 {
-		return ""
+		return -1, -1, ""
+	}
+
+	start := idx + 1
+	for start < len(line) && (line[start] == ' ' || line[start] == '\t') {
+		start++
 	}
+	value := strings.TrimRight(line[start:], " \t\r")
+	end := start + len(value)
 
-	value := strings.TrimSpace(line[idx+1:])
-	// Remove quotes if present
-	value = strings.Trim(value, `"'`)
+	switch {
+	case len(value) >= 2 && value[0] == '"':
+		if q := closingQuote(value); q != -1 {
+			return start, start + q + 1, unescapeDoubleQuoted(value[1:q])
+		}
+	case len(value) >= 2 && value[0] == '\'':
+		if q := closingSingleQuote(value); q != -1 {
+			return start, start + q + 1, strings.ReplaceAll(value[1:q], "''", "'")
+		}
+	default:
+		if hash := strings.Index(value, " #"); hash != -1 {
+			value = strings.TrimRight(value[:hash], " \t")
+			end = start + len(value)
+		}
+	}
 
-	return value
+	// Unbalanced quotes: keep the old, lenient behaviour
+	return start, end, strings.Trim(value, `"'`)
 }
 
-func checkURL(client *http.Client, urlStr string) (bool, error) {
-	req, err := http.NewRequest("HEAD", urlStr, nil)
-	if err != nil {
-		return false, err
+// closingQuote returns the index of the unescaped quote closing a
+// double-quoted value, or -1.
+func closingQuote(value string) int {
+	for i := 1; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
 	}
+	return -1
+}
 
-	req.Header.Set("User-Agent", userAgent)
+// closingSingleQuote is closingQuote for single-quoted values, where a quote
+// is escaped by doubling it.
+func closingSingleQuote(value string) int {
+	for i := 1; i < len(value); i++ {
+		if value[i] != '\'' {
+			continue
+		}
+		if i+1 < len(value) && value[i+1] == '\'' {
+			i++
+			continue
+		}
+		return i
+	}
+	return -1
+}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		// If we can't connect, treat as 404
-		return true, nil
+func unescapeDoubleQuoted(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
 	}
-	defer resp.Body.Close()
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
 
-	// Consider 404 and 410 as "not found"
-	return resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone, nil
+// quoteYAMLLike encodes value in the same quoting style as the raw value it
+// replaces.
+func quoteYAMLLike(raw, value string) string {
+	raw = strings.TrimSpace(raw)
+	switch {
+	case strings.HasPrefix(raw, `"`):
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+	case strings.HasPrefix(raw, "'"):
+		return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+	case strings.Contains(value, " #") || strings.ContainsAny(value, `"'`) || value != strings.TrimSpace(value) ||
+		value != "" && strings.ContainsRune("#[{&*!|>%@`", rune(value[0])):
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+	}
+	return value
 }
 
-func findArchivedVersion(client *http.Client, originalURL, bookmarkDate string) (string, error) {
+// findArchivedVersion returns the capture of originalURL closest to the
+// bookmark date, or "" if there is none. It asks the Availability API, and
+// only follows replay redirects when the API does not answer.
+func findArchivedVersion(ctx context.Context, client *http.Client, originalURL, bookmarkDate string, now time.Time) (string, error) {
 	// Parse the bookmark date to get a timestamp
-	timestamp := parseDateToTimestamp(bookmarkDate)
+	timestamp := parseDateToTimestamp(bookmarkDate, now)
+
+	snapshotURL, err := availableSnapshot(ctx, client, originalURL, timestamp)
+	if !errors.Is(err, errAvailabilityDown) {
+		return snapshotURL, err
+	}
 
 	// Try to find snapshot near the bookmark date
 	// Format: https://web.archive.org/web/<timestamp>/<url>
-	// Using the closest snapshot with availability check
+	snapshotURL, err = headSnapshot(ctx, client, fmt.Sprintf("%s/%s/%s", waybackAPI, timestamp, originalURL))
+	if err != nil || snapshotURL != "" {
+		return snapshotURL, err
+	}
 
-	// First, check availability API
-	availabilityURL := fmt.Sprintf("%s/%s/%s", waybackAPI, timestamp, originalURL)
+	// If that didn't work, try without timestamp to get any available snapshot
+	return headSnapshot(ctx, client, fmt.Sprintf("%s/*/%s", waybackAPI, originalURL))
+}
 
-	req, err := http.NewRequest("HEAD", availabilityURL, nil)
+// headSnapshot follows a Wayback replay URL and returns the snapshot it
+// redirects to, or "" if the replay does not end in a 200.
+func headSnapshot(ctx context.Context, client *http.Client, replayURL string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", replayURL, nil)
 	if err != nil {
 		return "", err
 	}
 
-	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("User-Agent", archiveUserAgent)
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", err
+		return "", classifyError("wayback lookup", replayURL, err)
 	}
 	resp.Body.Close()
 
 	if resp.StatusCode == http.StatusOK {
+		// Extract the actual snapshot URL from the redirect
 		return resp.Request.URL.String(), nil
 	}
 
-	// If that didn't work, try without timestamp to get any available snapshot
-	anySnapshotURL := fmt.Sprintf("%s/*/%s", waybackAPI, originalURL)
-
-	req2, err := http.NewRequest("HEAD", anySnapshotURL, nil)
-	if err != nil {
-		return "", err
-	}
-
-	req2.Header.Set("User-Agent", userAgent)
-
-	resp2, err := client.Do(req2)
-	if err != nil {
-		return "", err
-	}
-	resp2.Body.Close()
+	return "", statusError("wayback lookup", replayURL, resp.StatusCode)
+}
 
-	if resp2.StatusCode == http.StatusOK {
-		// Extract the actual snapshot URL from the redirect
-		return resp2.Request.URL.String(), nil
+func parseDateToTimestamp(dateStr string, now time.Time) string {
+	if t := parseDate(dateStr); !t.IsZero() {
+		return t.Format("20060102")
 	}
 
-	return "", nil
+	// Default to 6 months ago if there is no usable date
+	return now.AddDate(0, -6, 0).Format("20060102")
 }
 
-func parseDateToTimestamp(dateStr string) string {
-	if dateStr == "" {
-		// Default to 6 months ago if no date
-		return time.Now().AddDate(0, -6, 0).Format("20060102")
-	}
-
+// parseDate parses a frontmatter date, returning the zero time if it is
+// missing or in an unknown format.
+func parseDate(dateStr string) time.Time {
 	// Try different date formats
 	formats := []string{
 		time.RFC3339,
@@ -411,32 +2093,98 @@ func parseDateToTimestamp(dateStr string) string {
 
 	for _, format := range formats {
 		if t, err := time.Parse(format, dateStr); err == nil {
-			return t.Format("20060102")
+			return t
 		}
 	}
 
-	// If parsing fails, return current date minus 6 months
-	return time.Now().AddDate(0, -6, 0).Format("20060102")
+	return time.Time{}
 }
 
-func updateBookmarkFile(bookmark *BookmarkFile, newURL string) error {
-	data, err := os.ReadFile(bookmark.Path)
-	if err != nil {
-		return err
+// rewriteBookmarkContent replaces the value of the link line in the YAML
+// frontmatter, keeping its quoting style. Nothing else in the file is touched.
+func rewriteBookmarkContent(bookmark *BookmarkFile, data []byte, newURL string) ([]byte, error) {
+	lines := strings.Split(string(data), "\n")
+	start, end, ok := frontmatterBounds(lines)
+	if !ok {
+		return nil, fmt.Errorf("no frontmatter in %s", bookmark.Path)
+	}
+	for i := start + 1; i < end; i++ {
+		line := strings.TrimSuffix(lines[i], "\r")
+		if !strings.HasPrefix(line, bookmarkKeys.Link+":") {
+			continue
+		}
+		valueStart, valueEnd, value := splitYAMLLine(line)
+		// parseBookmarkFile reads the first link line with a link
+		if tidyLink(value) == "" {
+			continue
+		}
+		written := bookmark.Link
+		if bookmark.Written != "" {
+			written = bookmark.Written
+		}
+		if value != written {
+			return nil, fmt.Errorf("link in %s changed to %q since it was read", bookmark.Path, value)
+		}
+		lines[i] = line[:valueStart] + quoteYAMLLike(line[valueStart:valueEnd], newURL) + lines[i][valueEnd:]
+		return []byte(strings.Join(lines, "\n")), nil
 	}
 
-	content := string(data)
+	return nil, fmt.Errorf("no link line in the frontmatter of %s", bookmark.Path)
+}
 
-	// Replace the link in the YAML frontmatter
-	oldLinkPattern := regexp.MustCompile(`(link:\s*["']?)` + regexp.QuoteMeta(bookmark.Link) + `(["']?\s*)`)
-	newContent := oldLinkPattern.ReplaceAllString(content, "${1}"+newURL+"${2}")
+// frontmatterField is a frontmatter key and value to write.
+type frontmatterField struct {
+	Key, Value string
+	List       []string           // written as a block list instead of Value
+	Map        []frontmatterField // written as a block of fields instead of Value
+	Body       string             // a reading copy to end the body with
+}
 
-	if newContent == content {
-		// If regex didn't match, try simpler string replacement
-		newContent = strings.Replace(content, bookmark.Link, newURL, 1)
+// setFrontmatterFields sets the fields in the frontmatter of data, and ends
+// its body with any reading copy they carry.
+func setFrontmatterFields(data []byte, fields ...frontmatterField) []byte {
+	for _, field := range fields {
+		switch {
+		case field.List != nil:
+			data = setFrontmatterList(data, field.Key, field.List)
+		case field.Map != nil:
+			data = setFrontmatterMap(data, field.Key, field.Map)
+		default:
+			data = setFrontmatterField(data, field.Key, field.Value)
+		}
+		if field.Body != "" {
+			data = setReadingCopy(data, field.Body)
+		}
 	}
+	return data
+}
 
-	return os.WriteFile(bookmark.Path, []byte(newContent), 0644)
+// setFrontmatterField sets key in the frontmatter of data, replacing its
+// value where the key exists and adding it at the end otherwise. Data
+// without frontmatter is returned unchanged.
+func setFrontmatterField(data []byte, key, value string) []byte {
+	lines := strings.Split(string(data), "\n")
+	start, end, ok := frontmatterBounds(lines)
+	if !ok {
+		return data
+	}
+	for i := start + 1; i < end; i++ {
+		line := strings.TrimSuffix(lines[i], "\r")
+		if !strings.HasPrefix(line, key+":") {
+			continue
+		}
+		valueStart, valueEnd, _ := splitYAMLLine(line)
+		lines[i] = line[:valueStart] + quoteYAMLLike(line[valueStart:valueEnd], value) + lines[i][valueEnd:]
+		return []byte(strings.Join(lines, "\n"))
+	}
+	// Keep the file's line endings
+	eol := ""
+	if strings.HasSuffix(lines[end], "\r") {
+		eol = "\r"
+	}
+	field := key + ": " + quoteYAMLLike("", value) + eol
+	lines = append(lines[:end], append([]string{field}, lines[end:]...)...)
+	return []byte(strings.Join(lines, "\n"))
 }
 
 func extractMainContent(filePath string) (string, error) {
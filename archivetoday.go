@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// archiveTodayPolicy is the [archive_today] section:
+//
+//	[archive_today]
+//	host = "archive.ph"   # the mirror to ask
+//	submit = true         # capture pages it does not have yet
+//
+// archive.today answers on several domains, which come and go; any of them
+// reaches the same archive.
+type archiveTodayPolicy struct {
+	Host   string
+	Submit bool
+}
+
+var defaultArchiveTodayPolicy = archiveTodayPolicy{Host: "archive.ph"}
+
+// archiveTodaySettings are the [archive_today] settings of this process, set
+// once the config is final.
+var archiveTodaySettings = defaultArchiveTodayPolicy
+
+func (p *archiveTodayPolicy) set(key, value string) error {
+	switch key {
+	case "host":
+		host := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(value, "https://"), "http://"), "/")
+		if !containsString(archiveTodayHosts, host) {
+			return fmt.Errorf("invalid host %q (want one of %s)", value, strings.Join(archiveTodayHosts, ", "))
+		}
+		p.Host = host
+	case "submit":
+		p.Submit = value == "true"
+	default:
+		return fmt.Errorf("unknown [archive_today] key %q", key)
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// archiveTodayProvider finds copies on archive.today through its TimeMap,
+// the Memento list of every capture of a URL.
+type archiveTodayProvider struct{}
+
+func (archiveTodayProvider) name() string { return "archive_today" }
+
+func (archiveTodayProvider) endpoint() string { return "https://" + archiveTodaySettings.Host + "/" }
+
+// lookup offers the capture closest to the bookmark date and the most
+// recent one. With submit, a page archive.today does not have is captured;
+// a capture still in progress fails with ErrCapturing, so the link is looked
+// up again on the next run.
+func (archiveTodayProvider) lookup(ctx context.Context, client *http.Client, link, date string, now time.Time) ([]*snapshotCandidate, error) {
+	captures, err := archiveTodayTimeMap(ctx, client, link)
+	if err != nil {
+		return nil, err
+	}
+	if len(captures) == 0 {
+		if !archiveTodaySettings.Submit {
+			return nil, nil
+		}
+		snapshot, err := archiveTodaySubmit(ctx, client, link)
+		if err != nil {
+			return nil, err
+		}
+		return []*snapshotCandidate{{URL: snapshot, Captured: now.UTC()}}, nil
+	}
+
+	want := parseDate(date)
+	if want.IsZero() {
+		want = now.AddDate(0, -6, 0)
+	}
+	return closestAndLatest(captures, want), nil
+}
+
+// archiveTodayTimeMap lists the captures of link.
+func archiveTodayTimeMap(ctx context.Context, client *http.Client, link string) ([]*snapshotCandidate, error) {
+	endpoint := fmt.Sprintf("https://%s/timemap/%s", archiveTodaySettings.Host, link)
+	return fetchTimeMap(ctx, client, "archive.today lookup", endpoint, link)
+}
+
+// archiveTodaySubmit asks archive.today to capture link, and returns the
+// capture once it is done.
+func archiveTodaySubmit(ctx context.Context, client *http.Client, link string) (string, error) {
+	endpoint := fmt.Sprintf("https://%s/submit/", archiveTodaySettings.Host)
+	form := url.Values{}
+	form.Set("url", link)
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", archiveUserAgent)
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", classifyError("archive.today submit", link, err)
+	}
+	resp.Body.Close()
+	if err := statusError("archive.today submit", link, resp.StatusCode); err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("archive.today submit %s: status %d", link, resp.StatusCode)
+	}
+
+	// A capture in progress is announced with a refresh to its /wip/ page
+	final := resp.Request.URL
+	if refresh := resp.Header.Get("Refresh"); refresh != "" {
+		if _, target, ok := strings.Cut(refresh, "url="); ok {
+			if u, err := final.Parse(strings.TrimSpace(target)); err == nil {
+				final = u
+			}
+		}
+	}
+	if strings.HasPrefix(final.Path, "/wip/") || strings.HasPrefix(final.Path, "/submit") {
+		return "", &LinkError{Op: "archive.today submit", URL: link, Kind: ErrCapturing}
+	}
+	return final.String(), nil
+}
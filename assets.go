@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// assetsDirName is the directory at the top of the collection that holds
+// local copies of embedded assets, named by contentKey.
+const assetsDirName = "assets"
+
+var (
+	// markdownImagePattern matches ![alt](url "title"), group 1 is the URL
+	markdownImagePattern = regexp.MustCompile(`!\[[^\]]*\]\(\s*<?(https?://[^\s)>]+)>?`)
+	// htmlAssetPattern matches the src of embedded HTML elements
+	htmlAssetPattern = regexp.MustCompile(`(?i)<(?:img|source|video|audio|embed)\b[^>]*?\ssrc\s*=\s*["']?(https?://[^"'\s>]+)`)
+)
+
+// embeddedURLs lists the images and other embedded assets a bookmark body
+// loads from the web, each once, in order of appearance.
+func embeddedURLs(body string) []string {
+	seen := make(map[string]bool)
+	var assets []string
+	for _, pattern := range []*regexp.Regexp{markdownImagePattern, htmlAssetPattern} {
+		for _, m := range pattern.FindAllStringSubmatch(body, -1) {
+			if link := m[1]; !seen[link] {
+				seen[link] = true
+				assets = append(assets, link)
+			}
+		}
+	}
+	return assets
+}
+
+// extractAssets lists the embedded assets worth checking: those not already
+// served by the Wayback Machine.
+func extractAssets(body string) []string {
+	var assets []string
+	for _, link := range embeddedURLs(body) {
+		if !isWaybackURL(link) {
+			assets = append(assets, link)
+		}
+	}
+	return assets
+}
+
+// assetFileName is the name local copies of an asset were given before the
+// store was content-addressed: a hash of its URL, keeping a short extension
+// so the copy is served with the right type. Such copies are still used.
+func assetFileName(link string) string {
+	sum := sha256.Sum256([]byte(link))
+	return fmt.Sprintf("%x", sum[:8]) + urlExt(link)
+}
+
+// urlExt is the extension of a URL's path if it is a short, plain one.
+func urlExt(link string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	ext := strings.ToLower(path.Ext(u.Path))
+	if len(ext) > 1 && len(ext) <= 6 && strings.Trim(ext[1:], "abcdefghijklmnopqrstuvwxyz0123456789") == "" {
+		return ext
+	}
+	return ""
+}
+
+// checkAsset decides whether an embedded asset is gone. Besides 404s, 410s
+// and unreachable hosts, an asset URL answering with an HTML page is dead:
+// that is how image hosts serve their "no longer available" placeholders.
+func checkAsset(client *http.Client, link string, redirects redirectPolicy) (linkVerdict, error) {
+	verdict := linkVerdict{Method: "HEAD"}
+	resp, err := assetRequest(client, http.MethodHead, link)
+	if err == nil && (resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented) {
+		resp.Body.Close()
+		verdict.Method = "GET"
+		resp, err = assetRequest(client, http.MethodGet, link)
+	}
+	if err != nil {
+		verdict.Dead = true
+		verdict.Reason = fmt.Sprintf("could not connect (%s): %v", errorKind(classifyError("check", link, err)), err)
+		return verdict, nil
+	}
+	defer resp.Body.Close()
+	verdict.Status = resp.StatusCode
+	if redirects.inspect(&verdict, resp) {
+		verdict.Dead = true
+		return verdict, nil
+	}
+
+	switch mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		verdict.Dead = true
+		verdict.Reason = fmt.Sprintf("%s returned %d", verdict.Method, resp.StatusCode)
+	case resp.StatusCode == http.StatusOK && mediaType == "text/html":
+		verdict.Dead = true
+		verdict.Reason = fmt.Sprintf("%s returned an HTML page instead of the asset", verdict.Method)
+	default:
+		verdict.Reason = fmt.Sprintf("%s returned %d (%s)", verdict.Method, resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	return verdict, nil
+}
+
+func assetRequest(client *http.Client, method, link string) (*http.Response, error) {
+	req, err := http.NewRequest(method, wireURL(link), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	return client.Do(req)
+}
+
+// imageCapture finds an archived copy of a dead asset and returns its raw
+// replay URL: Wayback's im_ flag serves the captured bytes without the
+// replay toolbar, so the URL works in an image tag. Only Wayback captures
+// can be replayed this way.
+func imageCapture(client *http.Client, providers *providerChain, link, date string, opts runOptions) (string, error) {
+	candidates, err := providers.lookup(client, link, date, opts.now())
+	if err != nil {
+		return "", err
+	}
+	for _, candidate := range candidates {
+		if m := waybackReplayPattern.FindStringSubmatch(candidate.URL); m != nil {
+			return fmt.Sprintf("%s/%sim_/%s", waybackAPI, m[1], m[3]), nil
+		}
+	}
+	return "", &LinkError{Op: "archive lookup", URL: link, Kind: ErrNoSnapshot}
+}
+
+// checkAssets checks the assets a bookmark's body embeds and rewrites each
+// dead one to a local copy or an archived capture. The bookmark's own link
+// is untouched; it is checked separately.
+func checkAssets(client *http.Client, lock *LockFile, bookmark *BookmarkFile, run *RunRecord, opts runOptions, ex *explainer) {
+	assets := extractAssets(bookmark.Content)
+	if len(assets) == 0 {
+		return
+	}
+	opts.Worker.setPhase("assets")
+
+	replacements := make(map[string]string)
+	for _, asset := range assets {
+		if !opts.Filter.allows(asset) {
+			ex.logf("asset %s excluded by the blocklist/allowlist", asset)
+			continue
+		}
+		run.AssetsChecked++
+		var verdict linkVerdict
+		var err error
+		opts.unlocked(func() { verdict, err = checkAsset(client, asset, opts.Redirects) })
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "\nError checking asset %s: %v\n", asset, err)
+			continue
+		}
+		lock.recordStatus(asset, verdict.Status, verdict.Dead, opts.now())
+		events.emit(checkEvent(run, bookmark.Path, asset, "asset", verdict))
+		if !verdict.Dead {
+			ex.logf("asset %s: %s -> alive", asset, verdict.Reason)
+			continue
+		}
+		ex.logf("asset %s: %s -> dead", asset, verdict.Reason)
+		classification := opts.Flaky.classify(lock.statusHistory(asset))
+		events.emit(event{Event: "classified", Run: run.ID, File: bookmark.Path, URL: asset, Result: classification})
+		if classification != linkDead {
+			ex.logf("asset %s is %s; not replaced yet", asset, classification)
+			continue
+		}
+		run.DeadAssets++
+
+		if local, ok := assetCopy(opts.blobStore(), lock, bookmark.Path, asset); ok {
+			ex.logf("asset %s has a local copy at %s", asset, local)
+			replacements[asset] = local
+			continue
+		}
+		var capture string
+		opts.unlocked(func() { capture, err = imageCapture(client, opts.Providers, asset, bookmark.Date, opts) })
+		if err != nil {
+			ex.logf("no archived copy of asset %s: %v", asset, err)
+			fmt.Printf("\nNo archive found for embedded asset: %s\n", asset)
+			continue
+		}
+		replacements[asset] = capture
+	}
+	if len(replacements) == 0 {
+		return
+	}
+	if opts.Queue {
+		for asset, replacement := range replacements {
+			events.emit(event{Event: "queued", Run: run.ID, File: bookmark.Path, URL: asset, Scope: "asset", Archived: replacement})
+			fmt.Printf("\nDead embedded asset, not rewritten with --queue: %s\n  -> %s\n", asset, replacement)
+		}
+		return
+	}
+
+	data, err := os.ReadFile(bookmark.Path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nError updating %s: %v\n", bookmark.Path, err)
+		run.recordError(bookmark.Path, err)
+		return
+	}
+	updated := rewriteAssetURLs(data, replacements)
+	if err := lock.writeRewrite(bookmark.Path, data, updated, "embedded assets"); err != nil {
+		fmt.Fprintf(os.Stderr, "\nError updating %s: %v\n", bookmark.Path, err)
+		run.recordError(bookmark.Path, err)
+		return
+	}
+	for _, asset := range assets {
+		if replacement, ok := replacements[asset]; ok {
+			run.AssetsReplaced++
+			events.emit(event{Event: "replaced", Run: run.ID, File: bookmark.Path, URL: asset, Scope: "asset", Archived: replacement, DryRun: opts.DryRun})
+			fmt.Printf("\n%s Replaced embedded asset: %s\n  -> %s\n", console.mark(), asset, replacement)
+		}
+	}
+}
+
+// rewriteAssetURLs replaces asset URLs where the body embeds them, leaving
+// the frontmatter and any other mention of the same URL alone.
+func rewriteAssetURLs(data []byte, replacements map[string]string) []byte {
+	content := string(data)
+	head, body := "", content
+	lines := strings.SplitAfter(content, "\n")
+	if _, end, ok := frontmatterBounds(lines); ok {
+		head = strings.Join(lines[:end+1], "")
+		body = strings.Join(lines[end+1:], "")
+	}
+	for _, pattern := range []*regexp.Regexp{markdownImagePattern, htmlAssetPattern} {
+		body = pattern.ReplaceAllStringFunc(body, func(match string) string {
+			link := pattern.FindStringSubmatch(match)[1]
+			if replacement, ok := replacements[link]; ok {
+				return strings.Replace(match, link, replacement, 1)
+			}
+			return match
+		})
+	}
+	return []byte(head + body)
+}
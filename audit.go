@@ -0,0 +1,283 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// maxAudits bounds how many censuses are kept in the lock file, so two can
+// always be compared.
+const maxAudits = 6
+
+// auditCensus is one full sweep of the collection by `archive_tool audit`:
+// the liveness of every link, checked afresh regardless of the processed
+// state. It is saved as it goes, and a sweep that is interrupted resumes
+// where it stopped.
+type auditCensus struct {
+	ID       string                  `json:"id"`
+	Started  time.Time               `json:"started"`
+	Finished time.Time               `json:"finished,omitempty"`
+	Total    int                     `json:"total"`
+	Results  map[string]*auditResult `json:"results"` // by link
+}
+
+// auditResult is one link's state in a census. Final is where its redirects
+// ended, if somewhere else.
+type auditResult struct {
+	Status  int       `json:"status,omitempty"`
+	Dead    bool      `json:"dead,omitempty"`
+	Final   string    `json:"final,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	Checked time.Time `json:"checked"`
+}
+
+// currentAudit returns the census in progress, if any.
+func (lock *LockFile) currentAudit() *auditCensus {
+	if n := len(lock.Audits); n > 0 && lock.Audits[n-1].Finished.IsZero() {
+		return lock.Audits[n-1]
+	}
+	return nil
+}
+
+// putAudit stores a census, replacing its earlier state.
+func (lock *LockFile) putAudit(census *auditCensus) {
+	for i, c := range lock.Audits {
+		if c.ID == census.ID {
+			lock.Audits[i] = census
+			return
+		}
+	}
+	lock.Audits = append(lock.Audits, census)
+	if len(lock.Audits) > maxAudits {
+		lock.Audits = lock.Audits[len(lock.Audits)-maxAudits:]
+	}
+}
+
+// saveAudit writes a census into the lock file as it is on disk now. A sweep
+// runs for days beside regular runs, so it never writes back the rest of a
+// lock file it loaded long ago.
+func saveAudit(census *auditCensus) error {
+	lock, err := loadLockFile(false)
+	if err != nil {
+		return err
+	}
+	lock.putAudit(census)
+	return saveLockFile(lock)
+}
+
+// interleaveHosts orders links so that consecutive checks go to different
+// hosts wherever the collection allows it.
+func interleaveHosts(links []string) []string {
+	byHost := make(map[string][]string)
+	var hosts []string
+	for _, link := range links {
+		host := coverageHost(link)
+		if _, ok := byHost[host]; !ok {
+			hosts = append(hosts, host)
+		}
+		byHost[host] = append(byHost[host], link)
+	}
+	sort.Strings(hosts)
+
+	ordered := make([]string, 0, len(links))
+	for len(ordered) < len(links) {
+		for _, host := range hosts {
+			if queue := byHost[host]; len(queue) > 0 {
+				ordered = append(ordered, queue[0])
+				byHost[host] = queue[1:]
+			}
+		}
+	}
+	return ordered
+}
+
+// summary counts the results of a census.
+func (c *auditCensus) summary() (alive, dead, redirected, failed int) {
+	for _, r := range c.Results {
+		switch {
+		case r.Error != "":
+			failed++
+		case r.Dead:
+			dead++
+		default:
+			alive++
+			if r.Final != "" {
+				redirected++
+			}
+		}
+	}
+	return alive, dead, redirected, failed
+}
+
+// runAudit implements `archive_tool audit`: a slow sweep checking every link
+// in the collection, processed or not, into a census. Nothing is replaced
+// and bookmarks are never written.
+func runAudit(args []string) {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	opts := runOptions{Trigger: "audit", Profile: runProfiles["fast"]}
+	opts.register(fs)
+	interval := fs.Duration("interval", 15*time.Second, "wait this `duration` between two checks")
+	restart := fs.Bool("restart", false, "abandon the census in progress and start a new one")
+	loop := fs.Bool("loop", false, "keep running: start the next census when one is finished")
+	every := fs.Duration("every", 30*24*time.Hour, "with --loop, start censuses this `duration` apart")
+	status := fs.Bool("status", false, "show the progress of the census and exit")
+	fs.Parse(args)
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		os.Exit(1)
+	}
+	if err := opts.finish(cfg, fs.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	lock, err := loadLockFile(false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading lock file: %v\n", err)
+		os.Exit(1)
+	}
+	if *status {
+		printAuditStatus(lock, *interval)
+		return
+	}
+
+	ctl := newController()
+	ctl.stopOnSignal()
+	census := lock.currentAudit()
+	if *restart && census != nil {
+		lock.Audits = lock.Audits[:len(lock.Audits)-1]
+		if err := saveLockFile(lock); err != nil {
+			fmt.Fprintf(os.Stderr, "Error saving lock file: %v\n", err)
+			os.Exit(1)
+		}
+		census = nil
+	}
+	for {
+		if census == nil {
+			now := opts.now()
+			census = &auditCensus{ID: newRunID(now), Started: now, Results: make(map[string]*auditResult)}
+		}
+		if !auditSweep(census, opts, ctl, *interval) {
+			fmt.Printf("\nStopped; %d of %d links checked, the census resumes on the next audit\n", len(census.Results), census.Total)
+			return
+		}
+		alive, dead, redirected, failed := census.summary()
+		fmt.Printf("\nCensus %s finished: %d links, %d alive (%d redirected elsewhere), %d dead, %d could not be checked\n",
+			census.ID, len(census.Results), alive, redirected, dead, failed)
+		if !*loop {
+			return
+		}
+
+		next := census.Started.Add(*every)
+		fmt.Printf("Next census at %s\n", next.Format(time.RFC3339))
+		census = nil
+		select {
+		case <-ctl.stopCh:
+			return
+		case <-time.After(time.Until(next)):
+		}
+	}
+}
+
+// auditSweep checks the links of the collection the census does not have
+// yet, one every interval. It returns false if it was stopped first.
+func auditSweep(census *auditCensus, opts runOptions, ctl *controller, interval time.Duration) bool {
+	opts.Stop = ctl.stopCh
+	files, err := findMarkdownFiles(opts.Dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading directory: %v\n", err)
+		os.Exit(1)
+	}
+	if opts.Shard.Count > 1 {
+		files = opts.Shard.filter(opts.Dir, files)
+	}
+
+	seen := make(map[string]bool)
+	var links []string
+	for _, filePath := range files {
+		bookmark, err := parseBookmarkFile(filePath)
+		if err != nil || seen[bookmark.Link] || validateLink(bookmark.Link) != nil {
+			continue
+		}
+		if !opts.Filter.allows(bookmark.Link) || !opts.Tags.matches(bookmark.Tags) {
+			continue
+		}
+		seen[bookmark.Link] = true
+		links = append(links, bookmark.Link)
+	}
+	census.Total = len(links)
+
+	var todo []string
+	for _, link := range interleaveHosts(links) {
+		if _, done := census.Results[link]; !done {
+			todo = append(todo, link)
+		}
+	}
+	remaining := time.Duration(len(todo)) * interval
+	fmt.Printf("Census %s: %d links, %d left to check, about %s at one every %s\n",
+		census.ID, census.Total, len(todo), remaining.Round(time.Minute), interval)
+
+	client := opts.httpClient()
+	lastSave := time.Now()
+	for i, link := range todo {
+		if i > 0 {
+			select {
+			case <-ctl.stopCh:
+			case <-time.After(interval):
+			}
+		}
+		if !ctl.checkpoint() {
+			if err := saveAudit(census); err != nil {
+				fmt.Fprintf(os.Stderr, "Error saving the census: %v\n", err)
+			}
+			return false
+		}
+
+		result := &auditResult{Checked: opts.now()}
+		verdict, err := opts.diagnoseLinkSince(client, link, opts.Profile, nil)
+		if err != nil {
+			result.Error = err.Error()
+		} else {
+			result.Status, result.Dead = verdict.Status, verdict.Dead
+			if n := len(verdict.Chain); n > 1 && verdict.Chain[n-1] != link {
+				result.Final = verdict.Chain[n-1]
+			}
+		}
+		census.Results[link] = result
+		console.progress(len(census.Results), census.Total, "Auditing [%d/%d]", len(census.Results), census.Total)
+
+		if time.Since(lastSave) > time.Minute {
+			if err := saveAudit(census); err != nil {
+				fmt.Fprintf(os.Stderr, "\nError saving the census: %v\n", err)
+			}
+			lastSave = time.Now()
+		}
+	}
+
+	census.Finished = opts.now()
+	if err := saveAudit(census); err != nil {
+		fmt.Fprintf(os.Stderr, "\nError saving the census: %v\n", err)
+	}
+	return true
+}
+
+func printAuditStatus(lock *LockFile, interval time.Duration) {
+	if len(lock.Audits) == 0 {
+		fmt.Println("No census yet; start one with archive_tool audit")
+		return
+	}
+	for _, c := range lock.Audits {
+		alive, dead, redirected, failed := c.summary()
+		state := "finished " + c.Finished.Format(time.RFC3339)
+		if c.Finished.IsZero() {
+			left := time.Duration(c.Total-len(c.Results)) * interval
+			state = fmt.Sprintf("in progress, %d of %d checked, about %s left", len(c.Results), c.Total, left.Round(time.Minute))
+		}
+		fmt.Printf("%s  %s\n  %d alive (%d redirected elsewhere), %d dead, %d could not be checked\n",
+			c.ID, state, alive, redirected, dead, failed)
+	}
+}
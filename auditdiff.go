@@ -0,0 +1,218 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// auditTransition is a link whose state differs between two censuses.
+type auditTransition struct {
+	Link     string
+	From, To *auditResult
+}
+
+// auditDiff is what changed from one census to another. Links one of them
+// could not check, or did not reach, are left out.
+type auditDiff struct {
+	Died, Revived, Redirected []auditTransition
+
+	// DeadHosts are the hosts every link of which died, with their links,
+	// taken out of Died
+	DeadHosts map[string][]auditTransition
+}
+
+// censusOfRun rebuilds a census from what a run recorded: the statuses of
+// the links it checked and the redirect chains it flagged. Unflagged
+// redirects are not recorded, so their targets are unknown.
+func censusOfRun(lock *LockFile, run *RunRecord) *auditCensus {
+	census := &auditCensus{ID: run.ID, Started: run.Started, Finished: run.Finished, Results: make(map[string]*auditResult)}
+	for link, history := range lock.URLHistory {
+		for _, entry := range history {
+			if entry.Time.Before(run.Started) || entry.Time.After(run.Finished) {
+				continue
+			}
+			census.Results[link] = &auditResult{Status: entry.Status, Dead: entry.Dead, Checked: entry.Time}
+		}
+	}
+	for _, r := range run.Redirects {
+		if n := len(r.Chain); n > 1 {
+			if result := census.Results[r.Chain[0]]; result != nil {
+				result.Final = r.Chain[n-1]
+			}
+		}
+	}
+	census.Total = len(census.Results)
+	return census
+}
+
+// findCensus returns the census or run with the given ID, a run being
+// rebuilt into a census.
+func (lock *LockFile) findCensus(id string) (*auditCensus, error) {
+	for _, c := range lock.Audits {
+		if c.ID == id {
+			return c, nil
+		}
+	}
+	for _, run := range lock.Runs {
+		if run.ID == id {
+			return censusOfRun(lock, run), nil
+		}
+	}
+	return nil, fmt.Errorf("no census or run %s (see archive_tool audit --status)", id)
+}
+
+// diffCensuses compares two censuses. A host is reported as gone when at
+// least minHost of its links were alive in from and all of them are dead.
+func diffCensuses(from, to *auditCensus, minHost int) *auditDiff {
+	diff := &auditDiff{DeadHosts: make(map[string][]auditTransition)}
+	alive := make(map[string]int) // alive in from and checked in to, by host
+	died := make(map[string][]auditTransition)
+
+	links := make([]string, 0, len(to.Results))
+	for link := range to.Results {
+		links = append(links, link)
+	}
+	sort.Strings(links)
+	for _, link := range links {
+		before, after := from.Results[link], to.Results[link]
+		if before == nil || before.Error != "" || after.Error != "" {
+			continue
+		}
+		t := auditTransition{Link: link, From: before, To: after}
+		switch {
+		case !before.Dead && after.Dead:
+			died[coverageHost(link)] = append(died[coverageHost(link)], t)
+		case before.Dead && !after.Dead:
+			diff.Revived = append(diff.Revived, t)
+		case !before.Dead && before.Final != after.Final:
+			diff.Redirected = append(diff.Redirected, t)
+		}
+		if !before.Dead {
+			alive[coverageHost(link)]++
+		}
+	}
+
+	hosts := make([]string, 0, len(died))
+	for host := range died {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		if n := len(died[host]); n >= minHost && n == alive[host] {
+			diff.DeadHosts[host] = died[host]
+			continue
+		}
+		diff.Died = append(diff.Died, died[host]...)
+	}
+	sort.Slice(diff.Died, func(i, j int) bool { return diff.Died[i].Link < diff.Died[j].Link })
+	return diff
+}
+
+// describeResult is how a link's state reads in the report.
+func describeResult(r *auditResult) string {
+	switch {
+	case r.Status == 0:
+		return "unreachable"
+	case r.Final != "":
+		return fmt.Sprintf("%d via %s", r.Status, r.Final)
+	}
+	return fmt.Sprint(r.Status)
+}
+
+// runAuditDiff implements `archive_tool audit-diff`: it reports which links
+// changed state between two censuses, by default the last two finished
+// ones. Run IDs may be given too; a run only knows the links it checked.
+func runAuditDiff(args []string) {
+	fs := flag.NewFlagSet("audit-diff", flag.ExitOnError)
+	minHost := fs.Int("min-host", 3, "report a host as gone when at least `n` of its links all died")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: archive_tool audit-diff [--min-host n] [from-id [to-id]]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	lock, err := loadLockFile(false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading lock file: %v\n", err)
+		os.Exit(1)
+	}
+
+	var finished []*auditCensus
+	for _, c := range lock.Audits {
+		if !c.Finished.IsZero() {
+			finished = append(finished, c)
+		}
+	}
+	var from, to *auditCensus
+	switch fs.NArg() {
+	case 0:
+		if len(finished) < 2 {
+			fmt.Fprintf(os.Stderr, "Error: %d finished census(es), two are needed; give the IDs of two runs to compare them instead\n", len(finished))
+			os.Exit(1)
+		}
+		from, to = finished[len(finished)-2], finished[len(finished)-1]
+	case 1, 2:
+		if from, err = lock.findCensus(fs.Arg(0)); err == nil {
+			if fs.NArg() == 2 {
+				to, err = lock.findCensus(fs.Arg(1))
+			} else if len(finished) == 0 {
+				err = fmt.Errorf("no finished census to compare %s with", fs.Arg(0))
+			} else {
+				to = finished[len(finished)-1]
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	diff := diffCensuses(from, to, max(*minHost, 1))
+	fmt.Printf("From %s (%s) to %s (%s)\n", from.ID, from.Started.Format("2006-01-02"), to.ID, to.Started.Format("2006-01-02"))
+	if len(diff.Died)+len(diff.Revived)+len(diff.Redirected)+len(diff.DeadHosts) == 0 {
+		fmt.Println("\nNo link changed state")
+		return
+	}
+
+	if len(diff.DeadHosts) > 0 {
+		hosts := make([]string, 0, len(diff.DeadHosts))
+		for host := range diff.DeadHosts {
+			hosts = append(hosts, host)
+		}
+		sort.Slice(hosts, func(i, j int) bool {
+			if a, b := len(diff.DeadHosts[hosts[i]]), len(diff.DeadHosts[hosts[j]]); a != b {
+				return a > b
+			}
+			return hosts[i] < hosts[j]
+		})
+		fmt.Printf("\nHosts gone (%d), every link dead:\n", len(hosts))
+		for _, host := range hosts {
+			fmt.Printf("  %s: %d link(s)\n", host, len(diff.DeadHosts[host]))
+			for _, t := range diff.DeadHosts[host] {
+				fmt.Printf("    %s  %s -> %s\n", t.Link, describeResult(t.From), describeResult(t.To))
+			}
+		}
+	}
+	sections := []struct {
+		title       string
+		transitions []auditTransition
+	}{
+		{"Alive -> dead", diff.Died},
+		{"Dead -> alive", diff.Revived},
+		{"Redirect target changed", diff.Redirected},
+	}
+	for _, s := range sections {
+		if len(s.transitions) == 0 {
+			continue
+		}
+		fmt.Printf("\n%s (%d):\n", s.title, len(s.transitions))
+		for _, t := range s.transitions {
+			fmt.Printf("  %s  %s -> %s\n", t.Link, describeResult(t.From), describeResult(t.To))
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// blobStore keeps downloaded content, such as mirrored assets, by key. Keys
+// are flat file names. url is where a bookmark can embed a blob from: a
+// public URL for remote stores, "" for the filesystem, whose blobs are
+// embedded by relative path.
+type blobStore interface {
+	name() string
+	put(key string, data []byte, contentType string) error
+	get(key string) ([]byte, error)
+	has(key string) (bool, error)
+	remove(key string) error
+	list() ([]string, error)
+	url(key string) string
+}
+
+// errBlobNotFound is returned by get for a key the store does not have.
+var errBlobNotFound = errors.New("blob not found")
+
+// storageProfile is a [storage.<name>] section of the config file:
+//
+//	[storage.offsite]
+//	backend = "s3"             # fs, s3 or webdav
+//	endpoint = "https://s3.eu-central-1.amazonaws.com"
+//	region = "eu-central-1"
+//	bucket = "my-bookmarks"
+//	prefix = "assets/"
+//	public_url = "https://my-bookmarks.s3.eu-central-1.amazonaws.com/assets/"
+//	credentials = "s3_keys"    # secret holding "access:secret"
+//
+// The "fs" backend takes a path, by default the collection's assets/
+// directory. The top-level storage key, or --storage, picks the profile.
+type storageProfile struct {
+	Backend     string
+	Path        string
+	Endpoint    string
+	Region      string
+	Bucket      string
+	Prefix      string
+	PublicURL   string
+	Credentials string // name of the secret with the credentials
+	User        string // WebDAV user; the credentials secret is the password
+	PathStyle   bool   // S3 path-style requests, as MinIO and others need
+
+	// Encrypt seals blobs with the key in the EncryptionKey secret
+	Encrypt       bool
+	EncryptionKey string
+}
+
+type storageProfiles map[string]*storageProfile
+
+func (p *storageProfiles) set(name, key, value string) error {
+	if *p == nil {
+		*p = make(storageProfiles)
+	}
+	profile := (*p)[name]
+	if profile == nil {
+		profile = &storageProfile{}
+		(*p)[name] = profile
+	}
+	switch key {
+	case "backend":
+		if value != "fs" && value != "s3" && value != "webdav" {
+			return fmt.Errorf("invalid backend %q (want fs, s3 or webdav)", value)
+		}
+		profile.Backend = value
+	case "path":
+		profile.Path = expandHome(value)
+	case "endpoint":
+		profile.Endpoint = strings.TrimSuffix(value, "/")
+	case "region":
+		profile.Region = value
+	case "bucket":
+		profile.Bucket = value
+	case "prefix":
+		profile.Prefix = value
+	case "public_url":
+		profile.PublicURL = value
+	case "credentials":
+		profile.Credentials = value
+	case "user":
+		profile.User = value
+	case "path_style":
+		profile.PathStyle = value == "true"
+	case "encrypt":
+		profile.Encrypt = value == "true"
+	case "encryption_key":
+		profile.EncryptionKey = value
+	default:
+		return fmt.Errorf("unknown [storage.%s] key %q", name, key)
+	}
+	return nil
+}
+
+// openBlobStore opens the named storage profile.
+func openBlobStore(cfg *Config, name, dir string, client *http.Client) (blobStore, error) {
+	profile, ok := cfg.StorageSets[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown storage profile %q (add a [storage.%s] section to %s)", name, name, getConfigPath())
+	}
+	store, err := openBackend(cfg, name, profile, dir, client)
+	if err != nil || !profile.Encrypt {
+		return store, err
+	}
+	aead, err := loadCipher(&cfg.Secrets, profile.EncryptionKey)
+	if err != nil {
+		return nil, fmt.Errorf("storage %q: %w", name, err)
+	}
+	return encryptedStore{blobStore: store, aead: aead}, nil
+}
+
+func openBackend(cfg *Config, name string, profile *storageProfile, dir string, client *http.Client) (blobStore, error) {
+	switch profile.Backend {
+	case "", "fs":
+		path := profile.Path
+		if path == "" {
+			path = filepath.Join(dir, assetsDirName)
+		}
+		return fsStore{dir: path}, nil
+	case "s3":
+		if profile.Endpoint == "" || profile.Bucket == "" {
+			return nil, fmt.Errorf("storage %q: s3 needs an endpoint and a bucket", name)
+		}
+		keys, err := cfg.Secrets.get(defaultString(profile.Credentials, "s3_keys"))
+		if err != nil {
+			return nil, fmt.Errorf("storage %q: %w", name, err)
+		}
+		access, secret, ok := strings.Cut(keys, ":")
+		if !ok {
+			return nil, fmt.Errorf("storage %q: credentials must be \"access:secret\"", name)
+		}
+		return &s3Store{profile: *profile, access: access, secret: secret, client: client}, nil
+	case "webdav":
+		if profile.Endpoint == "" {
+			return nil, fmt.Errorf("storage %q: webdav needs an endpoint", name)
+		}
+		store := &webdavStore{profile: *profile, client: client}
+		if profile.User != "" {
+			password, err := cfg.Secrets.get(defaultString(profile.Credentials, "webdav_password"))
+			if err != nil {
+				return nil, fmt.Errorf("storage %q: %w", name, err)
+			}
+			store.password = password
+		}
+		return store, nil
+	}
+	return nil, fmt.Errorf("storage %q: unknown backend %q", name, profile.Backend)
+}
+
+func defaultString(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// publicBlobURL joins a remote store's public URL and a key.
+func publicBlobURL(base, key string) string {
+	if base == "" {
+		return ""
+	}
+	return strings.TrimSuffix(base, "/") + "/" + key
+}
+
+// fsStore keeps blobs as files in a directory.
+type fsStore struct {
+	dir string
+}
+
+func (s fsStore) name() string { return s.dir }
+
+func (s fsStore) put(key string, data []byte, contentType string) error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(s.dir, key), data, 0644)
+}
+
+func (s fsStore) get(key string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, key))
+	if os.IsNotExist(err) {
+		return nil, errBlobNotFound
+	}
+	return data, err
+}
+
+func (s fsStore) has(key string) (bool, error) {
+	_, err := os.Stat(filepath.Join(s.dir, key))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s fsStore) remove(key string) error {
+	err := os.Remove(filepath.Join(s.dir, key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s fsStore) list() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, entry := range entries {
+		// Skip directories and the temporary files of interrupted writes
+		if !entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			keys = append(keys, entry.Name())
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s fsStore) url(key string) string { return "" }
+
+// blobStore returns the store downloaded content goes to.
+func (opts *runOptions) blobStore() blobStore {
+	if opts.Store == nil {
+		return fsStore{dir: filepath.Join(opts.Dir, assetsDirName)}
+	}
+	return opts.Store
+}
+
+// assetCopy returns what a bookmark should embed instead of an asset, if the
+// store has a copy: a path relative to the bookmark for the filesystem store,
+// the blob's public URL for remote ones. Encrypted copies have neither.
+func assetCopy(store blobStore, lock *LockFile, bookmarkPath, link string) (string, bool) {
+	key := lock.blobKey(link)
+	if ok, err := store.has(key); err != nil || !ok {
+		return "", false
+	}
+	if fs, ok := store.(fsStore); ok {
+		rel, err := filepath.Rel(filepath.Dir(bookmarkPath), filepath.Join(fs.dir, key))
+		if err != nil {
+			return "", false
+		}
+		return filepath.ToSlash(rel), true
+	}
+	if u := store.url(key); u != "" {
+		return u, true
+	}
+	return "", false
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// bodyLinkPattern matches [text](url "title") links, and images, which group
+// 1 marks with its "!" so they can be told apart; group 2 is the URL. The
+// text may hold an image, as a linked badge does, and the URL balanced
+// parentheses, as Wikipedia's do.
+var bodyLinkPattern = regexp.MustCompile(`(!?)\[(?:[^\[\]]|!\[[^\]]*\]\([^)]*\))*\]\(\s*<?(https?://(?:[^\s()<>]|\([^\s()<>]*\))+)>?`)
+
+// BodyLinkRecord is a dead link found in a bookmark's body, and the archived
+// copy it was rewritten to, if one was found.
+type BodyLinkRecord struct {
+	File     string `json:"file"`
+	Original string `json:"original"`
+	URL      string `json:"url,omitempty"`
+	Reason   string `json:"reason"`
+	Queued   bool   `json:"queued,omitempty"`
+}
+
+// bodyLinkSpans finds the links in a bookmark body, as the start and end of
+// each URL. Images are left to --check-assets, and a reading copy is left as
+// it was made: its links are the article's.
+func bodyLinkSpans(body string) [][2]int {
+	copyStart, copyEnd := -1, -1
+	if i := strings.Index(body, readingCopyStart); i >= 0 {
+		copyStart, copyEnd = i, len(body)
+		if j := strings.Index(body[i:], readingCopyEnd); j >= 0 {
+			copyEnd = i + j
+		}
+	}
+	var spans [][2]int
+	for _, m := range bodyLinkPattern.FindAllStringSubmatchIndex(body, -1) {
+		if m[3] > m[2] || m[0] >= copyStart && m[0] < copyEnd {
+			continue
+		}
+		spans = append(spans, [2]int{m[4], m[5]})
+	}
+	return spans
+}
+
+// extractBodyLinks lists the links worth checking in a bookmark body, each
+// once, in order of appearance: not the bookmark's own link, which is
+// checked separately, nor links into the Wayback Machine.
+func extractBodyLinks(body string, own ...string) []string {
+	seen := make(map[string]bool)
+	for _, link := range own {
+		seen[link] = true
+	}
+	var links []string
+	for _, span := range bodyLinkSpans(body) {
+		if link := body[span[0]:span[1]]; !seen[link] && !isWaybackURL(link) {
+			seen[link] = true
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+// checkBodyLinks checks the links in a bookmark's body and rewrites each
+// dead one to an archived copy. Each dead link is recorded in the run, with
+// what it was rewritten to.
+func checkBodyLinks(client *http.Client, lock *LockFile, bookmark *BookmarkFile, run *RunRecord, opts runOptions, ex *explainer, sensitive bool) {
+	links := extractBodyLinks(bookmark.Content, bookmark.Link)
+	if len(links) == 0 {
+		return
+	}
+	opts.Worker.setPhase("body links")
+
+	replacements := make(map[string]string)
+	var dead []*BodyLinkRecord
+	for _, link := range links {
+		if !opts.Filter.allows(link) {
+			ex.logf("body link %s excluded by the blocklist/allowlist", link)
+			continue
+		}
+		run.BodyLinksChecked++
+		var verdict linkVerdict
+		var err error
+		opts.unlocked(func() { verdict, err = opts.diagnoseLinkSince(client, link, opts.Profile, nil) })
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "\nError checking body link %s: %v\n", link, err)
+			continue
+		}
+		lock.recordStatus(link, verdict.Status, verdict.Dead, opts.now())
+		events.emit(checkEvent(run, bookmark.Path, link, "body_link", verdict))
+		if !verdict.Dead {
+			ex.logf("body link %s: %s -> alive", link, verdict.Reason)
+			continue
+		}
+		ex.logf("body link %s: %s -> dead", link, verdict.Reason)
+		classification := opts.Flaky.classify(lock.statusHistory(link))
+		events.emit(event{Event: "classified", Run: run.ID, File: bookmark.Path, URL: link, Result: classification})
+		if classification != linkDead {
+			ex.logf("body link %s is %s; not replaced yet", link, classification)
+			continue
+		}
+		run.DeadBodyLinks++
+		record := &BodyLinkRecord{File: bookmark.Path, Original: link, Reason: verdict.Reason}
+		dead = append(dead, record)
+
+		// Links in a sensitive bookmark are as private as its own
+		if sensitive {
+			opts.Providers.sensitive.mark(link)
+		}
+		var candidates []*snapshotCandidate
+		opts.unlocked(func() { candidates, err = opts.Providers.lookup(client, link, bookmark.Date, opts.now()) })
+		switch {
+		case errors.Is(err, ErrSensitive):
+			ex.logf("body link %s is sensitive; not looked up", link)
+			fmt.Printf("\nDead sensitive link in the body, not sent to archive services: %s\n", link)
+			continue
+		case errors.Is(err, ErrNoSnapshot):
+			ex.logf("no archived copy of body link %s: %v", link, err)
+			fmt.Printf("\nNo archive found for link in the body: %s\n", link)
+			continue
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "\nError finding archive for %s: %v\n", link, err)
+			continue
+		}
+		var chosen *snapshotCandidate
+		opts.unlocked(func() {
+			chosen = selectCandidate(client, candidates, &BookmarkFile{Link: link, Date: bookmark.Date}, opts.Providers.count(link))
+		})
+		ex.logf("body link %s -> %s (%s)", link, chosen.URL, chosen.Provider)
+		replacements[link] = chosen.URL
+		record.URL = chosen.URL
+	}
+	run.BodyLinks = append(run.BodyLinks, dead...)
+	if len(replacements) == 0 {
+		return
+	}
+	if opts.Queue {
+		for _, record := range dead {
+			if record.URL != "" {
+				record.Queued = true
+				events.emit(event{Event: "queued", Run: run.ID, File: bookmark.Path, URL: record.Original, Scope: "body_link", Archived: record.URL})
+				fmt.Printf("\nDead link in the body, not rewritten with --queue: %s\n  -> %s\n", record.Original, record.URL)
+			}
+		}
+		return
+	}
+
+	data, err := os.ReadFile(bookmark.Path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nError updating %s: %v\n", bookmark.Path, err)
+		run.recordError(bookmark.Path, err)
+		return
+	}
+	updated := rewriteBodyLinks(data, replacements)
+	if err := lock.writeRewrite(bookmark.Path, data, updated, "links in the body"); err != nil {
+		fmt.Fprintf(os.Stderr, "\nError updating %s: %v\n", bookmark.Path, err)
+		run.recordError(bookmark.Path, err)
+		return
+	}
+	for _, record := range dead {
+		if record.URL != "" {
+			run.BodyLinksReplaced++
+			events.emit(event{Event: "replaced", Run: run.ID, File: bookmark.Path, URL: record.Original, Scope: "body_link", Archived: record.URL, DryRun: opts.DryRun})
+			fmt.Printf("\n%s Replaced link in the body: %s\n  -> %s\n", console.mark(), record.Original, record.URL)
+		}
+	}
+}
+
+// rewriteBodyLinks replaces link URLs where the body links to them, leaving
+// the frontmatter, the link text and any other mention of the same URL
+// alone.
+func rewriteBodyLinks(data []byte, replacements map[string]string) []byte {
+	content := string(data)
+	head, body := "", content
+	lines := strings.SplitAfter(content, "\n")
+	if _, end, ok := frontmatterBounds(lines); ok {
+		head = strings.Join(lines[:end+1], "")
+		body = strings.Join(lines[end+1:], "")
+	}
+	var b strings.Builder
+	last := 0
+	for _, span := range bodyLinkSpans(body) {
+		if replacement, ok := replacements[body[span[0]:span[1]]]; ok {
+			b.WriteString(body[last:span[0]])
+			b.WriteString(replacement)
+			last = span[1]
+		}
+	}
+	b.WriteString(body[last:])
+	return []byte(head + b.String())
+}
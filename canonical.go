@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// hostSet is a set of host names, without their "www.".
+type hostSet map[string]bool
+
+func (s *hostSet) add(hosts string) {
+	for _, host := range strings.Split(hosts, ",") {
+		host = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(host)), "www.")
+		if host == "" {
+			continue
+		}
+		if *s == nil {
+			*s = make(hostSet)
+		}
+		(*s)[host] = true
+	}
+}
+
+// ampCachePath is the path of a page in the Google AMP cache: a content
+// kind, "s/" for https, then the page's host and path.
+var ampCachePath = regexp.MustCompile(`^/(?:c|v|wp)/(s/)?(.+)$`)
+
+// mediumPostID ends the path of a Medium post, on medium.com or a custom
+// domain: the title slug, then the post's id.
+var mediumPostID = regexp.MustCompile(`-([0-9a-f]{10,16})/?$`)
+
+// mirrorHosts are reading mirrors that serve another site's pages under the
+// same path.
+var mirrorHosts = map[string]string{
+	"scribe.rip": "medium.com",
+}
+
+// canonicalArticle returns the URL of the article an AMP page or a mirror
+// copies, or link itself when it is neither. medium names the custom
+// domains of Medium publications, whose posts medium.com still serves after
+// the domain lapses.
+func canonicalArticle(link string, medium hostSet) string {
+	u, err := url.Parse(link)
+	if err != nil || u.Host == "" {
+		return link
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+
+	// The Google AMP cache and google.com/amp hold the page's own URL
+	if strings.HasSuffix(host, ".cdn.ampproject.org") {
+		if m := ampCachePath.FindStringSubmatch(u.EscapedPath()); m != nil {
+			return cachedArticle(m[1] != "", m[2], u.RawQuery, link)
+		}
+		return link
+	}
+	if strings.HasPrefix(host, "google.") && strings.HasPrefix(u.EscapedPath(), "/amp/") {
+		path := strings.TrimPrefix(u.EscapedPath(), "/amp/")
+		secure := strings.HasPrefix(path, "s/")
+		return cachedArticle(secure, strings.TrimPrefix(path, "s/"), u.RawQuery, link)
+	}
+
+	if canonical, ok := mirrorHosts[host]; ok {
+		u.Host = canonical
+		return u.String()
+	}
+	if medium[host] {
+		if m := mediumPostID.FindStringSubmatch(u.Path); m != nil {
+			return "https://medium.com/p/" + m[1]
+		}
+		return link
+	}
+
+	changed := false
+	if strings.HasPrefix(strings.ToLower(u.Host), "amp.") && strings.Count(host, ".") > 1 {
+		u.Host = u.Host[len("amp."):]
+		changed = true
+	}
+	if path := ampArticlePath(u.Path); path != u.Path {
+		u.Path, u.RawPath = path, ""
+		changed = true
+	}
+	if u.RawQuery != "" {
+		q := u.Query()
+		before := len(q)
+		for _, key := range []string{"amp", "_amp", "amp_js_v", "usqp"} {
+			q.Del(key)
+		}
+		if q.Get("outputType") == "amp" {
+			q.Del("outputType")
+		}
+		if len(q) < before {
+			u.RawQuery = q.Encode()
+			changed = true
+		}
+	}
+	if !changed {
+		return link
+	}
+	return u.String()
+}
+
+// cachedArticle rebuilds the URL of a page held in an AMP cache from its
+// host and path, or returns link if that is not a URL.
+func cachedArticle(secure bool, hostPath, query, link string) string {
+	scheme := "http://"
+	if secure {
+		scheme = "https://"
+	}
+	u, err := url.Parse(scheme + hostPath)
+	if err != nil || u.Host == "" {
+		return link
+	}
+	if u.RawQuery == "" {
+		u.RawQuery = query
+	}
+	// The page's own AMP markers go too
+	return canonicalArticle(u.String(), nil)
+}
+
+// ampArticlePath removes the AMP markers publishers put in paths: an /amp
+// segment, or an .amp extension.
+func ampArticlePath(original string) string {
+	path := original
+	switch {
+	case strings.HasSuffix(path, "/amp"):
+		path = strings.TrimSuffix(path, "/amp")
+	case strings.HasSuffix(path, "/amp/"):
+		path = strings.TrimSuffix(path, "amp/")
+	case strings.Contains(path, "/amp/"):
+		path = strings.Replace(path, "/amp/", "/", 1)
+	case strings.HasSuffix(path, ".amp.html"):
+		path = strings.TrimSuffix(path, ".amp.html") + ".html"
+	case strings.HasSuffix(path, ".amp"):
+		path = strings.TrimSuffix(path, ".amp")
+	}
+	if path == "" && original != "" {
+		return "/"
+	}
+	return path
+}
+
+// useCanonical points a bookmark whose AMP page or mirror is dead at the
+// live article it copied, or queues that for review with --queue.
+func useCanonical(lock *LockFile, bookmark *BookmarkFile, canonical string, run *RunRecord, opts runOptions, ex *explainer) {
+	if opts.Queue {
+		opts.Pending.add(&pendingItem{File: relativeTo(opts.Dir, bookmark.Path), Original: bookmark.Link, URL: canonical})
+		run.Queued++
+		fmt.Printf("\nQueued for review: %s\n  -> %s (canonical)\n", bookmark.Link, canonical)
+		return
+	}
+	if err := lock.rewriteBookmark(bookmark, canonical); err != nil {
+		fmt.Fprintf(os.Stderr, "\nError updating %s: %v\n", bookmark.Path, err)
+		run.recordError(bookmark.Path, err)
+		return
+	}
+	run.Canonical++
+	ex.logf("rewrote the link to the live article")
+	fmt.Printf("\n%s Canonical: %s\n  -> %s\n", console.mark(), bookmark.Link, canonical)
+	markFileProcessed(lock, bookmark.Path)
+}
+
+// checkCanonical checks the article behind a dead AMP page or mirror at
+// target. It reports whether the bookmark was dealt with; otherwise it
+// returns the article to look up in the archives instead, which is target
+// when there is none.
+func checkCanonical(client *http.Client, lock *LockFile, bookmark *BookmarkFile, target string, run *RunRecord, opts runOptions, ex *explainer) (string, bool) {
+	canonical := canonicalArticle(target, opts.MediumDomains)
+	if canonical == target {
+		return target, false
+	}
+	if opts.Providers.sensitive.covers(target) {
+		opts.Providers.sensitive.mark(canonical)
+	}
+	var verdict linkVerdict
+	var err error
+	opts.unlocked(func() { verdict, err = opts.diagnoseLinkSince(client, canonical, opts.Profile, nil) })
+	switch {
+	case err != nil:
+		ex.logf("%s copies %s, which could not be checked: %v", target, canonical, err)
+		return target, false
+	case verdict.Dead:
+		ex.logf("%s copies %s, which is dead too (%s); looking that up instead", target, canonical, verdict.Reason)
+		return canonical, false
+	}
+	ex.logf("%s copies %s, which is alive (%s)", target, canonical, verdict.Reason)
+	useCanonical(lock, bookmark, canonical, run, opts, ex)
+	return canonical, true
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// blobRecord is a blob in the content-addressed store. Refs is how many
+// bookmarks embedded it when they were last counted, by mirror-assets or gc.
+type blobRecord struct {
+	Size  int64     `json:"size"`
+	Type  string    `json:"type,omitempty"`
+	Added time.Time `json:"added"`
+	Refs  int       `json:"refs"`
+}
+
+// sniffedExtensions gives content keys an extension from the bytes
+// themselves, so the same file fetched from URLs with different extensions
+// is still stored once.
+var sniffedExtensions = map[string]string{
+	"image/png": ".png", "image/jpeg": ".jpg", "image/gif": ".gif", "image/webp": ".webp",
+	"image/bmp": ".bmp", "image/x-icon": ".ico", "video/mp4": ".mp4", "video/webm": ".webm",
+	"audio/mpeg": ".mp3", "audio/wave": ".wav", "application/ogg": ".ogg", "application/pdf": ".pdf",
+}
+
+// contentKey is the key of a blob: the SHA-256 of its bytes, plus an
+// extension so it is served with the right type.
+func contentKey(data []byte, link string) string {
+	ext := sniffedExtensions[http.DetectContentType(data)]
+	if ext == "" {
+		ext = urlExt(link)
+	}
+	return contentHash(data) + ext
+}
+
+// storeBlob stores the content of an asset under its content key and
+// indexes the asset's URL to it. Content already in the store is not
+// written again; the result reports whether it was.
+func (lock *LockFile) storeBlob(store blobStore, link string, data []byte, mediaType string, now time.Time) (string, bool, error) {
+	key := contentKey(data, link)
+	if lock.Blobs == nil {
+		lock.Blobs = make(map[string]*blobRecord)
+	}
+	if lock.BlobIndex == nil {
+		lock.BlobIndex = make(map[string]string)
+	}
+
+	written := false
+	if ok, err := store.has(key); err != nil {
+		return "", false, err
+	} else if !ok {
+		if err := store.put(key, data, mediaType); err != nil {
+			return "", false, err
+		}
+		written = true
+	}
+	if lock.Blobs[key] == nil {
+		lock.Blobs[key] = &blobRecord{Size: int64(len(data)), Type: mediaType, Added: now}
+	}
+	lock.BlobIndex[link] = key
+	return key, written, nil
+}
+
+// blobKey is the key of an asset's copy: its content key once mirrored, or
+// the URL-hash name copies were given before the store was content-addressed.
+func (lock *LockFile) blobKey(link string) string {
+	if key, ok := lock.BlobIndex[link]; ok {
+		return key
+	}
+	return assetFileName(link)
+}
+
+// blobKeyPattern matches the keys of stored blobs, content keys and the
+// older URL-hash names, in bookmark bodies.
+var blobKeyPattern = regexp.MustCompile(`\b[0-9a-f]{16}(?:[0-9a-f]{48})?(?:\.[a-z0-9]{1,5})?\b`)
+
+// countBlobRefs counts, for every key in keys, the bookmarks among files
+// whose content embeds it, or still embeds a URL whose copy it is, and
+// records the counts in the lock file. The latter keeps copies that are not
+// embedded, such as encrypted ones.
+func countBlobRefs(lock *LockFile, files []string, keys []string) (map[string]int, error) {
+	refs := make(map[string]int, len(keys))
+	for _, key := range keys {
+		refs[key] = 0
+	}
+	for _, filePath := range files {
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			return nil, err
+		}
+		seen := make(map[string]bool)
+		found := blobKeyPattern.FindAllString(string(data), -1)
+		for _, link := range embeddedURLs(string(data)) {
+			if key, ok := lock.BlobIndex[link]; ok {
+				found = append(found, key)
+			}
+		}
+		for _, key := range found {
+			if _, ok := refs[key]; ok && !seen[key] {
+				seen[key] = true
+				refs[key]++
+			}
+		}
+	}
+	for key, n := range refs {
+		if record := lock.Blobs[key]; record != nil {
+			record.Refs = n
+		}
+	}
+	return refs, nil
+}
+
+// dropBlob forgets a deleted blob and every URL indexed to it.
+func (lock *LockFile) dropBlob(key string) {
+	delete(lock.Blobs, key)
+	for link, indexed := range lock.BlobIndex {
+		if indexed == key {
+			delete(lock.BlobIndex, link)
+		}
+	}
+}
+
+// defaultGCGrace spares blobs stored this recently, which a mirror-assets
+// run may not have embedded yet.
+const defaultGCGrace = 24 * time.Hour
+
+// runGC implements `archive_tool gc`: it deletes the blobs of the store that
+// no bookmark embeds any more.
+func runGC(args []string) {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	opts := runOptions{Profile: runProfiles["fast"]}
+	opts.register(fs)
+	dryRun := fs.Bool("dry-run", false, "only list the orphaned blobs")
+	grace := fs.Duration("grace", defaultGCGrace, "keep orphaned blobs stored more recently than this")
+	fs.Parse(args)
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		os.Exit(1)
+	}
+	if err := opts.finish(cfg, fs.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	lock, err := loadLockFile(*dryRun)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading lock file: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Every bookmark counts, whatever the tag and shard options say: a blob
+	// embedded by one outside them is not an orphan
+	files, err := findMarkdownFiles(opts.Dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading directory: %v\n", err)
+		os.Exit(1)
+	}
+	store := opts.blobStore()
+	listedKeys, err := store.list()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error listing %s: %v\n", store.name(), err)
+		os.Exit(1)
+	}
+	var keys []string
+	for _, key := range listedKeys {
+		// Leases of coordinated runs sharing the store are not blobs
+		if !strings.HasPrefix(key, leaseKeyPrefix) {
+			keys = append(keys, key)
+		}
+	}
+	refs, err := countBlobRefs(lock, files, keys)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading bookmarks: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Records of blobs that are no longer in the store
+	listed := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		listed[key] = true
+	}
+	for key := range lock.Blobs {
+		if !listed[key] {
+			lock.dropBlob(key)
+		}
+	}
+
+	now := time.Now()
+	orphans, kept, deleted, failed := 0, 0, 0, 0
+	var freed int64
+	for _, key := range keys {
+		if refs[key] > 0 {
+			continue
+		}
+		orphans++
+		record := lock.Blobs[key]
+		if record != nil && now.Sub(record.Added) < *grace {
+			kept++
+			continue
+		}
+		if *dryRun {
+			fmt.Printf("  orphaned: %s\n", key)
+			continue
+		}
+		if err := store.remove(key); err != nil {
+			fmt.Fprintf(os.Stderr, "Error deleting %s: %v\n", key, err)
+			failed++
+			continue
+		}
+		if record != nil {
+			freed += record.Size
+		}
+		lock.dropBlob(key)
+		deleted++
+	}
+
+	if !*dryRun {
+		if err := saveLockFile(lock); err != nil {
+			fmt.Fprintf(os.Stderr, "Error saving lock file: %v\n", err)
+		}
+	}
+	fmt.Printf("%s: %d blob(s), %d orphaned", store.name(), len(keys), orphans)
+	if kept > 0 {
+		fmt.Printf(", %d kept as newer than %s", kept, *grace)
+	}
+	if *dryRun {
+		fmt.Println(" (dry run, nothing deleted)")
+	} else {
+		fmt.Printf(", %d deleted (%.1f MB freed)\n", deleted, float64(freed)/(1<<20))
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
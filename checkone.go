@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// traceTransport prints every request and its outcome, including each hop of
+// a redirect chain.
+type traceTransport struct {
+	base http.RoundTripper
+}
+
+func (t traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	fmt.Printf("    -> %s %s\n", req.Method, req.URL)
+	start := time.Now()
+	resp, err := base.RoundTrip(req)
+	elapsed := time.Since(start).Round(time.Millisecond)
+	if err != nil {
+		fmt.Printf("    <- error after %s: %v\n", elapsed, err)
+		return nil, err
+	}
+	line := fmt.Sprintf("    <- %s (%s)", resp.Status, elapsed)
+	if loc := resp.Header.Get("Location"); loc != "" {
+		line += " Location: " + loc
+	}
+	fmt.Println(line)
+	return resp, nil
+}
+
+// runCheckOne implements `archive_tool check-one <file-or-url>`: the full
+// pipeline for one bookmark, printing every request, the decision at each
+// step and the candidate snapshots, to debug why a bookmark was or wasn't
+// replaced. A URL runs every bookmark linking to it; a URL no bookmark links
+// to is checked and looked up without touching any file.
+func runCheckOne(args []string) {
+	fs := flag.NewFlagSet("check-one", flag.ExitOnError)
+	opts := runOptions{Trigger: "check-one", Profile: runProfiles["fast"]}
+	opts.register(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: archive_tool check-one [options] <file-or-url>")
+		os.Exit(2)
+	}
+	item := fs.Arg(0)
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		os.Exit(1)
+	}
+	if err := opts.finish(cfg, nil); err != nil {
+		fmt.Fprintf(os.Stderr, "Error %v\n", err)
+		os.Exit(1)
+	}
+	opts.Explain = true
+	opts.Transport = traceTransport{base: opts.Transport}
+	client := opts.httpClient()
+
+	var files []string
+	if strings.Contains(item, "://") {
+		all, err := findMarkdownFiles(opts.Dir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Not looking for bookmarks with this link: %v\n", err)
+		} else {
+			files = resolvePriorityItem(all, item)
+		}
+		if len(files) == 0 {
+			checkOneURL(client, item, opts)
+			return
+		}
+	} else {
+		files = resolvePriorityItem(nil, item)
+		if len(files) == 0 {
+			os.Exit(1)
+		}
+	}
+
+	lock, err := loadLockFile(false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading lock file: %v\n", err)
+		os.Exit(1)
+	}
+	run := &RunRecord{
+		ID:      newRunID(opts.now()),
+		Trigger: opts.Trigger,
+		Profile: opts.Profile.Name,
+		Started: opts.now(),
+		Status:  "completed",
+	}
+	for _, filePath := range files {
+		explainFile(lock, filePath, opts)
+		processFile(client, lock, filePath, run, opts)
+		fmt.Println()
+	}
+	run.Finished = opts.now()
+	lock.addRun(run)
+	if err := saveLockFile(lock); err != nil {
+		fmt.Fprintf(os.Stderr, "Error saving lock file: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Checked: %d, Replaced: %d, Errors: %d\n", run.Checked, run.Replaced, run.Errors)
+}
+
+// explainFile prints what the pipeline knows about a bookmark before it is
+// processed: its frontmatter, state, filters and link history.
+func explainFile(lock *LockFile, filePath string, opts runOptions) {
+	fmt.Printf("File: %s\n", filePath)
+	bookmark, err := parseBookmarkFile(filePath)
+	if err != nil {
+		fmt.Printf("  parse error: %v\n", err)
+		return
+	}
+	fmt.Printf("  link: %s\n  date: %s\n  tags: %v\n", bookmark.Link, bookmark.Date, bookmark.Tags)
+	if bookmark.Link == "" {
+		fmt.Println("  no link in the frontmatter; nothing to check")
+		return
+	}
+	if bookmark.Written != "" {
+		fmt.Printf("  written in the file as %q\n", bookmark.Written)
+	}
+	if err := validateLink(bookmark.Link); err != nil {
+		fmt.Printf("  cannot be checked: %v\n", err)
+	}
+	if isFileProcessed(lock, filePath) {
+		fmt.Println("  already processed and unchanged since; a regular run skips it, checking anyway")
+	}
+	if !opts.Filter.allows(bookmark.Link) {
+		fmt.Println("  excluded by the blocklist/allowlist")
+	}
+	if !opts.Tags.matches(bookmark.Tags) {
+		fmt.Println("  excluded by --tag/--not-tag")
+	}
+	profile, skip := opts.TagPolicies.apply(bookmark.Tags, opts.Profile)
+	if skip {
+		fmt.Println("  skipped by a tag policy")
+	} else {
+		fmt.Printf("  profile: %s\n", profile.Name)
+	}
+	if opts.Providers.sensitive.markBookmark(bookmark) {
+		fmt.Println("  sensitive: never sent to archive services; annotated if dead")
+	}
+
+	history := lock.statusHistory(bookmark.Link)
+	if len(history) > 0 {
+		fmt.Printf("  %d earlier checks, statuses seen %v, classified %s\n",
+			len(history), distinctStatuses(history), opts.Flaky.classify(history))
+	}
+	fmt.Println("  pipeline:")
+}
+
+// checkOneURL checks a URL that no bookmark links to and lists the snapshots
+// that would replace it, without writing anything.
+func checkOneURL(client *http.Client, link string, opts runOptions) {
+	fmt.Printf("URL: %s (no bookmark links to it; nothing will be changed)\n", link)
+	dead, status, err := opts.checkLink(client, link, opts.Profile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error checking %s: %v\n", link, err)
+		os.Exit(1)
+	}
+	fmt.Printf("  status %d, dead: %v (profile %s)\n", status, dead, opts.Profile.Name)
+	if !dead {
+		return
+	}
+
+	candidates, err := opts.Providers.lookup(client, link, "", opts.now())
+	if errors.Is(err, ErrNoSnapshot) {
+		fmt.Println("  no archive has a copy")
+		return
+	}
+	if errors.Is(err, ErrSensitive) {
+		fmt.Println("  sensitive; not looked up in any archive")
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error finding archive for %s: %v (%s)\n", link, err, errorKind(err))
+		os.Exit(1)
+	}
+	chosen := selectCandidate(client, candidates, &BookmarkFile{Link: link}, opts.Providers.count(link))
+	for _, candidate := range candidates {
+		marker := " "
+		if candidate == chosen {
+			marker = "*"
+		}
+		fmt.Printf("  %s %s %s (%s, score %.2f)\n", marker, candidate.ID, candidate.URL, candidate.Provider, candidate.Score)
+	}
+}
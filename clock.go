@@ -0,0 +1,35 @@
+package main
+
+import "time"
+
+// Clock supplies the current time to the checking pipeline, and waits.
+// Run IDs, status history, "latest snapshot" lookups, retry backoff and rate
+// limit waits all use it, so a run with a fixed clock and a fake
+// http.RoundTripper (see runOptions) is deterministic.
+type Clock interface {
+	Now() time.Time
+	// Sleep and After wait as time.Sleep and time.After do
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// FixedClock always returns the same time, and never waits.
+type FixedClock time.Time
+
+func (c FixedClock) Now() time.Time { return time.Time(c) }
+
+func (c FixedClock) Sleep(time.Duration) {}
+
+func (c FixedClock) After(time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	ch <- time.Time(c)
+	return ch
+}
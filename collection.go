@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// collectionTopDomains is how many domains the collection profile lists.
+const collectionTopDomains = 20
+
+// collectionProfile describes a bookmark collection, computed offline from
+// the files and the lock file, for `report --collection`. Nothing is sent
+// anywhere.
+type collectionProfile struct {
+	Dir          string
+	Files        int
+	TotalBytes   int
+	AverageBytes int
+
+	// WithLink have a link in the frontmatter; Archived already point at
+	// the Wayback Machine; Processed are marked processed in the lock file
+	WithLink  int
+	Archived  int
+	Processed int
+
+	Domains     []countEntry // the most common, collectionTopDomains at most
+	DomainCount int
+	Schemes     []countEntry
+	Ages        []countEntry // bookmark age by date:, named by message key
+
+	// Survival has a survival curve per bookmark year, from link checks
+	Survival []survivalCohort
+}
+
+// countEntry is one bar of a histogram.
+type countEntry struct {
+	Name  string
+	Count int
+}
+
+// ageBuckets are the bookmark age ranges, by their upper bound in years,
+// named by the message key of their label.
+var ageBuckets = []struct {
+	name  string
+	years int
+}{
+	{"report.age.1", 1},
+	{"report.age.2", 2},
+	{"report.age.5", 5},
+	{"report.age.10", 10},
+	{"report.age.older", 0},
+}
+
+func profileCollection(dir string, lock *LockFile, now time.Time) (*collectionProfile, error) {
+	files, err := findMarkdownFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &collectionProfile{Dir: dir, Files: len(files)}
+	domains := make(map[string]int)
+	schemes := make(map[string]int)
+	ages := make([]int, len(ageBuckets))
+	undated := 0
+	var survivors []survivalLink
+	for _, filePath := range files {
+		if info, err := os.Stat(filePath); err == nil {
+			p.TotalBytes += int(info.Size())
+		}
+		if _, ok := lock.ProcessedFiles[filePath]; ok {
+			p.Processed++
+		}
+		bookmark, err := parseBookmarkFile(filePath)
+		if err != nil || bookmark.Link == "" {
+			continue
+		}
+		p.WithLink++
+
+		if isWaybackURL(bookmark.Link) {
+			p.Archived++
+		}
+		if u, err := url.Parse(bookmark.Link); err == nil && u.Scheme != "" {
+			schemes[strings.ToLower(u.Scheme)]++
+		} else {
+			schemes["none"]++
+		}
+		if host := coverageHost(bookmark.Link); host != "" {
+			domains[host]++
+		}
+
+		date := parseDate(bookmark.Date)
+		if date.IsZero() {
+			undated++
+			continue
+		}
+		if l, ok := survivalLinkFor(lock, bookmark.Link, date); ok {
+			survivors = append(survivors, l)
+		}
+		for i, bucket := range ageBuckets {
+			if bucket.years == 0 || date.After(now.AddDate(-bucket.years, 0, 0)) {
+				ages[i]++
+				break
+			}
+		}
+	}
+
+	if p.Files > 0 {
+		p.AverageBytes = p.TotalBytes / p.Files
+	}
+	p.DomainCount = len(domains)
+	p.Domains = sortedCounts(domains)
+	if len(p.Domains) > collectionTopDomains {
+		p.Domains = p.Domains[:collectionTopDomains]
+	}
+	p.Schemes = sortedCounts(schemes)
+	for i, bucket := range ageBuckets {
+		p.Ages = append(p.Ages, countEntry{Name: bucket.name, Count: ages[i]})
+	}
+	if undated > 0 {
+		p.Ages = append(p.Ages, countEntry{Name: "report.age.undated", Count: undated})
+	}
+	p.Survival = survivalCohorts(survivors, now)
+	return p, nil
+}
+
+// sortedCounts orders a histogram by count, most common first.
+func sortedCounts(counts map[string]int) []countEntry {
+	entries := make([]countEntry, 0, len(counts))
+	for name, n := range counts {
+		entries = append(entries, countEntry{Name: name, Count: n})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	return entries
+}
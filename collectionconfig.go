@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// collectionConfigName is the config file kept at the root of a collection,
+// under version control with it, so everyone working on the collection gets
+// the same behavior. Its settings override the user's config file.
+const collectionConfigName = ".archive_tool.yml"
+
+// frontmatterKeys names the frontmatter keys holding a bookmark's link, date
+// and tags, for collections written by tools that use other names:
+//
+//	[fields]
+//	link = "url"
+//	date = "published"
+type frontmatterKeys struct {
+	Link, Date, Tags string
+}
+
+var defaultFrontmatterKeys = frontmatterKeys{Link: "link", Date: "date", Tags: "tags"}
+
+// bookmarkKeys are the keys bookmarks are read and rewritten with, set once
+// the config is final.
+var bookmarkKeys = defaultFrontmatterKeys
+
+func (k *frontmatterKeys) set(key, value string) error {
+	if value == "" || strings.ContainsAny(value, ": \t") {
+		return fmt.Errorf("invalid frontmatter key %q for %s", value, key)
+	}
+	switch key {
+	case "link":
+		k.Link = value
+	case "date":
+		k.Date = value
+	case "tags":
+		k.Tags = value
+	default:
+		return fmt.Errorf("unknown [fields] key %q (want link, date or tags)", key)
+	}
+	return nil
+}
+
+// excludePatterns are the exclude globs of the collection being scanned, set
+// once the config is final.
+var excludePatterns []string
+
+// excluded reports whether a path relative to the collection root matches
+// an exclude pattern. A pattern without a slash matches a file or directory
+// name at any depth; one with a slash matches the path from the root.
+func excluded(rel string, patterns []string) bool {
+	rel = filepath.ToSlash(rel)
+	for _, pattern := range patterns {
+		pattern = strings.TrimSuffix(strings.TrimPrefix(pattern, "/"), "/")
+		target := rel
+		if !strings.Contains(pattern, "/") {
+			target = path.Base(rel)
+		}
+		if ok, _ := path.Match(pattern, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// collectionDenied lists what the collection config may not set: credentials,
+// notification targets, storage profiles and identities belong to each user,
+// and a shared file must not redirect or impersonate them.
+var collectionDenied = map[string]bool{"secrets": true, "notify": true, "storage": true, "identity": true}
+
+// collectionPathKeys are settings naming files, which the collection config
+// gives relative to the collection root.
+var collectionPathKeys = map[string]bool{"blocklist": true, "allowlist": true, "sensitive": true}
+
+// loadCollectionConfig applies the collection config of dir, if it has one,
+// over cfg.
+func (cfg *Config) loadCollectionConfig(dir string) error {
+	configPath := filepath.Join(dir, collectionConfigName)
+	file, err := os.Open(configPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return parseYAMLConfig(file, func(lineNum int, section, key, value string) error {
+		top, _, _ := strings.Cut(section, ".")
+		switch {
+		case collectionDenied[top] || section == "" && (key == "dir" || key == "directory"):
+			name := key
+			if section != "" {
+				name = top
+			}
+			return fmt.Errorf("%s:%d: %s cannot be set by the collection, only in %s", configPath, lineNum, name, getConfigPath())
+		case top == "users":
+			user, ok := strings.CutPrefix(section, "users.")
+			if !ok {
+				return fmt.Errorf("%s:%d: want users: <email>: %s: ...", configPath, lineNum, key)
+			}
+			if err := cfg.Users.set(user, key, value); err != nil {
+				return fmt.Errorf("%s:%d: %w", configPath, lineNum, err)
+			}
+			return nil
+		case section == "" && collectionPathKeys[key] && value != "" && !filepath.IsAbs(expandHome(value)):
+			value = filepath.Join(dir, value)
+		}
+		if err := cfg.set(section, key, value); err != nil {
+			return fmt.Errorf("%s:%d: %w", configPath, lineNum, err)
+		}
+		return nil
+	})
+}
+
+// parseYAMLConfig reads the YAML subset config files need: nested mappings
+// of scalars, with lists as "- item" lines or [a, b]. Every scalar is passed
+// to fn with the keys above it joined by dots as its section, so that
+//
+//	redirects:
+//	  cross_host: flag
+//
+// reads like [redirects] cross_host = "flag". Each list item is passed
+// separately, under the list's key.
+func parseYAMLConfig(file *os.File, fn func(lineNum int, section, key, value string) error) error {
+	type level struct {
+		indent int
+		key    string
+	}
+	var stack []level
+	// section joins the keys of the first n levels
+	section := func(n int) string {
+		keys := make([]string, n)
+		for i, l := range stack[:n] {
+			keys[i] = l.key
+		}
+		return strings.Join(keys, ".")
+	}
+
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	listKey, listIndent := "", -1
+	for scanner.Scan() {
+		lineNum++
+		raw := strings.TrimRight(scanner.Text(), " \t\r")
+		trimmed := strings.TrimSpace(raw)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		indent := len(raw) - len(strings.TrimLeft(raw, " "))
+		if strings.HasPrefix(raw[indent:], "\t") {
+			return fmt.Errorf("line %d: tabs are not allowed for indentation", lineNum)
+		}
+
+		if item, ok := strings.CutPrefix(trimmed, "- "); ok && listKey != "" && indent >= listIndent {
+			// The list's key is the innermost level, not a section
+			if err := fn(lineNum, section(len(stack)-1), listKey, yamlScalar(item)); err != nil {
+				return err
+			}
+			continue
+		}
+		listKey, listIndent = "", -1
+
+		for len(stack) > 0 && indent <= stack[len(stack)-1].indent {
+			stack = stack[:len(stack)-1]
+		}
+		key, value, ok := strings.Cut(trimmed, ":")
+		if !ok || strings.TrimSpace(key) == "" {
+			return fmt.Errorf("line %d: want key: value, got %q", lineNum, trimmed)
+		}
+		key = strings.Trim(strings.TrimSpace(key), `"'`)
+		value = strings.TrimSpace(value)
+		if value != "" && !strings.HasPrefix(value, "#") {
+			if strings.HasPrefix(value, "[") {
+				for _, item := range strings.Split(strings.Trim(yamlScalar(value), "[]"), ",") {
+					if item = yamlScalar(strings.TrimSpace(item)); item != "" {
+						if err := fn(lineNum, section(len(stack)), key, item); err != nil {
+							return err
+						}
+					}
+				}
+				continue
+			}
+			if err := fn(lineNum, section(len(stack)), key, yamlScalar(value)); err != nil {
+				return err
+			}
+			continue
+		}
+		// A mapping or a list follows
+		stack = append(stack, level{indent: indent, key: key})
+		listKey, listIndent = key, indent
+	}
+	return scanner.Err()
+}
+
+// yamlScalar unquotes a scalar and drops a trailing comment.
+func yamlScalar(value string) string {
+	if strings.HasPrefix(value, `"`) || strings.HasPrefix(value, "'") {
+		if end := strings.Index(value[1:], value[:1]); end != -1 {
+			return value[1 : end+1]
+		}
+		return value
+	}
+	if hash := strings.Index(value, " #"); hash != -1 {
+		value = value[:hash]
+	}
+	return strings.TrimSpace(value)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// linkValidators are what a server returned to identify a version of a page,
+// sent back on the next check as If-None-Match and If-Modified-Since so an
+// unchanged page costs a 304 instead of a full response.
+type linkValidators struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+func (v *linkValidators) apply(req *http.Request) {
+	if v == nil {
+		return
+	}
+	if v.ETag != "" {
+		req.Header.Set("If-None-Match", v.ETag)
+	}
+	if v.LastModified != "" {
+		req.Header.Set("If-Modified-Since", v.LastModified)
+	}
+}
+
+// validatorsFor returns the stored validators of a link known to be alive,
+// or nil.
+func (lock *LockFile) validatorsFor(link string) *linkValidators {
+	v, ok := lock.Validators[link]
+	if !ok {
+		return nil
+	}
+	return &v
+}
+
+// storeValidators keeps the validators of an alive link and forgets those of
+// a dead one.
+func (lock *LockFile) storeValidators(link string, verdict linkVerdict) {
+	if verdict.Dead || verdict.Validators == (linkValidators{}) {
+		delete(lock.Validators, link)
+		return
+	}
+	if lock.Validators == nil {
+		lock.Validators = make(map[string]linkValidators)
+	}
+	lock.Validators[link] = verdict.Validators
+}
+
+// recheckPolicy turns a URL's Cache-Control or Expires into the time until a
+// --recheck run checks it again, from the [recheck] config section. Pages
+// without caching headers wait Default; hints are clamped to Min and Max.
+type recheckPolicy struct {
+	Min     time.Duration
+	Max     time.Duration
+	Default time.Duration
+}
+
+var defaultRecheckPolicy = recheckPolicy{Min: 24 * time.Hour, Max: 90 * 24 * time.Hour, Default: 7 * 24 * time.Hour}
+
+// set applies one key of the [recheck] section.
+func (p *recheckPolicy) set(key, value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("invalid %s %q", key, value)
+	}
+	switch key {
+	case "min":
+		p.Min = d
+	case "max":
+		p.Max = d
+	case "default":
+		p.Default = d
+	default:
+		return fmt.Errorf("unknown [recheck] key %q", key)
+	}
+	return nil
+}
+
+// interval is how long to wait before rechecking a page whose response
+// stays fresh for lifetime; known is false without caching headers.
+func (p recheckPolicy) interval(lifetime time.Duration, known bool) time.Duration {
+	if p == (recheckPolicy{}) {
+		p = defaultRecheckPolicy
+	}
+	if !known {
+		return p.Default
+	}
+	return min(max(lifetime, p.Min), p.Max)
+}
+
+// immutableLifetime stands in for Cache-Control: immutable, which promises
+// the page will never change; the policy's Max caps it.
+const immutableLifetime = 10 * 365 * 24 * time.Hour
+
+// cacheLifetime reads how long a response says it stays fresh, from
+// Cache-Control (max-age, s-maxage, no-cache, no-store, immutable) or else
+// Expires relative to Date, or to now without one.
+func cacheLifetime(h http.Header, now time.Time) (time.Duration, bool) {
+	if cc := h.Get("Cache-Control"); cc != "" {
+		lifetime, known := time.Duration(0), false
+		for _, directive := range strings.Split(cc, ",") {
+			name, value, _ := strings.Cut(strings.ToLower(strings.TrimSpace(directive)), "=")
+			switch name {
+			case "no-store", "no-cache":
+				return 0, true
+			case "immutable":
+				return immutableLifetime, true
+			case "max-age", "s-maxage":
+				if secs, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil && secs >= 0 {
+					lifetime, known = max(lifetime, time.Duration(secs)*time.Second), true
+				}
+			}
+		}
+		if known {
+			return lifetime, true
+		}
+	}
+	if exp := h.Get("Expires"); exp != "" {
+		expires, err := http.ParseTime(exp)
+		if err != nil {
+			// An invalid Expires, like "0", means already expired
+			return 0, true
+		}
+		date := now
+		if d, err := http.ParseTime(h.Get("Date")); err == nil {
+			date = d
+		}
+		return max(expires.Sub(date), 0), true
+	}
+	return 0, false
+}
+
+// scheduleRecheck records when an alive link is next worth checking.
+func (lock *LockFile) scheduleRecheck(link string, verdict linkVerdict, policy recheckPolicy, now time.Time) {
+	if verdict.Dead {
+		delete(lock.RecheckAfter, link)
+		return
+	}
+	if lock.RecheckAfter == nil {
+		lock.RecheckAfter = make(map[string]time.Time)
+	}
+	lock.RecheckAfter[link] = now.Add(policy.interval(verdict.Lifetime, verdict.LifetimeKnown))
+}
+
+// needsRecheck reports whether --recheck should look at a processed file
+// again: it has a checkable link that has not been replaced by a snapshot,
+// and the link is due according to its caching headers.
+func needsRecheck(lock *LockFile, filePath string, now time.Time) bool {
+	bookmark, err := parseBookmarkFile(filePath)
+	if err != nil || bookmark.Link == "" || isWaybackURL(bookmark.Link) || validateLink(bookmark.Link) != nil {
+		return false
+	}
+	due, scheduled := lock.RecheckAfter[bookmark.Link]
+	return !scheduled || !now.Before(due)
+}
@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds settings read from the user's config file.
+type Config struct {
+	Dir       string
+	Schedule  string
+	Jitter    time.Duration
+	Listen    string
+	Blocklist string
+	Allowlist string
+
+	// Sensitive lists domains never sent to archive services
+	Sensitive string
+
+	Flaky flakyPolicy
+
+	// DomainDeath is the [domain_death] section
+	DomainDeath domainDeathPolicy
+
+	// RDAP is the [rdap] section
+	RDAP rdapPolicy
+
+	// DomainWatch is the [domain_watch] section
+	DomainWatch domainWatchPolicy
+
+	// Digest is the digest period ("daily" or "weekly"), Notify its channels
+	Digest string
+	Notify notifyConfig
+
+	// Notifiers are the [notifier.<name>] push services
+	Notifiers notifiers
+
+	// Locale selects the language and number/date formats, e.g. "de"
+	Locale string
+
+	// ASCII avoids unicode symbols and in-place progress on the console
+	ASCII bool
+
+	// Redirects is the redirect policy from the [redirects] section
+	Redirects redirectPolicy
+
+	// Recheck re-verifies alive links when due; Rechecks is the scheduling
+	// policy from the [recheck] section
+	Recheck  bool
+	Rechecks recheckPolicy
+
+	// Shorteners adds URL shortener hosts to the built-in list;
+	// ExpandShorteners rewrites live short links to their destination
+	Shorteners       shortenerSet
+	ExpandShorteners bool
+
+	// MediumDomains are custom domains of Medium publications, whose posts
+	// are found on medium.com once the domain is gone
+	MediumDomains hostSet
+
+	// RequestCeiling aborts any single request that takes longer, and
+	// Timeout a request with all its redirects
+	RequestCeiling time.Duration
+	Timeout        time.Duration
+
+	// Concurrency is the number of files a run checks at once
+	Concurrency int
+
+	// FixLinks writes tidied links (scheme added, brackets and whitespace
+	// removed) back to the bookmark files
+	FixLinks bool
+
+	// CheckAssets also checks images and other assets embedded in bookmark
+	// bodies
+	CheckAssets bool
+
+	// NoBodyLinks is set by body_links = false
+	NoBodyLinks bool
+
+	// DetectLanguage records snapshot languages and flags mismatches
+	DetectLanguage bool
+
+	// FollowPages links every page of replaced multi-page articles
+	FollowPages bool
+
+	// Provenance records every replacement in an archive_tool block in the
+	// frontmatter
+	Provenance bool
+
+	// SnapshotDir keeps a local copy of the HTML of every bookmarked page,
+	// relative to the collection; WARC writes the pages as WARC records
+	SnapshotDir string
+	WARC        warcPolicy
+
+	// ReadingCopy appends the article of every bookmarked page to its body
+	// in markdown
+	ReadingCopy bool
+
+	// PDF prints every bookmarked page to a PDF next to its bookmark, with
+	// Chrome, or Chromium, found on the PATH unless it is configured
+	PDF    bool
+	Chrome string
+
+	// EventLog is the file or FIFO every run streams its events to
+	EventLog string
+
+	// Privacy strips credentials and tokens from links sent to archive
+	// services; SanitizeLinks also removes them from the bookmarks
+	Privacy       bool
+	SanitizeLinks bool
+
+	// Pinboard asks the Pinboard account in the pinboard_token secret for
+	// its archived copy before the public archives
+	Pinboard bool
+
+	// ArchiveLive submits alive links to Save Page Now during runs
+	ArchiveLive bool
+
+	// Identity is who changes are attributed to, from the [identity]
+	// section; Users restricts identities, from the collection config only, and
+	// GitCommit commits rewritten bookmarks
+	Identity  userIdentity
+	Users     userPolicies
+	GitCommit bool
+
+	// UserAgents configures the User-Agent for sites and archive services
+	UserAgents userAgentPolicy
+
+	// Queue proposes replacements in PENDING_REPLACEMENTS.md instead of
+	// rewriting bookmarks
+	Queue bool
+
+	// Providers lists archive providers in order of preference
+	Providers        string
+	ProviderTimeouts map[string]time.Duration
+
+	// FallbackArchives lists providers asked when none of Providers has a
+	// copy, ArchiveToday is the [archive_today] section
+	FallbackArchives string
+	ArchiveToday     archiveTodayPolicy
+	Memento          mementoPolicy
+
+	// Paywalls names the hosts whose copies are preferred from one provider
+	Paywalls paywallPolicy
+
+	// Retries is the [retries] section: how transient check failures are
+	// retried
+	Retries retryPolicy
+
+	// TagPolicies maps a frontmatter tag to a policy from the [tag_policies] section
+	TagPolicies tagPolicies
+
+	// Secrets resolves API tokens referenced in the [secrets] section
+	Secrets secretStore
+
+	// Site configures the sitemap and tag pages from the [site] section
+	Site sitePolicy
+
+	// Save paces Save Page Now submissions, from the [save] section
+	Save savePolicy
+
+	// RateLimits overrides archive service budgets, from the [rate_limits]
+	// section
+	RateLimits rateLimits
+
+	// HostRates paces requests to bookmarked hosts, from the [host_rates]
+	// section
+	HostRates hostRates
+
+	// Storage names the [storage.<name>] profile downloaded content goes to
+	Storage     string
+	StorageSets storageProfiles
+
+	// Coordination splits runs with other runners, from the [coordination]
+	// section
+	Coordination coordinationPolicy
+
+	// EncryptExports encrypts every export-state output
+	EncryptExports bool
+
+	// Fields names the frontmatter keys of bookmarks, and Exclude holds
+	// globs of files and directories the scan skips
+	Fields  frontmatterKeys
+	Exclude []string
+}
+
+// getConfigPath returns the config file: config.toml, or config.yaml or
+// config.yml next to it when there is no config.toml.
+func getConfigPath() string {
+	var dir string
+	if configHome := os.Getenv("XDG_CONFIG_HOME"); configHome != "" {
+		dir = filepath.Join(configHome, "archive_tool")
+	} else {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "archive_tool.toml"
+		}
+		dir = filepath.Join(home, ".config", "archive_tool")
+	}
+	path := filepath.Join(dir, "config.toml")
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		for _, name := range []string{"config.yaml", "config.yml"} {
+			if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+				return filepath.Join(dir, name)
+			}
+		}
+	}
+	return path
+}
+
+// loadConfig reads the config file. A missing file yields an empty config.
+func loadConfig() (*Config, error) {
+	cfg := &Config{Flaky: defaultFlakyPolicy, Redirects: defaultRedirectPolicy, Rechecks: defaultRecheckPolicy, Site: defaultSitePolicy, Save: defaultSavePolicy, Fields: defaultFrontmatterKeys, Concurrency: 4, DomainDeath: defaultDomainDeathPolicy, RDAP: defaultRDAPPolicy, DomainWatch: defaultDomainWatchPolicy, ArchiveToday: defaultArchiveTodayPolicy, Memento: defaultMementoPolicy, Paywalls: defaultPaywallPolicy, Retries: defaultRetryPolicy, HostRates: defaultHostRates, WARC: defaultWARCPolicy, Coordination: defaultCoordinationPolicy}
+
+	configPath := getConfigPath()
+	file, err := os.Open(configPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	// The YAML form has the same settings, sections as nested mappings
+	if ext := filepath.Ext(configPath); ext == ".yaml" || ext == ".yml" {
+		err := parseYAMLConfig(file, func(lineNum int, section, key, value string) error {
+			if err := cfg.set(section, key, value); err != nil {
+				return fmt.Errorf("%s:%d: %w", configPath, lineNum, err)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return cfg, nil
+	}
+
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	section := ""
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		key, value, ok := parseConfigLine(line)
+		if !ok {
+			continue
+		}
+
+		if err := cfg.set(section, key, value); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", getConfigPath(), lineNum, err)
+		}
+	}
+
+	return cfg, scanner.Err()
+}
+
+// set applies one key of the config file, in the named section ("" for the
+// top level).
+func (cfg *Config) set(section, key, value string) error {
+	if section == "notify" {
+		return cfg.Notify.set(key, value)
+	}
+
+	if name, ok := strings.CutPrefix(section, "notifier."); ok {
+		return cfg.Notifiers.set(name, key, value)
+	}
+
+	if section == "secrets" {
+		cfg.Secrets.setRef(key, value)
+		return nil
+	}
+
+	if section == "provider_timeouts" {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid timeout %q: %w", value, err)
+		}
+		if cfg.ProviderTimeouts == nil {
+			cfg.ProviderTimeouts = make(map[string]time.Duration)
+		}
+		cfg.ProviderTimeouts[key] = d
+		return nil
+	}
+
+	if section == "redirects" {
+		if err := cfg.Redirects.set(key, value); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if section == "recheck" {
+		if err := cfg.Rechecks.set(key, value); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if section == "user_agents" {
+		if err := cfg.UserAgents.set(key, value); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if name, ok := strings.CutPrefix(section, "storage."); ok {
+		if err := cfg.StorageSets.set(name, key, value); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if section == "rate_limits" {
+		if err := cfg.RateLimits.set(key, value); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if section == "save" {
+		if err := cfg.Save.set(key, value); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if section == "site" {
+		if err := cfg.Site.set(key, value); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if section == "domain_death" {
+		return cfg.DomainDeath.set(key, value)
+	}
+
+	if section == "rdap" {
+		return cfg.RDAP.set(key, value)
+	}
+
+	if section == "domain_watch" {
+		return cfg.DomainWatch.set(key, value)
+	}
+
+	if section == "archive_today" {
+		return cfg.ArchiveToday.set(key, value)
+	}
+
+	if section == "memento" {
+		return cfg.Memento.set(key, value)
+	}
+
+	if section == "paywalls" {
+		return cfg.Paywalls.set(key, value)
+	}
+
+	if section == "host_rates" {
+		return cfg.HostRates.set(key, value)
+	}
+
+	if section == "retries" {
+		return cfg.Retries.set(key, value)
+	}
+
+	if section == "coordination" {
+		return cfg.Coordination.set(key, value)
+	}
+
+	if section == "warc" {
+		return cfg.WARC.set(key, value)
+	}
+
+	if section == "identity" {
+		return cfg.Identity.set(key, value)
+	}
+
+	// Restrictions a user could lift for themselves would be none
+	if strings.HasPrefix(section, "users.") {
+		return fmt.Errorf("users can only be restricted in the collection's %s", collectionConfigName)
+	}
+
+	if section == "fields" {
+		return cfg.Fields.set(key, value)
+	}
+
+	if section == "tag_policies" {
+		if err := cfg.TagPolicies.add(strings.Trim(key, `"'`), value); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	switch key {
+	case "dir", "directory":
+		cfg.Dir = expandHome(value)
+	case "schedule":
+		cfg.Schedule = value
+	case "listen":
+		cfg.Listen = value
+	case "blocklist":
+		cfg.Blocklist = value
+	case "allowlist":
+		cfg.Allowlist = value
+	case "sensitive":
+		cfg.Sensitive = value
+	case "storage":
+		cfg.Storage = value
+	case "exclude":
+		for _, pattern := range strings.Split(value, ",") {
+			if pattern = strings.TrimSpace(pattern); pattern != "" {
+				cfg.Exclude = append(cfg.Exclude, pattern)
+			}
+		}
+	case "encrypt_exports":
+		cfg.EncryptExports = value == "true"
+	case "providers":
+		cfg.Providers = value
+	case "fallback_archives":
+		cfg.FallbackArchives = value
+	case "locale":
+		cfg.Locale = value
+	case "ascii":
+		cfg.ASCII = value == "true"
+	case "queue":
+		cfg.Queue = value == "true"
+	case "shorteners":
+		cfg.Shorteners.add(value)
+	case "expand_shorteners":
+		cfg.ExpandShorteners = value == "true"
+	case "medium_domains":
+		cfg.MediumDomains.add(value)
+	case "fix_links":
+		cfg.FixLinks = value == "true"
+	case "check_assets":
+		cfg.CheckAssets = value == "true"
+	case "body_links":
+		cfg.NoBodyLinks = value == "false"
+	case "detect_language":
+		cfg.DetectLanguage = value == "true"
+	case "follow_pages":
+		cfg.FollowPages = value == "true"
+	case "provenance":
+		cfg.Provenance = value == "true"
+	case "snapshot_dir":
+		cfg.SnapshotDir = value
+	case "reading_copy":
+		cfg.ReadingCopy = value == "true"
+	case "pdf":
+		cfg.PDF = value == "true"
+	case "chrome":
+		cfg.Chrome = value
+	case "event_log":
+		cfg.EventLog = expandHome(value)
+	case "privacy":
+		cfg.Privacy = value == "true"
+	case "sanitize_links":
+		cfg.SanitizeLinks = value == "true"
+	case "pinboard":
+		cfg.Pinboard = value == "true"
+	case "archive_live":
+		cfg.ArchiveLive = value == "true"
+	case "git_commit":
+		cfg.GitCommit = value == "true"
+	case "digest":
+		if _, err := digestPeriod(value); err != nil {
+			return err
+		}
+		cfg.Digest = value
+	case "dead_after", "flaky_window", "flaky_min_alive":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid %s %q", key, value)
+		}
+		switch key {
+		case "dead_after":
+			cfg.Flaky.DeadAfter = n
+		case "flaky_window":
+			cfg.Flaky.Window = n
+		case "flaky_min_alive":
+			cfg.Flaky.MinAlive = n
+		}
+	case "recheck":
+		cfg.Recheck = value == "true"
+	case "concurrency":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid concurrency %q", value)
+		}
+		cfg.Concurrency = n
+	case "timeout":
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid timeout %q", value)
+		}
+		cfg.Timeout = d
+	case "request_ceiling":
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid request_ceiling %q", value)
+		}
+		cfg.RequestCeiling = d
+	case "jitter":
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid jitter %q: %w", value, err)
+		}
+		cfg.Jitter = d
+	}
+	return nil
+}
+
+// parseConfigLine splits a `key = "value"` line, ignoring blanks and comments.
+func parseConfigLine(line string) (string, string, bool) {
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+		return "", "", false
+	}
+
+	idx := strings.Index(trimmed, "=")
+	if idx <= 0 {
+		return "", "", false
+	}
+
+	key := strings.TrimSpace(trimmed[:idx])
+	value := strings.TrimSpace(trimmed[idx+1:])
+	if strings.HasPrefix(value, `"`) || strings.HasPrefix(value, "'") {
+		quote := value[:1]
+		if end := strings.Index(value[1:], quote); end != -1 {
+			value = value[1 : end+1]
+		}
+	} else if hash := strings.Index(value, "#"); hash != -1 {
+		value = strings.TrimSpace(value[:hash])
+	}
+
+	return key, value, true
+}
+
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, strings.TrimPrefix(path, "~"))
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// consoleStyle controls how progress and results are written to the terminal.
+// ASCII mode avoids unicode symbols and carriage-return progress updates,
+// which screen readers and dumb terminals handle poorly.
+type consoleStyle struct {
+	ASCII bool
+
+	// board, while a run shows one, takes the progress line
+	board *progressBoard
+}
+
+var console consoleStyle
+
+// asciiProgressEvery is how often, in files, ASCII mode prints a progress line.
+const asciiProgressEvery = 25
+
+func (c *consoleStyle) detect(cfg *Config) {
+	if cfg.ASCII || os.Getenv("TERM") == "dumb" {
+		c.ASCII = true
+	}
+}
+
+// mark is the prefix for a successful change.
+func (c consoleStyle) mark() string {
+	if c.ASCII {
+		return "OK"
+	}
+	return "✓"
+}
+
+func (c consoleStyle) failMark() string {
+	if c.ASCII {
+		return "FAIL"
+	}
+	return "✗"
+}
+
+func (c consoleStyle) warnMark() string {
+	if c.ASCII {
+		return "WARN"
+	}
+	return "!"
+}
+
+// progress reports item i of total. On a terminal the line is rewritten in
+// place, or drawn below the worker lines of a progress board; in ASCII mode a full line is printed every asciiProgressEvery items
+// and for the last one.
+func (c consoleStyle) progress(i, total int, format string, args ...interface{}) {
+	if c.board != nil {
+		c.board.setProgress(i, total, fmt.Sprintf(format, args...))
+		return
+	}
+	if !c.ASCII {
+		fmt.Printf("\r"+format, args...)
+		return
+	}
+	if i%asciiProgressEvery == 0 || i == total {
+		fmt.Printf(format+"\n", args...)
+	}
+}
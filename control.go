@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// controller lets a running check or daemon be paused, resumed, inspected and
+// stopped from another process through a unix control socket.
+type controller struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	paused   bool
+	stopping bool
+	stopCh   chan struct{}
+
+	// priority holds files or URLs injected with `ctl check`, processed
+	// ahead of regular work; wake nudges an idle daemon to start on them
+	priority []string
+	wake     chan struct{}
+
+	phase   string
+	current string
+	done    int
+	total   int
+	started time.Time
+	nextRun time.Time
+}
+
+type controlStatus struct {
+	PID     int       `json:"pid"`
+	Phase   string    `json:"phase"`
+	Paused  bool      `json:"paused"`
+	Stop    bool      `json:"stopping"`
+	Current string    `json:"current,omitempty"`
+	Done    int       `json:"done"`
+	Total   int       `json:"total"`
+	Queued  int       `json:"queued"`
+	Started time.Time `json:"started"`
+	NextRun time.Time `json:"next_run,omitempty"`
+}
+
+func newController() *controller {
+	c := &controller{phase: "starting", started: time.Now(), stopCh: make(chan struct{}), wake: make(chan struct{}, 1)}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *controller) pause() {
+	c.mu.Lock()
+	c.paused = true
+	c.mu.Unlock()
+}
+
+func (c *controller) resume() {
+	c.mu.Lock()
+	c.paused = false
+	c.mu.Unlock()
+	c.cond.Broadcast()
+}
+
+func (c *controller) stop() {
+	c.mu.Lock()
+	if !c.stopping {
+		c.stopping = true
+		close(c.stopCh)
+	}
+	c.mu.Unlock()
+	c.cond.Broadcast()
+}
+
+// stopOnSignal turns SIGINT/SIGTERM into a graceful stop: no new files are
+// started, the file in flight is finished and state is saved. A second signal
+// exits immediately.
+func (c *controller) stopOnSignal() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		fmt.Fprintf(os.Stderr, "\nReceived %s, finishing current file and saving state (signal again to force exit)\n", sig)
+		sdNotify("STOPPING=1")
+		c.stop()
+
+		<-signals
+		fmt.Fprintln(os.Stderr, "Forced exit")
+		os.Exit(130)
+	}()
+}
+
+func (c *controller) stopped() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stopping
+}
+
+// checkpoint blocks while the controller is paused. It returns false once a
+// stop has been requested, so the caller can save its state and return.
+func (c *controller) checkpoint() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.paused && !c.stopping {
+		c.cond.Wait()
+	}
+	return !c.stopping
+}
+
+// pushPriority queues a file path or URL to be checked before anything else.
+func (c *controller) pushPriority(item string) int {
+	c.mu.Lock()
+	c.priority = append(c.priority, item)
+	queued := len(c.priority)
+	c.mu.Unlock()
+
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return queued
+}
+
+func (c *controller) popPriority() (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.priority) == 0 {
+		return "", false
+	}
+	item := c.priority[0]
+	c.priority = c.priority[1:]
+	return item, true
+}
+
+func (c *controller) hasPriority() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.priority) > 0
+}
+
+func (c *controller) setPhase(phase string) {
+	c.mu.Lock()
+	c.phase = phase
+	c.mu.Unlock()
+}
+
+func (c *controller) setProgress(done, total int, current string) {
+	c.mu.Lock()
+	c.done, c.total, c.current = done, total, current
+	c.mu.Unlock()
+}
+
+func (c *controller) setNextRun(t time.Time) {
+	c.mu.Lock()
+	c.nextRun = t
+	c.mu.Unlock()
+}
+
+func (c *controller) status() controlStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return controlStatus{
+		PID:     os.Getpid(),
+		Phase:   c.phase,
+		Paused:  c.paused,
+		Stop:    c.stopping,
+		Current: c.current,
+		Done:    c.done,
+		Total:   c.total,
+		Queued:  len(c.priority),
+		Started: c.started,
+		NextRun: c.nextRun,
+	}
+}
+
+func getControlSocketPath() string {
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		return filepath.Join(runtimeDir, "archive_tool.sock")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".archive_tool.sock"
+	}
+	return filepath.Join(home, ".archive_tool.sock")
+}
+
+// listen serves control commands until the returned listener is closed. It
+// refuses to take over a socket that another live process is serving.
+func (c *controller) listen() (net.Listener, error) {
+	socketPath := getControlSocketPath()
+
+	if conn, err := net.Dial("unix", socketPath); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("another archive_tool process is already listening on %s", socketPath)
+	}
+	os.Remove(socketPath)
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	os.Chmod(socketPath, 0600)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go c.handleConn(conn)
+		}
+	}()
+
+	return listener, nil
+}
+
+func (c *controller) handleConn(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && line == "" {
+		return
+	}
+
+	command, arg, _ := strings.Cut(strings.TrimSpace(line), " ")
+
+	switch command {
+	case "check":
+		if arg == "" {
+			fmt.Fprintf(conn, "{\"error\":%q}\n", "check needs a file or URL")
+			return
+		}
+		c.pushPriority(arg)
+	case "pause":
+		c.pause()
+	case "resume":
+		c.resume()
+	case "stop":
+		c.stop()
+	case "status":
+	default:
+		fmt.Fprintf(conn, "{\"error\":%q}\n", "unknown command: "+command)
+		return
+	}
+
+	json.NewEncoder(conn).Encode(c.status())
+}
+
+// runCtl implements `archive_tool ctl <command>`.
+func runCtl(args []string) {
+	if len(args) == 0 || (args[0] == "check" && len(args) != 2) || (args[0] != "check" && len(args) != 1) {
+		fmt.Fprintln(os.Stderr, "Usage: archive_tool ctl pause|resume|status|stop")
+		fmt.Fprintln(os.Stderr, "       archive_tool ctl check <file-or-url>")
+		os.Exit(2)
+	}
+
+	command := args[0]
+	if command == "check" {
+		item := args[1]
+		if !strings.Contains(item, "://") {
+			// The daemon may run in another working directory
+			if abs, err := filepath.Abs(item); err == nil {
+				item = abs
+			}
+		}
+		command += " " + item
+	}
+
+	conn, err := net.DialTimeout("unix", getControlSocketPath(), 5*time.Second)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: no running archive_tool process found (%v)\n", err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "%s\n", command)
+
+	var status struct {
+		controlStatus
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(conn).Decode(&status); err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading response: %v\n", err)
+		os.Exit(1)
+	}
+	if status.Error != "" {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", status.Error)
+		os.Exit(1)
+	}
+
+	state := status.Phase
+	if status.Stop {
+		state += " (stopping)"
+	} else if status.Paused {
+		state += " (paused)"
+	}
+
+	fmt.Printf("PID:      %d\n", status.PID)
+	fmt.Printf("State:    %s\n", state)
+	if status.Total > 0 {
+		fmt.Printf("Progress: %d/%d\n", status.Done, status.Total)
+	}
+	if status.Current != "" {
+		fmt.Printf("Current:  %s\n", status.Current)
+	}
+	if status.Queued > 0 {
+		fmt.Printf("Queued:   %d requested check(s)\n", status.Queued)
+	}
+	if !status.NextRun.IsZero() {
+		fmt.Printf("Next run: %s\n", status.NextRun.Format(time.RFC3339))
+	}
+}
+
+// resolvePriorityItem maps a `ctl check` argument to bookmark files: a path
+// must be one of the collection's files, a URL matches every bookmark whose
+// link is that URL.
+func resolvePriorityItem(files []string, item string) []string {
+	if !strings.Contains(item, "://") {
+		if _, err := os.Stat(item); err != nil {
+			fmt.Fprintf(os.Stderr, "\nRequested check skipped: %v\n", err)
+			return nil
+		}
+		for _, filePath := range files {
+			if abs, err := filepath.Abs(filePath); err == nil && abs == item {
+				return []string{filePath}
+			}
+		}
+		fmt.Fprintf(os.Stderr, "\nRequested check skipped: %s is not in the collection\n", item)
+		return nil
+	}
+
+	var matches []string
+	for _, filePath := range files {
+		bookmark, err := parseBookmarkFile(filePath)
+		if err == nil && bookmark.Link == item {
+			matches = append(matches, filePath)
+		}
+	}
+	if len(matches) == 0 {
+		fmt.Fprintf(os.Stderr, "\nRequested check skipped: no bookmark links to %s\n", item)
+	}
+	return matches
+}
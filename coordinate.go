@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// coordinationPolicy is the [coordination] section, or --coordinate:
+//
+//	[coordination]
+//	storage = "shared"   # the storage profile the runners share
+//	runner = "nas"       # this runner's name, by default the host name
+//	parts = 64           # how many parts the collection is split into
+//	lease = "10m"        # how long a claim on a part holds unless renewed
+//	round = "12h"        # how long a finished part stays done
+//
+// Runners that share a storage profile split a run between them: each
+// claims a part of the collection at a time by writing a lease for it to
+// the store, checks its files and marks it done, then claims the next, so
+// a fast runner takes over the work of one that is slow or down.
+type coordinationPolicy struct {
+	Storage string
+	Runner  string
+	Parts   int
+	Lease   time.Duration
+	Round   time.Duration
+}
+
+var defaultCoordinationPolicy = coordinationPolicy{Parts: 64, Lease: 10 * time.Minute, Round: 12 * time.Hour}
+
+func (p *coordinationPolicy) set(key, value string) error {
+	switch key {
+	case "storage":
+		p.Storage = value
+	case "runner":
+		p.Runner = value
+	case "parts":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid parts %q", value)
+		}
+		p.Parts = n
+	case "lease", "round":
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid %s %q", key, value)
+		}
+		if key == "lease" {
+			p.Lease = d
+		} else {
+			p.Round = d
+		}
+	default:
+		return fmt.Errorf("unknown [coordination] key %q", key)
+	}
+	return nil
+}
+
+// leaseKeyPrefix starts the store keys of leases, which gc leaves alone.
+const leaseKeyPrefix = "lease-"
+
+func leaseKey(part int) string {
+	return fmt.Sprintf("%s%03d.json", leaseKeyPrefix, part)
+}
+
+// coordinationSettle is how long a runner waits after writing a lease
+// before reading it back. Stores keep the last of two writes, so of two
+// runners claiming a part at once, the one whose lease was overwritten
+// sees the other's and moves on.
+const coordinationSettle = 2 * time.Second
+
+// partLease is the state of one part in the store.
+type partLease struct {
+	Runner  string    `json:"runner"`
+	Expires time.Time `json:"expires"`
+	Done    time.Time `json:"done,omitempty"`
+}
+
+// coordinator claims the parts of a run for this runner. Files are put in
+// parts by their path relative to the collection, as --shard does, so every
+// runner computes the same split.
+type coordinator struct {
+	store  blobStore
+	policy coordinationPolicy
+	clock  Clock
+	dryRun bool
+
+	files  map[int][]string // the files of every part, to check once claimed
+	partOf map[string]int
+	order  []int // the parts in the order to claim them
+
+	held    map[int]int // claimed parts: how many of their files are left
+	renewed time.Time
+}
+
+// newCoordinator splits files into parts and reads the leases, to claim the
+// parts this runner finished last time first: their files are the ones its
+// lock file knows.
+func newCoordinator(opts *runOptions, files []string) (*coordinator, error) {
+	c := &coordinator{
+		store:  opts.Leases,
+		policy: opts.Coordination,
+		clock:  opts.clock(),
+		dryRun: opts.DryRun,
+		files:  make(map[int][]string),
+		partOf: make(map[string]int, len(files)),
+		held:   make(map[int]int),
+	}
+	for _, file := range files {
+		part := shardIndex(opts.Dir, file, c.policy.Parts)
+		c.files[part] = append(c.files[part], file)
+		c.partOf[file] = part
+	}
+
+	mine := make(map[int]bool)
+	for part := 0; part < c.policy.Parts; part++ {
+		lease, err := c.read(part)
+		if err != nil {
+			return nil, err
+		}
+		mine[part] = lease != nil && lease.Runner == c.policy.Runner
+		c.order = append(c.order, part)
+	}
+	sort.SliceStable(c.order, func(i, j int) bool { return mine[c.order[i]] && !mine[c.order[j]] })
+	return c, nil
+}
+
+func (c *coordinator) read(part int) (*partLease, error) {
+	data, err := c.store.get(leaseKey(part))
+	if errors.Is(err, errBlobNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading the lease of part %d: %w", part+1, err)
+	}
+	var lease partLease
+	if err := json.Unmarshal(data, &lease); err != nil {
+		// A damaged lease claims nothing
+		return nil, nil
+	}
+	return &lease, nil
+}
+
+func (c *coordinator) write(part int, lease partLease) error {
+	if c.dryRun {
+		return nil
+	}
+	data, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+	return c.store.put(leaseKey(part), data, "application/json")
+}
+
+// claimable reports whether a part may be claimed: nobody has it, or its
+// holder's lease ran out before finishing it, or it was finished in an
+// earlier round. An unfinished lease of this runner's own is from a run
+// that was interrupted.
+func (c *coordinator) claimable(lease *partLease, now time.Time) bool {
+	switch {
+	case lease == nil:
+		return true
+	case !lease.Done.IsZero():
+		return now.Sub(lease.Done) >= c.policy.Round
+	default:
+		return lease.Runner == c.policy.Runner || now.After(lease.Expires)
+	}
+}
+
+// claim claims the next part with files to check and returns them, nil once
+// no part is left to claim. Parts without such files are marked done on the
+// way, as this runner has checked them.
+func (c *coordinator) claim() ([]string, error) {
+	for len(c.order) > 0 {
+		part := c.order[0]
+		c.order = c.order[1:]
+
+		lease, err := c.read(part)
+		if err != nil {
+			return nil, err
+		}
+		now := c.clock.Now()
+		if !c.claimable(lease, now) {
+			continue
+		}
+		files := c.files[part]
+		if len(files) == 0 {
+			if err := c.write(part, partLease{Runner: c.policy.Runner, Expires: now, Done: now}); err != nil {
+				return nil, fmt.Errorf("marking part %d done: %w", part+1, err)
+			}
+			continue
+		}
+
+		if err := c.write(part, partLease{Runner: c.policy.Runner, Expires: now.Add(c.policy.Lease)}); err != nil {
+			return nil, fmt.Errorf("claiming part %d: %w", part+1, err)
+		}
+		if !c.dryRun {
+			c.clock.Sleep(coordinationSettle)
+			if lease, err = c.read(part); err != nil {
+				return nil, err
+			}
+			if lease == nil || lease.Runner != c.policy.Runner {
+				continue
+			}
+		}
+		c.held[part] = len(files)
+		c.renewed = now
+		fmt.Printf("\nClaimed part %d/%d: %d files\n", part+1, c.policy.Parts, len(files))
+		return files, nil
+	}
+	return nil, nil
+}
+
+// finished counts a file of a claimed part as checked, and marks the part
+// done with its last file.
+func (c *coordinator) finished(file string) {
+	part, ok := c.partOf[file]
+	if !ok || c.held[part] == 0 {
+		return
+	}
+	c.held[part]--
+	if c.held[part] > 0 {
+		return
+	}
+	delete(c.held, part)
+	now := c.clock.Now()
+	if err := c.write(part, partLease{Runner: c.policy.Runner, Expires: now, Done: now}); err != nil {
+		fmt.Fprintf(os.Stderr, "\nError marking part %d done: %v\n", part+1, err)
+	}
+}
+
+// renew extends the leases of the claimed parts once a third of the lease
+// has passed, so they are not taken over while their files are checked.
+func (c *coordinator) renew() {
+	now := c.clock.Now()
+	if len(c.held) == 0 || now.Sub(c.renewed) < c.policy.Lease/3 {
+		return
+	}
+	c.renewed = now
+	for part := range c.held {
+		if err := c.write(part, partLease{Runner: c.policy.Runner, Expires: now.Add(c.policy.Lease)}); err != nil {
+			fmt.Fprintf(os.Stderr, "\nError renewing the lease of part %d: %v\n", part+1, err)
+		}
+	}
+}
+
+// release gives up the parts a stopped run did not finish, so another
+// runner can take them over at once.
+func (c *coordinator) release() {
+	now := c.clock.Now()
+	var parts []int
+	for part := range c.held {
+		if err := c.write(part, partLease{Runner: c.policy.Runner, Expires: now}); err != nil {
+			fmt.Fprintf(os.Stderr, "\nError releasing part %d: %v\n", part+1, err)
+		}
+		parts = append(parts, part)
+	}
+	sort.Ints(parts)
+	names := make([]string, len(parts))
+	for i, part := range parts {
+		names[i] = strconv.Itoa(part + 1)
+	}
+	if len(names) > 0 {
+		fmt.Printf("Released unfinished parts %s\n", strings.Join(names, ", "))
+	}
+	c.held = make(map[int]int)
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const cdxAPI = "https://web.archive.org/cdx/search/cdx"
+
+const (
+	// hostQueryMin is how many bookmarks must share a host before coverage
+	// asks CDX for every capture on the host in one query.
+	hostQueryMin = 3
+	// hostQueryLimit caps the size of a host-wide listing. URLs it misses
+	// are checked one by one.
+	hostQueryLimit = 10000
+	cdxTimeout     = 60 * time.Second
+)
+
+// coverageLink is a bookmark URL and the files that link to it.
+type coverageLink struct {
+	url   string
+	files []string
+}
+
+// runCoverage implements `archive_tool coverage`: it lists the bookmarks the
+// Wayback Machine has never captured, dead or alive, so they can be submitted
+// for saving while they still exist. Only the CDX index is queried; the
+// bookmarked sites themselves are not contacted.
+func runCoverage(args []string) {
+	fs := flag.NewFlagSet("coverage", flag.ExitOnError)
+	opts := runOptions{Profile: runProfiles["fast"]}
+	opts.register(fs)
+	output := fs.String("output", "", "write the uninsured URLs to this file, one per line")
+	concurrency := fs.Int("concurrency", 4, "CDX queries in flight at once")
+	fs.Parse(args)
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		os.Exit(1)
+	}
+	if err := opts.finish(cfg, fs.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "Error %v\n", err)
+		os.Exit(1)
+	}
+
+	files, err := findMarkdownFiles(opts.Dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading directory: %v\n", err)
+		os.Exit(1)
+	}
+	if opts.Shard.Count > 1 {
+		files = opts.Shard.filter(opts.Dir, files)
+	}
+
+	links := make(map[string]*coverageLink)
+	for _, filePath := range files {
+		bookmark, err := parseBookmarkFile(filePath)
+		if err != nil || bookmark.Link == "" {
+			continue
+		}
+		if !opts.Filter.allows(bookmark.Link) || !opts.Tags.matches(bookmark.Tags) {
+			continue
+		}
+		if isWaybackURL(bookmark.Link) || validateLink(bookmark.Link) != nil {
+			continue
+		}
+		opts.Providers.sensitive.markBookmark(bookmark)
+		link := links[bookmark.Link]
+		if link == nil {
+			link = &coverageLink{url: bookmark.Link}
+			links[bookmark.Link] = link
+		}
+		link.files = append(link.files, filePath)
+	}
+	// Marked once every bookmark is seen: a URL is sensitive if any bookmark
+	// of it is
+	sensitive := 0
+	for u := range links {
+		if opts.Providers.permit(u) != nil {
+			delete(links, u)
+			sensitive++
+		}
+	}
+	fmt.Printf("Checking Wayback coverage of %d URLs from %d files\n", len(links), len(files))
+	if sensitive > 0 {
+		fmt.Printf("Not querying %d sensitive URLs\n", sensitive)
+	}
+
+	client := opts.httpClient()
+	covered, errs := checkCoverage(client, opts.Providers, links, max(*concurrency, 1))
+
+	var uninsured []*coverageLink
+	for u, link := range links {
+		if _, failed := errs[u]; !failed && !covered[u] {
+			uninsured = append(uninsured, link)
+		}
+	}
+	sort.Slice(uninsured, func(i, j int) bool { return uninsured[i].url < uninsured[j].url })
+
+	fmt.Printf("\n\n%d of %d URLs have no Wayback captures\n", len(uninsured), len(links))
+	for _, link := range uninsured {
+		fmt.Printf("  %s\n", link.url)
+		for _, file := range link.files {
+			fmt.Printf("      %s\n", file)
+		}
+	}
+	if len(errs) > 0 {
+		kinds := make(map[string]int)
+		for _, err := range errs {
+			kinds[errorKind(err)]++
+		}
+		fmt.Fprintf(os.Stderr, "%d URLs could not be checked: %v\n", len(errs), kinds)
+	}
+
+	if *output != "" {
+		var b strings.Builder
+		for _, link := range uninsured {
+			b.WriteString(link.url + "\n")
+		}
+		if err := writeFileAtomic(*output, []byte(b.String()), 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing %s: %v\n", *output, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Wrote %d URLs to %s\n", len(uninsured), *output)
+	}
+}
+
+// isWaybackURL reports whether a link already points into the Wayback Machine.
+func isWaybackURL(link string) bool {
+	return strings.HasPrefix(link, waybackAPI+"/") || strings.HasPrefix(link, "http://web.archive.org/web/") ||
+		legacyWaybackPattern.MatchString(link)
+}
+
+// checkCoverage reports which links have at least one capture. Hosts with
+// several bookmarks are answered by one host-wide query; whatever that does
+// not confirm, and every other link, gets its own limit=1 query. Links that
+// could not be checked are returned in errs.
+func checkCoverage(client *http.Client, providers *providerChain, links map[string]*coverageLink, workers int) (map[string]bool, map[string]error) {
+	byHost := make(map[string][]string)
+	for u := range links {
+		byHost[coverageHost(u)] = append(byHost[coverageHost(u)], u)
+	}
+
+	covered := make(map[string]bool)
+	errs := make(map[string]error)
+	var mu sync.Mutex
+	var pending []string
+
+	var hosts []string
+	for host, urls := range byHost {
+		if host != "" && len(urls) >= hostQueryMin {
+			hosts = append(hosts, host)
+		} else {
+			pending = append(pending, urls...)
+		}
+	}
+	runPool(hosts, workers, func(host string) {
+		captured, err := cdxHostCaptures(client, host)
+		mu.Lock()
+		defer mu.Unlock()
+		for _, u := range byHost[host] {
+			if err == nil && captured[coverageKey(u)] {
+				covered[u] = true
+				continue
+			}
+			// Missing from the listing, or the listing failed. coverageKey
+			// only approximates CDX's normalisation, so even a complete
+			// listing is confirmed with an exact query
+			pending = append(pending, u)
+		}
+	})
+
+	done := 0
+	runPool(pending, workers, func(u string) {
+		found := false
+		outbound, err := providers.outbound(u)
+		if err == nil {
+			found, err = cdxHasCapture(client, outbound)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		done++
+		console.progress(done, len(pending), "Querying CDX [%d/%d]", done, len(pending))
+		if err != nil {
+			errs[u] = err
+			return
+		}
+		covered[u] = found
+	})
+	return covered, errs
+}
+
+// runPool calls fn for each item with at most workers calls in flight.
+func runPool(items []string, workers int, fn func(string)) {
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < min(workers, len(items)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range jobs {
+				fn(item)
+			}
+		}()
+	}
+	for _, item := range items {
+		jobs <- item
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// cdxHasCapture asks CDX for a single successful or redirected capture of link.
+func cdxHasCapture(client *http.Client, link string) (bool, error) {
+	q := url.Values{}
+	q.Set("url", wireURL(link))
+	q.Set("fl", "timestamp")
+	q.Set("limit", "1")
+	rows, err := cdxQuery(client, q)
+	return len(rows) > 0, err
+}
+
+// cdxHostCaptures lists the distinct captured URLs on host, keyed by
+// coverageKey.
+func cdxHostCaptures(client *http.Client, host string) (map[string]bool, error) {
+	q := url.Values{}
+	q.Set("url", host)
+	q.Set("matchType", "host")
+	q.Set("fl", "original")
+	q.Set("collapse", "urlkey")
+	q.Set("limit", fmt.Sprint(hostQueryLimit))
+	rows, err := cdxQuery(client, q)
+	if err != nil {
+		return nil, err
+	}
+	captured := make(map[string]bool, len(rows))
+	for _, row := range rows {
+		if len(row) > 0 {
+			captured[coverageKey(row[0])] = true
+		}
+	}
+	return captured, nil
+}
+
+// cdxQuery runs a CDX search, keeping only 2xx and 3xx captures unless q
+// has filters of its own, and returns the result rows without the header
+// row.
+func cdxQuery(client *http.Client, q url.Values) ([][]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cdxTimeout)
+	defer cancel()
+	return cdxQueryContext(ctx, client, q)
+}
+
+func cdxQueryContext(ctx context.Context, client *http.Client, q url.Values) ([][]string, error) {
+	q.Set("output", "json")
+	if _, ok := q["filter"]; !ok {
+		q.Set("filter", "statuscode:[23]..")
+	}
+	endpoint := cdxAPI + "?" + q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", archiveUserAgent)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, classifyError("cdx query", q.Get("url"), err)
+	}
+	defer resp.Body.Close()
+	if err := statusError("cdx query", q.Get("url"), resp.StatusCode); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("cdx query %s: status %d", q.Get("url"), resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, classifyError("cdx query", q.Get("url"), err)
+	}
+	if len(strings.TrimSpace(string(body))) == 0 {
+		return nil, nil
+	}
+	var rows [][]string
+	if err := json.Unmarshal(body, &rows); err != nil {
+		return nil, fmt.Errorf("cdx query %s: %w", q.Get("url"), err)
+	}
+	if len(rows) > 0 {
+		rows = rows[1:]
+	}
+	return rows, nil
+}
+
+// coverageHost is the host CDX groups a URL under, without "www.".
+func coverageHost(link string) string {
+	u, err := url.Parse(wireURL(link))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+}
+
+// coverageKey normalises a URL roughly the way CDX's urlkey does: scheme,
+// "www.", default ports, fragment and a trailing slash do not count.
+func coverageKey(link string) string {
+	u, err := url.Parse(wireURL(link))
+	if err != nil {
+		return link
+	}
+	key := coverageHost(link) + strings.TrimSuffix(u.EscapedPath(), "/")
+	if u.RawQuery != "" {
+		key += "?" + u.RawQuery
+	}
+	return key
+}
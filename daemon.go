@@ -0,0 +1,218 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+)
+
+// runDaemon keeps the process alive and starts a check whenever the configured
+// cron schedule fires, for platforms without cron or systemd timers.
+func runDaemon(args []string) {
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		os.Exit(1)
+	}
+
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	schedule := fs.String("schedule", cfg.Schedule, "cron expression for scheduled runs, e.g. \"0 3 * * *\"")
+	jitter := fs.Duration("jitter", cfg.Jitter, "random delay added to each scheduled run")
+	listen := fs.String("listen", cfg.Listen, "serve the live event stream at http://`addr`/events, e.g. 127.0.0.1:8350")
+	opts := runOptions{Trigger: "schedule", Profile: runProfiles["fast"]}
+	opts.register(fs)
+	fs.IntVar(&opts.Concurrency, "concurrency", 0, "check `N` files at once (default 4)")
+	fs.Parse(args)
+
+	if err := opts.finish(cfg, fs.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "Error %v\n", err)
+		os.Exit(1)
+	}
+
+	if *schedule == "" {
+		fmt.Fprintf(os.Stderr, "Error: no schedule configured (set schedule in %s or pass --schedule)\n", getConfigPath())
+		os.Exit(2)
+	}
+
+	sched, err := parseCron(*schedule)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+
+	ctl := newController()
+	listener, err := ctl.listen()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer listener.Close()
+
+	if *listen != "" {
+		// The stream has subscribers even without an event log file
+		if events == nil {
+			events = &eventLog{clock: opts.clock()}
+		}
+		srv, err := listenEvents(*listen, events, ctl.stopCh)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer srv.Close()
+		fmt.Printf("Streaming events at http://%s/events\n", *listen)
+	}
+
+	ctl.stopOnSignal()
+
+	sdNotify("READY=1")
+	defer sdNotify("STOPPING=1")
+
+	ctl.setPhase("idle")
+	next := sched.next(time.Now())
+	for !next.IsZero() {
+		fireAt := next
+		if *jitter > 0 {
+			fireAt = fireAt.Add(time.Duration(rand.Int63n(int64(*jitter))))
+		}
+
+		ctl.setNextRun(fireAt)
+		fmt.Printf("Next run at %s\n", fireAt.Format(time.RFC3339))
+		sdNotify("STATUS=Idle, next run at " + fireAt.Format(time.RFC3339))
+
+		if !waitForRun(opts, fireAt, ctl) {
+			return
+		}
+
+		// Pausing the daemon while idle holds back the next scheduled run
+		if !ctl.checkpoint() {
+			return
+		}
+
+		ctl.setNextRun(time.Time{})
+		if run, err := runCheck(opts, ctl); err != nil {
+			fmt.Fprintf(os.Stderr, "Error %v\n", err)
+		} else {
+			notifyRunDone(opts.httpClient(), cfg, run)
+		}
+		if ctl.stopped() {
+			return
+		}
+		maybeSendDigest(opts.httpClient(), cfg)
+
+		// Runs never overlap: fire times that passed while a run was still
+		// going are recorded as skipped rather than queued up behind it
+		now := time.Now()
+		next = sched.next(next)
+		var missed []time.Time
+		for !next.IsZero() && next.Before(now) {
+			missed = append(missed, next)
+			next = sched.next(next)
+		}
+		if len(missed) > 0 {
+			recordSkippedRuns(missed)
+		}
+	}
+}
+
+// waitForRun sleeps until fireAt, handling requested checks in the meantime.
+// It returns false if the daemon was asked to stop.
+func waitForRun(opts runOptions, fireAt time.Time, ctl *controller) bool {
+	timer := time.NewTimer(time.Until(fireAt))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctl.stopCh:
+			fmt.Println("Stop requested, exiting")
+			return false
+		case <-ctl.wake:
+			if ctl.hasPriority() {
+				if err := runRequested(opts, ctl); err != nil {
+					fmt.Fprintf(os.Stderr, "Error %v\n", err)
+				}
+			}
+			if ctl.stopped() {
+				return false
+			}
+		case <-timer.C:
+			return true
+		}
+	}
+}
+
+// runRequested processes only the items injected with `ctl check`, without
+// waiting for the next scheduled sweep.
+func runRequested(opts runOptions, ctl *controller) error {
+	ctl.setPhase("checking")
+	defer ctl.setPhase("idle")
+
+	files, err := findMarkdownFiles(opts.Dir)
+	if err != nil {
+		return fmt.Errorf("reading directory: %w", err)
+	}
+
+	lock, err := loadLockFile(false)
+	if err != nil {
+		return fmt.Errorf("loading lock file: %w", err)
+	}
+
+	if err := opts.Filter.refresh(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error reloading URL lists, keeping previous rules: %v\n", err)
+	}
+
+	run := &RunRecord{
+		ID:      newRunID(opts.now()),
+		Trigger: "request",
+		Profile: opts.Profile.Name,
+		Started: opts.now(),
+		Status:  "completed",
+	}
+	events.emit(event{Event: "run_started", Run: run.ID, Trigger: run.Trigger, Dir: opts.Dir})
+
+	client := opts.httpClient()
+	for ctl.checkpoint() {
+		item, ok := ctl.popPriority()
+		if !ok {
+			break
+		}
+		for _, filePath := range resolvePriorityItem(files, item) {
+			ctl.setProgress(0, 0, filePath)
+			fmt.Printf("Checking now (requested): %s\n", filePath)
+			processFile(client, lock, filePath, run, opts)
+		}
+	}
+	ctl.setProgress(0, 0, "")
+
+	run.Finished = opts.now()
+	lock.addRun(run)
+	events.emit(event{Event: "run_finished", Run: run.ID, Result: run.Status, Checked: run.Checked, Replaced: run.Replaced, Errors: run.Errors})
+
+	fmt.Printf("Requested checks done. Checked: %d, Replaced: %d, Errors: %d\n", run.Checked, run.Replaced, run.Errors)
+
+	return saveLockFile(lock)
+}
+
+func recordSkippedRuns(fireTimes []time.Time) {
+	lock, err := loadLockFile(false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading lock file: %v\n", err)
+		return
+	}
+
+	for _, t := range fireTimes {
+		fmt.Printf("Skipped run scheduled at %s: previous run still in progress\n", t.Format(time.RFC3339))
+		lock.addRun(&RunRecord{
+			ID:       t.UTC().Format("20060102T150405.000Z"),
+			Trigger:  "schedule",
+			Status:   "skipped-overlap",
+			Started:  t,
+			Finished: t,
+		})
+	}
+
+	if err := saveLockFile(lock); err != nil {
+		fmt.Fprintf(os.Stderr, "Error saving lock file: %v\n", err)
+	}
+}
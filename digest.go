@@ -0,0 +1,149 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// maxDigests bounds how many past digests are kept for the RSS feed.
+const maxDigests = 50
+
+func digestPeriod(name string) (time.Duration, error) {
+	switch name {
+	case "daily":
+		return 24 * time.Hour, nil
+	case "weekly":
+		return 7 * 24 * time.Hour, nil
+	}
+	return 0, fmt.Errorf("unknown digest period %q (want daily or weekly)", name)
+}
+
+// buildDigest summarises every run that finished after since.
+func buildDigest(lock *LockFile, period string, since, now time.Time) notification {
+	var runs, checked, replaced, errors, flaky, overlaps, stopped int
+	var lines []string
+
+	for _, run := range lock.Runs {
+		if !run.Finished.After(since) {
+			continue
+		}
+		runs++
+		checked += run.Checked
+		replaced += run.Replaced
+		errors += run.Errors
+		flaky += run.Flaky
+		switch run.Status {
+		case "skipped-overlap":
+			overlaps++
+		case "stopped":
+			stopped++
+		}
+		for _, r := range run.Replacements {
+			lines = append(lines, fmt.Sprintf("  %s\n    -> %s", r.Original, r.URL))
+		}
+	}
+
+	title := fmt.Sprintf("archive_tool %s digest: %d replaced, %d errors", period, replaced, errors)
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "Activity since %s\n\n", since.Format("2006-01-02 15:04"))
+	fmt.Fprintf(&body, "Runs: %d", runs)
+	if overlaps > 0 || stopped > 0 {
+		fmt.Fprintf(&body, " (%d skipped for overlap, %d stopped early)", overlaps, stopped)
+	}
+	fmt.Fprintf(&body, "\nLinks checked: %d\nReplaced: %d\nErrors: %d\nFlaky: %d\n", checked, replaced, errors, flaky)
+	if len(lines) > 0 {
+		fmt.Fprintf(&body, "\nReplacements:\n%s\n", strings.Join(lines, "\n"))
+	}
+
+	return notification{Kind: notifyDigest, Title: title, Body: body.String(), Time: now}
+}
+
+// sendDigest builds a digest of the activity since the last one, stores it,
+// and delivers it to the configured channels. Unless force is set it does
+// nothing until a full period has passed.
+func sendDigest(client *http.Client, cfg *Config, period string, force bool) (*notification, error) {
+	length, err := digestPeriod(period)
+	if err != nil {
+		return nil, err
+	}
+
+	lock, err := loadLockFile(false)
+	if err != nil {
+		return nil, fmt.Errorf("loading lock file: %w", err)
+	}
+
+	now := time.Now()
+	since := lock.LastDigest
+	if since.IsZero() {
+		since = now.Add(-length)
+	}
+	if !force && now.Sub(since) < length {
+		return nil, nil
+	}
+
+	digest := buildDigest(lock, period, since, now)
+	lock.Digests = append(lock.Digests, digest)
+	if len(lock.Digests) > maxDigests {
+		lock.Digests = lock.Digests[len(lock.Digests)-maxDigests:]
+	}
+	lock.LastDigest = now
+
+	errs := deliver(client, cfg, lock, digest)
+
+	if err := saveLockFile(lock); err != nil {
+		return &digest, fmt.Errorf("saving lock file: %w", err)
+	}
+	if len(errs) > 0 {
+		return &digest, fmt.Errorf("delivering digest: %v", errs)
+	}
+	return &digest, nil
+}
+
+// maybeSendDigest is called by the daemon after each run.
+func maybeSendDigest(client *http.Client, cfg *Config) {
+	if cfg.Digest == "" {
+		return
+	}
+	digest, err := sendDigest(client, cfg, cfg.Digest, false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error sending digest: %v\n", err)
+	} else if digest != nil {
+		fmt.Printf("Sent %s digest\n", cfg.Digest)
+	}
+}
+
+// runDigest implements `archive_tool digest`, for sending digests from cron.
+func runDigest(args []string) {
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		os.Exit(1)
+	}
+
+	fs := flag.NewFlagSet("digest", flag.ExitOnError)
+	period := fs.String("period", cfg.Digest, "digest period: daily or weekly")
+	force := fs.Bool("force", false, "send even if a full period has not passed since the last digest")
+	fs.Parse(args)
+
+	if *period == "" {
+		*period = "daily"
+	}
+
+	var opts runOptions
+	opts.finishClient(cfg)
+	digest, err := sendDigest(opts.httpClient(), cfg, *period, *force)
+	if digest != nil {
+		fmt.Printf("%s\n\n%s", digest.Title, digest.Body)
+	} else if err == nil {
+		fmt.Printf("Last digest was less than a %s period ago; use --force to send anyway\n", *period)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error %v\n", err)
+		os.Exit(1)
+	}
+}
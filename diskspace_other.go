@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+func freeDiskSpace(path string) (uint64, error) {
+	return 0, errors.New("not supported on this platform")
+}
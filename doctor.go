@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// minFreeSpace is the free disk space doctor asks for. Rewrites are
+// atomic, so each one briefly needs room for a second copy of the file.
+const minFreeSpace = 100 << 20
+
+// doctorReport collects check results and prints them as they come in.
+type doctorReport struct {
+	failures int
+	warnings int
+}
+
+func (d *doctorReport) ok(format string, args ...interface{}) {
+	fmt.Printf("%s %s\n", console.mark(), fmt.Sprintf(format, args...))
+}
+
+// fail reports a problem and how to fix it.
+func (d *doctorReport) fail(fix, format string, args ...interface{}) {
+	d.failures++
+	fmt.Printf("%s %s\n", console.failMark(), fmt.Sprintf(format, args...))
+	if fix != "" {
+		fmt.Printf("    fix: %s\n", fix)
+	}
+}
+
+func (d *doctorReport) warn(fix, format string, args ...interface{}) {
+	d.warnings++
+	fmt.Printf("%s %s\n", console.warnMark(), fmt.Sprintf(format, args...))
+	if fix != "" {
+		fmt.Printf("    fix: %s\n", fix)
+	}
+}
+
+// runDoctor implements `archive_tool doctor`: it checks the config, secrets,
+// state file, bookmarks directory, disk space and the archive providers, and
+// says how to fix anything that would break a run.
+func runDoctor(args []string) {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	opts := runOptions{Profile: runProfiles["fast"]}
+	opts.register(fs)
+	offline := fs.Bool("offline", false, "skip the network checks")
+	fs.Parse(args)
+
+	d := &doctorReport{}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		d.fail("correct the line named in the error", "config %s: %v", getConfigPath(), err)
+		cfg = &Config{Flaky: defaultFlakyPolicy}
+	} else if _, statErr := os.Stat(getConfigPath()); statErr != nil {
+		d.ok("no config file at %s, using defaults", getConfigPath())
+	} else {
+		d.ok("config %s", getConfigPath())
+	}
+
+	if err := opts.finish(cfg, fs.Args()); err != nil {
+		d.fail("check the providers and blocklist/allowlist settings", "options: %v", err)
+	} else {
+		names := make([]string, len(opts.Providers.providers))
+		for i, p := range opts.Providers.providers {
+			names[i] = p.name()
+		}
+		d.ok("providers: %v", names)
+		if len(opts.Providers.fallbacks) > 0 {
+			names = names[:0]
+			for _, p := range opts.Providers.fallbacks {
+				names = append(names, p.name())
+			}
+			d.ok("fallback archives: %v", names)
+		}
+	}
+
+	doctorSecrets(d, cfg)
+	doctorBookmarks(d, opts.Dir)
+	doctorState(d)
+	doctorDiskSpace(d, opts.Dir)
+	doctorDaemon(d)
+
+	if !*offline && opts.Providers != nil {
+		client := opts.httpClient()
+		for _, provider := range append(opts.Providers.providers, opts.Providers.fallbacks...) {
+			doctorProvider(d, client, provider)
+		}
+	}
+
+	fmt.Println()
+	switch {
+	case d.failures > 0:
+		fmt.Printf("%d problem(s), %d warning(s)\n", d.failures, d.warnings)
+		os.Exit(1)
+	case d.warnings > 0:
+		fmt.Printf("No problems, %d warning(s)\n", d.warnings)
+	default:
+		fmt.Println("Everything looks good")
+	}
+}
+
+func doctorSecrets(d *doctorReport, cfg *Config) {
+	names := cfg.Secrets.names()
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := cfg.Secrets.get(name); err != nil {
+			d.fail("fix the reference in [secrets] or set ARCHIVE_TOOL_"+strings.ToUpper(name), "%v", err)
+			continue
+		}
+		d.ok("secret %s resolves", name)
+	}
+
+	n := cfg.Notify
+	if n.EmailTo != "" && n.SMTPHost == "" {
+		d.fail("set smtp_host in [notify]", "email_to is set but smtp_host is not")
+	}
+	if n.EmailTo != "" && n.SMTPUser != "" {
+		if _, err := cfg.Secrets.get("smtp_password"); err != nil {
+			d.fail("add smtp_password to [secrets]", "smtp_user is set but no SMTP password: %v", err)
+		}
+	}
+}
+
+func doctorBookmarks(d *doctorReport, dir string) {
+	if dir == "" {
+		return
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		d.fail("pass the directory as an argument or set dir in the config file", "bookmarks directory: %v", err)
+		return
+	}
+	if !info.IsDir() {
+		d.fail("point dir at the directory holding the .md files", "%s is not a directory", dir)
+		return
+	}
+
+	files, err := findMarkdownFiles(dir)
+	if err != nil {
+		d.fail("", "scanning %s: %v", dir, err)
+		return
+	}
+	if len(files) == 0 {
+		d.warn("check that this is the right directory", "no markdown files in %s", dir)
+		return
+	}
+
+	probe, err := os.CreateTemp(dir, ".archive_tool-doctor-")
+	if err != nil {
+		d.fail("make the directory writable; links are rewritten in place", "%s is not writable: %v", dir, err)
+		return
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+
+	d.ok("bookmarks: %d markdown files in %s", len(files), dir)
+}
+
+func doctorState(d *doctorReport) {
+	path := getLockFilePath()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		d.ok("no state file yet at %s", path)
+		return
+	}
+	if err != nil {
+		d.fail("", "state file: %v", err)
+		return
+	}
+
+	lock, err := decodeLockFile(data)
+	if err == nil {
+		lock.resolvePaths(path)
+	}
+	if err != nil {
+		d.fail("the next run restores the newest good backup automatically", "state file %s is corrupt: %v", path, err)
+		return
+	}
+
+	missing := 0
+	for file := range lock.ProcessedFiles {
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			missing++
+		}
+	}
+	d.ok("state file %s: %d processed files, %d runs, %d URL histories", path, len(lock.ProcessedFiles), len(lock.Runs), len(lock.URLHistory))
+	if missing > 0 {
+		d.warn("harmless; the entries belong to deleted or moved bookmarks", "%d processed files no longer exist", missing)
+	}
+
+	backups := 0
+	for i := 1; i <= maxStateBackups; i++ {
+		if _, err := os.Stat(stateBackupPath(path, i)); err == nil {
+			backups++
+		}
+	}
+	d.ok("%d state backups", backups)
+}
+
+func doctorDiskSpace(d *doctorReport, dir string) {
+	for _, path := range []string{dir, filepath.Dir(getLockFilePath())} {
+		if path == "" {
+			continue
+		}
+		free, err := freeDiskSpace(path)
+		if err != nil {
+			continue
+		}
+		if free < minFreeSpace {
+			d.fail("free up disk space before a big run", "only %d MB free on the filesystem holding %s", free>>20, path)
+			continue
+		}
+		d.ok("%d MB free for %s", free>>20, path)
+	}
+}
+
+func doctorDaemon(d *doctorReport) {
+	conn, err := net.DialTimeout("unix", getControlSocketPath(), time.Second)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	fmt.Fprintln(conn, "status")
+	var status controlStatus
+	if err := json.NewDecoder(conn).Decode(&status); err != nil {
+		return
+	}
+	d.warn("stop it with `archive_tool ctl stop`, or let it do the run", "another archive_tool process is running (%s)", status.Phase)
+}
+
+// doctorProvider measures connectivity and baseline latency to a provider.
+func doctorProvider(d *doctorReport, client *http.Client, provider archiveProvider) {
+	const probes = 3
+	var latencies []time.Duration
+	var lastErr error
+	status := 0
+
+	for i := 0; i < probes; i++ {
+		req, err := http.NewRequest("HEAD", provider.endpoint(), nil)
+		if err != nil {
+			lastErr = err
+			break
+		}
+		req.Header.Set("User-Agent", archiveUserAgent)
+
+		start := time.Now()
+		resp, err := client.Do(req)
+		if err != nil {
+			lastErr = classifyError("probe", provider.endpoint(), err)
+			continue
+		}
+		resp.Body.Close()
+		status = resp.StatusCode
+		if err := statusError("probe", provider.endpoint(), resp.StatusCode); err != nil {
+			lastErr = err
+			continue
+		}
+		latencies = append(latencies, time.Since(start))
+	}
+
+	if len(latencies) == 0 {
+		d.fail(providerFix(lastErr), "%s unreachable: %v", provider.name(), lastErr)
+		return
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	median := latencies[len(latencies)/2].Round(time.Millisecond)
+	if median > 5*time.Second {
+		d.warn("expect a slow run; consider a larger timeout in [provider_timeouts]", "%s is slow: median %s over %d requests", provider.name(), median, len(latencies))
+		return
+	}
+	d.ok("%s reachable (status %d), median latency %s", provider.name(), status, median)
+}
+
+func providerFix(err error) string {
+	switch errorKind(err) {
+	case "dns":
+		return "check your DNS settings or network connection"
+	case "timeout":
+		return "check your network, proxy (HTTPS_PROXY) or firewall"
+	case "tls":
+		return "check the system clock and CA certificates"
+	case "rate_limited":
+		return "wait a while before the run; the archive is throttling this address"
+	case "blocked":
+		return "the archive refuses this address; try another network"
+	}
+	return ""
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Decisions on the bookmarks of a host that looks gone.
+const (
+	domainAsk     = "ask"     // prompt on a terminal, keep otherwise
+	domainReplace = "replace" // replace them all with their closest snapshots
+	domainQueue   = "queue"   // propose them all in the review checklist
+	domainKeep    = "keep"    // leave them for the next run
+)
+
+// domainDeathPolicy decides when a host looks gone and what happens to its
+// bookmarks then:
+//
+//	[domain_death]
+//	threshold = 5      # dead links on a host, none alive, 0 to disable
+//	decision = "ask"   # ask, replace, queue or keep
+//
+// Once a host has reached the threshold in a run, its further dead links
+// are held instead of looked up one by one, and decided on together at the
+// end of the run.
+type domainDeathPolicy struct {
+	Threshold int
+	Decision  string
+}
+
+var defaultDomainDeathPolicy = domainDeathPolicy{Threshold: 5, Decision: domainAsk}
+
+func (p *domainDeathPolicy) set(key, value string) error {
+	switch key {
+	case "threshold":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid threshold %q", value)
+		}
+		p.Threshold = n
+	case "decision":
+		switch value {
+		case domainAsk, domainReplace, domainQueue, domainKeep:
+			p.Decision = value
+		default:
+			return fmt.Errorf("invalid decision %q (want ask, replace, queue or keep)", value)
+		}
+	default:
+		return fmt.Errorf("unknown [domain_death] key %q", key)
+	}
+	return nil
+}
+
+// DeadDomain is a host that looked gone during a run, with the bookmarks
+// held for it and what was decided about them.
+type DeadDomain struct {
+	Host     string `json:"host"`
+	Dead     int    `json:"dead"`
+	Held     int    `json:"held"`
+	Decision string `json:"decision"`
+}
+
+// heldLink is a dead link held back with what processFile knew of it.
+type heldLink struct {
+	bookmark *BookmarkFile
+	target   string
+	verdict  linkVerdict
+	profile  runProfile
+	ex       *explainer
+}
+
+// domainTracker counts dead and alive links per host during a run. It is
+// used under opts.Shared.
+type domainTracker struct {
+	policy domainDeathPolicy
+	dead   map[string]int
+	alive  map[string]int
+	held   map[string][]heldLink
+}
+
+func newDomainTracker(policy domainDeathPolicy) *domainTracker {
+	return &domainTracker{
+		policy: policy,
+		dead:   make(map[string]int),
+		alive:  make(map[string]int),
+		held:   make(map[string][]heldLink),
+	}
+}
+
+// observe counts a checked link.
+func (t *domainTracker) observe(link string, dead bool) {
+	if t == nil {
+		return
+	}
+	if dead {
+		t.dead[coverageHost(link)]++
+	} else {
+		t.alive[coverageHost(link)]++
+	}
+}
+
+// gone reports whether a host looks gone: enough dead links in this run and
+// not one alive.
+func (t *domainTracker) gone(host string) bool {
+	return t.policy.Threshold > 0 && t.dead[host] >= t.policy.Threshold && t.alive[host] == 0
+}
+
+// hold keeps back a dead link when its host looks gone and has not been
+// decided on yet.
+func (t *domainTracker) hold(h heldLink) bool {
+	if t == nil {
+		return false
+	}
+	host := coverageHost(h.bookmark.Link)
+	if !t.gone(host) {
+		return false
+	}
+	if len(t.held[host]) == 0 {
+		fmt.Printf("\n%s looks gone (%d dead links, none alive); holding its dead links for a decision at the end of the run\n", host, t.dead[host])
+	}
+	t.held[host] = append(t.held[host], h)
+	return true
+}
+
+// heldHosts returns the hosts with held bookmarks, the most first.
+func (t *domainTracker) heldHosts() []string {
+	if t == nil {
+		return nil
+	}
+	hosts := make([]string, 0, len(t.held))
+	for host := range t.held {
+		hosts = append(hosts, host)
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		if a, b := len(t.held[hosts[i]]), len(t.held[hosts[j]]); a != b {
+			return a > b
+		}
+		return hosts[i] < hosts[j]
+	})
+	return hosts
+}
+
+// askDomainDecision prompts for what to do with the held bookmarks of a
+// host.
+func askDomainDecision(in *bufio.Reader, host string, dead, held int) string {
+	fmt.Printf("\n%s looks gone: %d dead links in this run, none alive.\n", host, dead)
+	fmt.Printf("Replace all %d held %s bookmarks with their closest snapshots? [y]es, [q]ueue for review, [N]o: ", held, host)
+	answer, _ := in.ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return domainReplace
+	case "q", "queue":
+		return domainQueue
+	}
+	return domainKeep
+}
+
+// settleDeadDomains decides on the bookmarks held for hosts that looked
+// gone, once every other file of the run is done.
+func settleDeadDomains(client *http.Client, lock *LockFile, run *RunRecord, opts *runOptions) {
+	hosts := opts.Domains.heldHosts()
+	if len(hosts) == 0 {
+		return
+	}
+	interactive := opts.Trigger == "manual" && isTerminal(os.Stdin)
+	in := bufio.NewReader(os.Stdin)
+	for _, host := range hosts {
+		held := opts.Domains.held[host]
+		decision := opts.DomainDeath.Decision
+		if decision == domainAsk {
+			decision = domainKeep
+			if interactive {
+				decision = askDomainDecision(in, host, opts.Domains.dead[host], len(held))
+			}
+		}
+		run.DeadDomains = append(run.DeadDomains, &DeadDomain{Host: host, Dead: opts.Domains.dead[host], Held: len(held), Decision: decision})
+		if decision == domainKeep {
+			fmt.Printf("\n%s looks gone; %d bookmarks held for the next run\n", host, len(held))
+			continue
+		}
+
+		bulk := *opts
+		bulk.Worker = nil
+		if decision == domainQueue && !opts.Queue {
+			pending, err := loadPendingList(opts.Dir)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "\nError loading %s, %s bookmarks held: %v\n", pendingFileName, host, err)
+				continue
+			}
+			bulk.Queue, bulk.Pending = true, pending
+		}
+		fmt.Printf("\n%s looks gone; %s %d bookmarks\n", host, map[string]string{domainReplace: "replacing", domainQueue: "queueing"}[decision], len(held))
+		for _, h := range held {
+			bulk.Profile = h.profile
+			opts.Shared.Lock()
+			archiveDeadLink(client, lock, h.bookmark, h.target, h.verdict, run, bulk, h.ex)
+			opts.Shared.Unlock()
+		}
+		if bulk.Pending != opts.Pending && !opts.DryRun {
+			if err := bulk.Pending.save(); err != nil {
+				fmt.Fprintf(os.Stderr, "\nError writing %s: %v\n", bulk.Pending.path, err)
+			}
+		}
+	}
+}
+
+// printDeadDomains lists the hosts that looked gone in a run.
+func printDeadDomains(domains []*DeadDomain) {
+	if len(domains) == 0 {
+		return
+	}
+	parts := make([]string, len(domains))
+	for i, d := range domains {
+		parts[i] = fmt.Sprintf("%s (%d dead, %d held, %s)", d.Host, d.Dead, d.Held, d.Decision)
+	}
+	fmt.Printf("Hosts that look gone: %s\n", strings.Join(parts, ", "))
+}
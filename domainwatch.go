@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// crtshAPI is crt.sh's search of the Certificate Transparency logs.
+const crtshAPI = "https://crt.sh/"
+
+// domainWatchPolicy is what `archive_tool watch-domains` watches:
+//
+//	[domain_watch]
+//	hosts = "example.com, blog.example.org"   # default: every host seen gone
+//	every = "6h"
+//	ct = true   # also look for new certificates in the CT logs
+//
+// A domain that comes back usually gets a certificate before anything else,
+// so the CT logs tell a resurrection early; DNS tells it for sure.
+type domainWatchPolicy struct {
+	Hosts []string
+	Every time.Duration
+	CT    bool
+}
+
+var defaultDomainWatchPolicy = domainWatchPolicy{Every: 6 * time.Hour, CT: true}
+
+func (p *domainWatchPolicy) set(key, value string) error {
+	switch key {
+	case "hosts":
+		for _, host := range strings.Split(value, ",") {
+			if host = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(host)), "www."); host != "" {
+				p.Hosts = append(p.Hosts, host)
+			}
+		}
+	case "every":
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid every %q", value)
+		}
+		p.Every = d
+	case "ct":
+		p.CT = value == "true"
+	default:
+		return fmt.Errorf("unknown [domain_watch] key %q", key)
+	}
+	return nil
+}
+
+// DomainWatch is the state of a watched host: since when it is gone, and
+// the signs of life seen since.
+type DomainWatch struct {
+	Host     string    `json:"host"`
+	Since    time.Time `json:"since"`
+	Checked  time.Time `json:"checked,omitempty"`
+	Resolves bool      `json:"resolves,omitempty"`
+	NewCerts int       `json:"new_certs,omitempty"` // issued after Since
+	Revived  time.Time `json:"revived,omitempty"`   // when a link was first restored
+	Restored int       `json:"restored,omitempty"`
+}
+
+// Restoration records a replaced link put back once its page was alive
+// again.
+type Restoration struct {
+	File     string `json:"file"`
+	Archived string `json:"archived"`
+	URL      string `json:"url"`
+}
+
+// goneSince finds the hosts the run history has seen gone, and when they
+// were first: hosts held as dead domains and domains RDAP found dead.
+func (lock *LockFile) goneSince() map[string]time.Time {
+	since := make(map[string]time.Time)
+	note := func(host string, t time.Time) {
+		if first, ok := since[host]; !ok || t.Before(first) {
+			since[host] = t
+		}
+	}
+	for _, run := range lock.Runs {
+		for _, d := range run.DeadDomains {
+			note(d.Host, run.Started)
+		}
+		for _, r := range run.RDAP {
+			if r.dead() {
+				note(r.Host, run.Started)
+			}
+		}
+	}
+	return since
+}
+
+// replacedOn returns the replacements still in effect for links on host,
+// the latest for each file.
+func (lock *LockFile) replacedOn(host string) []*Replacement {
+	byFile := make(map[string]*Replacement)
+	for _, run := range lock.Runs {
+		for _, r := range run.Replacements {
+			if coverageHost(r.Original) == host {
+				byFile[r.File] = r
+			}
+		}
+	}
+	replacements := make([]*Replacement, 0, len(byFile))
+	for _, r := range byFile {
+		replacements = append(replacements, r)
+	}
+	sort.Slice(replacements, func(i, j int) bool { return replacements[i].File < replacements[j].File })
+	return replacements
+}
+
+// watchedDomains brings the watch list of the lock file up to date with the
+// hosts to watch: the configured ones, or every host seen gone.
+func (lock *LockFile) watchedDomains(hosts []string, now time.Time) []*DomainWatch {
+	gone := lock.goneSince()
+	if len(hosts) == 0 {
+		for host := range gone {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+	if lock.Watches == nil {
+		lock.Watches = make(map[string]*DomainWatch)
+	}
+	var watches []*DomainWatch
+	for _, host := range hosts {
+		w := lock.Watches[host]
+		if w == nil {
+			since, ok := gone[host]
+			if !ok {
+				since = now
+			}
+			w = &DomainWatch{Host: host, Since: since}
+			lock.Watches[host] = w
+		}
+		watches = append(watches, w)
+	}
+	return watches
+}
+
+// resolves reports whether a host has an address again, with or without
+// its "www.".
+func resolves(host string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, name := range []string{host, "www." + host} {
+		if addrs, err := net.DefaultResolver.LookupHost(ctx, name); err == nil && len(addrs) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// newCertificates counts the certificates the CT logs have for host issued
+// after since.
+func newCertificates(client *http.Client, host string, since time.Time) (int, error) {
+	q := url.Values{}
+	q.Set("q", host)
+	q.Set("output", "json")
+	endpoint := crtshAPI + "?" + q.Encode()
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("User-Agent", archiveUserAgent)
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, classifyError("ct search", host, err)
+	}
+	defer resp.Body.Close()
+	if err := statusError("ct search", host, resp.StatusCode); err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("ct search %s: status %d", host, resp.StatusCode)
+	}
+
+	var entries []struct {
+		Serial    string `json:"serial_number"`
+		NotBefore string `json:"not_before"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return 0, fmt.Errorf("ct search %s: %w", host, err)
+	}
+	// A precertificate and its certificate are logged with the same serial
+	serials := make(map[string]bool)
+	for _, e := range entries {
+		issued, err := time.Parse("2006-01-02T15:04:05", e.NotBefore)
+		if err == nil && issued.After(since) {
+			serials[e.Serial] = true
+		}
+	}
+	return len(serials), nil
+}
+
+// restoreRevived puts back the original links of a host's replaced
+// bookmarks whose pages are alive again. Bookmarks edited since their
+// replacement are left alone.
+func restoreRevived(client *http.Client, lock *LockFile, w *DomainWatch, run *RunRecord, opts runOptions) {
+	for _, r := range lock.replacedOn(w.Host) {
+		bookmark, err := parseBookmarkFile(r.File)
+		if err != nil || bookmark.Link != r.URL {
+			continue
+		}
+		// The thorough profile reads the page, so a parking page that
+		// answers everything with a 200 does not count as revived
+		verdict, err := opts.diagnoseLink(client, r.Original, runProfiles["thorough"])
+		run.Checked++
+		if err != nil || verdict.Dead {
+			continue
+		}
+
+		if opts.DryRun {
+			fmt.Printf("Would restore %s\n  -> %s\n", relativeTo(opts.Dir, r.File), r.Original)
+			continue
+		}
+		processed := isFileProcessed(lock, r.File)
+		if err := lock.rewriteBookmark(bookmark, r.Original); err != nil {
+			fmt.Fprintf(os.Stderr, "Error updating %s: %v\n", r.File, err)
+			run.recordError(r.File, err)
+			continue
+		}
+		if processed {
+			markFileProcessed(lock, r.File)
+		}
+		run.Restored = append(run.Restored, &Restoration{File: r.File, Archived: r.URL, URL: r.Original})
+		if w.Revived.IsZero() {
+			w.Revived = opts.now()
+		}
+		w.Restored++
+		fmt.Printf("%s Restored: %s\n  -> %s\n", console.mark(), relativeTo(opts.Dir, r.File), r.Original)
+	}
+}
+
+// watchRound checks every watched host once, restoring the bookmarks of
+// those that resolve again.
+func watchRound(client *http.Client, policy domainWatchPolicy, opts runOptions) error {
+	lock, err := loadLockFile(false)
+	if err != nil {
+		return err
+	}
+	now := opts.now()
+	run := &RunRecord{ID: newRunID(now), Trigger: "watch", Status: "completed", Started: now}
+	watches := lock.watchedDomains(policy.Hosts, now)
+	if len(watches) == 0 {
+		fmt.Println("No domains to watch: none has been seen gone, and [domain_watch] names none")
+		return nil
+	}
+
+	for _, w := range watches {
+		if policy.CT {
+			n, err := newCertificates(client, w.Host, w.Since)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error searching the CT logs for %s: %v\n", w.Host, err)
+			} else if n > w.NewCerts {
+				fmt.Printf("%s: %d new certificate(s) since %s\n", w.Host, n, w.Since.Format("2006-01-02"))
+				w.NewCerts = n
+			}
+		}
+		w.Checked = opts.now()
+		if w.Resolves = resolves(w.Host); w.Resolves {
+			restoreRevived(client, lock, w, run, opts)
+		}
+	}
+
+	if opts.DryRun {
+		return nil
+	}
+	run.Finished = opts.now()
+	if len(run.Restored) > 0 || run.Errors > 0 {
+		lock.addRun(run)
+	}
+	return saveLockFile(lock)
+}
+
+// runWatchDomains implements `archive_tool watch-domains`: it watches the
+// hosts that looked gone for signs of life and, once one resolves again,
+// puts back the original links of its bookmarks whose pages are alive.
+func runWatchDomains(args []string) {
+	fs := flag.NewFlagSet("watch-domains", flag.ExitOnError)
+	opts := runOptions{Trigger: "watch", Profile: runProfiles["fast"]}
+	opts.register(fs)
+	var hosts stringList
+	fs.Var(&hosts, "host", "watch `host` instead of the configured ones (repeatable)")
+	every := fs.Duration("every", 0, "check the hosts this `duration` apart (default 6h)")
+	once := fs.Bool("once", false, "check the hosts once and exit")
+	noCT := fs.Bool("no-ct", false, "do not search the Certificate Transparency logs")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "only list the links that would be restored")
+	fs.Parse(args)
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		os.Exit(1)
+	}
+	if err := opts.finish(cfg, fs.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	policy := cfg.DomainWatch
+	if len(hosts) > 0 {
+		policy.Hosts = nil
+		for _, host := range hosts {
+			policy.set("hosts", host)
+		}
+	}
+	if *every > 0 {
+		policy.Every = *every
+	}
+	if *noCT {
+		policy.CT = false
+	}
+
+	ctl := newController()
+	ctl.stopOnSignal()
+	opts.Stop = ctl.stopCh
+	client := opts.httpClient()
+	for {
+		if err := watchRound(client, policy, opts); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if *once {
+			return
+		}
+		select {
+		case <-ctl.stopCh:
+			return
+		case <-time.After(policy.Every):
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// encryptedMagic starts every file encrypted by the tool, followed by the
+// nonce and the AES-256-GCM sealed content.
+const encryptedMagic = "archive_tool-enc-1\n"
+
+// defaultEncryptionSecret is the secret holding the 32-byte key, as base64
+// or hex.
+const defaultEncryptionSecret = "encryption_key"
+
+// loadCipher reads the key from the named secret.
+func loadCipher(secrets *secretStore, name string) (cipher.AEAD, error) {
+	value, err := secrets.get(defaultString(name, defaultEncryptionSecret))
+	if err != nil {
+		return nil, err
+	}
+	value = strings.TrimSpace(value)
+	var key []byte
+	for _, decode := range []func(string) ([]byte, error){
+		hex.DecodeString, base64.StdEncoding.DecodeString, base64.RawStdEncoding.DecodeString, base64.URLEncoding.DecodeString,
+	} {
+		if k, err := decode(value); err == nil && len(k) == 32 {
+			key = k
+			break
+		}
+	}
+	if key == nil {
+		return nil, fmt.Errorf("encryption key must be 32 bytes as base64 or hex (e.g. from `head -c 32 /dev/urandom | base64`)")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func seal(aead cipher.AEAD, plain []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	out := append([]byte(encryptedMagic), nonce...)
+	return aead.Seal(out, nonce, plain, []byte(encryptedMagic)), nil
+}
+
+var errNotEncrypted = errors.New("not encrypted by archive_tool")
+
+func unseal(aead cipher.AEAD, data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(encryptedMagic)) {
+		return nil, errNotEncrypted
+	}
+	data = data[len(encryptedMagic):]
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted content is truncated")
+	}
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(encryptedMagic))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt: wrong key or damaged content")
+	}
+	return plain, nil
+}
+
+// encryptedStore encrypts blobs before they reach the store. Keys stay
+// content hashes, so gc and deduplication work as usual, but that also
+// lets anyone who has a file tell whether it is stored. Encrypted copies
+// cannot be embedded: they are backups, restored with `archive_tool decrypt`.
+type encryptedStore struct {
+	blobStore
+	aead cipher.AEAD
+}
+
+func (s encryptedStore) name() string { return s.blobStore.name() + " (encrypted)" }
+
+func (s encryptedStore) put(key string, data []byte, contentType string) error {
+	sealed, err := seal(s.aead, data)
+	if err != nil {
+		return err
+	}
+	return s.blobStore.put(key, sealed, "application/octet-stream")
+}
+
+func (s encryptedStore) get(key string) ([]byte, error) {
+	data, err := s.blobStore.get(key)
+	if err != nil {
+		return nil, err
+	}
+	return unseal(s.aead, data)
+}
+
+func (s encryptedStore) url(key string) string { return "" }
+
+// isEncrypted reports whether a store's copies are encrypted, and so can be
+// kept but not embedded.
+func isEncrypted(store blobStore) bool {
+	_, ok := store.(encryptedStore)
+	return ok
+}
+
+// runExportState implements `archive_tool export-state`: it writes the state
+// file, encrypted with --encrypt, for backups kept on shared or cloud storage.
+func runExportState(args []string) {
+	fs := flag.NewFlagSet("export-state", flag.ExitOnError)
+	output := fs.String("output", "", "write to this `file` instead of stdout")
+	encrypt := fs.Bool("encrypt", false, "encrypt with the encryption_key secret")
+	fs.Parse(args)
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		os.Exit(1)
+	}
+	lock, err := loadLockFile(false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading lock file: %v\n", err)
+		os.Exit(1)
+	}
+	data, err := encodeLockFile(lock, getLockFilePath())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error encoding state: %v\n", err)
+		os.Exit(1)
+	}
+	if *encrypt || cfg.EncryptExports {
+		aead, err := loadCipher(&cfg.Secrets, "")
+		if err == nil {
+			data, err = seal(aead, data)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error encrypting state: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *output == "" {
+		os.Stdout.Write(data)
+		return
+	}
+	if err := writeFileAtomic(*output, data, 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing %s: %v\n", *output, err)
+		os.Exit(1)
+	}
+}
+
+// runDecrypt implements `archive_tool decrypt`: it restores a file the tool
+// encrypted, an exported state file or a blob from an encrypted store.
+func runDecrypt(args []string) {
+	fs := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	output := fs.String("output", "", "write to this `file` instead of stdout")
+	secret := fs.String("key", defaultEncryptionSecret, "name of the `secret` holding the key")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: archive_tool decrypt [--output file] [--key secret] <file>")
+		os.Exit(2)
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		os.Exit(1)
+	}
+	aead, err := loadCipher(&cfg.Secrets, *secret)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	data, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	plain, err := unseal(aead, data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s: %v\n", fs.Arg(0), err)
+		os.Exit(1)
+	}
+
+	if *output == "" {
+		os.Stdout.Write(plain)
+		return
+	}
+	if err := writeFileAtomic(*output, plain, 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing %s: %v\n", *output, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strings"
+	"syscall"
+)
+
+// Failure kinds. Errors from checking links and looking up archives wrap one
+// of these, so callers can branch with errors.Is.
+var (
+	ErrDNS         = errors.New("dns lookup failed")
+	ErrTimeout     = errors.New("timed out")
+	ErrRefused     = errors.New("connection refused")
+	ErrTLS         = errors.New("tls handshake failed")
+	ErrBlocked     = errors.New("blocked by server")
+	ErrRateLimited = errors.New("rate limited")
+	ErrServer      = errors.New("server error")
+	ErrNoSnapshot  = errors.New("no snapshot available")
+	ErrSensitive   = errors.New("sensitive, not sent to archive services")
+	ErrCapturing   = errors.New("capture in progress")
+
+	// Redirect chains that never end
+	ErrRedirectLoop = errors.New("redirect loop")
+	ErrCrawlTrap    = errors.New("crawl trap: redirects to the same page with a new query")
+	ErrCookieGate   = errors.New("cookie gate: redirects until a cookie is sent back")
+
+	// A bug: processing a file panicked
+	ErrPanic = errors.New("panicked")
+)
+
+// errorKinds maps each failure kind to its report category.
+var errorKinds = []struct {
+	err  error
+	name string
+}{
+	{ErrDNS, "dns"},
+	{ErrTimeout, "timeout"},
+	{ErrRefused, "refused"},
+	{ErrTLS, "tls"},
+	{ErrBlocked, "blocked"},
+	{ErrRateLimited, "rate_limited"},
+	{ErrServer, "server"},
+	{ErrNoSnapshot, "no_snapshot"},
+	{ErrSensitive, "sensitive"},
+	{ErrCapturing, "capturing"},
+	{ErrRedirectLoop, "redirect_loop"},
+	{ErrCrawlTrap, "crawl_trap"},
+	{ErrCookieGate, "cookie_gate"},
+	{ErrPanic, "panic"},
+}
+
+// PanicRecord is a file whose processing panicked, with the stack, for a bug
+// report.
+type PanicRecord struct {
+	File  string `json:"file"`
+	Error string `json:"error"`
+	Stack string `json:"stack"`
+}
+
+// maxPanicStack caps the stack a PanicRecord keeps in the state file; the
+// whole stack goes to stderr.
+const maxPanicStack = 8 * 1024
+
+// PanicError is a recovered panic, with the stack it happened on.
+type PanicError struct {
+	Value interface{}
+	Stack string
+}
+
+func (e *PanicError) Error() string { return fmt.Sprintf("%v: %v", ErrPanic, e.Value) }
+
+func (e *PanicError) Unwrap() error { return ErrPanic }
+
+// recovered makes a PanicError of v, a value returned by recover while doing
+// what, and prints it with its trace to stderr.
+func recovered(what string, v interface{}) *PanicError {
+	err := &PanicError{Value: v, Stack: string(debug.Stack())}
+	fmt.Fprintf(os.Stderr, "\nError %s: %v; this is a bug, please report it with this trace:\n%s\n", what, err, err.Stack)
+	return err
+}
+
+// recoverFile, deferred while processing a file, turns a panic into an error
+// of that file, so one malformed bookmark or parser bug does not abort the
+// run: the file is left unprocessed, and the run goes on with the others.
+func (run *RunRecord) recoverFile(file string) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	err := recovered("processing "+file, v)
+	run.recordError(file, err)
+	stack := err.Stack
+	if len(stack) > maxPanicStack {
+		stack = stack[:maxPanicStack] + "\n..."
+	}
+	run.Panics = append(run.Panics, &PanicRecord{File: file, Error: err.Error(), Stack: stack})
+}
+
+// LinkError describes a failed operation on a URL. Kind is one of the Err*
+// values, or nil if the failure could not be classified.
+type LinkError struct {
+	Op   string
+	URL  string
+	Kind error
+	Err  error
+}
+
+func (e *LinkError) Error() string {
+	msg := e.Op + " " + e.URL
+	if e.Kind != nil {
+		msg += ": " + e.Kind.Error()
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *LinkError) Unwrap() []error {
+	var errs []error
+	if e.Kind != nil {
+		errs = append(errs, e.Kind)
+	}
+	if e.Err != nil {
+		errs = append(errs, e.Err)
+	}
+	return errs
+}
+
+// classifyError wraps a transport error from client.Do in a LinkError with
+// its failure kind.
+func classifyError(op, urlStr string, err error) error {
+	return &LinkError{Op: op, URL: urlStr, Kind: transportKind(err), Err: err}
+}
+
+func transportKind(err error) error {
+	var dnsErr *net.DNSError
+	var certErr *tls.CertificateVerificationError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var netErr net.Error
+
+	switch {
+	case errors.As(err, &dnsErr):
+		return ErrDNS
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return ErrTimeout
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ErrTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrRefused
+	case errors.As(err, &certErr), errors.As(err, &unknownAuthority), errors.As(err, &hostnameErr):
+		return ErrTLS
+	case strings.Contains(err.Error(), "tls: "):
+		return ErrTLS
+	}
+	return nil
+}
+
+// statusError returns a LinkError for HTTP statuses that mean the request was
+// refused rather than answered, or nil.
+func statusError(op, urlStr string, status int) error {
+	var kind error
+	switch {
+	case status == http.StatusTooManyRequests:
+		kind = ErrRateLimited
+	case status == http.StatusForbidden, status == http.StatusUnavailableForLegalReasons:
+		kind = ErrBlocked
+	case status >= 500:
+		kind = ErrServer
+	default:
+		return nil
+	}
+	return &LinkError{Op: op, URL: urlStr, Kind: kind, Err: fmt.Errorf("status %d", status)}
+}
+
+// errorKind returns the report category of err, "other" if it has none.
+func errorKind(err error) string {
+	for _, kind := range errorKinds {
+		if errors.Is(err, kind.err) {
+			return kind.name
+		}
+	}
+	return "other"
+}
+
+// providerErrors collects the errors of every archive provider in a lookup.
+type providerErrors []error
+
+func (e providerErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e providerErrors) Unwrap() []error {
+	return e
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// eventWriteTimeout bounds how long a reader of a FIFO may keep the run
+// waiting on one event; the event is dropped after.
+const eventWriteTimeout = 5 * time.Second
+
+// eventBacklog is how many events a subscriber of the daemon's event stream
+// may fall behind by before it misses some.
+const eventBacklog = 256
+
+// eventKeepAlive is how often an idle event stream sends a comment, so
+// proxies do not close it between runs.
+const eventKeepAlive = 30 * time.Second
+
+// event is one line of the --event-log stream. Every event has Event, Time
+// and, within a run, Run; the rest are set as they apply:
+//
+//	run_started   Trigger, Dir
+//	check         File, URL, Scope, Result (alive, dead), Status, Method, Reason
+//	classified    File, URL, Result (flaky, failing, dead)
+//	replaced      File, URL, Scope, Archived, Provider, DryRun
+//	queued        File, URL, Scope, Archived, Provider
+//	error         URL, Kind, Error
+//	run_finished  Result (completed, stopped), Checked, Replaced, Errors
+//
+// Scope is what was checked: the bookmark's link, an embedded asset or a
+// link in the body. Counts and flags that are left out are zero. Fields are
+// only ever added, so consumers should ignore the ones they do not know.
+type event struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	Run   string    `json:"run,omitempty"`
+
+	File     string `json:"file,omitempty"`
+	URL      string `json:"url,omitempty"`
+	Scope    string `json:"scope,omitempty"` // link, asset or body_link
+	Result   string `json:"result,omitempty"`
+	Status   int    `json:"status,omitempty"`
+	Method   string `json:"method,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	Archived string `json:"archived,omitempty"`
+	Provider string `json:"provider,omitempty"`
+	DryRun   bool   `json:"dry_run,omitempty"`
+
+	Kind  string `json:"kind,omitempty"`
+	Error string `json:"error,omitempty"`
+
+	Trigger  string `json:"trigger,omitempty"`
+	Dir      string `json:"dir,omitempty"`
+	Checked  int    `json:"checked,omitempty"`
+	Replaced int    `json:"replaced,omitempty"`
+	Errors   int    `json:"errors,omitempty"`
+}
+
+// eventLog appends events to a file or FIFO as JSON lines, and hands them
+// to the subscribers of the daemon's event stream. Each event is written with
+// one write, so readers see whole lines. A FIFO is opened without waiting for
+// a reader: events are dropped while nobody reads, and the stream resumes for
+// a reader that comes back.
+type eventLog struct {
+	mu     sync.Mutex
+	path   string
+	clock  Clock
+	file   *os.File
+	warned bool
+
+	subscribers map[chan []byte]bool
+}
+
+// events is the --event-log stream of the current command; nil, and a no-op,
+// without one.
+var events *eventLog
+
+func newEventLog(path string, clock Clock) *eventLog {
+	if path == "" {
+		return nil
+	}
+	return &eventLog{path: path, clock: clock}
+}
+
+// emit appends an event to the stream. The stream never fails a run: an
+// event that cannot be written is dropped, with a warning the first time.
+func (l *eventLog) emit(e event) {
+	if l == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		clock := l.clock
+		if clock == nil {
+			clock = systemClock{}
+		}
+		e.Time = clock.Now()
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for ch := range l.subscribers {
+		// A subscriber that falls behind misses events rather than holding
+		// up the run
+		select {
+		case ch <- data:
+		default:
+		}
+	}
+	if l.path == "" {
+		return
+	}
+	if l.file == nil {
+		// Without O_NONBLOCK, opening a FIFO waits for a reader
+		l.file, err = os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND|syscall.O_NONBLOCK, 0644)
+		if errors.Is(err, syscall.ENXIO) {
+			l.file = nil
+			return
+		}
+		if err != nil {
+			l.file = nil
+			l.warn(err)
+			return
+		}
+	}
+	// Files have no deadlines; FIFOs do
+	l.file.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		// A FIFO whose reader went away is opened again for the next event
+		l.file.Close()
+		l.file = nil
+		if !errors.Is(err, syscall.EPIPE) {
+			l.warn(err)
+		}
+		return
+	}
+	l.warned = false
+}
+
+// subscribe returns a channel that receives every event from now on, as
+// JSON, until cancel is called.
+func (l *eventLog) subscribe() (<-chan []byte, func()) {
+	ch := make(chan []byte, eventBacklog)
+	l.mu.Lock()
+	if l.subscribers == nil {
+		l.subscribers = make(map[chan []byte]bool)
+	}
+	l.subscribers[ch] = true
+	l.mu.Unlock()
+	return ch, func() {
+		l.mu.Lock()
+		delete(l.subscribers, ch)
+		l.mu.Unlock()
+	}
+}
+
+func (l *eventLog) warn(err error) {
+	if !l.warned {
+		fmt.Fprintf(os.Stderr, "\nWarning: writing to the event log: %v\n", err)
+		l.warned = true
+	}
+}
+
+// checkEvent is the event for a check of link in file, as scope.
+func checkEvent(run *RunRecord, file, link, scope string, verdict linkVerdict) event {
+	result := "alive"
+	if verdict.Dead {
+		result = "dead"
+	}
+	return event{Event: "check", Run: run.ID, File: file, URL: link, Scope: scope, Result: result,
+		Status: verdict.Status, Method: verdict.Method, Reason: verdict.Reason}
+}
+
+// serveEvents streams the events of the process to an HTTP client as
+// server-sent events, until it disconnects or the daemon stops. Each event is
+// named after its kind, with the same JSON object --event-log writes as its
+// data.
+func serveEvents(l *eventLog, stop <-chan struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+		ch, cancel := l.subscribe()
+		defer cancel()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, ": archive_tool events\n\n")
+		flusher.Flush()
+
+		keepAlive := time.NewTicker(eventKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case data := <-ch:
+				var e struct {
+					Event string `json:"event"`
+				}
+				json.Unmarshal(data, &e)
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Event, data)
+			case <-keepAlive.C:
+				fmt.Fprint(w, ": keep-alive\n\n")
+			case <-r.Context().Done():
+				return
+			case <-stop:
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// listenEvents serves the daemon's event stream at /events on addr.
+func listenEvents(addr string, l *eventLog, stop <-chan struct{}) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", serveEvents(l, stop))
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go srv.Serve(listener)
+	return srv, nil
+}
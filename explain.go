@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// explainer prints the reasoning behind each decision the pipeline makes for
+// a bookmark. A nil explainer prints nothing, so call sites need no checks.
+type explainer struct {
+	file    string
+	started bool
+}
+
+// explainerFor returns an explainer if --explain is on for every file or
+// --explain-file names this one, and nil otherwise.
+func (opts *runOptions) explainerFor(filePath string) *explainer {
+	if opts.Explain {
+		return &explainer{file: filePath}
+	}
+	for _, want := range opts.ExplainFiles {
+		if sameFile(want, filePath) {
+			return &explainer{file: filePath}
+		}
+	}
+	return nil
+}
+
+func sameFile(a, b string) bool {
+	if a == b {
+		return true
+	}
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA == absB
+}
+
+func (e *explainer) logf(format string, args ...interface{}) {
+	if e == nil {
+		return
+	}
+	if !e.started {
+		// Move off the in-place progress line
+		fmt.Println()
+		e.started = true
+	}
+	fmt.Printf("  [explain %s] %s\n", filepath.Base(e.file), fmt.Sprintf(format, args...))
+}
+
+// history explains the flaky/failing/dead verdict from the recorded checks.
+func (e *explainer) history(history []StatusEntry, policy flakyPolicy, verdict string) {
+	if e == nil {
+		return
+	}
+	window := history
+	if policy.Window > 0 && len(window) > policy.Window {
+		window = window[len(window)-policy.Window:]
+	}
+	alive := 0
+	for _, entry := range window {
+		if !entry.Dead {
+			alive++
+		}
+	}
+	trailing := 0
+	for i := len(history) - 1; i >= 0 && history[i].Dead; i-- {
+		trailing++
+	}
+	e.logf("history: %d checks, statuses seen %v; %d alive in the last %d (flaky at %d), %d dead in a row (dead after %d) -> %s",
+		len(history), distinctStatuses(history), alive, len(window), policy.MinAlive, trailing, policy.DeadAfter, verdict)
+}
+
+// candidates lists every candidate's score terms and why the winner won.
+func (e *explainer) candidates(candidates []*snapshotCandidate, chosen *snapshotCandidate, bookmark *BookmarkFile, providerCount int) {
+	if e == nil {
+		return
+	}
+	if len(candidates) == 1 && chosen.Status == 0 {
+		e.logf("one candidate, used without fetching it: %s (%s)", chosen.URL, chosen.Provider)
+		return
+	}
+	target := parseDate(bookmark.Date)
+	for _, c := range candidates {
+		var terms []string
+		for _, part := range scoreParts(c, target, providerCount) {
+			terms = append(terms, fmt.Sprintf("%s %+.2f", part.name, part.value))
+		}
+		if len(terms) == 0 {
+			terms = append(terms, "could not be fetched")
+		}
+		mark := "candidate"
+		if c == chosen {
+			mark = "chosen   "
+		}
+		e.logf("%s %s %s (%s): %.2f = %s", mark, c.ID, c.URL, c.Provider, c.Score, strings.Join(terms, ", "))
+	}
+	e.logf("chose %s: highest score of %d candidates", chosen.ID, len(candidates))
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const waybackTimestamp = "20060102150405"
+
+// fakeArchive is an in-process stand-in for the Wayback Machine (replay,
+// availability, CDX and Save Page Now endpoints) and a few target sites, used
+// by TestPipeline. Requests reach it through fakeTransport, which keeps the
+// original Host header so one server can play every site.
+type fakeArchive struct {
+	server *httptest.Server
+	clock  Clock
+
+	mu        sync.Mutex
+	snapshots map[string][]time.Time // original URL -> capture times, sorted
+	limited   map[string]bool        // original URLs whose lookups get a 429
+	redirects map[string]string      // original URL -> target its captures redirect to
+	saves     []string
+}
+
+// newFakeArchive starts the fake archive's server, which is closed when the
+// test ends.
+func newFakeArchive(t testing.TB, clock Clock) *fakeArchive {
+	f := &fakeArchive{
+		clock:     clock,
+		snapshots: make(map[string][]time.Time),
+		limited:   make(map[string]bool),
+		redirects: make(map[string]string),
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+// addSnapshot records a capture of link at the given time (YYYYMMDDhhmmss).
+func (f *fakeArchive) addSnapshot(t testing.TB, link, timestamp string) {
+	t.Helper()
+	at, err := time.Parse(waybackTimestamp, timestamp)
+	if err != nil {
+		t.Fatalf("snapshot of %s: %v", link, err)
+	}
+	f.addCapture(link, at)
+}
+
+func (f *fakeArchive) addCapture(link string, at time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.snapshots[link] = append(f.snapshots[link], at)
+	sort.Slice(f.snapshots[link], func(i, j int) bool { return f.snapshots[link][i].Before(f.snapshots[link][j]) })
+}
+
+// addRedirectCapture records a capture of link that is a redirect to target,
+// as for a short link archived while its shortener still worked.
+func (f *fakeArchive) addRedirectCapture(t testing.TB, link, timestamp, target string) {
+	t.Helper()
+	f.addSnapshot(t, link, timestamp)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.redirects[link] = target
+}
+
+func (f *fakeArchive) rateLimit(link string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.limited[link] = true
+}
+
+// closest returns the capture of link nearest to t.
+func (f *fakeArchive) closest(link string, t time.Time) (time.Time, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var best time.Time
+	found := false
+	for _, capture := range f.snapshots[link] {
+		if !found || absDuration(capture.Sub(t)) < absDuration(best.Sub(t)) {
+			best, found = capture, true
+		}
+	}
+	return best, found
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+func (f *fakeArchive) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Host == "web.archive.org" || r.Host == "archive.org" {
+		f.serveArchive(w, r)
+		return
+	}
+	serveFakeSite(w, r)
+}
+
+// serveFakeSite plays the target sites. The host name says how it behaves.
+func serveFakeSite(w http.ResponseWriter, r *http.Request) {
+	switch r.Host {
+	case "alive.test":
+		fmt.Fprintf(w, "<html><head><title>Alive</title></head><body>Still here: %s</body></html>", r.URL.Path)
+	case "img.test":
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("\x89PNG\r\n\x1a\n"))
+	case "gone.test":
+		http.Error(w, "gone", http.StatusGone)
+	case "soft404.test":
+		fmt.Fprint(w, "<html><head><title>Page Not Found</title></head><body>Sorry.</body></html>")
+	case "moved.test":
+		http.Redirect(w, r, "http://dead.test"+r.URL.Path, http.StatusMovedPermanently)
+	case "short.test":
+		// A URL shortener: /to/<host>/<path> forwards to http://<host>/<path>
+		http.Redirect(w, r, "http://"+strings.TrimPrefix(r.URL.Path, "/to/"), http.StatusMovedPermanently)
+	case "rehomed.test":
+		// A domain that now forwards everything to an unrelated live site
+		http.Redirect(w, r, "http://alive.test/", http.StatusMovedPermanently)
+	case "loop.test":
+		// Two pages sending the client back and forth
+		next := "/a"
+		if r.URL.Path == "/a" {
+			next = "/b"
+		}
+		http.Redirect(w, r, next, http.StatusFound)
+	case "cookiegate.test":
+		// Lets a client in only once it sends back the cookie it was given
+		if _, err := r.Cookie("consent"); err == nil {
+			fmt.Fprint(w, "<html><head><title>Welcome</title></head><body>In.</body></html>")
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: "consent", Value: "1"})
+		http.Redirect(w, r, r.URL.Path+"?gate="+strconv.Itoa(len(r.URL.RawQuery)), http.StatusFound)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeArchive) serveArchive(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/web/"):
+		f.serveReplay(w, r)
+	case r.URL.Path == "/wayback/available":
+		f.serveAvailability(w, r)
+	case r.URL.Path == "/cdx/search/cdx":
+		f.serveCDX(w, r)
+	case strings.HasPrefix(r.URL.Path, "/save/"):
+		f.serveSave(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveReplay answers /web/<timestamp>/<url> by redirecting to the closest
+// capture, like the real replay service.
+func (f *fakeArchive) serveReplay(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.RequestURI(), "/web/")
+	timestamp, link, ok := strings.Cut(rest, "/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	// Split off replay flags such as id_
+	flags := strings.TrimLeft(timestamp, "0123456789")
+	timestamp = strings.TrimSuffix(timestamp, flags)
+
+	f.mu.Lock()
+	limited := f.limited[link]
+	target, isRedirect := f.redirects[link]
+	f.mu.Unlock()
+	if limited {
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+		return
+	}
+
+	want := f.clock.Now()
+	if timestamp != "*" {
+		padded := (timestamp + "00000000000000")[:14]
+		t, err := time.Parse(waybackTimestamp, padded)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		want = t
+	}
+
+	capture, found := f.closest(link, want)
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	if capture.Format(waybackTimestamp) != timestamp {
+		http.Redirect(w, r, fmt.Sprintf("%s/%s%s/%s", waybackAPI, capture.Format(waybackTimestamp), flags, link), http.StatusFound)
+		return
+	}
+	if isRedirect {
+		// The captured redirect, with its target rewritten into the archive
+		w.Header().Set("Location", fmt.Sprintf("%s/%s%s/%s", waybackAPI, timestamp, flags, target))
+		w.WriteHeader(http.StatusMovedPermanently)
+		return
+	}
+	fmt.Fprintf(w, "<html><head><title>Archived %s</title></head><body>Archived copy of %s from %s.</body></html>",
+		link, link, capture.Format("2006-01-02"))
+}
+
+func (f *fakeArchive) serveAvailability(w http.ResponseWriter, r *http.Request) {
+	link := r.URL.Query().Get("url")
+	f.mu.Lock()
+	limited := f.limited[link]
+	_, isRedirect := f.redirects[link]
+	f.mu.Unlock()
+	if limited {
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+		return
+	}
+	want := f.clock.Now()
+	if ts := r.URL.Query().Get("timestamp"); ts != "" {
+		if t, err := time.Parse(waybackTimestamp, (ts + "00000000000000")[:14]); err == nil {
+			want = t
+		}
+	}
+
+	snapshots := map[string]interface{}{}
+	if capture, found := f.closest(link, want); found {
+		ts := capture.Format(waybackTimestamp)
+		snapshots["closest"] = map[string]interface{}{
+			"available": true,
+			"url":       fmt.Sprintf("http://web.archive.org/web/%s/%s", ts, link),
+			"timestamp": ts,
+			"status":    map[bool]string{false: "200", true: "301"}[isRedirect],
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"url": link, "archived_snapshots": snapshots})
+}
+
+// serveCDX answers in the JSON output format: a header row, then one row per
+// capture.
+func (f *fakeArchive) serveCDX(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	link := q.Get("url")
+	fields := []string{"urlkey", "timestamp", "original", "mimetype", "statuscode", "digest", "length"}
+	if fl := q.Get("fl"); fl != "" {
+		fields = strings.Split(fl, ",")
+	}
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	// Each filter is field:regexp, matched against the whole field
+	filters := make(map[string]*regexp.Regexp)
+	for _, filter := range q["filter"] {
+		if field, expr, ok := strings.Cut(filter, ":"); ok {
+			if re, err := regexp.Compile("^(?:" + expr + ")$"); err == nil {
+				filters[field] = re
+			}
+		}
+	}
+
+	f.mu.Lock()
+	if f.limited[link] {
+		f.mu.Unlock()
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+		return
+	}
+	var originals []string
+	if q.Get("matchType") == "host" {
+		for original := range f.snapshots {
+			if coverageHost(original) == coverageHost("http://"+link) {
+				originals = append(originals, original)
+			}
+		}
+		sort.Strings(originals)
+	} else {
+		originals = []string{link}
+	}
+	rows := [][]string{fields}
+	for _, original := range originals {
+		for _, capture := range f.snapshots[original] {
+			if limit > 0 && len(rows)-1 >= limit {
+				break
+			}
+			status := "200"
+			if _, ok := f.redirects[original]; ok {
+				status = "301"
+			}
+			record := map[string]string{
+				"urlkey": original, "timestamp": capture.Format(waybackTimestamp), "original": original,
+				"mimetype": "text/html", "statuscode": status, "digest": "FAKEDIGEST", "length": "1024",
+			}
+			if !matchesFilters(record, filters) {
+				continue
+			}
+			row := make([]string, len(fields))
+			for i, field := range fields {
+				row[i] = record[field]
+			}
+			rows = append(rows, row)
+			if q.Get("collapse") == "urlkey" {
+				break
+			}
+		}
+	}
+	f.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rows)
+}
+
+func matchesFilters(record map[string]string, filters map[string]*regexp.Regexp) bool {
+	for field, re := range filters {
+		if !re.MatchString(record[field]) {
+			return false
+		}
+	}
+	return true
+}
+
+// serveSave captures the URL at the current clock time.
+func (f *fakeArchive) serveSave(w http.ResponseWriter, r *http.Request) {
+	link := strings.TrimPrefix(r.URL.RequestURI(), "/save/")
+	if link == "" {
+		link = r.FormValue("url")
+	}
+	now := f.clock.Now().UTC()
+	ts := now.Format(waybackTimestamp)
+	f.addCapture(link, now.Truncate(time.Second))
+	f.mu.Lock()
+	f.saves = append(f.saves, link)
+	f.mu.Unlock()
+	w.Header().Set("Content-Location", "/web/"+ts+"/"+link)
+	fmt.Fprintf(w, `{"url": %q, "job_id": "fake-%s", "timestamp": %q}`, link, ts, ts)
+}
+
+// fakeTransport sends every request to the fake archive's server. Hosts
+// ending in .invalid fail with a DNS error instead.
+type fakeTransport struct {
+	target *url.URL
+}
+
+func (t fakeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if strings.HasSuffix(req.URL.Hostname(), ".invalid") {
+		return nil, &net.DNSError{Err: "no such host", Name: req.URL.Hostname(), IsNotFound: true}
+	}
+
+	out := req.Clone(req.Context())
+	out.URL.Scheme = t.target.Scheme
+	out.URL.Host = t.target.Host
+	out.Host = req.URL.Host
+
+	resp, err := http.DefaultTransport.RoundTrip(out)
+	if resp != nil {
+		resp.Request = req
+	}
+	return resp, err
+}
+
+func (f *fakeArchive) transport() http.RoundTripper {
+	target, _ := url.Parse(f.server.URL)
+	return fakeTransport{target: target}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// versionField is the frontmatter field, and the state file key, that
+// records the format a file was last written in.
+const versionField = "archive_tool_version"
+
+// formatVersion is the version of the formats this build writes: the fields
+// it adds to bookmarks, the state file and the pending checklist. Files
+// without a version are in format 1, as files were before versions.
+const formatVersion = 2
+
+// formatMigration upgrades a bookmark to the format To from the one before.
+// Every new format adds one. A bookmark is taken through each it is behind
+// on, in order, so a collection last written by any version upgrades in one
+// pass.
+type formatMigration struct {
+	To    int
+	About string
+
+	// Apply rewrites the bookmark's content; nil when the new format only
+	// adds to the old one
+	Apply func(data []byte) ([]byte, error)
+}
+
+var formatMigrations = []formatMigration{
+	{To: 2, About: "stamped with its format version"},
+}
+
+// newerFormatError is a file written by a newer archive_tool, in a format
+// this one may not know all of. It is left alone rather than half-upgraded.
+type newerFormatError struct {
+	Version int
+}
+
+func (e newerFormatError) Error() string {
+	return fmt.Sprintf("written in format %d by a newer archive_tool (this one writes format %d); upgrade archive_tool", e.Version, formatVersion)
+}
+
+// parseFormatVersion reads a version stamp.
+func parseFormatVersion(value string) (int, error) {
+	v, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || v < 1 {
+		return 0, fmt.Errorf("invalid %s %q", versionField, value)
+	}
+	return v, nil
+}
+
+// checkFormat reports whether this build may rewrite the bookmark: not when
+// a newer one wrote it, or when its stamp cannot be read.
+func (b *BookmarkFile) checkFormat() error {
+	line, ok := b.Headers[versionField]
+	if !ok {
+		return nil
+	}
+	v, err := parseFormatVersion(extractYAMLValue(line))
+	if err != nil {
+		return err
+	}
+	if v > formatVersion {
+		return newerFormatError{v}
+	}
+	return nil
+}
+
+// upgradeFormat takes bookmark content through the migrations its format is
+// behind on, and stamps it with this build's version. It returns what the
+// upgrade changed, nothing for content that is up to date or has no
+// frontmatter to stamp.
+func upgradeFormat(data []byte) ([]byte, []string, error) {
+	lines := strings.Split(string(data), "\n")
+	start, end, ok := frontmatterBounds(lines)
+	if !ok {
+		return data, nil, nil
+	}
+	version := 1
+	for _, line := range lines[start+1 : end] {
+		if strings.HasPrefix(line, versionField+":") {
+			v, err := parseFormatVersion(extractYAMLValue(strings.TrimSuffix(line, "\r")))
+			if err != nil {
+				return nil, nil, err
+			}
+			version = v
+		}
+	}
+	switch {
+	case version > formatVersion:
+		return nil, nil, newerFormatError{version}
+	case version == formatVersion:
+		return data, nil, nil
+	}
+
+	var changes []string
+	for _, m := range formatMigrations {
+		if m.To <= version {
+			continue
+		}
+		if m.Apply != nil {
+			var err error
+			if data, err = m.Apply(data); err != nil {
+				return nil, nil, fmt.Errorf("upgrading to format %d: %v", m.To, err)
+			}
+		}
+		changes = append(changes, fmt.Sprintf("upgraded to format %d (%s)", m.To, m.About))
+	}
+	return setFrontmatterField(data, versionField, strconv.Itoa(formatVersion)), changes, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fuzzBookmarks seed the bookmark fuzz targets: the pipeline's golden files
+// and frontmatter as odd as exports write it.
+func fuzzBookmarks(f *testing.F) []string {
+	seeds := []string{
+		"",
+		"---\n---\n",
+		"---\nlink: http://example.com/\n",
+		"---\ntitle: a: b: c\nlink: http://example.com/a\ndate: 2020-01-01\n---\nBody\n",
+		"\ufeff---\r\ntitle: \"CRLF \\\"quoted\\\"\"\r\nlink: 'http://example.com/it''s'\r\n---\r\n",
+		"---\nlink: \"http://example.com/?q=\\u00e9#frag\" # comment\ntags:\n  - one\n  - \"two\"\n---\n",
+		"---\nlink:    <http://example.com/bracketed>   \ntags: [a, 'b c', \"d\"]\n---\nlink: http://body.example/\n",
+		"---\nlink:\nlink: http://example.com/second\n---\n",
+		"\n\n---\nlink: example.com/no-scheme\narchive_tool_provenance:\n  link: http://old.example/\n---\n---\n",
+		"---\ntitle: \"unterminated\nlink: \"http://example.com/\n---\n",
+		"---\nlink: http://example.com/ #not a comment#\n---\n",
+		"---\ntitle: ☃ «☂» \x00\x7f\nlink: http://bücher.example/straße\n---\n",
+	}
+	if goldens, err := filepath.Glob(filepath.Join("testdata", "pipeline", "*.golden")); err == nil {
+		for _, golden := range goldens {
+			if data, err := os.ReadFile(golden); err == nil {
+				seeds = append(seeds, string(data))
+			}
+		}
+	}
+	return seeds
+}
+
+// parseFuzzBookmark parses content as a bookmark file.
+func parseFuzzBookmark(t *testing.T, dir, content string) *BookmarkFile {
+	t.Helper()
+	path := filepath.Join(dir, "bookmark.md")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	bookmark, err := parseBookmarkFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bookmark
+}
+
+func FuzzParseBookmarkFile(f *testing.F) {
+	for _, seed := range fuzzBookmarks(f) {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, content string) {
+		bookmark := parseFuzzBookmark(t, t.TempDir(), content)
+		if strings.ContainsAny(bookmark.Link, "\r\n\t") {
+			t.Errorf("link %q keeps line breaks or tabs", bookmark.Link)
+		}
+		if bookmark.Link != strings.TrimSpace(bookmark.Link) {
+			t.Errorf("link %q keeps surrounding space", bookmark.Link)
+		}
+	})
+}
+
+func FuzzExtractYAMLValue(f *testing.F) {
+	for _, seed := range []string{
+		"link: http://example.com/",
+		"link: \"http://example.com/\\\"q\\\"\" # comment",
+		"link: 'it''s' # comment",
+		"link: plain # comment",
+		"link: plain#not-a-comment",
+		"link: \"unterminated",
+		"link: '",
+		"link:",
+		"no colon",
+		"tags: [a, b]",
+		"key: \"\\u00e9\\x41\\t\\\\\"",
+		"key:\t\tvalue\t \r",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, line string) {
+		start, end, value := splitYAMLLine(line)
+		if start == -1 {
+			return
+		}
+		if start < 0 || end < start || end > len(line) {
+			t.Fatalf("value range %d:%d out of line %q", start, end, line)
+		}
+		if got := extractYAMLValue(line); got != value {
+			t.Errorf("extractYAMLValue(%q) = %q, splitYAMLLine decodes %q", line, got, value)
+		}
+
+		// Whatever a value is, writing it in any of the quoting styles and
+		// reading it back gives it again
+		if strings.ContainsAny(value, "\r\n") {
+			return
+		}
+		for _, raw := range []string{"", `""`, "''"} {
+			written := "key: " + quoteYAMLLike(raw, value)
+			if got := extractYAMLValue(written); got != value {
+				t.Errorf("value %q written as %q reads back as %q", value, written, got)
+			}
+		}
+	})
+}
+
+func FuzzRewriteBookmarkContent(f *testing.F) {
+	links := []string{
+		"https://web.archive.org/web/20200101000000/http://example.com/",
+		"http://example.com/it's \"quoted\"",
+		"http://example.com/#fragment # with a hash",
+		"https://example.com/\\path\\",
+	}
+	for i, seed := range fuzzBookmarks(f) {
+		f.Add(seed, links[i%len(links)])
+	}
+	f.Fuzz(func(t *testing.T, content, newURL string) {
+		dir := t.TempDir()
+		bookmark := parseFuzzBookmark(t, dir, content)
+		if bookmark.Link == "" || newURL == "" || tidyLink(newURL) != newURL {
+			return
+		}
+		rewritten, err := rewriteBookmarkContent(bookmark, []byte(content), newURL)
+		if err != nil {
+			t.Fatalf("rewriting the link just read: %v\n%s", err, content)
+		}
+
+		reparsed := parseFuzzBookmark(t, dir, string(rewritten))
+		if reparsed.Link != newURL {
+			t.Fatalf("rewritten to %q, the link reads back as %q\n--- before\n%s\n--- after\n%s", newURL, reparsed.Link, content, rewritten)
+		}
+		if reparsed.Date != bookmark.Date || !reflect.DeepEqual(reparsed.Tags, bookmark.Tags) || reparsed.Content != bookmark.Content {
+			t.Fatalf("rewriting the link changed more than the link\n--- before\n%s\n--- after\n%s", content, rewritten)
+		}
+
+		// Only the link line changes
+		before, after := strings.Split(content, "\n"), strings.Split(string(rewritten), "\n")
+		if len(before) != len(after) {
+			t.Fatalf("rewriting the link changed the number of lines from %d to %d", len(before), len(after))
+		}
+		changed := 0
+		for i := range before {
+			if before[i] != after[i] {
+				changed++
+			}
+		}
+		if changed > 1 {
+			t.Fatalf("rewriting the link changed %d lines\n--- before\n%s\n--- after\n%s", changed, content, rewritten)
+		}
+	})
+}
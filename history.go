@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// maxStatusHistory bounds how many check results are kept per URL.
+const maxStatusHistory = 20
+
+// StatusEntry is one check of a URL. Status 0 means the server could not be
+// reached at all.
+type StatusEntry struct {
+	Time   time.Time `json:"time"`
+	Status int       `json:"status"`
+	Dead   bool      `json:"dead,omitempty"`
+}
+
+func (lock *LockFile) recordStatus(link string, status int, dead bool, at time.Time) {
+	lock.journalOrWarn(journalEntry{Op: "status", Time: at, URL: link, Status: status, Dead: dead})
+	lock.appendStatus(link, StatusEntry{Time: at, Status: status, Dead: dead})
+}
+
+func (lock *LockFile) appendStatus(link string, entry StatusEntry) {
+	if lock.URLHistory == nil {
+		lock.URLHistory = make(map[string][]StatusEntry)
+	}
+	lock.updateLife(link, entry)
+
+	history := append(lock.URLHistory[link], entry)
+	if len(history) > maxStatusHistory {
+		history = history[len(history)-maxStatusHistory:]
+	}
+	lock.URLHistory[link] = history
+}
+
+// flakyPolicy decides when a failing link is considered dead enough to
+// replace, based on its status history across runs.
+type flakyPolicy struct {
+	// DeadAfter is how many consecutive dead checks are needed before replacing
+	DeadAfter int
+	// Window is how many recent checks are considered for flakiness
+	Window int
+	// MinAlive is how many alive checks within the window make a link flaky
+	MinAlive int
+}
+
+var defaultFlakyPolicy = flakyPolicy{DeadAfter: 1, Window: 5, MinAlive: 2}
+
+// Link classifications produced by flakyPolicy.classify.
+const (
+	linkAlive   = "alive"
+	linkDead    = "dead"
+	linkFailing = "failing" // dead, but not for long enough yet
+	linkFlaky   = "flaky"   // dead now, but recently alive several times
+)
+
+// classify looks at a URL's history, newest check last.
+func (p flakyPolicy) classify(history []StatusEntry) string {
+	if len(history) == 0 || !history[len(history)-1].Dead {
+		return linkAlive
+	}
+
+	window := history
+	if p.Window > 0 && len(window) > p.Window {
+		window = window[len(window)-p.Window:]
+	}
+	alive := 0
+	for _, entry := range window {
+		if !entry.Dead {
+			alive++
+		}
+	}
+	if p.MinAlive > 0 && alive >= p.MinAlive {
+		return linkFlaky
+	}
+
+	trailing := 0
+	for i := len(history) - 1; i >= 0 && history[i].Dead; i-- {
+		trailing++
+	}
+	if trailing < p.DeadAfter {
+		return linkFailing
+	}
+
+	return linkDead
+}
+
+// statusHistory returns the recorded checks for a URL, oldest first.
+func (lock *LockFile) statusHistory(link string) []StatusEntry {
+	return lock.URLHistory[link]
+}
+
+// distinctStatuses lists the different statuses seen for a URL in the order
+// they first appeared, e.g. [200 503] for a link alternating between them.
+func distinctStatuses(history []StatusEntry) []int {
+	seen := make(map[int]bool)
+	var statuses []int
+	for _, entry := range history {
+		if !seen[entry.Status] {
+			seen[entry.Status] = true
+			statuses = append(statuses, entry.Status)
+		}
+	}
+	return statuses
+}
+
+// runHistory implements `archive_tool history <url>`, printing every recorded
+// check of a URL.
+func runHistory(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: archive_tool history <url>")
+		os.Exit(2)
+	}
+
+	lock, err := loadLockFile(false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading lock file: %v\n", err)
+		os.Exit(1)
+	}
+
+	history := lock.statusHistory(args[0])
+	if len(history) == 0 {
+		fmt.Printf("No checks recorded for %s\n", args[0])
+		return
+	}
+
+	for _, entry := range history {
+		status := strconv.Itoa(entry.Status)
+		if entry.Status == 0 {
+			status = "unreachable"
+		}
+		if entry.Dead {
+			status += " (dead)"
+		}
+		fmt.Printf("%s  %s\n", entry.Time.Format("2006-01-02 15:04"), status)
+	}
+
+	if statuses := distinctStatuses(history); len(statuses) > 1 {
+		fmt.Printf("\nStatuses seen: %v\n", statuses)
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// locale formats numbers and dates and translates user-facing messages.
+type locale struct {
+	Tag        string
+	Thousands  string
+	Decimal    string
+	DateLayout string
+	messages   map[string]string
+}
+
+var localeFormats = map[string]locale{
+	"en": {Thousands: ",", Decimal: ".", DateLayout: "2006-01-02 15:04"},
+	"de": {Thousands: ".", Decimal: ",", DateLayout: "02.01.2006 15:04"},
+	"fr": {Thousands: " ", Decimal: ",", DateLayout: "02/01/2006 15:04"},
+	"es": {Thousands: ".", Decimal: ",", DateLayout: "02/01/2006 15:04"},
+	"it": {Thousands: ".", Decimal: ",", DateLayout: "02/01/2006 15:04"},
+	"nl": {Thousands: ".", Decimal: ",", DateLayout: "02-01-2006 15:04"},
+	"pt": {Thousands: ".", Decimal: ",", DateLayout: "02/01/2006 15:04"},
+}
+
+// messageCatalogs holds the built-in translations. Missing keys fall back to
+// English; users can add or override entries in
+// ~/.config/archive_tool/messages.<lang>.toml.
+var messageCatalogs = map[string]map[string]string{
+	"en": {
+		"report.title":          "archive_tool report",
+		"report.generated":      "Generated %s.",
+		"report.runs":           "Runs",
+		"report.run":            "Run",
+		"report.trigger":        "Trigger",
+		"report.status":         "Status",
+		"report.started":        "Started",
+		"report.checked":        "Checked",
+		"report.replaced":       "Replaced",
+		"report.errors":         "Errors",
+		"report.error_kinds":    "Errors by kind",
+		"report.flaky":          "Flaky",
+		"report.replacements":   "Replacements",
+		"report.totals":         "Totals",
+		"report.file":           "File",
+		"report.original":       "Original link",
+		"report.archived":       "Archived copy",
+		"report.text_version":   "Plain-text version",
+		"report.collection":     "Collection",
+		"report.files":          "Files",
+		"report.with_link":      "With a link",
+		"report.archived_links": "Archived links",
+		"report.processed":      "Processed",
+		"report.average_size":   "Average size",
+		"report.schemes":        "Schemes",
+		"report.ages":           "Bookmark age",
+		"report.domains":        "Top domains (%s in all)",
+		"report.age.1":          "under 1 year",
+		"report.age.2":          "1-2 years",
+		"report.age.5":          "2-5 years",
+		"report.age.10":         "5-10 years",
+		"report.age.older":      "10 years or more",
+		"report.age.undated":    "no date",
+		"report.survival":       "Link survival by bookmark year",
+		"report.survival_year":  "Year",
+		"report.survival_count": "Links",
+		"report.survival_links": "%s links",
+		"report.survival_now":   "alive now",
+		"report.survival_after": "after %s years",
+		"report.survival_axis":  "Years since bookmarked",
+		"report.suspicious":     "Suspicious",
+		"report.text_match":     "Matches the saved text",
+		"report.secrets":        "Links with credentials or tokens",
+		"report.sanitized":      "removed from the file",
+		"report.traps":          "Redirect chains that never end",
+		"report.body_links":     "Dead links in bodies",
+		"report.no_archive":     "no archived copy",
+		"report.queued":         "queued",
+		"done.summary":          "Done! Checked: %s, Replaced: %s, Errors: %s, Skipped: %s",
+	},
+	"de": {
+		"report.title":          "archive_tool-Bericht",
+		"report.generated":      "Erstellt am %s.",
+		"report.runs":           "Durchläufe",
+		"report.run":            "Durchlauf",
+		"report.trigger":        "Auslöser",
+		"report.status":         "Status",
+		"report.started":        "Gestartet",
+		"report.checked":        "Geprüft",
+		"report.replaced":       "Ersetzt",
+		"report.errors":         "Fehler",
+		"report.error_kinds":    "Fehler nach Art",
+		"report.flaky":          "Unzuverlässig",
+		"report.replacements":   "Ersetzungen",
+		"report.totals":         "Summen",
+		"report.file":           "Datei",
+		"report.original":       "Ursprünglicher Link",
+		"report.archived":       "Archivierte Kopie",
+		"report.text_version":   "Textfassung",
+		"report.collection":     "Sammlung",
+		"report.files":          "Dateien",
+		"report.with_link":      "Mit Link",
+		"report.archived_links": "Archivierte Links",
+		"report.processed":      "Verarbeitet",
+		"report.average_size":   "Durchschnittliche Größe",
+		"report.schemes":        "Schemata",
+		"report.ages":           "Alter der Lesezeichen",
+		"report.domains":        "Häufigste Domains (%s insgesamt)",
+		"report.age.1":          "unter 1 Jahr",
+		"report.age.2":          "1-2 Jahre",
+		"report.age.5":          "2-5 Jahre",
+		"report.age.10":         "5-10 Jahre",
+		"report.age.older":      "10 Jahre oder mehr",
+		"report.age.undated":    "ohne Datum",
+		"report.survival":       "Überleben der Links nach Lesezeichenjahr",
+		"report.survival_year":  "Jahr",
+		"report.survival_count": "Links",
+		"report.survival_links": "%s Links",
+		"report.survival_now":   "jetzt erreichbar",
+		"report.survival_after": "nach %s Jahren",
+		"report.survival_axis":  "Jahre seit dem Speichern",
+		"report.suspicious":     "Verdächtig",
+		"report.text_match":     "Übereinstimmung mit dem gespeicherten Text",
+		"report.secrets":        "Links mit Zugangsdaten oder Tokens",
+		"report.sanitized":      "aus der Datei entfernt",
+		"report.traps":          "Endlose Weiterleitungsketten",
+		"report.body_links":     "Tote Links im Text",
+		"report.no_archive":     "keine archivierte Kopie",
+		"report.queued":         "vorgemerkt",
+		"done.summary":          "Fertig! Geprüft: %s, Ersetzt: %s, Fehler: %s, Übersprungen: %s",
+	},
+	"fr": {
+		"report.title":          "Rapport archive_tool",
+		"report.generated":      "Généré le %s.",
+		"report.runs":           "Exécutions",
+		"report.run":            "Exécution",
+		"report.trigger":        "Déclencheur",
+		"report.status":         "État",
+		"report.started":        "Début",
+		"report.checked":        "Vérifiés",
+		"report.replaced":       "Remplacés",
+		"report.errors":         "Erreurs",
+		"report.error_kinds":    "Erreurs par type",
+		"report.flaky":          "Instables",
+		"report.replacements":   "Remplacements",
+		"report.totals":         "Totaux",
+		"report.file":           "Fichier",
+		"report.original":       "Lien d’origine",
+		"report.archived":       "Copie archivée",
+		"report.text_version":   "Version texte",
+		"report.collection":     "Collection",
+		"report.files":          "Fichiers",
+		"report.with_link":      "Avec un lien",
+		"report.archived_links": "Liens archivés",
+		"report.processed":      "Traités",
+		"report.average_size":   "Taille moyenne",
+		"report.schemes":        "Schémas",
+		"report.ages":           "Âge des signets",
+		"report.domains":        "Domaines principaux (%s au total)",
+		"report.age.1":          "moins d’un an",
+		"report.age.2":          "1 à 2 ans",
+		"report.age.5":          "2 à 5 ans",
+		"report.age.10":         "5 à 10 ans",
+		"report.age.older":      "10 ans ou plus",
+		"report.age.undated":    "sans date",
+		"report.survival":       "Survie des liens par année d’enregistrement",
+		"report.survival_year":  "Année",
+		"report.survival_count": "Liens",
+		"report.survival_links": "%s liens",
+		"report.survival_now":   "en ligne",
+		"report.survival_after": "après %s ans",
+		"report.survival_axis":  "Années depuis l’enregistrement",
+		"report.suspicious":     "Suspect",
+		"report.text_match":     "Correspondance avec le texte enregistré",
+		"report.secrets":        "Liens avec identifiants ou jetons",
+		"report.sanitized":      "retirés du fichier",
+		"report.traps":          "Chaînes de redirection sans fin",
+		"report.body_links":     "Liens morts dans le texte",
+		"report.no_archive":     "aucune copie archivée",
+		"report.queued":         "en attente",
+		"done.summary":          "Terminé ! Vérifiés : %s, remplacés : %s, erreurs : %s, ignorés : %s",
+	},
+	"es": {
+		"report.title":          "Informe de archive_tool",
+		"report.generated":      "Generado el %s.",
+		"report.runs":           "Ejecuciones",
+		"report.run":            "Ejecución",
+		"report.trigger":        "Origen",
+		"report.status":         "Estado",
+		"report.started":        "Inicio",
+		"report.checked":        "Comprobados",
+		"report.replaced":       "Reemplazados",
+		"report.errors":         "Errores",
+		"report.error_kinds":    "Errores por tipo",
+		"report.flaky":          "Inestables",
+		"report.replacements":   "Reemplazos",
+		"report.totals":         "Totales",
+		"report.file":           "Archivo",
+		"report.original":       "Enlace original",
+		"report.archived":       "Copia archivada",
+		"report.text_version":   "Versión en texto plano",
+		"report.collection":     "Colección",
+		"report.files":          "Archivos",
+		"report.with_link":      "Con enlace",
+		"report.archived_links": "Enlaces archivados",
+		"report.processed":      "Procesados",
+		"report.average_size":   "Tamaño medio",
+		"report.schemes":        "Esquemas",
+		"report.ages":           "Antigüedad de los marcadores",
+		"report.domains":        "Dominios principales (%s en total)",
+		"report.age.1":          "menos de 1 año",
+		"report.age.2":          "1-2 años",
+		"report.age.5":          "2-5 años",
+		"report.age.10":         "5-10 años",
+		"report.age.older":      "10 años o más",
+		"report.age.undated":    "sin fecha",
+		"report.survival":       "Supervivencia de enlaces por año de guardado",
+		"report.survival_year":  "Año",
+		"report.survival_count": "Enlaces",
+		"report.survival_links": "%s enlaces",
+		"report.survival_now":   "vivos ahora",
+		"report.survival_after": "tras %s años",
+		"report.survival_axis":  "Años desde que se guardó",
+		"report.suspicious":     "Sospechoso",
+		"report.text_match":     "Coincidencia con el texto guardado",
+		"report.secrets":        "Enlaces con credenciales o tokens",
+		"report.sanitized":      "eliminados del archivo",
+		"report.traps":          "Cadenas de redirecciones sin fin",
+		"report.body_links":     "Enlaces muertos en el texto",
+		"report.no_archive":     "sin copia archivada",
+		"report.queued":         "en cola",
+		"done.summary":          "¡Listo! Comprobados: %s, reemplazados: %s, errores: %s, omitidos: %s",
+	},
+}
+
+// detectLocale picks the locale from the config, falling back to the usual
+// environment variables and finally English.
+func detectLocale(configured string) string {
+	for _, value := range []string{configured, os.Getenv("LC_ALL"), os.Getenv("LC_MESSAGES"), os.Getenv("LANG")} {
+		if value == "" || value == "C" || value == "POSIX" {
+			continue
+		}
+		// "de_DE.UTF-8" -> "de"
+		tag := strings.ToLower(value)
+		if idx := strings.IndexAny(tag, "_.-@"); idx != -1 {
+			tag = tag[:idx]
+		}
+		return tag
+	}
+	return "en"
+}
+
+func loadLocale(tag string) *locale {
+	l, ok := localeFormats[tag]
+	if !ok {
+		l = localeFormats["en"]
+	}
+	l.Tag = tag
+	l.messages = make(map[string]string)
+	for key, msg := range messageCatalogs[tag] {
+		l.messages[key] = msg
+	}
+
+	userCatalog := filepath.Join(filepath.Dir(getConfigPath()), "messages."+tag+".toml")
+	if file, err := os.Open(userCatalog); err == nil {
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			if key, value, ok := parseConfigLine(scanner.Text()); ok {
+				l.messages[strings.Trim(key, `"'`)] = value
+			}
+		}
+		file.Close()
+	}
+
+	return &l
+}
+
+// T translates a message key, formatting any arguments into it.
+func (l *locale) T(key string, args ...interface{}) string {
+	msg, ok := l.messages[key]
+	if !ok {
+		msg, ok = messageCatalogs["en"][key]
+	}
+	if !ok {
+		msg = key
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(msg, args...)
+	}
+	return msg
+}
+
+// Num formats an integer with the locale's digit grouping.
+func (l *locale) Num(n int) string {
+	digits := strconv.Itoa(n)
+	sign := ""
+	if strings.HasPrefix(digits, "-") {
+		sign, digits = "-", digits[1:]
+	}
+
+	var b strings.Builder
+	for i, d := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteString(l.Thousands)
+		}
+		b.WriteRune(d)
+	}
+	return sign + b.String()
+}
+
+// Float formats a number with the given precision and the locale's decimal
+// separator.
+func (l *locale) Float(f float64, precision int) string {
+	s := strconv.FormatFloat(f, 'f', precision, 64)
+	whole, frac, _ := strings.Cut(s, ".")
+	n, _ := strconv.Atoi(whole)
+	out := l.Num(n)
+	if n == 0 && strings.HasPrefix(whole, "-") {
+		out = "-" + out
+	}
+	if frac != "" {
+		out += l.Decimal + frac
+	}
+	return out
+}
+
+func (l *locale) Date(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(l.DateLayout)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// userIdentity is who is running the tool, for attributing changes in a
+// collection several people maintain:
+//
+//	[identity]
+//	name = "Ada Lovelace"
+//	email = "ada@example.com"
+//
+// Without the section, the git user.name and user.email of the collection
+// are used. The identity is recorded with every journal entry and run, and
+// is the author of the commits --git-commit makes.
+type userIdentity struct {
+	Name  string
+	Email string
+}
+
+// identity is the identity of this process, set once the config is final.
+var identity userIdentity
+
+func (id *userIdentity) set(key, value string) error {
+	switch key {
+	case "name":
+		id.Name = value
+	case "email":
+		id.Email = value
+	default:
+		return fmt.Errorf("unknown [identity] key %q (want name or email)", key)
+	}
+	return nil
+}
+
+func (id userIdentity) String() string {
+	switch {
+	case id.Name != "" && id.Email != "":
+		return fmt.Sprintf("%s <%s>", id.Name, id.Email)
+	case id.Email != "":
+		return id.Email
+	}
+	return id.Name
+}
+
+// resolveIdentity fills what the config leaves out of its identity from the
+// git config of the collection in dir.
+func resolveIdentity(configured userIdentity, dir string) userIdentity {
+	id := configured
+	if id.Name == "" {
+		id.Name = gitConfigValue(dir, "user.name")
+	}
+	if id.Email == "" {
+		id.Email = gitConfigValue(dir, "user.email")
+	}
+	return id
+}
+
+func gitConfigValue(dir, key string) string {
+	out, err := exec.Command("git", "-C", dir, "config", "--get", key).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// userPolicy restricts what one identity may do to a shared collection. The
+// collection config keys them by email, with "*" for everyone without an
+// entry of their own:
+//
+//	users:
+//	  intern@example.com:
+//	    queue: true      # only propose replacements, never apply them
+//	    tags: [public]   # only process bookmarks with these tags
+//	    not_tags: [private]
+//
+// The restrictions add to the command line's; no option lifts them.
+type userPolicy struct {
+	Queue   bool
+	Tags    []string
+	NotTags []string
+}
+
+type userPolicies map[string]*userPolicy
+
+func (p *userPolicies) set(user, key, value string) error {
+	user = strings.ToLower(strings.Trim(user, `"'`))
+	if *p == nil {
+		*p = make(userPolicies)
+	}
+	policy := (*p)[user]
+	if policy == nil {
+		policy = &userPolicy{}
+		(*p)[user] = policy
+	}
+	switch key {
+	case "queue":
+		policy.Queue = value == "true"
+	case "tags":
+		policy.Tags = append(policy.Tags, parseTagList(value)...)
+	case "not_tags":
+		policy.NotTags = append(policy.NotTags, parseTagList(value)...)
+	default:
+		return fmt.Errorf("unknown [users.%s] key %q (want queue, tags or not_tags)", user, key)
+	}
+	return nil
+}
+
+// forUser returns the policy of an identity, nil when it is unrestricted.
+func (p userPolicies) forUser(id userIdentity) *userPolicy {
+	if policy, ok := p[strings.ToLower(id.Email)]; ok && id.Email != "" {
+		return policy
+	}
+	return p["*"]
+}
+
+// applyIdentity sets the identity of this process for the collection in dir
+// and returns its policy there.
+func (cfg *Config) applyIdentity(dir string) *userPolicy {
+	identity = resolveIdentity(cfg.Identity, dir)
+	return cfg.Users.forUser(identity)
+}
+
+// restrict applies the policy of the current identity to a run.
+func (opts *runOptions) restrict(policy *userPolicy) {
+	if policy == nil {
+		return
+	}
+	opts.Queue = opts.Queue || policy.Queue
+	opts.Tags.Include = append(opts.Tags.Include, policy.Tags...)
+	opts.Tags.Exclude = append(opts.Tags.Exclude, policy.NotTags...)
+}
+
+// commitRewrites commits the bookmark files a run rewrote to the git
+// repository of the collection in dir, authored by the current identity.
+// Other changes in the work tree are left alone.
+func commitRewrites(dir string, files []string, run *RunRecord) error {
+	if len(files) == 0 {
+		return nil
+	}
+	seen := make(map[string]bool)
+	args := []string{"-C", dir, "add", "--"}
+	for _, file := range files {
+		file = relativeTo(dir, file)
+		if !seen[file] {
+			seen[file] = true
+			args = append(args, filepath.ToSlash(file))
+		}
+	}
+	if err := runGit(args...); err != nil {
+		return err
+	}
+
+	subject := fmt.Sprintf("archive_tool: update %d bookmark(s)", len(seen))
+	if run.Replaced > 0 {
+		subject = fmt.Sprintf("archive_tool: replace %d dead link(s)", run.Replaced)
+	}
+	var body strings.Builder
+	for _, r := range run.Replacements {
+		fmt.Fprintf(&body, "%s: %s -> %s\n", relativeTo(dir, r.File), r.Original, r.URL)
+	}
+	fmt.Fprintf(&body, "\nRun: %s\n", run.ID)
+	if run.User != "" {
+		fmt.Fprintf(&body, "Performed-by: %s\n", run.User)
+	}
+
+	args = []string{"-C", dir, "commit", "--quiet", "-m", subject, "-m", body.String()}
+	if identity.Name != "" && identity.Email != "" {
+		args = append(args, "--author", identity.String())
+	}
+	args = append(args, "--")
+	for file := range seen {
+		args = append(args, filepath.ToSlash(file))
+	}
+	return runGit(args...)
+}
+
+func runGit(args ...string) error {
+	cmd := exec.Command("git", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("git %s: %v: %s", args[2], err, msg)
+		}
+		return fmt.Errorf("git %s: %v", args[2], err)
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+// requestURL is the form of a bookmark link that is safe to put on the wire
+// and into archive queries: internationalized host names are IDNA-encoded
+// (punycode), non-ASCII and other unsafe characters in the path and query
+// are percent-encoded, and a stray "%" that does not start an escape is
+// itself escaped. The link as written in the bookmark is left alone; only
+// requests use this form.
+func requestURL(link string) (string, error) {
+	u, err := url.Parse(fixPercentEscapes(link))
+	if err != nil {
+		return "", err
+	}
+	if u.Host != "" {
+		host, err := idnaToASCII(u.Hostname())
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", link, err)
+		}
+		if port := u.Port(); port != "" {
+			host += ":" + port
+		}
+		u.Host = host
+	}
+	u.RawQuery = escapeNonASCII(u.RawQuery)
+	u.Fragment = ""
+	u.RawFragment = ""
+	return u.String(), nil
+}
+
+// wireURL is requestURL for callers that would rather try the link as
+// written than fail on it; preparing the request reports any real error.
+func wireURL(link string) string {
+	if fixed, err := requestURL(link); err == nil {
+		return fixed
+	}
+	return link
+}
+
+// fixPercentEscapes escapes every "%" not followed by two hex digits, so that
+// links like "50%off" or "%zz" parse.
+func fixPercentEscapes(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && !(i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2])) {
+			b.WriteString("%25")
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// escapeNonASCII percent-encodes bytes outside printable ASCII, plus spaces,
+// leaving existing escapes and query syntax as they are.
+func escapeNonASCII(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c >= 0x7f || c == '"' || c == '<' || c == '>' || c == '`' {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// idnaToASCII converts a host name to its ASCII form, label by label, using
+// punycode with the "xn--" prefix (RFC 3490/3492). Labels are lowercased;
+// full IDNA2008 mapping would need Unicode normalisation, so hosts are
+// assumed to be in NFC already, which is how they are normally typed and
+// pasted.
+func idnaToASCII(host string) (string, error) {
+	// The ideographic and fullwidth full stops also separate labels
+	host = strings.NewReplacer("。", ".", "．", ".", "｡", ".").Replace(host)
+
+	labels := strings.Split(strings.ToLower(host), ".")
+	for i, label := range labels {
+		if isASCII(label) {
+			continue
+		}
+		if !utf8.ValidString(label) {
+			return "", fmt.Errorf("invalid UTF-8 in host label %q", label)
+		}
+		encoded := "xn--" + punycodeEncode(label)
+		if len(encoded) > 63 {
+			return "", fmt.Errorf("host label %q is too long once encoded", label)
+		}
+		labels[i] = encoded
+	}
+	return strings.Join(labels, "."), nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// Punycode parameters from RFC 3492.
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+)
+
+func punycodeEncode(label string) string {
+	input := []rune(label)
+	var out strings.Builder
+	for _, r := range input {
+		if r < 0x80 {
+			out.WriteRune(r)
+		}
+	}
+	basic := out.Len()
+	handled := basic
+	if basic > 0 {
+		out.WriteByte('-')
+	}
+
+	n, delta, bias := rune(punyInitialN), 0, punyInitialBias
+	for handled < len(input) {
+		m := rune(0x10FFFF)
+		for _, r := range input {
+			if r >= n && r < m {
+				m = r
+			}
+		}
+		delta += int(m-n) * (handled + 1)
+		n = m
+
+		for _, r := range input {
+			if r < n {
+				delta++
+			}
+			if r != n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := k - bias
+				if t < punyTMin {
+					t = punyTMin
+				} else if t > punyTMax {
+					t = punyTMax
+				}
+				if q < t {
+					break
+				}
+				out.WriteByte(punyDigit(t + (q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			out.WriteByte(punyDigit(q))
+			bias = punyAdapt(delta, handled+1, handled == basic)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+	return out.String()
+}
+
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func punyAdapt(delta, points int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / points
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
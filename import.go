@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// runImport implements `archive_tool import <source>`: it creates bookmark
+// files from another service, one per bookmark, in the collection's
+// frontmatter schema. Bookmarks whose link the collection already has are
+// skipped, so an import can be repeated to pick up new ones.
+func runImport(args []string) {
+	if len(args) == 0 || args[0] != "pinboard" {
+		fmt.Fprintln(os.Stderr, "Usage: archive_tool import pinboard [--dry-run] [directory]")
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	opts := runOptions{Profile: runProfiles["fast"]}
+	opts.register(fs)
+	dryRun := fs.Bool("dry-run", false, "only list the bookmarks that would be created")
+	fs.Parse(args[1:])
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		os.Exit(1)
+	}
+	if err := opts.finish(cfg, fs.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	provider, err := newPinboardProvider(&cfg.Secrets)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating %s: %v\n", opts.Dir, err)
+		os.Exit(1)
+	}
+
+	// What the collection has already
+	files, err := findMarkdownFiles(opts.Dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading directory: %v\n", err)
+		os.Exit(1)
+	}
+	have := make(map[string]bool)
+	taken := make(map[string]bool)
+	for _, filePath := range files {
+		if filepath.Dir(filePath) == filepath.Clean(opts.Dir) {
+			taken[strings.ToLower(filepath.Base(filePath))] = true
+		}
+		if bookmark, err := parseBookmarkFile(filePath); err == nil && bookmark.Link != "" {
+			have[bookmark.Link] = true
+		}
+	}
+
+	posts, err := fetchPinboardPosts(opts.httpClient(), provider.token)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	created, failed := 0, 0
+	for _, post := range posts {
+		if post.Href == "" || have[post.Href] {
+			continue
+		}
+		have[post.Href] = true
+		filePath := filepath.Join(opts.Dir, post.fileName(taken))
+		fmt.Printf("%s: %s\n", filePath, post.Href)
+		if *dryRun {
+			created++
+			continue
+		}
+		if err := writeFileAtomic(filePath, []byte(post.bookmark()), 0o644); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing %s: %v\n", filePath, err)
+			failed++
+			continue
+		}
+		created++
+	}
+
+	if *dryRun {
+		fmt.Printf("\nWould create %d bookmark(s) of %d (dry run, nothing written)", created, len(posts))
+	} else {
+		fmt.Printf("\nCreated %d bookmark(s) of %d", created, len(posts))
+	}
+	if failed > 0 {
+		fmt.Printf(", %d failed", failed)
+	}
+	fmt.Println()
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
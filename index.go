@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// indexSchema is the bookmark index. Tags are stored both as a space
+// separated column, for display, and one row per tag, for joins.
+const indexSchema = `CREATE TABLE bookmarks (
+  id INTEGER PRIMARY KEY,
+  path TEXT NOT NULL,
+  url TEXT,
+  domain TEXT,
+  title TEXT,
+  tags TEXT,
+  date TEXT,
+  status TEXT NOT NULL,
+  http_status INTEGER,
+  checked TEXT,
+  original_url TEXT,
+  archive_url TEXT,
+  processed INTEGER NOT NULL
+);
+CREATE TABLE tags (
+  bookmark_id INTEGER NOT NULL REFERENCES bookmarks(id),
+  tag TEXT NOT NULL
+);
+CREATE TABLE meta (key TEXT PRIMARY KEY, value TEXT);
+CREATE INDEX bookmarks_url ON bookmarks(url);
+CREATE INDEX bookmarks_original_url ON bookmarks(original_url);
+CREATE INDEX bookmarks_domain ON bookmarks(domain);
+CREATE INDEX bookmarks_date ON bookmarks(date);
+CREATE INDEX bookmarks_status ON bookmarks(status);
+CREATE INDEX tags_tag ON tags(tag);
+CREATE INDEX tags_bookmark ON tags(bookmark_id);
+`
+
+// cannedQuery is a ready-made query for `archive_tool query <name>`.
+type cannedQuery struct {
+	name string
+	help string
+	sql  string
+}
+
+var cannedQueries = []cannedQuery{
+	{"dead", "dead links with their files",
+		`SELECT path, url, checked FROM bookmarks WHERE status = 'dead' ORDER BY path`},
+	{"dead-by-domain", "domains with the most dead links",
+		`SELECT domain, COUNT(*) AS dead FROM bookmarks WHERE status = 'dead' GROUP BY domain ORDER BY dead DESC, domain LIMIT 50`},
+	{"by-year", "bookmarks per year, with how many are dead or archived",
+		`SELECT substr(date, 1, 4) AS year, COUNT(*) AS bookmarks, SUM(status = 'dead') AS dead, SUM(status = 'archived') AS archived FROM bookmarks WHERE date IS NOT NULL GROUP BY year ORDER BY year`},
+	{"top-tags", "the most used tags",
+		`SELECT tag, COUNT(*) AS bookmarks FROM tags GROUP BY tag ORDER BY bookmarks DESC, tag LIMIT 50`},
+	{"archived", "links already replaced with a Wayback snapshot",
+		`SELECT path, original_url, archive_url FROM bookmarks WHERE status = 'archived' ORDER BY path`},
+	{"unchecked", "links never checked",
+		`SELECT path, url FROM bookmarks WHERE status = 'unchecked' ORDER BY path`},
+	{"duplicates", "URLs bookmarked more than once",
+		`SELECT url, COUNT(*) AS files, group_concat(path, ' ') AS paths FROM bookmarks WHERE url IS NOT NULL GROUP BY url HAVING files > 1 ORDER BY files DESC, url`},
+}
+
+func findCannedQuery(name string) (cannedQuery, bool) {
+	for _, q := range cannedQueries {
+		if q.name == name {
+			return q, true
+		}
+	}
+	return cannedQuery{}, false
+}
+
+// queryModes are the sqlite3 output modes `query --mode` accepts.
+var queryModes = []string{"column", "box", "table", "markdown", "csv", "json", "line", "list"}
+
+// defaultIndexPath keeps the index next to the state file.
+func defaultIndexPath() string {
+	lockPath := getLockFilePath()
+	return strings.TrimSuffix(lockPath, filepath.Ext(lockPath)) + ".db"
+}
+
+// sqlite3Command finds the sqlite3 command line tool the index is built and
+// queried through.
+func sqlite3Command() (string, error) {
+	path, err := exec.LookPath("sqlite3")
+	if err != nil {
+		return "", fmt.Errorf("the bookmark index needs the sqlite3 command line tool; install it, or write the index as SQL with --sql")
+	}
+	return path, nil
+}
+
+// writeIndexSQL writes the bookmark index as SQL statements that create and
+// fill the database.
+func writeIndexSQL(w io.Writer, dir string, lock *LockFile, now time.Time) (int, error) {
+	files, err := findMarkdownFiles(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	out := bufio.NewWriter(w)
+	out.WriteString("BEGIN;\n" + indexSchema)
+	fmt.Fprintf(out, "INSERT INTO meta VALUES ('generated', %s), ('directory', %s);\n",
+		sqlQuote(now.UTC().Format(time.RFC3339)), sqlQuote(dir))
+	for i, filePath := range files {
+		bookmark, err := parseBookmarkFile(filePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", filePath, err)
+			continue
+		}
+		id := i + 1
+		row := indexRow(bookmark, lock)
+		fmt.Fprintf(out, "INSERT INTO bookmarks VALUES (%d, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %d);\n",
+			id, sqlQuote(filePath), sqlQuote(bookmark.Link), sqlQuote(row.domain), sqlQuote(row.title),
+			sqlQuote(strings.Join(bookmark.Tags, " ")), sqlQuote(row.date), sqlQuote(row.status),
+			sqlInt(row.httpStatus), sqlQuote(row.checked), sqlQuote(row.original), sqlQuote(row.archive),
+			sqlBool(row.processed))
+		for _, tag := range bookmark.Tags {
+			fmt.Fprintf(out, "INSERT INTO tags VALUES (%d, %s);\n", id, sqlQuote(tag))
+		}
+	}
+	out.WriteString("COMMIT;\n")
+	return len(files), out.Flush()
+}
+
+// indexEntry is what the index records about one bookmark besides its
+// frontmatter.
+type indexEntry struct {
+	domain, title, date string
+	status              string // alive, dead, archived, unchecked or none
+	httpStatus          int
+	checked             string
+	original, archive   string
+	processed           bool
+}
+
+func indexRow(bookmark *BookmarkFile, lock *LockFile) indexEntry {
+	var row indexEntry
+	if header, ok := bookmark.Headers["title"]; ok {
+		row.title = extractYAMLValue(header)
+	}
+	if date := parseDate(bookmark.Date); !date.IsZero() {
+		row.date = date.Format("2006-01-02")
+	}
+	_, row.processed = lock.ProcessedFiles[bookmark.Path]
+
+	row.original = bookmark.Link
+	switch {
+	case bookmark.Link == "":
+		row.status = "none"
+		return row
+	case isWaybackURL(bookmark.Link):
+		row.status = "archived"
+		row.archive = bookmark.Link
+		if m := waybackReplayPattern.FindStringSubmatch(bookmark.Link); m != nil {
+			row.original = m[3]
+		} else {
+			row.original = ""
+		}
+	}
+	row.domain = coverageHost(row.original)
+
+	history := lock.statusHistory(row.original)
+	if len(history) > 0 {
+		latest := history[len(history)-1]
+		row.httpStatus = latest.Status
+		row.checked = latest.Time.UTC().Format(time.RFC3339)
+		if row.status == "" {
+			row.status = "alive"
+			if latest.Dead {
+				row.status = "dead"
+			}
+		}
+	}
+	if row.status == "" {
+		row.status = "unchecked"
+	}
+	return row
+}
+
+// sqlQuote quotes a string literal; the empty string is NULL.
+func sqlQuote(s string) string {
+	if s == "" {
+		return "NULL"
+	}
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+func sqlInt(n int) string {
+	if n == 0 {
+		return "NULL"
+	}
+	return fmt.Sprint(n)
+}
+
+func sqlBool(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// buildIndex writes the SQLite index to path, replacing any old one only
+// once the new one is complete.
+func buildIndex(path, dir string, lock *LockFile) (int, error) {
+	sqlite3, err := sqlite3Command()
+	if err != nil {
+		return 0, err
+	}
+	var script bytes.Buffer
+	n, err := writeIndexSQL(&script, dir, lock, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	cmd := exec.Command(sqlite3, "-bail", tmp)
+	cmd.Stdin = &script
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		os.Remove(tmp)
+		return 0, fmt.Errorf("sqlite3: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return n, os.Rename(tmp, path)
+}
+
+// indexDir is the collection to index: the argument, the configured
+// directory or the default.
+func indexDir(cfg *Config, args []string) string {
+	if len(args) > 0 {
+		return args[0]
+	}
+	if cfg.Dir != "" {
+		return cfg.Dir
+	}
+	return defaultBookmarksDir()
+}
+
+// runIndex implements `archive_tool index`.
+func runIndex(args []string) {
+	fs := flag.NewFlagSet("index", flag.ExitOnError)
+	output := fs.String("output", "", "write the index to this `file` (default: next to the lock file)")
+	asSQL := fs.Bool("sql", false, "write the index as SQL statements instead, to stdout or --output")
+	fs.Parse(args)
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		os.Exit(1)
+	}
+	lock, err := loadLockFile(false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading lock file: %v\n", err)
+		os.Exit(1)
+	}
+	dir := indexDir(cfg, fs.Args())
+
+	if *asSQL {
+		var w io.Writer = os.Stdout
+		if *output != "" {
+			file, err := os.Create(*output)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error creating %s: %v\n", *output, err)
+				os.Exit(1)
+			}
+			defer file.Close()
+			w = file
+		}
+		if _, err := writeIndexSQL(w, dir, lock, time.Now()); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing index: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	path := *output
+	if path == "" {
+		path = defaultIndexPath()
+	}
+	n, err := buildIndex(path, dir, lock)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error building index: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Indexed %d bookmark(s) into %s\n", n, path)
+}
+
+// runQuery implements `archive_tool query`.
+func runQuery(args []string) {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	indexPath := fs.String("index", "", "query this index `file` (default: next to the lock file)")
+	refresh := fs.Bool("refresh", false, "rebuild the index from the collection first")
+	mode := fs.String("mode", "column", "output mode: "+strings.Join(queryModes, ", "))
+	dir := fs.String("dir", "", "collection to index when building it (default: config or ~/pinboard-bookmarks)")
+	list := fs.Bool("list", false, "list the canned queries")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), `Usage: archive_tool query [options] "SELECT ..." | <canned query>`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *list {
+		for _, q := range cannedQueries {
+			fmt.Printf("  %-16s %s\n", q.name, q.help)
+		}
+		return
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	sql := fs.Arg(0)
+	if q, ok := findCannedQuery(sql); ok {
+		sql = q.sql
+	}
+	// sqlite3 runs an argument that starts with a dot as a dot-command,
+	// such as .shell or .output, rather than as SQL
+	if strings.HasPrefix(strings.TrimSpace(sql), ".") {
+		fmt.Fprintln(os.Stderr, "Error: queries are SQL; sqlite3 dot-commands are not run")
+		os.Exit(2)
+	}
+	validMode := false
+	for _, m := range queryModes {
+		validMode = validMode || m == *mode
+	}
+	if !validMode {
+		fmt.Fprintf(os.Stderr, "Error: unknown output mode %q (want %s)\n", *mode, strings.Join(queryModes, ", "))
+		os.Exit(1)
+	}
+
+	sqlite3, err := sqlite3Command()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	path := *indexPath
+	if path == "" {
+		path = defaultIndexPath()
+	}
+	if _, err := os.Stat(path); *refresh || os.IsNotExist(err) {
+		cfg, err := loadConfig()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+			os.Exit(1)
+		}
+		lock, err := loadLockFile(false)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading lock file: %v\n", err)
+			os.Exit(1)
+		}
+		var dirArgs []string
+		if *dir != "" {
+			dirArgs = []string{*dir}
+		}
+		if _, err := buildIndex(path, indexDir(cfg, dirArgs), lock); err != nil {
+			fmt.Fprintf(os.Stderr, "Error building index: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// The index is opened read-only, so queries never change it
+	cmd := exec.Command(sqlite3, "-readonly", "-bail", "-header", "-"+*mode, path, strings.TrimSpace(sql))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		os.Exit(1)
+	}
+}
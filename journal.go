@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The lock file is saved once per run, so every mutation in between is also
+// appended to a write-ahead journal, <lock>.journal.<pid>, and synced before
+// the change is made. Saving the lock file checkpoints and removes the
+// journal. If a process dies mid-run, the next one to load the lock file
+// replays the journal: state changes are rolled forward, and each bookmark
+// rewrite that was announced but not confirmed is resolved by hashing the file
+// (rewritten: keep; untouched: drop the intent; edited since: leave and warn).
+type journalEntry struct {
+	Op   string    `json:"op"` // processed, status, rewrite, rewritten, replacement, applied
+	Time time.Time `json:"time"`
+
+	File   string `json:"file,omitempty"`
+	Hash   string `json:"hash,omitempty"`  // processed: content hash; rewrite: hash before
+	After  string `json:"after,omitempty"` // rewrite: hash the file will have
+	URL    string `json:"url,omitempty"`
+	Status int    `json:"status,omitempty"`
+	Dead   bool   `json:"dead,omitempty"`
+
+	User        string       `json:"user,omitempty"` // the identity making the change
+	RunID       string       `json:"run_id,omitempty"`
+	Candidate   string       `json:"candidate,omitempty"`
+	Replacement *Replacement `json:"replacement,omitempty"`
+}
+
+type journal struct {
+	path string
+	file *os.File
+}
+
+func journalPath(lockPath string, pid int) string {
+	return fmt.Sprintf("%s.journal.%d", lockPath, pid)
+}
+
+// logJournal appends an entry and syncs it to disk before returning.
+func (lock *LockFile) logJournal(entry journalEntry) error {
+	if lock.dryRun {
+		return nil
+	}
+	if lock.journal == nil {
+		path := journalPath(getLockFilePath(), os.Getpid())
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("opening journal: %w", err)
+		}
+		lock.journal = &journal{path: path, file: file}
+	}
+
+	if entry.Time.IsZero() {
+		entry.Time = lock.now()
+	}
+	if entry.User == "" {
+		entry.User = identity.String()
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := lock.journal.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("writing journal: %w", err)
+	}
+	return lock.journal.file.Sync()
+}
+
+// journalOrWarn logs an entry for a change that goes ahead either way.
+func (lock *LockFile) journalOrWarn(entry journalEntry) {
+	if err := lock.logJournal(entry); err != nil {
+		fmt.Fprintf(os.Stderr, "\nWarning: %v\n", err)
+	}
+}
+
+// checkpointJournal is called once the lock file is saved: everything in the
+// journal is now in the lock file.
+func (lock *LockFile) checkpointJournal() {
+	if lock.journal == nil {
+		return
+	}
+	lock.journal.file.Close()
+	os.Remove(lock.journal.path)
+	lock.journal = nil
+}
+
+// rewriteBookmark replaces a bookmark's link, and sets any frontmatter
+// fields given (see setFrontmatterFields), journaling the rewrite first. A rewrite that cannot be
+// journaled is not made.
+func (lock *LockFile) rewriteBookmark(bookmark *BookmarkFile, newURL string, fields ...frontmatterField) error {
+	data, err := os.ReadFile(bookmark.Path)
+	if err != nil {
+		return err
+	}
+	updated, err := rewriteBookmarkContent(bookmark, data, newURL)
+	if err != nil {
+		return err
+	}
+	return lock.writeRewrite(bookmark.Path, data, setFrontmatterFields(updated, fields...), newURL)
+}
+
+// writeRewrite replaces a file's content data with updated, journaling the
+// rewrite first; newURL is what the rewrite points at, for the warning if an
+// interrupted rewrite has to be checked by hand. The content is upgraded to
+// the current format and stamped with it.
+func (lock *LockFile) writeRewrite(path string, data, updated []byte, newURL string) error {
+	if lock.dryRun {
+		return nil
+	}
+	var err error
+	if updated, _, err = upgradeFormat(updated); err != nil {
+		return err
+	}
+	if err := lock.logJournal(journalEntry{
+		Op:   "rewrite",
+		File: path,
+		Hash: contentHash(data),
+		// After is what markFileProcessed will record
+		After: contentHash(updated),
+		URL:   newURL,
+	}); err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(path, updated, 0644); err != nil {
+		return err
+	}
+	lock.rewritten = append(lock.rewritten, path)
+	lock.journalOrWarn(journalEntry{Op: "rewritten", File: path})
+	return nil
+}
+
+// replayJournals applies the journals left behind by processes that are no
+// longer running, then saves the lock file so they can be removed. In a dry
+// run they are applied in memory only and left for the next real run.
+func (lock *LockFile) replayJournals(lockPath string) {
+	paths, _ := filepath.Glob(lockPath + ".journal.*")
+	var replayed []string
+	for _, path := range paths {
+		pid, err := strconv.Atoi(path[strings.LastIndex(path, ".")+1:])
+		if err != nil || pid == os.Getpid() || processAlive(pid) {
+			continue
+		}
+		if err := lock.replayJournal(path); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: replaying %s: %v\n", path, err)
+			continue
+		}
+		replayed = append(replayed, path)
+	}
+	if len(replayed) == 0 || lock.dryRun {
+		return
+	}
+
+	if err := saveLockFile(lock); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: could not save state after journal replay: %v\n", err)
+		return
+	}
+	for _, path := range replayed {
+		os.Remove(path)
+	}
+}
+
+func (lock *LockFile) replayJournal(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var entries []journalEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A torn final line from the crash; everything before it stands
+			break
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	known := make(map[string]bool)
+	for _, run := range lock.Runs {
+		known[run.ID] = true
+	}
+
+	pending := make(map[string]journalEntry)
+	recovered := make(map[string]*RunRecord)
+	var runOrder []string
+	kept, dropped, conflicts := 0, 0, 0
+
+	for _, e := range entries {
+		switch e.Op {
+		case "processed":
+			lock.ProcessedFiles[e.File] = e.Hash
+		case "status":
+			history := lock.URLHistory[e.URL]
+			if n := len(history); n == 0 || !history[n-1].Time.Equal(e.Time) {
+				lock.appendStatus(e.URL, StatusEntry{Time: e.Time, Status: e.Status, Dead: e.Dead})
+			}
+		case "rewrite":
+			pending[e.File] = e
+		case "rewritten":
+			delete(pending, e.File)
+			kept++
+		case "replacement":
+			if known[e.RunID] || e.Replacement == nil {
+				continue
+			}
+			run, ok := recovered[e.RunID]
+			if !ok {
+				run = &RunRecord{ID: e.RunID, Trigger: "recovered", Status: "interrupted", Started: e.Time}
+				recovered[e.RunID] = run
+				runOrder = append(runOrder, e.RunID)
+			}
+			run.Replaced++
+			run.Replacements = append(run.Replacements, e.Replacement)
+			run.Finished = e.Time
+		case "applied":
+			if replacement, candidate := lock.findCandidate(e.Candidate); candidate != nil {
+				replacement.URL = candidate.URL
+				replacement.Chosen = candidate.ID
+			}
+		}
+	}
+
+	for file, e := range pending {
+		current, err := computeFileHash(file)
+		switch {
+		case err == nil && current == e.After:
+			// The rename went through before the crash: roll forward
+			lock.ProcessedFiles[file] = current
+			kept++
+		case err == nil && current == e.Hash:
+			// The file was never touched: roll back by dropping the intent
+			dropped++
+		default:
+			conflicts++
+			fmt.Fprintf(os.Stderr, "Warning: %s changed during an interrupted rewrite to %s; check it by hand\n", file, e.URL)
+		}
+	}
+
+	for _, id := range runOrder {
+		lock.addRun(recovered[id])
+	}
+
+	fmt.Fprintf(os.Stderr, "Recovered an interrupted run from %s: %d journal entries, %d rewrites kept, %d not applied, %d conflicts\n",
+		path, len(entries), kept, dropped, conflicts)
+	return nil
+}
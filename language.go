@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// languageField is the frontmatter field --detect-language records the
+// archived copy's language in.
+const languageField = "language"
+
+var (
+	htmlLangPattern     = regexp.MustCompile(`(?is)<html\b[^>]*?\s(?:xml:)?lang\s*=\s*["']?([A-Za-z]{2,3}(?:[-_][A-Za-z0-9]+)*)`)
+	metaLanguagePattern = regexp.MustCompile(`(?is)<meta\b[^>]*?http-equiv\s*=\s*["']?content-language["']?[^>]*?\scontent\s*=\s*["']?([A-Za-z]{2,3}(?:[-_][A-Za-z0-9]+)*)`)
+	ogLocalePattern     = regexp.MustCompile(`(?is)<meta\b[^>]*?property\s*=\s*["']og:locale["'][^>]*?\scontent\s*=\s*["']?([A-Za-z]{2,3}(?:[-_][A-Za-z0-9]+)*)`)
+)
+
+// knownLanguages are the ISO 639-1 codes recognized in URLs, where a two
+// letter path segment or subdomain is only taken as a language if it is one.
+var knownLanguages = map[string]bool{
+	"ar": true, "bg": true, "ca": true, "cs": true, "da": true, "de": true, "el": true, "en": true,
+	"es": true, "et": true, "fa": true, "fi": true, "fr": true, "he": true, "hi": true, "hr": true,
+	"hu": true, "id": true, "it": true, "ja": true, "ko": true, "lt": true, "lv": true, "nl": true,
+	"no": true, "pl": true, "pt": true, "ro": true, "ru": true, "sk": true, "sl": true, "sv": true,
+	"th": true, "tr": true, "uk": true, "vi": true, "zh": true,
+}
+
+// languageStopwords are frequent short words that tell languages written in
+// Latin script apart, for pages that do not declare a language.
+var languageStopwords = map[string][]string{
+	"en": {"the", "and", "of", "to", "is", "in", "that", "it", "for", "with", "was", "on", "are", "this", "you"},
+	"de": {"der", "die", "und", "das", "ist", "nicht", "mit", "den", "ein", "eine", "auf", "sich", "auch", "für", "wir"},
+	"fr": {"le", "la", "les", "et", "des", "est", "une", "dans", "que", "pour", "qui", "pas", "sur", "du", "avec"},
+	"es": {"el", "los", "las", "y", "que", "es", "una", "por", "para", "con", "del", "como", "pero", "su", "se"},
+	"it": {"il", "che", "di", "e", "per", "una", "sono", "non", "della", "con", "gli", "anche", "come", "nel", "è"},
+	"nl": {"de", "het", "een", "en", "van", "dat", "niet", "zijn", "op", "voor", "met", "ook", "maar", "wordt", "naar"},
+	"pt": {"o", "os", "que", "não", "uma", "para", "com", "do", "da", "em", "mais", "por", "como", "dos", "são"},
+}
+
+var stopwordLanguages = func() map[string][]string {
+	byWord := make(map[string][]string)
+	for lang, words := range languageStopwords {
+		for _, w := range words {
+			byWord[w] = append(byWord[w], lang)
+		}
+	}
+	return byWord
+}()
+
+var languageWordPattern = regexp.MustCompile(`\pL+`)
+
+// primaryLanguage reduces a language tag to its primary subtag: "pt-BR" and
+// "pt_BR" are "pt".
+func primaryLanguage(tag string) string {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if i := strings.IndexAny(tag, "-_"); i >= 0 {
+		tag = tag[:i]
+	}
+	if len(tag) < 2 || len(tag) > 3 {
+		return ""
+	}
+	return tag
+}
+
+// pageLanguage finds a page's language and says how: from the markup, the
+// Content-Language header, or failing those, from its words.
+func pageLanguage(header http.Header, body string) (string, string) {
+	for _, p := range []struct {
+		pattern *regexp.Regexp
+		how     string
+	}{
+		{htmlLangPattern, "html lang"},
+		{metaLanguagePattern, "meta content-language"},
+		{ogLocalePattern, "og:locale"},
+	} {
+		if m := p.pattern.FindStringSubmatch(body); m != nil {
+			if lang := primaryLanguage(m[1]); lang != "" {
+				return lang, p.how
+			}
+		}
+	}
+	if header != nil {
+		// The header may list several languages; the first is the main one
+		first, _, _ := strings.Cut(header.Get("Content-Language"), ",")
+		if lang := primaryLanguage(first); lang != "" {
+			return lang, "Content-Language header"
+		}
+	}
+	if lang := guessLanguage(stripTags(body)); lang != "" {
+		return lang, "text"
+	}
+	return "", ""
+}
+
+// guessLanguage picks the language whose stopwords are most frequent in
+// text. It gives up on short texts and close calls.
+func guessLanguage(text string) string {
+	counts := make(map[string]int)
+	for _, word := range languageWordPattern.FindAllString(strings.ToLower(text), 2000) {
+		for _, lang := range stopwordLanguages[word] {
+			counts[lang]++
+		}
+	}
+	best, bestN, secondN := "", 0, 0
+	for lang, n := range counts {
+		switch {
+		case n > bestN || (n == bestN && lang < best):
+			best, bestN, secondN = lang, n, max(bestN, secondN)
+		case n > secondN:
+			secondN = n
+		}
+	}
+	if bestN < 8 || float64(bestN) < 1.5*float64(secondN) {
+		return ""
+	}
+	return best
+}
+
+// urlLanguage reads a locale from a URL: a lang, hl or locale query
+// parameter, a leading path segment such as /de/ or /pt-br/, or a
+// subdomain such as fr.example.org.
+func urlLanguage(link string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	for _, key := range []string{"lang", "hl", "locale"} {
+		if lang := primaryLanguage(u.Query().Get(key)); knownLanguages[lang] {
+			return lang
+		}
+	}
+	first, _, _ := strings.Cut(strings.TrimPrefix(u.Path, "/"), "/")
+	if lang := primaryLanguage(first); knownLanguages[lang] && len(first) <= 5 {
+		return lang
+	}
+	label, _, _ := strings.Cut(u.Hostname(), ".")
+	if knownLanguages[label] && strings.Count(u.Hostname(), ".") >= 2 {
+		return label
+	}
+	return ""
+}
+
+// expectedLanguage is the language a bookmark's page should be in: as the
+// frontmatter says, as its URL says, or as its own title and notes are
+// written.
+func expectedLanguage(bookmark *BookmarkFile) (string, string) {
+	for _, key := range []string{"lang", languageField} {
+		if header, ok := bookmark.Headers[key]; ok {
+			if lang := primaryLanguage(extractYAMLValue(header)); lang != "" {
+				return lang, "frontmatter " + key
+			}
+		}
+	}
+	if lang := urlLanguage(bookmark.Link); lang != "" {
+		return lang, "the bookmarked URL"
+	}
+	text := bookmark.Content
+	if header, ok := bookmark.Headers["title"]; ok {
+		text = extractYAMLValue(header) + "\n" + text
+	}
+	if lang := guessLanguage(text); lang != "" {
+		return lang, "the bookmark's notes"
+	}
+	return "", ""
+}
+
+// snapshotLanguage fetches an archived copy as it was captured and detects
+// its language. The final URL matters too: a snapshot can redirect to a
+// capture of another locale's page.
+func snapshotLanguage(client *http.Client, snapshotURL string) (string, string, error) {
+	raw := snapshotURL
+	if m := waybackReplayPattern.FindStringSubmatch(snapshotURL); m != nil {
+		raw = fmt.Sprintf("%s/%sid_/%s", waybackAPI, m[1], m[3])
+	}
+	req, err := http.NewRequest("GET", raw, nil)
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("User-Agent", archiveUserAgent)
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("snapshot returned %d", resp.StatusCode)
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxSnapshotBytes))
+	lang, how := pageLanguage(resp.Header, string(body))
+	if lang == "" {
+		if m := waybackReplayPattern.FindStringSubmatch(resp.Request.URL.String()); m != nil {
+			if lang = urlLanguage(m[3]); lang != "" {
+				how = "the captured URL"
+			}
+		}
+	}
+	return lang, how, nil
+}
+
+// detectLanguage finds the language of the snapshot about to replace a
+// bookmark's link and, when the bookmark's own language is known and
+// differs, says why the replacement looks suspicious.
+func detectLanguage(client *http.Client, bookmark *BookmarkFile, snapshotURL string, ex *explainer) (lang, suspicious string) {
+	lang, how, err := snapshotLanguage(client, snapshotURL)
+	if err != nil {
+		ex.logf("could not detect the snapshot's language: %v", err)
+		return "", ""
+	}
+	if lang == "" {
+		ex.logf("snapshot language not recognized")
+		return "", ""
+	}
+	ex.logf("snapshot language %s (from %s)", lang, how)
+
+	want, source := expectedLanguage(bookmark)
+	if want != "" && want != lang {
+		suspicious = fmt.Sprintf("snapshot is in %s (from %s), but %s says %s", lang, how, source, want)
+		ex.logf("suspicious replacement: %s", suspicious)
+	}
+	return lang, suspicious
+}
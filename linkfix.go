@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// tidyLink repairs the link shapes found in old bookmark exports: stray
+// whitespace, angle brackets (<https://...>), scheme-relative links
+// (//example.com/...) and links without a scheme (example.com/...). Links
+// without a scheme are assumed to be https. Anything else is returned as it
+// was, for validateLink to judge.
+func tidyLink(raw string) string {
+	link := strings.TrimSpace(raw)
+	if strings.HasPrefix(link, "<") && strings.HasSuffix(link, ">") {
+		link = strings.TrimSpace(link[1 : len(link)-1])
+	}
+	// Line breaks and tabs are left over from wrapped exports
+	link = strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\r' || r == '\t' {
+			return -1
+		}
+		return r
+	}, link)
+
+	switch {
+	case link == "" || strings.Contains(link, "://"):
+		return link
+	case strings.HasPrefix(link, "//"):
+		return "https:" + link
+	case looksLikeHost(link):
+		return "https://" + link
+	}
+	return link
+}
+
+// looksLikeHost reports whether a scheme-less link starts with a host name,
+// so that "example.com/page" is taken for a link but "notes/page" or
+// "mailto:someone" are not.
+func looksLikeHost(link string) bool {
+	host := link
+	if i := strings.IndexAny(host, "/?#"); i >= 0 {
+		host = host[:i]
+	}
+	if h, port, ok := strings.Cut(host, ":"); ok {
+		if port == "" || strings.Trim(port, "0123456789") != "" {
+			return false
+		}
+		host = h
+	}
+	if !strings.Contains(host, ".") || strings.HasPrefix(host, ".") || strings.HasSuffix(host, ".") {
+		return false
+	}
+	return !strings.ContainsAny(host, " @\\")
+}
+
+// validateLink reports why a link cannot be checked, if it cannot.
+func validateLink(link string) error {
+	wire, err := requestURL(link)
+	if err != nil {
+		return err
+	}
+	u, err := url.Parse(wire)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%q is not an http(s) link", link)
+	}
+	if u.Host == "" || strings.ContainsAny(u.Hostname(), " <>") {
+		return fmt.Errorf("%q has no valid host", link)
+	}
+	return nil
+}
+
+// fixLinkInFile writes a tidied link back to its bookmark, with --fix-links.
+func fixLinkInFile(lock *LockFile, bookmark *BookmarkFile, run *RunRecord, ex *explainer) {
+	if err := lock.rewriteBookmark(bookmark, bookmark.Link); err != nil {
+		fmt.Fprintf(os.Stderr, "\nError fixing the link in %s: %v\n", bookmark.Path, err)
+		run.recordError(bookmark.Path, err)
+		return
+	}
+	ex.logf("wrote the normalized link back to the file")
+	fmt.Printf("\nFixed link: %q\n  -> %s\n", bookmark.Written, bookmark.Link)
+	bookmark.Written = ""
+	run.Fixed++
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// localCopyField is the frontmatter field --snapshot-dir records the path of
+// a bookmark's local copy in, relative to the bookmark.
+const localCopyField = "local_copy"
+
+// maxLocalCopyBytes bounds the page a local copy is made of.
+const maxLocalCopyBytes = 20 << 20
+
+// localCopyName is the name of a bookmark's local copy: a hash of the link
+// it was bookmarked with, so the copy keeps its name once the link is
+// replaced.
+func localCopyName(link string) string {
+	sum := sha256.Sum256([]byte(link))
+	return fmt.Sprintf("%x", sum[:8]) + ".html"
+}
+
+// fetchedPage is a page as it was fetched for a local copy or a WARC: the
+// URL it stands for, when it was captured, and the response.
+type fetchedPage struct {
+	URI      string
+	Date     time.Time
+	Status   int
+	Header   http.Header
+	Body     []byte
+	Request  *http.Request
+	Archived bool
+}
+
+// html reports whether the page is an HTML page.
+func (p *fetchedPage) html() bool {
+	mediaType, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+	return mediaType == "text/html" || mediaType == "application/xhtml+xml"
+}
+
+// fetchPage downloads a page. A Wayback capture is fetched as it was
+// recorded, without the archive's toolbar and link rewriting, and stands for
+// the URL that was captured.
+func fetchPage(client *http.Client, pageURL string, now time.Time) (*fetchedPage, error) {
+	page := &fetchedPage{URI: pageURL, Date: now.UTC()}
+	endpoint, agent := wireURL(pageURL), userAgent
+	if m := waybackReplayPattern.FindStringSubmatch(pageURL); m != nil {
+		endpoint, agent = fmt.Sprintf("%s/%sid_/%s", waybackAPI, m[1], m[3]), archiveUserAgent
+		page.URI, page.Archived = m[3], true
+		if captured, err := time.Parse("20060102150405", m[1]); err == nil {
+			page.Date = captured
+		}
+	}
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", agent)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, classifyError("page copy", pageURL, err)
+	}
+	defer resp.Body.Close()
+	if err := statusError("page copy", pageURL, resp.StatusCode); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("page copy %s: status %d", pageURL, resp.StatusCode)
+	}
+	page.Body, err = io.ReadAll(io.LimitReader(resp.Body, maxLocalCopyBytes))
+	if err != nil {
+		return nil, classifyError("page copy", pageURL, err)
+	}
+	page.Status, page.Header, page.Request = resp.StatusCode, resp.Header, resp.Request
+	return page, nil
+}
+
+// saveLocalCopy stores the HTML of a bookmark's page, the live page or the
+// archived copy replacing it, in dir, fetching it with fetch. It returns the
+// copy's path relative to the bookmark. A bookmark that has a copy already
+// keeps it.
+func saveLocalCopy(dir string, bookmark *BookmarkFile, fetch func() (*fetchedPage, error)) (string, error) {
+	path := filepath.Join(dir, localCopyName(bookmark.Link))
+	if _, err := os.Stat(path); err != nil {
+		page, err := fetch()
+		if err != nil {
+			return "", err
+		}
+		if !page.html() {
+			return "", fmt.Errorf("page copy %s: not an HTML page (%s)", page.URI, page.Header.Get("Content-Type"))
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", err
+		}
+		if err := writeFileAtomic(path, page.Body, 0644); err != nil {
+			return "", err
+		}
+	}
+	rel, err := filepath.Rel(filepath.Dir(bookmark.Path), path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// keepsPages reports whether the run keeps anything of the pages it checks.
+func (opts *runOptions) keepsPages() bool {
+	return opts.SnapshotDir != "" || opts.WARCs != nil || opts.ReadingCopy || opts.PDF
+}
+
+// wantsCopies reports whether keeping a live page would add to what its
+// bookmark has: a copy it lacks, or the run's WARC records.
+func wantsCopies(bookmark *BookmarkFile, opts runOptions) bool {
+	has := func(key string) bool {
+		_, ok := bookmark.Headers[key]
+		return ok
+	}
+	return opts.WARCs != nil ||
+		opts.SnapshotDir != "" && !has(localCopyField) ||
+		opts.ReadingCopy && !has(readingCopyField) ||
+		opts.PDF && !has(pdfField)
+}
+
+// keepPage keeps what --snapshot-dir, --warc, --reading-copy and --pdf ask
+// for of pageURL, the live page of a bookmark or the archived copy replacing it,
+// fetching it once. It returns the frontmatter fields that record the copies
+// made.
+func keepPage(client *http.Client, bookmark *BookmarkFile, pageURL string, opts runOptions, ex *explainer) []frontmatterField {
+	var page *fetchedPage
+	var fetchErr error
+	fetch := func() (*fetchedPage, error) {
+		if page == nil && fetchErr == nil {
+			opts.unlocked(func() { page, fetchErr = fetchPage(client, pageURL, opts.now()) })
+		}
+		return page, fetchErr
+	}
+
+	var fields []frontmatterField
+	if opts.SnapshotDir != "" {
+		if local, err := saveLocalCopy(opts.SnapshotDir, bookmark, fetch); err != nil {
+			ex.logf("no local copy of %s: %v", pageURL, err)
+			fmt.Fprintf(os.Stderr, "\nError saving a local copy of %s: %v\n", pageURL, err)
+		} else {
+			ex.logf("local copy of %s in %s", pageURL, local)
+			fields = append(fields, frontmatterField{Key: localCopyField, Value: local})
+		}
+	}
+	if opts.WARCs != nil {
+		page, err := fetch()
+		if err == nil {
+			opts.unlocked(func() { err = opts.WARCs.capture(client, page) })
+		}
+		if err != nil {
+			ex.logf("%s not written to the WARC: %v", pageURL, err)
+			fmt.Fprintf(os.Stderr, "\nError writing %s to the WARC: %v\n", pageURL, err)
+		} else {
+			ex.logf("%s written to the WARC", pageURL)
+		}
+	}
+	// A bookmark keeps its reading copy, as it does its local copy
+	if _, read := bookmark.Headers[readingCopyField]; opts.ReadingCopy && !read {
+		page, err := fetch()
+		markdown := ""
+		if err == nil {
+			opts.unlocked(func() { markdown, err = readingCopy(page) })
+		}
+		if err != nil {
+			ex.logf("no reading copy of %s: %v", pageURL, err)
+			// Not every page is an article
+			if !errors.Is(err, errNoArticle) {
+				fmt.Fprintf(os.Stderr, "\nError making a reading copy of %s: %v\n", pageURL, err)
+			}
+		} else {
+			ex.logf("reading copy of %s, %d words", pageURL, len(strings.Fields(markdown)))
+			fields = append(fields, frontmatterField{Key: readingCopyField, Value: pageURL, Body: markdown})
+		}
+	}
+	if _, printed := bookmark.Headers[pdfField]; opts.PDF && !printed {
+		if name, err := keepPDF(bookmark, pageURL, opts); err != nil {
+			ex.logf("no PDF of %s: %v", pageURL, err)
+			fmt.Fprintf(os.Stderr, "\nError printing %s to PDF: %v\n", pageURL, err)
+		} else {
+			ex.logf("PDF of %s in %s", pageURL, name)
+			fields = append(fields, frontmatterField{Key: pdfField, Value: name})
+		}
+	}
+	return fields
+}
+
+// keepLiveCopy keeps the page of a live bookmark with --snapshot-dir,
+// --warc, --reading-copy or --pdf, and records its copies in the bookmark. A
+// bookmark with copies keeps them, so only its WARC records are written
+// again.
+func keepLiveCopy(client *http.Client, lock *LockFile, bookmark *BookmarkFile, target string, run *RunRecord, opts runOptions, ex *explainer) {
+	if opts.DryRun || !wantsCopies(bookmark, opts) {
+		return
+	}
+	opts.Worker.setPhase("copying")
+	fields := keepPage(client, bookmark, target, opts, ex)
+	if len(fields) == 0 {
+		return
+	}
+	data, err := os.ReadFile(bookmark.Path)
+	if err == nil {
+		if updated := setFrontmatterFields(data, fields...); !bytes.Equal(updated, data) {
+			err = lock.writeRewrite(bookmark.Path, data, updated, bookmark.Link)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nError updating %s: %v\n", bookmark.Path, err)
+		run.recordError(bookmark.Path, err)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+)
+
+// CoverageStats is the result of a --measure run: how many dead links each
+// archive provider could replace.
+type CoverageStats struct {
+	Checked       int            `json:"checked"`
+	Dead          int            `json:"dead"`
+	Providers     map[string]int `json:"providers"`               // dead links the provider has a copy of
+	LookupErrors  map[string]int `json:"lookup_errors,omitempty"` // lookups that failed, per provider
+	Recoverable   int            `json:"recoverable"`             // covered by at least one provider
+	Unrecoverable int            `json:"unrecoverable"`           // every provider answered "no copy"
+	Undetermined  int            `json:"undetermined,omitempty"`  // no copy found, but a lookup failed
+}
+
+// runMeasure checks links and, for each dead one, asks every known archive
+// provider (configured or not) whether it has a copy. No files are changed,
+// so the numbers can guide which providers and credentials to set up.
+func runMeasure(opts runOptions, ctl *controller) (*RunRecord, error) {
+	ctl.setPhase("scanning")
+	defer ctl.setPhase("idle")
+
+	fmt.Printf("Scanning directory: %s\n", opts.Dir)
+
+	files, err := findMarkdownFiles(opts.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading directory: %w", err)
+	}
+	if opts.Shard.Count > 1 {
+		files = opts.Shard.filter(opts.Dir, files)
+	}
+	if opts.Sample > 0 && opts.Sample < len(files) {
+		rand.Shuffle(len(files), func(i, j int) { files[i], files[j] = files[j], files[i] })
+		files = files[:opts.Sample]
+	}
+
+	lock, err := loadLockFile(false)
+	if err != nil {
+		return nil, fmt.Errorf("loading lock file: %w", err)
+	}
+
+	var names []string
+	for name := range archiveProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	chains := make(map[string]*providerChain)
+	for _, name := range names {
+		chain, err := newProviderChain(name, opts.Providers.timeouts)
+		if err != nil {
+			return nil, err
+		}
+		chains[name] = chain
+	}
+
+	run := &RunRecord{
+		ID:      newRunID(opts.now()),
+		Trigger: opts.Trigger,
+		Shard:   opts.Shard.String(),
+		Profile: opts.Profile.Name,
+		Started: opts.now(),
+		Status:  "completed",
+	}
+	stats := &CoverageStats{Providers: make(map[string]int)}
+	for _, name := range names {
+		stats.Providers[name] = 0
+	}
+
+	client := opts.httpClient()
+	wd := newWatchdog()
+	ctl.setPhase("measuring")
+
+	for i, filePath := range files {
+		wd.ping()
+		if !ctl.checkpoint() {
+			run.Status = "stopped"
+			break
+		}
+		ctl.setProgress(i, len(files), filePath)
+		console.progress(i+1, len(files), "Measuring [%d/%d] - Checked: %d, Dead: %d, Recoverable: %d",
+			i+1, len(files), stats.Checked, stats.Dead, stats.Recoverable)
+
+		bookmark, err := parseBookmarkFile(filePath)
+		if err != nil {
+			run.recordError(filePath, err)
+			continue
+		}
+		if bookmark.Link == "" || !opts.Filter.allows(bookmark.Link) || !opts.Tags.matches(bookmark.Tags) {
+			continue
+		}
+		if validateLink(bookmark.Link) != nil {
+			run.Invalid++
+			continue
+		}
+
+		run.Checked++
+		stats.Checked++
+		isDead, status, err := opts.checkLink(client, bookmark.Link, opts.Profile)
+		if err != nil {
+			run.recordError(filePath, err)
+			continue
+		}
+		lock.recordStatus(bookmark.Link, status, isDead, opts.now())
+		if !isDead {
+			continue
+		}
+		stats.Dead++
+
+		covered, failed := false, false
+		for _, name := range names {
+			_, err := chains[name].lookup(client, bookmark.Link, bookmark.Date, opts.now())
+			switch {
+			case err == nil:
+				stats.Providers[name]++
+				covered = true
+			case errors.Is(err, ErrNoSnapshot):
+			default:
+				if stats.LookupErrors == nil {
+					stats.LookupErrors = make(map[string]int)
+				}
+				stats.LookupErrors[name]++
+				failed = true
+			}
+		}
+		switch {
+		case covered:
+			stats.Recoverable++
+		case failed:
+			stats.Undetermined++
+		default:
+			stats.Unrecoverable++
+		}
+	}
+
+	run.Finished = opts.now()
+	run.Coverage = stats
+	lock.addRun(run)
+
+	if err := saveLockFile(lock); err != nil {
+		fmt.Fprintf(os.Stderr, "\nError saving lock file: %v\n", err)
+	}
+
+	fmt.Printf("\n\nChecked %d links: %d dead\n", stats.Checked, stats.Dead)
+	for _, name := range names {
+		line := fmt.Sprintf("  %-12s has a copy of %d", name, stats.Providers[name])
+		if n := stats.LookupErrors[name]; n > 0 {
+			line += fmt.Sprintf(" (%d lookups failed)", n)
+		}
+		fmt.Println(line)
+	}
+	fmt.Printf("Recoverable: %d, unrecoverable: %d", stats.Recoverable, stats.Unrecoverable)
+	if stats.Undetermined > 0 {
+		fmt.Printf(", undetermined: %d", stats.Undetermined)
+	}
+	fmt.Println()
+
+	return run, nil
+}
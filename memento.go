@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// mementoPolicy is the [memento] section:
+//
+//	[memento]
+//	aggregator = "http://timetravel.mementoweb.org"
+//	archives = "web.archive.org, archive.today, webarchive.org.uk"
+//
+// archives is the preference order of the archives the aggregator knows;
+// the first that has a capture is used. Archives not listed come after,
+// closest capture first.
+type mementoPolicy struct {
+	Aggregator string
+	Archives   []string
+}
+
+var defaultMementoPolicy = mementoPolicy{Aggregator: "http://timetravel.mementoweb.org"}
+
+// mementoSettings are the [memento] settings of this process, set once the
+// config is final.
+var mementoSettings = defaultMementoPolicy
+
+func (p *mementoPolicy) set(key, value string) error {
+	switch key {
+	case "aggregator":
+		u, err := url.Parse(value)
+		if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("invalid aggregator %q", value)
+		}
+		p.Aggregator = strings.TrimSuffix(value, "/")
+	case "archives":
+		for _, archive := range strings.Split(value, ",") {
+			if archive = strings.ToLower(strings.TrimSpace(archive)); archive != "" {
+				p.Archives = append(p.Archives, archive)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown [memento] key %q", key)
+	}
+	return nil
+}
+
+// timeMapEntryPattern matches one entry of a TimeMap in link format: the
+// URI, then its attributes.
+var (
+	timeMapEntryPattern = regexp.MustCompile(`<([^>]+)>((?:\s*;\s*[a-zA-Z]+\s*=\s*"[^"]*")*)`)
+	timeMapAttrPattern  = regexp.MustCompile(`([a-zA-Z]+)\s*=\s*"([^"]*)"`)
+)
+
+// parseTimeMap returns the mementos of a TimeMap (RFC 7089) as candidates
+// with their capture time.
+func parseTimeMap(body string) []*snapshotCandidate {
+	var mementos []*snapshotCandidate
+	for _, m := range timeMapEntryPattern.FindAllStringSubmatch(body, -1) {
+		attrs := make(map[string]string)
+		for _, a := range timeMapAttrPattern.FindAllStringSubmatch(m[2], -1) {
+			attrs[strings.ToLower(a[1])] = a[2]
+		}
+		isMemento := false
+		for _, rel := range strings.Fields(attrs["rel"]) {
+			isMemento = isMemento || rel == "memento"
+		}
+		if !isMemento {
+			continue
+		}
+		captured, err := http.ParseTime(attrs["datetime"])
+		if err != nil {
+			continue
+		}
+		mementos = append(mementos, &snapshotCandidate{URL: m[1], Captured: captured})
+	}
+	return mementos
+}
+
+// fetchTimeMap gets and parses a TimeMap; op names the request in errors.
+// A 404 means no captures.
+func fetchTimeMap(ctx context.Context, client *http.Client, op, endpoint, link string) ([]*snapshotCandidate, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", archiveUserAgent)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, classifyError(op, link, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err := statusError(op, link, resp.StatusCode); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: status %d", op, link, resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return nil, classifyError(op, link, err)
+	}
+	return parseTimeMap(string(body)), nil
+}
+
+// closestAndLatest picks, among captures, the one closest to want and the
+// most recent one, which may be the same.
+func closestAndLatest(captures []*snapshotCandidate, want time.Time) []*snapshotCandidate {
+	if len(captures) == 0 {
+		return nil
+	}
+	distance := func(t time.Time) time.Duration {
+		if d := t.Sub(want); d > 0 {
+			return d
+		}
+		return want.Sub(t)
+	}
+	closest, latest := captures[0], captures[0]
+	for _, c := range captures[1:] {
+		if distance(c.Captured) < distance(closest.Captured) {
+			closest = c
+		}
+		if c.Captured.After(latest.Captured) {
+			latest = c
+		}
+	}
+	if latest == closest {
+		return []*snapshotCandidate{closest}
+	}
+	return []*snapshotCandidate{closest, latest}
+}
+
+// mementoArchive tells whether a memento is held by a named archive: its
+// host or a parent domain, with "archive.today" covering all its mirrors.
+func mementoArchive(memento, archive string) bool {
+	u, err := url.Parse(memento)
+	if err != nil {
+		return false
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	if archive == "archive.today" {
+		return containsString(archiveTodayHosts, host)
+	}
+	return host == archive || strings.HasSuffix(host, "."+archive)
+}
+
+// mementoProvider queries a Memento aggregator, which knows the captures of
+// many web archives (national libraries, archive.today, the Wayback Machine
+// and others) and lists them in one TimeMap.
+type mementoProvider struct{}
+
+func (mementoProvider) name() string { return "memento" }
+
+func (mementoProvider) endpoint() string { return mementoSettings.Aggregator + "/" }
+
+// lookup offers the capture closest to the bookmark date and the most
+// recent one, from the first archive in the preference order that has any.
+func (mementoProvider) lookup(ctx context.Context, client *http.Client, link, date string, now time.Time) ([]*snapshotCandidate, error) {
+	captures, err := fetchTimeMap(ctx, client, "memento lookup", mementoSettings.Aggregator+"/timemap/link/1/"+link, link)
+	if err != nil || len(captures) == 0 {
+		return nil, err
+	}
+	want := parseDate(date)
+	if want.IsZero() {
+		want = now.AddDate(0, -6, 0)
+	}
+
+	// Wayback captures are named the way the wayback provider names them
+	for _, c := range captures {
+		if canonical := canonicalWayback(c.URL); canonical != "" {
+			c.URL = canonical
+		}
+	}
+	for _, archive := range mementoSettings.Archives {
+		var held []*snapshotCandidate
+		for _, c := range captures {
+			if mementoArchive(c.URL, archive) {
+				held = append(held, c)
+			}
+		}
+		if len(held) > 0 {
+			return closestAndLatest(held, want), nil
+		}
+	}
+	return closestAndLatest(captures, want), nil
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// migration is a set of frontmatter transformations applied to every
+// bookmark, in this order: key renames, then the date format and the tags
+// of the keys as renamed, then the upgrade to the current format.
+type migration struct {
+	Renames    [][2]string // old key, new key
+	DateField  string
+	DateLayout string
+	TagsList   bool              // rewrite inline tags as a block list
+	Retags     map[string]string // lowercased old tag -> new tag, "" to drop it
+	Upgrade    bool              // upgrade bookmarks in older formats
+}
+
+// dateLayouts are the names --date-format accepts besides Go layouts.
+var dateLayouts = map[string]string{
+	"date":     "2006-01-02",
+	"datetime": "2006-01-02 15:04:05",
+	"rfc3339":  time.RFC3339,
+}
+
+// parsePair splits an "old=new" flag value.
+func parsePair(flagName, value string, allowEmpty bool) (string, string, error) {
+	from, to, ok := strings.Cut(value, "=")
+	from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+	if !ok || from == "" || to == "" && !allowEmpty {
+		return "", "", fmt.Errorf("--%s wants old=new, got %q", flagName, value)
+	}
+	return from, to, nil
+}
+
+func (m *migration) empty() bool {
+	return len(m.Renames) == 0 && m.DateLayout == "" && !m.TagsList && len(m.Retags) == 0 && !m.Upgrade
+}
+
+// apply transforms the frontmatter of data. It returns the new content and
+// what changed; no changes means the bookmark is already migrated.
+func (m *migration) apply(data []byte) ([]byte, []string, error) {
+	lines := strings.Split(string(data), "\n")
+	start, end, ok := frontmatterBounds(lines)
+	if !ok {
+		return data, nil, nil
+	}
+	var changes []string
+
+	// topLevel finds a top-level key of the frontmatter
+	topLevel := func(key string) int {
+		for i := start + 1; i < end; i++ {
+			if strings.HasPrefix(lines[i], key+":") {
+				return i
+			}
+		}
+		return -1
+	}
+
+	for _, rename := range m.Renames {
+		i := topLevel(rename[0])
+		if i == -1 {
+			continue
+		}
+		if topLevel(rename[1]) != -1 {
+			return nil, nil, fmt.Errorf("has both %s and %s", rename[0], rename[1])
+		}
+		lines[i] = rename[1] + lines[i][len(rename[0]):]
+		changes = append(changes, fmt.Sprintf("renamed %s to %s", rename[0], rename[1]))
+	}
+
+	if m.DateLayout != "" {
+		if i := topLevel(m.DateField); i != -1 {
+			line := strings.TrimSuffix(lines[i], "\r")
+			valueStart, valueEnd, value := splitYAMLLine(line)
+			if value != "" {
+				t := parseDate(value)
+				if t.IsZero() {
+					return nil, nil, fmt.Errorf("cannot parse %s %q", m.DateField, value)
+				}
+				if formatted := t.Format(m.DateLayout); formatted != value {
+					lines[i] = line[:valueStart] + quoteYAMLLike(line[valueStart:valueEnd], formatted) + lines[i][valueEnd:]
+					changes = append(changes, fmt.Sprintf("%s %s to %s", m.DateField, value, formatted))
+				}
+			}
+		}
+	}
+
+	if m.TagsList || len(m.Retags) > 0 {
+		if i := topLevel(bookmarkKeys.Tags); i != -1 {
+			var tagChanges []string
+			lines, end, tagChanges = m.migrateTags(lines, i, end)
+			changes = append(changes, tagChanges...)
+		}
+	}
+
+	updated := data
+	if len(changes) > 0 {
+		updated = []byte(strings.Join(lines, "\n"))
+	}
+	if m.Upgrade {
+		var upgrades []string
+		var err error
+		if updated, upgrades, err = upgradeFormat(updated); err != nil {
+			return nil, nil, err
+		}
+		changes = append(changes, upgrades...)
+	}
+	if len(changes) == 0 {
+		return data, nil, nil
+	}
+	return updated, changes, nil
+}
+
+// migrateTags rewrites the tags field at line i, in the form it was written
+// in unless TagsList asks for a block list. It returns the lines, the new
+// end of the frontmatter and what changed.
+func (m *migration) migrateTags(lines []string, i, end int) ([]string, int, []string) {
+	key := bookmarkKeys.Tags
+	eol := ""
+	if strings.HasSuffix(lines[i], "\r") {
+		eol = "\r"
+	}
+	value := extractYAMLValue(strings.TrimSuffix(lines[i], "\r"))
+	trimmed := strings.TrimSpace(value)
+
+	var tags []string
+	form, indent, last := "space", "  ", i
+	switch {
+	case trimmed == "":
+		form = "block"
+		for j := i + 1; j < end; j++ {
+			item := strings.TrimSuffix(lines[j], "\r")
+			if !strings.HasPrefix(strings.TrimSpace(item), "- ") {
+				break
+			}
+			if j == i+1 {
+				indent = item[:len(item)-len(strings.TrimLeft(item, " \t"))]
+			}
+			tags = append(tags, strings.Trim(strings.TrimSpace(strings.TrimSpace(item)[2:]), `"'`))
+			last = j
+		}
+	case strings.HasPrefix(trimmed, "["):
+		form = "flow"
+	case strings.Contains(trimmed, ","):
+		form = "comma"
+	}
+	if form != "block" {
+		tags = parseTagList(value)
+	}
+
+	var changes []string
+	var migrated []string
+	for _, tag := range tags {
+		if to, ok := m.Retags[strings.ToLower(tag)]; ok {
+			if to == "" {
+				changes = append(changes, "dropped tag "+tag)
+				continue
+			}
+			changes = append(changes, fmt.Sprintf("tag %s to %s", tag, to))
+			tag = to
+		}
+		if !hasTag(migrated, tag) {
+			migrated = append(migrated, tag)
+		}
+	}
+	if m.TagsList && form != "block" {
+		form = "block"
+		changes = append(changes, "tags to a list")
+	}
+	if len(changes) == 0 {
+		return lines, end, nil
+	}
+
+	quoted := make([]string, len(migrated))
+	for j, tag := range migrated {
+		quoted[j] = quoteYAMLLike("", tag)
+	}
+	var field []string
+	switch {
+	case len(migrated) == 0:
+		field = []string{key + ": []" + eol}
+	case form == "block":
+		field = []string{key + ":" + eol}
+		for _, tag := range quoted {
+			field = append(field, indent+"- "+tag+eol)
+		}
+	case form == "flow":
+		field = []string{key + ": [" + strings.Join(quoted, ", ") + "]" + eol}
+	case form == "comma":
+		field = []string{key + ": " + strings.Join(quoted, ", ") + eol}
+	default:
+		field = []string{key + ": " + strings.Join(quoted, " ") + eol}
+	}
+
+	rest := append(field, lines[last+1:]...)
+	lines = append(lines[:i], rest...)
+	return lines, end + len(field) - (last + 1 - i), changes
+}
+
+// runMigrate implements `archive_tool migrate`: it applies frontmatter
+// transformations across the collection, such as when moving to a static
+// site generator that expects other keys. Rewrites are journaled like any
+// other, and processed bookmarks stay processed.
+func runMigrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	opts := runOptions{Profile: runProfiles["fast"]}
+	opts.register(fs)
+	var renames, retags stringList
+	fs.Var(&renames, "rename", "rename frontmatter key `old=new` (repeatable)")
+	dateField := fs.String("date-field", "", "frontmatter `key` --date-format applies to (default: the date key)")
+	dateFormat := fs.String("date-format", "", "rewrite dates in this Go `layout`, or date, datetime or rfc3339")
+	tagsList := fs.Bool("tags-list", false, "rewrite inline tags as a YAML block list")
+	fs.Var(&retags, "retag", "rename tag `old=new`, or drop it with old= (repeatable)")
+	upgrade := fs.Bool("upgrade", false, "upgrade bookmarks written by older versions to the current format")
+	dryRun := fs.Bool("dry-run", false, "only show what would change")
+	fs.Parse(args)
+
+	m := migration{DateField: *dateField, TagsList: *tagsList, Upgrade: *upgrade}
+	for _, value := range renames {
+		from, to, err := parsePair("rename", value, false)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(2)
+		}
+		m.Renames = append(m.Renames, [2]string{from, to})
+	}
+	for _, value := range retags {
+		from, to, err := parsePair("retag", value, true)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(2)
+		}
+		if m.Retags == nil {
+			m.Retags = make(map[string]string)
+		}
+		m.Retags[strings.ToLower(from)] = to
+	}
+	if *dateFormat != "" {
+		m.DateLayout = *dateFormat
+		if layout, ok := dateLayouts[*dateFormat]; ok {
+			m.DateLayout = layout
+		} else if !strings.Contains(*dateFormat, "2006") {
+			fmt.Fprintf(os.Stderr, "Error: --date-format %q is not a Go layout (such as 2006-01-02) or date, datetime or rfc3339\n", *dateFormat)
+			os.Exit(2)
+		}
+	}
+	if m.empty() {
+		fmt.Fprintln(os.Stderr, "Nothing to migrate: give --rename, --date-format, --tags-list, --retag or --upgrade")
+		os.Exit(2)
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		os.Exit(1)
+	}
+	if err := opts.finish(cfg, fs.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if m.DateField == "" {
+		m.DateField = bookmarkKeys.Date
+	}
+	lock, err := loadLockFile(*dryRun)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading lock file: %v\n", err)
+		os.Exit(1)
+	}
+	files, err := findMarkdownFiles(opts.Dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading directory: %v\n", err)
+		os.Exit(1)
+	}
+	if opts.Shard.Count > 1 {
+		files = opts.Shard.filter(opts.Dir, files)
+	}
+
+	migrated, failed := 0, 0
+	for _, filePath := range files {
+		bookmark, err := parseBookmarkFile(filePath)
+		if err != nil || !opts.Tags.matches(bookmark.Tags) {
+			continue
+		}
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", filePath, err)
+			failed++
+			continue
+		}
+		updated, changes, err := m.apply(data)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error migrating %s: %v\n", filePath, err)
+			failed++
+			continue
+		}
+		if len(changes) == 0 {
+			continue
+		}
+		fmt.Printf("%s: %s\n", filePath, strings.Join(changes, "; "))
+		migrated++
+		if *dryRun {
+			continue
+		}
+
+		processed := isFileProcessed(lock, filePath)
+		if err := lock.writeRewrite(filePath, data, updated, ""); err != nil {
+			fmt.Fprintf(os.Stderr, "Error updating %s: %v\n", filePath, err)
+			migrated--
+			failed++
+			continue
+		}
+		if processed {
+			if err := markFileProcessed(lock, filePath); err != nil {
+				fmt.Fprintf(os.Stderr, "Error updating the lock file for %s: %v\n", filePath, err)
+			}
+		}
+	}
+
+	if migrated > 0 && !*dryRun {
+		if err := saveLockFile(lock); err != nil {
+			fmt.Fprintf(os.Stderr, "Error saving lock file: %v\n", err)
+		}
+	}
+	if *dryRun {
+		fmt.Printf("\nWould migrate %d of %d bookmark(s) (dry run, nothing written)", migrated, len(files))
+	} else {
+		fmt.Printf("\nMigrated %d of %d bookmark(s)", migrated, len(files))
+	}
+	if failed > 0 {
+		fmt.Printf(", %d failed", failed)
+	}
+	fmt.Println()
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
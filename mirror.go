@@ -0,0 +1,211 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+)
+
+// defaultMirrorMaxSize bounds a single mirrored asset, in MiB.
+const defaultMirrorMaxSize = 20
+
+// runMirrorAssets implements `archive_tool mirror-assets`: it downloads the
+// images and other assets bookmark bodies embed into the collection's assets/
+// directory and points the bodies at the local copies, so notes keep their
+// images when the hosts serving them go away.
+func runMirrorAssets(args []string) {
+	fs := flag.NewFlagSet("mirror-assets", flag.ExitOnError)
+	opts := runOptions{Profile: runProfiles["fast"]}
+	opts.register(fs)
+	maxSize := fs.Int("max-size", defaultMirrorMaxSize, "skip assets larger than this many `MiB`")
+	fs.Parse(args)
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		os.Exit(1)
+	}
+	if err := opts.finish(cfg, fs.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "Error %v\n", err)
+		os.Exit(1)
+	}
+	lock, err := loadLockFile(false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading lock file: %v\n", err)
+		os.Exit(1)
+	}
+
+	files, err := findMarkdownFiles(opts.Dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading directory: %v\n", err)
+		os.Exit(1)
+	}
+	allFiles := files
+	if opts.Shard.Count > 1 {
+		files = opts.Shard.filter(opts.Dir, files)
+	}
+	store := opts.blobStore()
+	if _, ok := store.(fsStore); !ok && store.url("") == "" && !isEncrypted(store) {
+		fmt.Fprintf(os.Stderr, "Error: storage %q has no public_url for bookmarks to embed its copies from\n", opts.Storage)
+		os.Exit(1)
+	}
+
+	client := opts.httpClient()
+	limit := int64(*maxSize) << 20
+	downloaded, shared, rewritten, failed := 0, 0, 0, 0
+	for _, filePath := range files {
+		bookmark, err := parseBookmarkFile(filePath)
+		if err != nil || !opts.Tags.matches(bookmark.Tags) {
+			continue
+		}
+		// Assets of sensitive bookmarks are mirrored from their hosts only
+		opts.Providers.sensitive.markBookmark(bookmark)
+		replacements := make(map[string]string)
+		for _, asset := range embeddedURLs(bookmark.Content) {
+			if !opts.Filter.allows(asset) {
+				continue
+			}
+			if isEncrypted(store) {
+				// Kept as a backup; the embedding stays as it is
+				if ok, err := store.has(lock.blobKey(asset)); err == nil && ok {
+					continue
+				}
+				written, err := mirrorAsset(client, store, lock, asset, bookmark.Date, limit, opts)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error mirroring %s from %s: %v\n", asset, filePath, err)
+					failed++
+					continue
+				}
+				downloaded++
+				if !written {
+					shared++
+				}
+				continue
+			}
+			if _, ok := assetCopy(store, lock, filePath, asset); !ok {
+				written, err := mirrorAsset(client, store, lock, asset, bookmark.Date, limit, opts)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error mirroring %s from %s: %v\n", asset, filePath, err)
+					failed++
+					continue
+				}
+				downloaded++
+				if !written {
+					shared++
+				}
+			}
+			local, ok := assetCopy(store, lock, filePath, asset)
+			if !ok {
+				fmt.Fprintf(os.Stderr, "Error: %s did not keep the copy of %s\n", store.name(), asset)
+				failed++
+				continue
+			}
+			replacements[asset] = local
+		}
+		if len(replacements) == 0 {
+			continue
+		}
+		changed, err := mirrorRewrite(lock, filePath, replacements)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error updating %s: %v\n", filePath, err)
+			failed++
+			continue
+		}
+		if !changed {
+			continue
+		}
+		rewritten++
+		fmt.Printf("%s %s: %d asset(s) now local\n", console.mark(), filePath, len(replacements))
+	}
+
+	keys := make([]string, 0, len(lock.Blobs))
+	for key := range lock.Blobs {
+		keys = append(keys, key)
+	}
+	if _, err := countBlobRefs(lock, allFiles, keys); err != nil {
+		fmt.Fprintf(os.Stderr, "Error counting references: %v\n", err)
+	}
+	if err := saveLockFile(lock); err != nil {
+		fmt.Fprintf(os.Stderr, "Error saving lock file: %v\n", err)
+	}
+	fmt.Printf("\nMirrored %d asset(s) into %s, %d already stored from other URLs, updated %d bookmark(s), %d failed\n",
+		downloaded, store.name(), shared, rewritten, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// mirrorAsset downloads an asset into the store and reports whether its
+// content was new there; content another URL already brought is stored
+// once. An asset its host no longer serves is taken from its Wayback image
+// capture instead.
+func mirrorAsset(client *http.Client, store blobStore, lock *LockFile, link, date string, limit int64, opts runOptions) (bool, error) {
+	data, mediaType, err := downloadAsset(client, link, limit)
+	if err != nil && !isWaybackURL(link) {
+		capture, lookupErr := imageCapture(client, opts.Providers, link, date, opts)
+		if lookupErr != nil {
+			return false, fmt.Errorf("%v, and no archived copy: %v", err, lookupErr)
+		}
+		var archiveErr error
+		if data, mediaType, archiveErr = downloadAsset(client, capture, limit); archiveErr != nil {
+			return false, fmt.Errorf("%v, and the archived copy failed: %v", err, archiveErr)
+		}
+		fmt.Printf("  %s is gone; mirrored its archived copy %s\n", link, capture)
+	} else if err != nil {
+		return false, err
+	}
+	_, written, err := lock.storeBlob(store, link, data, mediaType, opts.now())
+	return written, err
+}
+
+// downloadAsset fetches link with its media type, refusing error pages and
+// anything over limit bytes.
+func downloadAsset(client *http.Client, link string, limit int64) ([]byte, string, error) {
+	resp, err := assetRequest(client, http.MethodGet, link)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("GET returned %d", resp.StatusCode)
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType == "text/html" {
+		return nil, "", fmt.Errorf("GET returned an HTML page instead of the asset")
+	}
+	if resp.ContentLength > limit {
+		return nil, "", fmt.Errorf("%d bytes is over the %d MiB limit", resp.ContentLength, limit>>20)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(data)) > limit {
+		return nil, "", fmt.Errorf("over the %d MiB limit", limit>>20)
+	}
+	return data, mediaType, nil
+}
+
+// mirrorRewrite points a bookmark's embedded assets at their local copies.
+// A file that was processed stays processed: only its body changed.
+func mirrorRewrite(lock *LockFile, filePath string, replacements map[string]string) (bool, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return false, err
+	}
+	updated := rewriteAssetURLs(data, replacements)
+	if string(updated) == string(data) {
+		return false, nil
+	}
+	processed := isFileProcessed(lock, filePath)
+	if err := lock.writeRewrite(filePath, data, updated, assetsDirName+"/"); err != nil {
+		return false, err
+	}
+	if processed {
+		return true, markFileProcessed(lock, filePath)
+	}
+	return true, nil
+}
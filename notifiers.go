@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Notification kinds, which channels pick with their events key.
+const (
+	notifyDigest = "digest" // the daily or weekly digest
+	notifyRun    = "run"    // the summary of every run
+	notifyErrors = "errors" // a run that had errors
+)
+
+// notifierServices are the push services a [notifier.<name>] section can
+// deliver to, with the API they are reached at unless url is set, and the
+// secret their token is read from unless token names another.
+var notifierServices = map[string]struct{ API, Token string }{
+	"ntfy":     {"", "ntfy_token"},
+	"pushover": {"https://api.pushover.net", "pushover_token"},
+	"gotify":   {"", "gotify_token"},
+	"telegram": {"https://api.telegram.org", "telegram_token"},
+}
+
+// notifierConfig is a [notifier.<name>] section of the config file:
+//
+//	[notifier.phone]
+//	service = "ntfy"                        # ntfy, pushover, gotify or telegram
+//	url = "https://ntfy.sh/my-bookmarks"    # the ntfy topic, or the Gotify server
+//	events = "errors"                       # digest, run and errors; default digest
+//
+// Pushover also needs the user key to deliver to, as user, and Telegram the
+// chat, as chat. Tokens come from the secrets layer.
+type notifierConfig struct {
+	Name    string
+	Service string
+	URL     string
+	Token   string // name of the secret with the token
+	User    string
+	Chat    string
+	Events  []string
+}
+
+// notifiers are the [notifier.<name>] sections, by name.
+type notifiers map[string]*notifierConfig
+
+func (n *notifiers) set(name, key, value string) error {
+	if *n == nil {
+		*n = make(notifiers)
+	}
+	notifier := (*n)[name]
+	if notifier == nil {
+		notifier = &notifierConfig{Name: name}
+		(*n)[name] = notifier
+	}
+	switch key {
+	case "service":
+		if _, ok := notifierServices[value]; !ok {
+			return fmt.Errorf("invalid service %q (want ntfy, pushover, gotify or telegram)", value)
+		}
+		notifier.Service = value
+	case "url":
+		notifier.URL = strings.TrimSuffix(value, "/")
+	case "token":
+		notifier.Token = value
+	case "user":
+		notifier.User = value
+	case "chat":
+		notifier.Chat = value
+	case "events":
+		events, err := parseNotifyEvents(value)
+		if err != nil {
+			return err
+		}
+		notifier.Events = events
+	default:
+		return fmt.Errorf("unknown [notifier.%s] key %q", name, key)
+	}
+	return nil
+}
+
+// parseNotifyEvents reads an events list, e.g. "digest, errors".
+func parseNotifyEvents(value string) ([]string, error) {
+	var events []string
+	for _, kind := range strings.Split(value, ",") {
+		switch kind = strings.TrimSpace(kind); kind {
+		case notifyDigest, notifyRun, notifyErrors:
+			events = append(events, kind)
+		case "":
+		default:
+			return nil, fmt.Errorf("invalid notification event %q (want digest, run or errors)", kind)
+		}
+	}
+	return events, nil
+}
+
+// wantsNotification reports whether a channel routed to events takes a
+// notification of kind. Channels without events take digests.
+func wantsNotification(events []string, kind string) bool {
+	if len(events) == 0 {
+		return kind == notifyDigest
+	}
+	for _, e := range events {
+		if e == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// sorted lists the notifiers by name, so they are delivered to in the same
+// order every time.
+func (n notifiers) sorted() []*notifierConfig {
+	list := make([]*notifierConfig, 0, len(n))
+	for _, notifier := range n {
+		list = append(list, notifier)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// send delivers a notification through the notifier's service.
+func (n *notifierConfig) send(client *http.Client, cfg *Config, msg notification) error {
+	service, ok := notifierServices[n.Service]
+	if !ok {
+		return fmt.Errorf("no service configured")
+	}
+	api := n.URL
+	if api == "" {
+		api = service.API
+	}
+	if api == "" {
+		return fmt.Errorf("%s needs url", n.Service)
+	}
+	token, err := cfg.Secrets.get(defaultString(n.Token, service.Token))
+	// An ntfy topic may be open to anyone
+	if err != nil && (n.Service != "ntfy" || n.Token != "") {
+		return err
+	}
+	urgent := msg.Kind == notifyErrors
+
+	var req *http.Request
+	switch n.Service {
+	case "ntfy":
+		req, err = http.NewRequest("POST", api, strings.NewReader(truncateText(msg.Body, 4096)))
+		if err == nil {
+			req.Header.Set("Title", msg.Title)
+			if urgent {
+				req.Header.Set("Priority", "high")
+			}
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+		}
+	case "pushover":
+		if n.User == "" {
+			return fmt.Errorf("pushover needs user")
+		}
+		form := url.Values{
+			"token":   {token},
+			"user":    {n.User},
+			"title":   {truncateText(msg.Title, 250)},
+			"message": {truncateText(msg.Body, 1024)},
+		}
+		if urgent {
+			form.Set("priority", "1")
+		}
+		req, err = postForm(api+"/1/messages.json", form)
+	case "gotify":
+		priority := 5
+		if urgent {
+			priority = 8
+		}
+		var body []byte
+		body, err = json.Marshal(map[string]interface{}{"title": msg.Title, "message": msg.Body, "priority": priority})
+		if err == nil {
+			req, err = http.NewRequest("POST", api+"/message", bytes.NewReader(body))
+		}
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Gotify-Key", token)
+		}
+	case "telegram":
+		if n.Chat == "" {
+			return fmt.Errorf("telegram needs chat")
+		}
+		req, err = postForm(api+"/bot"+token+"/sendMessage", url.Values{
+			"chat_id": {n.Chat},
+			"text":    {truncateText(msg.Title+"\n\n"+msg.Body, 4096)},
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		// Not the URL, which holds the Telegram token
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("%s: %v", n.Service, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s: status %d", n.Service, resp.StatusCode)
+	}
+	return nil
+}
+
+func postForm(endpoint string, form url.Values) (*http.Request, error) {
+	req, err := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
+
+// truncateText cuts text to at most max bytes, at a line break where it can,
+// for services that refuse longer messages.
+func truncateText(text string, max int) string {
+	if len(text) <= max {
+		return text
+	}
+	const more = "\n…"
+	cut := max - len(more)
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	if i := strings.LastIndex(text[:cut], "\n"); i > cut/2 {
+		cut = i
+	}
+	return text[:cut] + more
+}
+
+// runNotifications are the notifications a finished run sends: its summary,
+// and an alert when it had errors.
+func runNotifications(run *RunRecord, now time.Time) []notification {
+	var body strings.Builder
+	fmt.Fprintf(&body, "Run %s (%s, %s)\n\n", run.ID, run.Trigger, run.Status)
+	fmt.Fprintf(&body, "Links checked: %d\nReplaced: %d\nErrors: %d\nFlaky: %d\n", run.Checked, run.Replaced, run.Errors, run.Flaky)
+	if len(run.Replacements) > 0 {
+		body.WriteString("\nReplacements:\n")
+		for _, r := range run.Replacements {
+			fmt.Fprintf(&body, "  %s\n    -> %s\n", r.Original, r.URL)
+		}
+	}
+	msgs := []notification{{
+		Kind:  notifyRun,
+		Title: fmt.Sprintf("archive_tool run: %d replaced, %d errors", run.Replaced, run.Errors),
+		Body:  body.String(),
+		Time:  now,
+	}}
+	if run.Errors == 0 {
+		return msgs
+	}
+
+	kinds := make([]string, 0, len(run.ErrorKinds))
+	for kind := range run.ErrorKinds {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	var alert strings.Builder
+	fmt.Fprintf(&alert, "Run %s had %d errors of %d links checked:\n", run.ID, run.Errors, run.Checked)
+	for _, kind := range kinds {
+		fmt.Fprintf(&alert, "  %s: %d\n", kind, run.ErrorKinds[kind])
+	}
+	return append(msgs, notification{
+		Kind:  notifyErrors,
+		Title: fmt.Sprintf("archive_tool run: %d errors", run.Errors),
+		Body:  alert.String(),
+		Time:  now,
+	})
+}
+
+// notifyRunDone delivers a finished run's notifications to the channels
+// routed to them, with the run's client.
+func notifyRunDone(client *http.Client, cfg *Config, run *RunRecord) {
+	if run == nil {
+		return
+	}
+	for _, msg := range runNotifications(run, time.Now()) {
+		for _, err := range deliver(client, cfg, nil, msg) {
+			fmt.Fprintf(os.Stderr, "Error sending the %s notification: %v\n", msg.Kind, err)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// notifyConfig holds the [notify] section of the config file:
+//
+//	[notify]
+//	webhook = "https://hooks.example.com/archive"
+//	email_to = "me@example.com"
+//	email_from = "archive_tool@example.com"
+//	smtp_host = "smtp.example.com:587"
+//	smtp_user = "me@example.com"
+//	rss = "~/public_html/archive_tool.xml"
+//	events = "digest, errors"
+//
+// Events routes notifications to the webhook and email; the feed only has
+// digests. The SMTP password and an optional webhook signing key come from the
+// secrets layer as smtp_password and webhook_secret.
+type notifyConfig struct {
+	Webhook   string
+	EmailTo   string
+	EmailFrom string
+	SMTPHost  string
+	SMTPUser  string
+	RSS       string
+	Events    []string
+}
+
+func (n *notifyConfig) set(key, value string) error {
+	switch key {
+	case "webhook":
+		n.Webhook = value
+	case "email_to":
+		n.EmailTo = value
+	case "email_from":
+		n.EmailFrom = value
+	case "smtp_host":
+		n.SMTPHost = value
+	case "smtp_user":
+		n.SMTPUser = value
+	case "rss":
+		n.RSS = expandHome(value)
+	case "events":
+		events, err := parseNotifyEvents(value)
+		if err != nil {
+			return err
+		}
+		n.Events = events
+	}
+	return nil
+}
+
+func (n *notifyConfig) configured() bool {
+	return n.Webhook != "" || n.EmailTo != "" || n.RSS != ""
+}
+
+// notification is a message delivered to the channels routed to its kind.
+type notification struct {
+	Kind  string    `json:"kind,omitempty"` // digest, run or errors
+	Title string    `json:"title"`
+	Body  string    `json:"body"`
+	Time  time.Time `json:"time"`
+}
+
+// deliver sends a notification to every configured channel routed to its
+// kind and returns the errors of the channels that failed.
+func deliver(client *http.Client, cfg *Config, lock *LockFile, msg notification) []error {
+	var errs []error
+	routed := wantsNotification(cfg.Notify.Events, msg.Kind)
+	if routed && cfg.Notify.Webhook != "" {
+		if err := sendWebhook(client, cfg, msg); err != nil {
+			errs = append(errs, fmt.Errorf("webhook: %w", err))
+		}
+	}
+	if routed && cfg.Notify.EmailTo != "" {
+		if err := sendEmail(cfg, msg); err != nil {
+			errs = append(errs, fmt.Errorf("email: %w", err))
+		}
+	}
+	if cfg.Notify.RSS != "" && msg.Kind == notifyDigest {
+		if err := writeRSS(cfg.Notify.RSS, lock.Digests); err != nil {
+			errs = append(errs, fmt.Errorf("rss: %w", err))
+		}
+	}
+	for _, notifier := range cfg.Notifiers.sorted() {
+		if wantsNotification(notifier.Events, msg.Kind) {
+			if err := notifier.send(client, cfg, msg); err != nil {
+				errs = append(errs, fmt.Errorf("notifier %s: %w", notifier.Name, err))
+			}
+		}
+	}
+	return errs
+}
+
+// sendWebhook POSTs the notification as JSON. With a webhook_secret the body
+// is signed in the X-Archive-Tool-Signature header (hex HMAC-SHA256).
+func sendWebhook(client *http.Client, cfg *Config, msg notification) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", cfg.Notify.Webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if secret, err := cfg.Secrets.get("webhook_secret"); err == nil {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		req.Header.Set("X-Archive-Tool-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func sendEmail(cfg *Config, msg notification) error {
+	n := cfg.Notify
+	if n.SMTPHost == "" {
+		return fmt.Errorf("smtp_host is not configured")
+	}
+
+	from := n.EmailFrom
+	if from == "" {
+		from = n.SMTPUser
+	}
+
+	var auth smtp.Auth
+	if n.SMTPUser != "" {
+		password, err := cfg.Secrets.get("smtp_password")
+		if err != nil {
+			return err
+		}
+		host, _, err := net.SplitHostPort(n.SMTPHost)
+		if err != nil {
+			host = n.SMTPHost
+		}
+		auth = smtp.PlainAuth("", n.SMTPUser, password, host)
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", n.EmailTo)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", msg.Title)
+	fmt.Fprintf(&buf, "Date: %s\r\n", msg.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	buf.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+
+	return smtp.SendMail(n.SMTPHost, auth, from, strings.Split(n.EmailTo, ","), buf.Bytes())
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title       string    `xml:"title"`
+	Description string    `xml:"description"`
+	Items       []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string `xml:"title"`
+	Description string `xml:"description"`
+	PubDate     string `xml:"pubDate"`
+	GUID        string `xml:"guid"`
+}
+
+// writeRSS regenerates the feed from the stored digests, newest first.
+func writeRSS(path string, digests []notification) error {
+	feed := rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:       "archive_tool digest",
+			Description: "Summaries of dead links found and replaced in your bookmarks",
+		},
+	}
+	for i := len(digests) - 1; i >= 0; i-- {
+		d := digests[i]
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:       d.Title,
+			Description: d.Body,
+			PubDate:     d.Time.Format(time.RFC1123Z),
+			GUID:        "archive_tool-digest-" + d.Time.UTC().Format("20060102T150405Z"),
+		})
+	}
+
+	data, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append([]byte(xml.Header), append(data, '\n')...), 0644)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// pagesField is the frontmatter field --follow-pages lists the captures of
+// an article's further pages in.
+const pagesField = "pages"
+
+// maxArticlePages bounds how far a rel=next chain is followed.
+const maxArticlePages = 20
+
+var (
+	nextLinkPattern = regexp.MustCompile(`(?is)<(?:link|a)\b[^>]*\brel\s*=\s*["']?next\b[^>]*>`)
+	hrefPattern     = regexp.MustCompile(`(?is)\bhref\s*=\s*["']([^"']+)["']`)
+	anchorPattern   = regexp.MustCompile(`(?is)<a\b([^>]*)>(.*?)</a>`)
+
+	// singlePageText and singlePageHref recognize the link to an article's
+	// single-page or print-all view
+	singlePageText = regexp.MustCompile(`(?i)\b(?:single[- ]page|one page|view all|show all|all pages|full article)\b`)
+	singlePageHref = regexp.MustCompile(`(?i)[?&](?:page=all|view=all|showall=1|single=1|singlepage=1)\b|/(?:all|singlepage|single-page)/?$`)
+)
+
+// articlePage is what one page of a captured article links to.
+type articlePage struct {
+	next, single string
+}
+
+// readArticlePage fetches a Wayback capture as it was recorded and finds its
+// rel=next link and the link to its single-page view, both absolute.
+func readArticlePage(ctx context.Context, client *http.Client, snapshotURL string) (articlePage, error) {
+	m := waybackReplayPattern.FindStringSubmatch(snapshotURL)
+	if m == nil {
+		return articlePage{}, fmt.Errorf("%s is not a Wayback capture", snapshotURL)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/%sid_/%s", waybackAPI, m[1], m[3]), nil)
+	if err != nil {
+		return articlePage{}, err
+	}
+	req.Header.Set("User-Agent", archiveUserAgent)
+	resp, err := client.Do(req)
+	if err != nil {
+		return articlePage{}, classifyError("page lookup", snapshotURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return articlePage{}, statusError("page lookup", snapshotURL, resp.StatusCode)
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxSnapshotBytes))
+	html := string(body)
+
+	base, err := url.Parse(m[3])
+	if err != nil {
+		return articlePage{}, err
+	}
+	resolve := func(href string) string {
+		u, err := base.Parse(strings.TrimSpace(href))
+		if err != nil || u.Scheme != "http" && u.Scheme != "https" || coverageHost(u.String()) != coverageHost(base.String()) {
+			return ""
+		}
+		u.Fragment = ""
+		return u.String()
+	}
+
+	var page articlePage
+	if tag := nextLinkPattern.FindString(html); tag != "" {
+		if h := hrefPattern.FindStringSubmatch(tag); h != nil {
+			page.next = resolve(h[1])
+		}
+	}
+	for _, a := range anchorPattern.FindAllStringSubmatch(html, -1) {
+		h := hrefPattern.FindStringSubmatch(a[1])
+		if h == nil || !singlePageText.MatchString(stripTags(a[2])) && !singlePageHref.MatchString(h[1]) {
+			continue
+		}
+		if single := resolve(h[1]); single != "" && single != base.String() {
+			page.single = single
+			break
+		}
+	}
+	return page, nil
+}
+
+// followPages looks for the rest of a multi-page article whose first page is
+// the capture snapshotURL. It returns the capture of the article's
+// single-page view when it has one, and otherwise the captures of the pages
+// its rel=next chain leads to, in order. A page without a capture ends the
+// chain.
+func followPages(client *http.Client, snapshotURL string, ex *explainer) (single string, pages []string) {
+	m := waybackReplayPattern.FindStringSubmatch(snapshotURL)
+	if m == nil {
+		return "", nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultProviderTimeout)
+	defer cancel()
+	capture := func(link string) string {
+		final, err := headSnapshot(ctx, client, fmt.Sprintf("%s/%s/%s", waybackAPI, m[1], link))
+		if err != nil || final == "" {
+			return ""
+		}
+		if canonical := canonicalWayback(final); canonical != "" {
+			return canonical
+		}
+		return final
+	}
+
+	seen := map[string]bool{m[3]: true}
+	current := snapshotURL
+	for len(pages) < maxArticlePages {
+		page, err := readArticlePage(ctx, client, current)
+		if err != nil {
+			ex.logf("could not read %s for further pages: %v", current, err)
+			break
+		}
+		if current == snapshotURL && page.single != "" {
+			if view := capture(page.single); view != "" {
+				ex.logf("article has a single-page view, %s, captured at %s", page.single, view)
+				return view, nil
+			}
+			ex.logf("article has a single-page view, %s, but it was never captured", page.single)
+		}
+		if page.next == "" || seen[page.next] {
+			break
+		}
+		seen[page.next] = true
+		next := capture(page.next)
+		if next == "" {
+			ex.logf("next page %s was never captured", page.next)
+			break
+		}
+		pages = append(pages, next)
+		current = next
+	}
+	if len(pages) > 0 {
+		ex.logf("article continues on %d more page(s)", len(pages))
+	}
+	return "", pages
+}
+
+// setFrontmatterList sets key in the frontmatter of data to a block list of
+// values, replacing the key and its items where it exists.
+func setFrontmatterList(data []byte, key string, values []string) []byte {
+	block := make([]string, len(values))
+	for i, value := range values {
+		block[i] = "  - " + quoteYAMLLike("", value)
+	}
+	return setFrontmatterBlock(data, key, block)
+}
+
+// setFrontmatterBlock sets key in the frontmatter of data to the lines of a
+// block, replacing the key and its block where it exists: the list items
+// and indented lines that follow it.
+func setFrontmatterBlock(data []byte, key string, block []string) []byte {
+	lines := strings.Split(string(data), "\n")
+	start, end, ok := frontmatterBounds(lines)
+	if !ok {
+		return data
+	}
+	eol := ""
+	if strings.HasSuffix(lines[end], "\r") {
+		eol = "\r"
+	}
+	field := []string{key + ":" + eol}
+	for _, line := range block {
+		field = append(field, line+eol)
+	}
+
+	at, last := end, end-1
+	for i := start + 1; i < end; i++ {
+		if strings.HasPrefix(lines[i], key+":") {
+			at, last = i, i
+			for last+1 < end && (strings.HasPrefix(strings.TrimSpace(lines[last+1]), "- ") || strings.HasPrefix(lines[last+1], " ") || strings.HasPrefix(lines[last+1], "\t")) {
+				last++
+			}
+			break
+		}
+	}
+	rest := append(field, lines[last+1:]...)
+	lines = append(lines[:at], rest...)
+	return []byte(strings.Join(lines, "\n"))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// paywallPolicy is the [paywalls] section:
+//
+//	[paywalls]
+//	hosts = "nytimes.com, ft.com, wsj.com"
+//	prefer = "archive_today"
+//
+// The Wayback Machine mostly captures a paywalled article as its paywall;
+// archive.today captures what a reader sees, often the full text. Copies
+// from the preferred provider are scored up for those hosts and their
+// subdomains, and the provider is asked even when it is not configured.
+type paywallPolicy struct {
+	Hosts  hostSet
+	Prefer string
+}
+
+var defaultPaywallPolicy = paywallPolicy{Prefer: "archive_today"}
+
+// paywallSettings are the [paywalls] settings of this process, set once the
+// config is final.
+var paywallSettings = defaultPaywallPolicy
+
+// paywallBonus is what a copy from the preferred provider gains: more than
+// closeness to the date, size and provider order together, less than a
+// failed replay or the saved text costs.
+const paywallBonus = 4
+
+func (p *paywallPolicy) set(key, value string) error {
+	switch key {
+	case "hosts":
+		p.Hosts.add(value)
+	case "prefer":
+		if _, ok := archiveProviders[value]; !ok {
+			return fmt.Errorf("unknown archive provider %q", value)
+		}
+		p.Prefer = value
+	default:
+		return fmt.Errorf("unknown [paywalls] key %q", key)
+	}
+	return nil
+}
+
+// covers reports whether link is on a paywalled host or one of its
+// subdomains.
+func (p paywallPolicy) covers(link string) bool {
+	if len(p.Hosts) == 0 {
+		return false
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for host != "" {
+		if p.Hosts[strings.TrimPrefix(host, "www.")] {
+			return true
+		}
+		_, host, _ = strings.Cut(host, ".")
+	}
+	return false
+}
+
+// order is providers in the order to prefer them for link: for a paywalled
+// link the preferred provider comes first, asked even if it is not among
+// them.
+func (p paywallPolicy) order(link string, providers []archiveProvider) []archiveProvider {
+	prefer := archiveProviders[p.Prefer]
+	if !p.covers(link) || prefer == nil {
+		return providers
+	}
+	ordered := []archiveProvider{prefer}
+	for _, provider := range providers {
+		if provider.name() != p.Prefer {
+			ordered = append(ordered, provider)
+		}
+	}
+	return ordered
+}
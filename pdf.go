@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// pdfField is the frontmatter field --pdf records the name of a bookmark's
+// PDF in. The PDF sits next to the bookmark, named after it.
+const pdfField = "pdf"
+
+// pdfTimeout bounds how long Chrome may take to load and print a page.
+const pdfTimeout = 90 * time.Second
+
+// chromeNames are the names Chrome and Chromium go by on the PATH.
+var chromeNames = []string{"google-chrome", "google-chrome-stable", "chromium", "chromium-browser", "chrome", "msedge"}
+
+// chromeCommand finds the browser PDFs are printed with: the one configured,
+// or Chrome or Chromium where they are usually installed. It is run headless
+// from the command line.
+func chromeCommand(configured string) (string, error) {
+	if configured != "" {
+		path, err := exec.LookPath(configured)
+		if err != nil {
+			return "", fmt.Errorf("cannot run Chrome %q: %v", configured, err)
+		}
+		return path, nil
+	}
+	for _, name := range chromeNames {
+		if path, err := exec.LookPath(name); err == nil {
+			return path, nil
+		}
+	}
+	var installed []string
+	switch runtime.GOOS {
+	case "darwin":
+		installed = []string{"/Applications/Google Chrome.app/Contents/MacOS/Google Chrome", "/Applications/Chromium.app/Contents/MacOS/Chromium"}
+	case "windows":
+		for _, dir := range []string{os.Getenv("ProgramFiles"), os.Getenv("ProgramFiles(x86)"), os.Getenv("LocalAppData")} {
+			if dir != "" {
+				installed = append(installed, filepath.Join(dir, `Google\Chrome\Application\chrome.exe`))
+			}
+		}
+	}
+	for _, path := range installed {
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("--pdf needs Chrome or Chromium; install one, or set chrome = \"/path/to/chrome\" in the config file")
+}
+
+// pdfPath is where a bookmark's PDF goes: next to it, under its name.
+func pdfPath(bookmark *BookmarkFile) string {
+	return strings.TrimSuffix(bookmark.Path, filepath.Ext(bookmark.Path)) + ".pdf"
+}
+
+// pdfPageURL is the URL Chrome prints for pageURL. A Wayback capture is
+// printed without the archive's toolbar, but with its links still pointing
+// into the archive, so the page loads its archived images and stylesheets
+// rather than the dead site's.
+func pdfPageURL(pageURL string) string {
+	if m := waybackReplayPattern.FindStringSubmatch(pageURL); m != nil {
+		return fmt.Sprintf("%s/%sif_/%s", waybackAPI, m[1], m[3])
+	}
+	return wireURL(pageURL)
+}
+
+// renderPDF prints pageURL to a PDF at path with headless Chrome. The PDF is
+// written read-only: it stands for the page as it was when it was printed.
+func renderPDF(chrome, pageURL, path string) error {
+	profile, err := os.MkdirTemp("", "archive_tool-chrome-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(profile)
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	// Chrome resolves a relative path against its own working directory
+	tmpPath, err := filepath.Abs(tmp.Name())
+	if err != nil {
+		return err
+	}
+
+	args := []string{
+		"--headless=new",
+		"--disable-gpu",
+		"--hide-scrollbars",
+		"--no-first-run",
+		"--no-default-browser-check",
+		"--user-data-dir=" + profile,
+		"--user-agent=" + userAgent,
+		"--no-pdf-header-footer",
+		// Give scripts and late images time to load before printing
+		"--virtual-time-budget=15000",
+		"--print-to-pdf=" + tmpPath,
+		pdfPageURL(pageURL),
+	}
+	// Chrome will not run its sandbox as root, as in most containers
+	if os.Geteuid() == 0 {
+		args = append([]string{"--no-sandbox"}, args...)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pdfTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, chrome, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("printing %s to PDF: timed out after %v", pageURL, pdfTimeout)
+		}
+		return fmt.Errorf("printing %s to PDF: %v: %s", pageURL, err, lastLine(stderr.String()))
+	}
+
+	// Chrome exits cleanly even when it printed nothing
+	data, err := os.ReadFile(tmpPath)
+	if err != nil || !bytes.HasPrefix(data, []byte("%PDF-")) {
+		return fmt.Errorf("printing %s to PDF: Chrome wrote no PDF: %s", pageURL, lastLine(stderr.String()))
+	}
+	if err := os.Chmod(tmpPath, 0444); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// lastLine is the last line of a command's output, which is where Chrome
+// says what went wrong.
+func lastLine(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// keepPDF prints pageURL to the bookmark's PDF, unless a PDF is there
+// already, and returns its name relative to the bookmark.
+func keepPDF(bookmark *BookmarkFile, pageURL string, opts runOptions) (string, error) {
+	path := pdfPath(bookmark)
+	if _, err := os.Stat(path); err != nil {
+		opts.unlocked(func() { err = renderPDF(opts.Chrome, pageURL, path) })
+		if err != nil {
+			return "", err
+		}
+	}
+	return filepath.Base(path), nil
+}
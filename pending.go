@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// pendingFileName is the review checklist written into the collection by
+// `--queue` runs. It is never treated as a bookmark.
+const pendingFileName = "PENDING_REPLACEMENTS.md"
+
+const pendingHeader = `# Pending Replacements
+
+Dead links found by archive_tool, with the archived copy it proposes. Tick an
+item (` + "`- [x]`" + `) to accept it, optionally after changing its ` + "`to:`" + ` line to one
+of the alternatives, then run ` + "`archive_tool apply --pending`" + `. Unticked items
+stay here. Delete an item to have the link checked again on the next run.
+`
+
+// pendingItem is one proposed replacement in the checklist. File is relative
+// to the collection directory.
+type pendingItem struct {
+	File         string
+	Original     string
+	URL          string
+	Alternatives []string
+	Checked      bool
+
+	// skip drops the item and keeps the link, as an /archive skip asks
+	skip bool
+}
+
+type pendingList struct {
+	path  string
+	items []*pendingItem
+}
+
+var (
+	pendingVersionLine = regexp.MustCompile(`^<!-- ` + versionField + `: (\S+) -->$`)
+	pendingItemLine    = regexp.MustCompile("^- \\[([ xX])\\] `?([^`]+?)`?\\s*$")
+	pendingFieldRe     = regexp.MustCompile(`^\s+- (from|to|or): (\S+)\s*$`)
+)
+
+func pendingPath(dir string) string {
+	return filepath.Join(dir, pendingFileName)
+}
+
+// loadPendingList reads the checklist in dir. A missing file is an empty list.
+func loadPendingList(dir string) (*pendingList, error) {
+	list := &pendingList{path: pendingPath(dir)}
+	data, err := os.ReadFile(list.path)
+	if os.IsNotExist(err) {
+		return list, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var item *pendingItem
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if m := pendingVersionLine.FindStringSubmatch(line); m != nil {
+			v, err := parseFormatVersion(m[1])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", list.path, lineNum, err)
+			}
+			if v > formatVersion {
+				return nil, fmt.Errorf("%s: %w", list.path, newerFormatError{v})
+			}
+			continue
+		}
+		if m := pendingItemLine.FindStringSubmatch(line); m != nil {
+			item = &pendingItem{File: filepath.FromSlash(m[2]), Checked: m[1] != " "}
+			list.items = append(list.items, item)
+			continue
+		}
+		m := pendingFieldRe.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		if item == nil {
+			return nil, fmt.Errorf("%s:%d: %s: line outside an item", list.path, lineNum, m[1])
+		}
+		switch m[1] {
+		case "from":
+			item.Original = m[2]
+		case "to":
+			item.URL = m[2]
+		case "or":
+			item.Alternatives = append(item.Alternatives, m[2])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, item := range list.items {
+		if item.Original == "" || item.URL == "" {
+			return nil, fmt.Errorf("%s: item %s needs both a from: and a to: line", list.path, item.File)
+		}
+	}
+	return list, nil
+}
+
+func (l *pendingList) has(file string) bool {
+	for _, item := range l.items {
+		if item.File == file {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *pendingList) add(item *pendingItem) {
+	l.items = append(l.items, item)
+}
+
+// save rewrites the checklist, or removes it once it is empty.
+func (l *pendingList) save() error {
+	if len(l.items) == 0 {
+		if err := os.Remove(l.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	var b strings.Builder
+	b.WriteString(pendingHeader)
+	fmt.Fprintf(&b, "\n<!-- %s: %d -->\n", versionField, formatVersion)
+	for _, item := range l.items {
+		box := " "
+		if item.Checked {
+			box = "x"
+		}
+		fmt.Fprintf(&b, "\n- [%s] `%s`\n", box, filepath.ToSlash(item.File))
+		fmt.Fprintf(&b, "  - from: %s\n", item.Original)
+		fmt.Fprintf(&b, "  - to: %s\n", item.URL)
+		for _, alt := range item.Alternatives {
+			fmt.Fprintf(&b, "  - or: %s\n", alt)
+		}
+	}
+	return writeFileAtomic(l.path, []byte(b.String()), 0644)
+}
+
+// relativeTo returns file relative to dir, or file itself if it is outside.
+func relativeTo(dir, file string) string {
+	rel, err := filepath.Rel(dir, file)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return file
+	}
+	return rel
+}
+
+// queueReplacement puts a proposed replacement on the checklist instead of
+// rewriting the bookmark.
+func queueReplacement(opts runOptions, bookmark *BookmarkFile, chosen *snapshotCandidate, candidates []*snapshotCandidate) {
+	item := &pendingItem{
+		File:     relativeTo(opts.Dir, bookmark.Path),
+		Original: bookmark.Link,
+		URL:      chosen.URL,
+	}
+	for _, candidate := range candidates {
+		if candidate != chosen {
+			item.Alternatives = append(item.Alternatives, candidate.URL)
+		}
+	}
+	opts.Pending.add(item)
+}
+
+// applyPending makes the ticked replacements in the checklist in dir and
+// keeps the rest for later, committing them when gitCommit is set.
+func applyPending(dir string, list *pendingList, gitCommit bool) error {
+	lock, err := loadLockFile(false)
+	if err != nil {
+		return fmt.Errorf("loading lock file: %w", err)
+	}
+
+	now := time.Now()
+	run := &RunRecord{
+		ID:      newRunID(now),
+		Trigger: "apply",
+		Started: now,
+		Status:  "completed",
+	}
+
+	var remaining []*pendingItem
+	skipped := 0
+	for _, item := range list.items {
+		if item.skip {
+			// Kept as it is, and not proposed again while it is unchanged
+			path := item.File
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(dir, path)
+			}
+			if err := markFileProcessed(lock, path); err != nil {
+				fmt.Fprintf(os.Stderr, "Error updating the lock file for %s: %v\n", item.File, err)
+				remaining = append(remaining, item)
+				continue
+			}
+			fmt.Printf("Skipped, link kept: %s\n", item.Original)
+			skipped++
+			continue
+		}
+		if !item.Checked {
+			remaining = append(remaining, item)
+			continue
+		}
+		path := item.File
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+
+		bookmark, err := parseBookmarkFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error parsing %s: %v\n", item.File, err)
+			run.recordError(item.File, err)
+			remaining = append(remaining, item)
+			continue
+		}
+		if bookmark.Link != item.Original {
+			fmt.Fprintf(os.Stderr, "Error: %s now links to %s, not %s; leaving it on the list\n", item.File, bookmark.Link, item.Original)
+			run.Errors++
+			remaining = append(remaining, item)
+			continue
+		}
+		if err := lock.rewriteBookmark(bookmark, item.URL); err != nil {
+			fmt.Fprintf(os.Stderr, "Error updating %s: %v\n", item.File, err)
+			run.recordError(item.File, err)
+			remaining = append(remaining, item)
+			continue
+		}
+
+		markFileProcessed(lock, path)
+		replacement := &Replacement{
+			File:     path,
+			Original: item.Original,
+			URL:      item.URL,
+			Chosen:   candidateID(item.URL),
+		}
+		lock.journalOrWarn(journalEntry{Op: "replacement", RunID: run.ID, Replacement: replacement})
+		run.Replaced++
+		run.Replacements = append(run.Replacements, replacement)
+		fmt.Printf("%s Replaced: %s\n  -> %s\n", console.mark(), item.Original, item.URL)
+	}
+
+	run.Finished = time.Now()
+	if run.Replaced > 0 || run.Errors > 0 || skipped > 0 {
+		lock.addRun(run)
+		if err := saveLockFile(lock); err != nil {
+			return fmt.Errorf("saving lock file: %w", err)
+		}
+	}
+
+	list.items = remaining
+	if err := list.save(); err != nil {
+		return fmt.Errorf("updating %s: %w", list.path, err)
+	}
+	fmt.Printf("Applied %d replacements", run.Replaced)
+	if skipped > 0 {
+		fmt.Printf(", skipped %d", skipped)
+	}
+	fmt.Printf(", %d left in %s\n", len(remaining), list.path)
+	if gitCommit && (len(lock.rewritten) > 0 || skipped > 0) {
+		if err := commitRewrites(dir, append(lock.rewritten, list.path), run); err != nil {
+			return fmt.Errorf("committing: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// pinboardAPI is Pinboard's v1 API. pinboardSecret is the secret holding
+// the API token, "user:TOKEN" as shown on the account's password page.
+const (
+	pinboardAPI    = "https://api.pinboard.in/v1"
+	pinboardSecret = "pinboard_token"
+)
+
+// pinboardProvider looks a link up among the bookmarks of a Pinboard
+// account, whose paid tier archives every bookmarked page. The API does not
+// expose the archived copy's own URL, so the candidate is the bookmark's page
+// on Pinboard, which links to it. It is not in archiveProviders: it needs an
+// account, and is consulted before the public archives instead of with them.
+type pinboardProvider struct {
+	user  string
+	token string
+}
+
+func newPinboardProvider(secrets *secretStore) (*pinboardProvider, error) {
+	token, err := secrets.get(pinboardSecret)
+	if err != nil {
+		return nil, err
+	}
+	user, _, ok := strings.Cut(strings.TrimSpace(token), ":")
+	if !ok || user == "" {
+		return nil, fmt.Errorf("secret %q must be the API token as \"user:TOKEN\"", pinboardSecret)
+	}
+	return &pinboardProvider{user: user, token: strings.TrimSpace(token)}, nil
+}
+
+func (p *pinboardProvider) name() string { return "pinboard" }
+
+func (p *pinboardProvider) endpoint() string { return "https://api.pinboard.in/" }
+
+type pinboardPosts struct {
+	User  string `json:"user"`
+	Posts []struct {
+		Href string `json:"href"`
+		Hash string `json:"hash"`
+		Time string `json:"time"`
+	} `json:"posts"`
+}
+
+func (p *pinboardProvider) lookup(ctx context.Context, client *http.Client, link, date string, now time.Time) ([]*snapshotCandidate, error) {
+	q := url.Values{}
+	q.Set("url", link)
+	q.Set("auth_token", p.token)
+	q.Set("format", "json")
+	endpoint := pinboardAPI + "/posts/get"
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		// The request URL carries the token; report the endpoint alone
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, classifyError("pinboard lookup", endpoint, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, fmt.Errorf("pinboard lookup: token rejected (check the %s secret)", pinboardSecret)
+	}
+	if err := statusError("pinboard lookup", endpoint, resp.StatusCode); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("pinboard lookup: status %d", resp.StatusCode)
+	}
+
+	var answer pinboardPosts
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return nil, fmt.Errorf("pinboard lookup: %w", err)
+	}
+	var candidates []*snapshotCandidate
+	for _, post := range answer.Posts {
+		if len(post.Hash) < 12 {
+			continue
+		}
+		candidate := &snapshotCandidate{URL: fmt.Sprintf("https://pinboard.in/u:%s/b:%s/", url.PathEscape(p.user), post.Hash[:12])}
+		if t, err := time.Parse(time.RFC3339, post.Time); err == nil {
+			candidate.Captured = t
+		}
+		candidates = append(candidates, candidate)
+	}
+	return candidates, nil
+}
+
+// pinboardPost is a bookmark as posts/all returns it. Description is the
+// title and Extended the notes; Tags are separated by spaces.
+type pinboardPost struct {
+	Href        string `json:"href"`
+	Description string `json:"description"`
+	Extended    string `json:"extended"`
+	Time        string `json:"time"`
+	Tags        string `json:"tags"`
+	ToRead      string `json:"toread"`
+}
+
+// fetchPinboardPosts downloads every bookmark of the account. Pinboard
+// allows posts/all once every five minutes.
+func fetchPinboardPosts(client *http.Client, token string) ([]pinboardPost, error) {
+	q := url.Values{}
+	q.Set("auth_token", token)
+	q.Set("format", "json")
+	endpoint := pinboardAPI + "/posts/all"
+	resp, err := client.Get(endpoint + "?" + q.Encode())
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, classifyError("pinboard import", endpoint, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, fmt.Errorf("pinboard import: token rejected (check the %s secret)", pinboardSecret)
+	}
+	if err := statusError("pinboard import", endpoint, resp.StatusCode); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("pinboard import: status %d", resp.StatusCode)
+	}
+	var posts []pinboardPost
+	if err := json.NewDecoder(resp.Body).Decode(&posts); err != nil {
+		return nil, fmt.Errorf("pinboard import: %w", err)
+	}
+	return posts, nil
+}
+
+// bookmark renders a post as a bookmark file, with the frontmatter keys the
+// collection uses and the post's notes as the body. Unread posts get the
+// toread tag.
+func (p pinboardPost) bookmark() string {
+	tags := strings.Fields(p.Tags)
+	if p.ToRead == "yes" && !hasTag(tags, "toread") {
+		tags = append(tags, "toread")
+	}
+	title := strings.TrimSpace(p.Description)
+	if title == "" {
+		title = p.Href
+	}
+
+	var b strings.Builder
+	b.WriteString("---\n")
+	fmt.Fprintf(&b, "title: %s\n", quoteYAMLLike(`"`, title))
+	fmt.Fprintf(&b, "%s: %s\n", bookmarkKeys.Link, quoteYAMLLike(`"`, p.Href))
+	if p.Time != "" {
+		fmt.Fprintf(&b, "%s: %s\n", bookmarkKeys.Date, p.Time)
+	}
+	if len(tags) > 0 {
+		quoted := make([]string, len(tags))
+		for i, tag := range tags {
+			quoted[i] = quoteYAMLLike("", tag)
+		}
+		fmt.Fprintf(&b, "%s: [%s]\n", bookmarkKeys.Tags, strings.Join(quoted, ", "))
+	}
+	fmt.Fprintf(&b, "%s: %d\n", versionField, formatVersion)
+	b.WriteString("---\n")
+	if notes := strings.TrimSpace(p.Extended); notes != "" {
+		b.WriteString("\n" + notes + "\n")
+	}
+	return b.String()
+}
+
+// fileName is the name of a post's bookmark file, from its title or else
+// its URL, and unique among taken.
+func (p pinboardPost) fileName(taken map[string]bool) string {
+	base := tagSlug(p.Description)
+	if base == "" {
+		if u, err := url.Parse(p.Href); err == nil {
+			base = tagSlug(u.Hostname() + u.Path)
+		}
+	}
+	for strings.Contains(base, "--") {
+		base = strings.ReplaceAll(base, "--", "-")
+	}
+	if base == "" {
+		base = "bookmark"
+	}
+	if r := []rune(base); len(r) > 80 {
+		base = strings.TrimRight(string(r[:80]), "-")
+	}
+	name := base + ".md"
+	for i := 2; taken[strings.ToLower(name)]; i++ {
+		name = fmt.Sprintf("%s-%d.md", base, i)
+	}
+	taken[strings.ToLower(name)] = true
+	return name
+}
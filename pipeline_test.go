@@ -0,0 +1,317 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata with the results")
+
+// pipelineCase is a bookmark run through the full pipeline against the fake
+// archive. Its content after the run is in testdata/pipeline/caseNN.golden.
+type pipelineCase struct {
+	name      string
+	link      string
+	date      string
+	tags      string
+	snapshots []string
+	limited   bool
+	shortened bool   // snapshots are of the short link's destination
+	canonical bool   // snapshots are of the AMP page's article
+	image     bool   // snapshots are of the first image in the notes
+	redirect  string // the single snapshot is a captured redirect to this URL
+	notes     string
+}
+
+var pipelineCases = []pipelineCase{
+	{
+		name:      "dead link replaced with closest capture",
+		link:      "http://dead.test/article",
+		date:      "2020-01-15",
+		snapshots: []string{"20200110120000"},
+	},
+	{
+		name:      "closest of several captures wins",
+		link:      "http://dead.test/two",
+		date:      "2019-06-01",
+		snapshots: []string{"20190520000000", "20240101000000"},
+	},
+	{
+		name: "live link left alone",
+		link: "http://alive.test/post",
+		date: "2021-03-01",
+	},
+	{
+		name:      "410 Gone is dead",
+		link:      "http://gone.test/old",
+		date:      "2018-02-02",
+		snapshots: []string{"20180201000000"},
+	},
+	{
+		name:      "redirect to a 404 is dead",
+		link:      "http://moved.test/page",
+		date:      "2017-07-07",
+		snapshots: []string{"20170707070707"},
+	},
+	{
+		name:      "soft 404 caught by the thorough profile",
+		link:      "http://soft404.test/missing",
+		date:      "2022-05-05",
+		tags:      "test-thorough",
+		snapshots: []string{"20220505000000"},
+	},
+	{
+		name:      "cross-host redirect treated as moved content",
+		link:      "http://rehomed.test/essay",
+		date:      "2019-09-09",
+		snapshots: []string{"20190909000000"},
+	},
+	{
+		name:      "dead short link replaced with a capture of its destination",
+		link:      "http://short.test/to/dead.test/long-article",
+		date:      "2015-05-05",
+		snapshots: []string{"20150505000000"},
+		shortened: true,
+	},
+	{
+		name: "live short link expanded",
+		link: "http://short.test/to/alive.test/long-post",
+		date: "2015-05-05",
+	},
+	{
+		name:      "dead shortener recovered from its archived redirect",
+		link:      "http://oldshort.invalid/x7k",
+		date:      "2012-01-01",
+		snapshots: []string{"20120101000000"},
+		redirect:  "http://alive.test/recovered",
+	},
+	{
+		name: "dead AMP page pointed at its live article",
+		link: "http://amp.alive.test/story",
+		date: "2019-09-09",
+	},
+	{
+		name:      "dead AMP page replaced with a capture of its article",
+		link:      "http://dead.test/story/amp",
+		date:      "2019-09-09",
+		snapshots: []string{"20190909000000"},
+		canonical: true,
+	},
+	{
+		name:      "internationalized domain and path encoded for the archive",
+		link:      "http://bücher.test/straße",
+		date:      "2018-03-03",
+		snapshots: []string{"20180303000000"},
+	},
+	{
+		name:      "scheme-relative link assumed to be https",
+		link:      "//dead.test/relative",
+		date:      "2017-07-07",
+		snapshots: []string{"20170707000000"},
+	},
+	{
+		name: "bracketed link fixed in the file",
+		link: " <http://alive.test/bracketed> ",
+		date: "2017-07-07",
+	},
+	{
+		name: "unusable link skipped without an error",
+		link: "mailto:someone@example.com",
+		date: "2017-07-07",
+	},
+	{
+		name:      "unresolvable host treated as dead",
+		link:      "http://nxdomain.invalid/",
+		date:      "2016-01-01",
+		snapshots: []string{"20160102000000"},
+	},
+	{
+		name:      "only the frontmatter link is rewritten",
+		link:      "http://dead.test/quoted?a=$1",
+		date:      "2021-01-01",
+		snapshots: []string{"20210101000000"},
+		notes:     "link: http://dead.test/quoted?a=$1 is also mentioned here.",
+	},
+	{
+		name:      "dead embedded image replaced with its image capture",
+		link:      "http://alive.test/gallery",
+		date:      "2019-04-04",
+		snapshots: []string{"20190404000000"},
+		notes:     "![chart](http://dead.test/chart.png) and ![logo](http://img.test/logo.png)",
+		image:     true,
+	},
+	{
+		name:      "sensitive dead link annotated, never looked up",
+		link:      "http://dead.test/private",
+		date:      "2020-02-02",
+		tags:      "test-sensitive",
+		snapshots: []string{"20200202000000"},
+	},
+	{
+		name:      "token stripped before the lookup",
+		link:      "http://dead.test/doc?page=2&access_token=s3cr3t",
+		date:      "2022-02-02",
+		snapshots: []string{"20220202000000"},
+	},
+	{
+		name:      "redirect loop treated as dead",
+		link:      "http://loop.test/start",
+		date:      "2015-05-05",
+		snapshots: []string{"20150505000000"},
+	},
+	{
+		name:      "cookie gate left alone",
+		link:      "http://cookiegate.test/article",
+		date:      "2015-05-05",
+		snapshots: []string{"20150505000000"},
+	},
+	{
+		name: "no capture leaves the link",
+		link: "http://dead.test/never-archived",
+		date: "2020-01-01",
+	},
+	{
+		name:      "rate-limited lookup leaves the link",
+		link:      "http://dead.test/busy",
+		date:      "2020-01-01",
+		snapshots: []string{"20200101000000"},
+		limited:   true,
+	},
+}
+
+func (c pipelineCase) bookmark() string {
+	var b strings.Builder
+	b.WriteString("---\n")
+	fmt.Fprintf(&b, "title: \"%s\"\n", c.name)
+	fmt.Fprintf(&b, "link: \"%s\"\n", c.link)
+	fmt.Fprintf(&b, "date: %s\n", c.date)
+	if c.tags != "" {
+		fmt.Fprintf(&b, "tags: [%s]\n", c.tags)
+	}
+	b.WriteString("---\n\nNotes about " + c.name + ".\n")
+	if c.notes != "" {
+		b.WriteString(c.notes + "\n")
+	}
+	return b.String()
+}
+
+// TestPipeline runs the whole pipeline, with several workers, against an
+// in-process fake Wayback Machine and fake sites, with a fixed clock and a
+// throwaway collection and lock file, and compares every bookmark with its
+// golden file. Run with -update to rewrite the golden files.
+func TestPipeline(t *testing.T) {
+	clock := FixedClock(time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC))
+	archive := newFakeArchive(t, clock)
+
+	dir := t.TempDir()
+	files := make([]string, len(pipelineCases))
+	for i, c := range pipelineCases {
+		for _, ts := range c.snapshots {
+			switch {
+			case c.redirect != "":
+				archive.addRedirectCapture(t, c.link, ts, c.redirect)
+			case c.image:
+				archive.addSnapshot(t, markdownImagePattern.FindStringSubmatch(c.notes)[1], ts)
+			case c.shortened:
+				archive.addSnapshot(t, "http://"+strings.TrimPrefix(c.link, "http://short.test/to/"), ts)
+			case c.canonical:
+				archive.addSnapshot(t, canonicalArticle(c.link, nil), ts)
+			default:
+				// The archive never sees a link's secrets
+				clean, _ := stripSecrets(wireURL(tidyLink(c.link)))
+				archive.addSnapshot(t, clean, ts)
+			}
+		}
+		if c.limited {
+			archive.rateLimit(c.link)
+		}
+		files[i] = filepath.Join(dir, fmt.Sprintf("case%02d.md", i+1))
+		if err := os.WriteFile(files[i], []byte(c.bookmark()), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("ARCHIVE_TOOL_LOCK", filepath.Join(t.TempDir(), "lock.json"))
+
+	providers, err := newProviderChain("wayback", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var policies tagPolicies
+	policies.add("test-thorough", "thorough")
+	policies.add("test-sensitive", "sensitive")
+	if providers.sensitive, err = newSensitivePolicy("", policies); err != nil {
+		t.Fatal(err)
+	}
+	providers.privacy = true
+
+	var shorteners shortenerSet
+	shorteners.add("short.test, oldshort.invalid")
+
+	opts := runOptions{
+		Dir:              dir,
+		Trigger:          "test",
+		Profile:          runProfiles["fast"],
+		Concurrency:      4,
+		TagPolicies:      policies,
+		Providers:        providers,
+		Flaky:            defaultFlakyPolicy,
+		RetryPolicy:      defaultRetryPolicy,
+		Shorteners:       shorteners,
+		ExpandShorteners: true,
+		FixLinks:         true,
+		CheckAssets:      true,
+		Privacy:          true,
+		Redirects:        redirectPolicy{MaxHops: defaultMaxRedirects, CrossHost: redirectDead, Downgrade: redirectFlag},
+		Locale:           loadLocale("en"),
+		Transport:        archive.transport(),
+		Clock:            clock,
+	}
+	run, err := runCheck(opts, newController())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, c := range pipelineCases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := os.ReadFile(files[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			golden := filepath.Join("testdata", "pipeline", fmt.Sprintf("case%02d.golden", i+1))
+			if *update {
+				if err := os.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(want) {
+				t.Errorf("--- want\n%s--- got\n%s", want, got)
+			}
+		})
+	}
+
+	if n := len(run.Redirects) - len(run.redirectTraps()); n != 2 {
+		t.Errorf("run recorded %d cross-host redirect chains, want 2", n)
+	}
+	if run.Invalid != 1 {
+		t.Errorf("run skipped %d unusable links, want 1", run.Invalid)
+	}
+	if kinds := trapKinds(run.redirectTraps()); kinds["redirect_loop"] != 1 || kinds["cookie_gate"] != 1 {
+		t.Errorf("run recorded redirect traps %v, want one redirect_loop and one cookie_gate", kinds)
+	}
+	if n := len(run.Secrets); n != 1 {
+		t.Errorf("run reported %d links with secrets, want 1", n)
+	}
+	if n := run.ErrorKinds["rate_limited"]; n != 1 {
+		t.Errorf("run recorded %d rate_limited errors, want 1", n)
+	}
+}
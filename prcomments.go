@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// githubSecret is the secret holding a GitHub token that can read pull
+// request comments; GITHUB_TOKEN, as CI sets it, is used when it is not
+// configured.
+const githubSecret = "github_token"
+
+// prCommandPattern matches an /archive command on a line of its own:
+//
+//	/archive use [snapshot] [file]
+//	/archive skip [file]
+//
+// The snapshot is a Wayback timestamp, or its start, or a URL; the file names
+// the bookmark when the comment is not on its checklist item.
+var prCommandPattern = regexp.MustCompile(`(?m)^/archive[ \t]+(use|skip)((?:[ \t]+\S+)*)[ \t]*\r?$`)
+
+// trustedAssociations are the GitHub author associations whose commands are
+// followed; anyone can comment on a public repository.
+var trustedAssociations = map[string]bool{"OWNER": true, "MEMBER": true, "COLLABORATOR": true}
+
+// prComment is a pull request comment: a review comment has a Path and the
+// DiffHunk ending in the line it is on.
+type prComment struct {
+	ID          int64     `json:"id"`
+	Body        string    `json:"body"`
+	Path        string    `json:"path"`
+	DiffHunk    string    `json:"diff_hunk"`
+	Created     time.Time `json:"created_at"`
+	Association string    `json:"author_association"`
+	User        struct {
+		Login string `json:"login"`
+	} `json:"user"`
+}
+
+// prCommand is one /archive command.
+type prCommand struct {
+	Action   string // use or skip
+	Snapshot string
+	File     string
+	Comment  *prComment
+}
+
+// parsePRCommands returns the commands of a comment, in order.
+func parsePRCommands(comment *prComment) []prCommand {
+	var commands []prCommand
+	for _, m := range prCommandPattern.FindAllStringSubmatch(comment.Body, -1) {
+		cmd := prCommand{Action: m[1], Comment: comment}
+		for _, arg := range strings.Fields(m[2]) {
+			if strings.HasSuffix(strings.ToLower(arg), ".md") {
+				cmd.File = arg
+			} else if cmd.Action == "use" {
+				cmd.Snapshot = arg
+			}
+		}
+		commands = append(commands, cmd)
+	}
+	return commands
+}
+
+// fetchPRComments reads the review and conversation comments of a pull
+// request, oldest first.
+func fetchPRComments(client *http.Client, repo, token string, pr int) ([]*prComment, error) {
+	api := strings.TrimSuffix(defaultString(os.Getenv("GITHUB_API_URL"), "https://api.github.com"), "/")
+	var comments []*prComment
+	for _, path := range []string{"pulls/%d/comments", "issues/%d/comments"} {
+		endpoint := fmt.Sprintf("%s/repos/%s/"+path, api, repo, pr)
+		for page := 1; ; page++ {
+			var batch []*prComment
+			if err := githubGet(client, fmt.Sprintf("%s?per_page=100&page=%d", endpoint, page), token, &batch); err != nil {
+				return nil, err
+			}
+			comments = append(comments, batch...)
+			if len(batch) < 100 {
+				break
+			}
+		}
+	}
+	sort.SliceStable(comments, func(i, j int) bool { return comments[i].Created.Before(comments[j].Created) })
+	return comments, nil
+}
+
+func githubGet(client *http.Client, endpoint, token string, v interface{}) error {
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("User-Agent", archiveUserAgent)
+	resp, err := client.Do(req)
+	if err != nil {
+		return classifyError("github", endpoint, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("github: token rejected (check the %s secret)", githubSecret)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("github: %s: status %d", endpoint, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// commentedLine is the checklist line a review comment is on, without the
+// diff marker.
+func commentedLine(comment *prComment) string {
+	hunk := strings.TrimRight(comment.DiffHunk, "\n")
+	line := hunk[strings.LastIndex(hunk, "\n")+1:]
+	if line != "" && strings.ContainsAny(line[:1], "+- ") {
+		line = line[1:]
+	}
+	return strings.TrimRight(line, " \r")
+}
+
+// target finds the checklist item a command is about, and the alternative
+// it was left on, if any.
+func (l *pendingList) target(cmd prCommand) (*pendingItem, string) {
+	matches := func(item *pendingItem, path string) bool {
+		file := filepath.ToSlash(item.File)
+		return path == file || strings.HasSuffix(path, "/"+file)
+	}
+	if cmd.File != "" {
+		for _, item := range l.items {
+			if matches(item, filepath.ToSlash(cmd.File)) {
+				return item, ""
+			}
+		}
+		return nil, ""
+	}
+
+	comment := cmd.Comment
+	if comment.Path == "" {
+		return nil, ""
+	}
+	if filepath.Base(comment.Path) != pendingFileName {
+		// A comment on the bookmark itself
+		for _, item := range l.items {
+			if matches(item, comment.Path) {
+				return item, ""
+			}
+		}
+		return nil, ""
+	}
+
+	line := commentedLine(comment)
+	if m := pendingItemLine.FindStringSubmatch(line); m != nil {
+		for _, item := range l.items {
+			if filepath.ToSlash(item.File) == m[2] {
+				return item, ""
+			}
+		}
+		return nil, ""
+	}
+	if m := pendingFieldRe.FindStringSubmatch(line); m != nil {
+		for _, item := range l.items {
+			switch {
+			case m[1] == "to" && item.URL == m[2], m[1] == "from" && item.Original == m[2]:
+				return item, ""
+			case m[1] == "or":
+				for _, alt := range item.Alternatives {
+					if alt == m[2] {
+						return item, alt
+					}
+				}
+			}
+		}
+	}
+	return nil, ""
+}
+
+// choose makes link the item's replacement, keeping the one it had among
+// the alternatives.
+func (item *pendingItem) choose(link string) {
+	if link == item.URL {
+		return
+	}
+	var alternatives []string
+	for _, alt := range item.Alternatives {
+		if alt != link {
+			alternatives = append(alternatives, alt)
+		}
+	}
+	item.Alternatives = append(alternatives, item.URL)
+	item.URL = link
+}
+
+// resolveSnapshot finds the snapshot a use command names among the item's
+// candidates, or asks the Wayback Machine for the capture closest to a
+// timestamp none of them has.
+func (item *pendingItem) resolveSnapshot(client *http.Client, snapshot string) (string, error) {
+	for _, link := range append([]string{item.URL}, item.Alternatives...) {
+		if link == snapshot {
+			return link, nil
+		}
+		if m := waybackTimestampPattern.FindStringSubmatch(link); m != nil && strings.HasPrefix(m[1], snapshot) {
+			return link, nil
+		}
+	}
+	if strings.HasPrefix(snapshot, "https://") || strings.HasPrefix(snapshot, "http://") {
+		return snapshot, nil
+	}
+	if strings.Trim(snapshot, "0123456789") != "" || len(snapshot) > 14 {
+		return "", fmt.Errorf("%q is neither a Wayback timestamp nor a URL", snapshot)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultProviderTimeout)
+	defer cancel()
+	final, err := headSnapshot(ctx, client, fmt.Sprintf("%s/%s/%s", waybackAPI, snapshot, item.Original))
+	if err != nil {
+		return "", err
+	}
+	if final == "" {
+		return "", fmt.Errorf("no capture of %s near %s", item.Original, snapshot)
+	}
+	if canonical := canonicalWayback(final); canonical != "" {
+		final = canonical
+	}
+	return final, nil
+}
+
+// followPRComments applies the /archive commands on pull request pr of repo
+// to the checklist.
+func followPRComments(client *http.Client, cfg *Config, list *pendingList, repo string, pr int) error {
+	if repo == "" {
+		return fmt.Errorf("no repository: give --repo owner/name")
+	}
+	token, err := cfg.Secrets.get(githubSecret)
+	if err != nil {
+		if token = os.Getenv("GITHUB_TOKEN"); token == "" {
+			return err
+		}
+	}
+	comments, err := fetchPRComments(client, repo, token, pr)
+	if err != nil {
+		return err
+	}
+	applyPRCommands(client, list, comments)
+	return nil
+}
+
+// applyPRCommands ticks or skips checklist items as the /archive commands
+// on a pull request say. Later commands about an item override earlier ones;
+// commands from commenters without write access are ignored.
+func applyPRCommands(client *http.Client, list *pendingList, comments []*prComment) {
+	for _, comment := range comments {
+		for _, cmd := range parsePRCommands(comment) {
+			if !trustedAssociations[comment.Association] {
+				fmt.Printf("Ignoring /archive %s from %s, who cannot write to the repository\n", cmd.Action, comment.User.Login)
+				continue
+			}
+			item, alternative := list.target(cmd)
+			if item == nil {
+				// Most likely applied by an earlier run
+				continue
+			}
+
+			switch cmd.Action {
+			case "skip":
+				item.Checked, item.skip = false, true
+				fmt.Printf("%s: skip, requested by %s\n", filepath.ToSlash(item.File), comment.User.Login)
+			case "use":
+				link := alternative
+				if cmd.Snapshot != "" {
+					var err error
+					if link, err = item.resolveSnapshot(client, cmd.Snapshot); err != nil {
+						fmt.Fprintf(os.Stderr, "Error: %s: /archive use %s from %s: %v\n", filepath.ToSlash(item.File), cmd.Snapshot, comment.User.Login, err)
+						continue
+					}
+				}
+				if link != "" {
+					item.choose(link)
+				}
+				item.Checked, item.skip = true, false
+				fmt.Printf("%s: use %s, requested by %s\n", filepath.ToSlash(item.File), item.URL, comment.User.Login)
+			}
+		}
+	}
+}
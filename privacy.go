@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// secretParamNames are query parameters that carry credentials or session
+// state; a parameter is also secret if its name contains one of
+// secretParamParts, or if its value is a JSON Web Token.
+var (
+	secretParamNames = map[string]bool{
+		"auth": true, "sid": true, "sig": true, "pwd": true, "pass": true,
+		"apikey": true, "api_key": true, "access_key": true, "private_key": true,
+	}
+	secretParamParts = []string{"token", "secret", "passw", "sessid", "sessionid", "session_id", "signature", "credential", "x-amz-"}
+
+	jwtPattern = regexp.MustCompile(`^eyJ[\w-]+\.[\w-]+\.[\w-]*$`)
+	// pathSessionPattern matches session IDs in path parameters, as in
+	// /page;jsessionid=0123abcd
+	pathSessionPattern = regexp.MustCompile(`(?i);\s*(?:jsessionid|phpsessid|sid|sessionid)=[^/?#;]*`)
+)
+
+// SecretRecord notes a bookmark whose link carried credentials or tokens,
+// stripped before the link was sent to archive services. Removed names what
+// was found, never the values.
+type SecretRecord struct {
+	File      string   `json:"file"`
+	URL       string   `json:"url"` // the link with its secrets removed
+	Removed   []string `json:"removed"`
+	Sanitized bool     `json:"sanitized,omitempty"`
+}
+
+func isSecretParam(name, value string) bool {
+	name = strings.ToLower(name)
+	if secretParamNames[name] || jwtPattern.MatchString(value) {
+		return true
+	}
+	for _, part := range secretParamParts {
+		if strings.Contains(name, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripSecrets removes credentials, session IDs and tokens from a URL and
+// lists what it removed. Links without any are returned unchanged, byte for
+// byte: the query is only re-encoded when a parameter goes.
+func stripSecrets(link string) (string, []string) {
+	u, err := url.Parse(link)
+	if err != nil || u.Host == "" {
+		return link, nil
+	}
+
+	var removed []string
+	if u.User != nil {
+		removed = append(removed, "userinfo")
+		u.User = nil
+	}
+	if path := pathSessionPattern.ReplaceAllString(u.EscapedPath(), ""); path != u.EscapedPath() {
+		removed = append(removed, "path session id")
+		u.RawPath = ""
+		u.Path, _ = url.PathUnescape(path)
+	}
+
+	if u.RawQuery != "" {
+		var kept []string
+		for _, pair := range strings.Split(u.RawQuery, "&") {
+			name, value, _ := strings.Cut(pair, "=")
+			unescapedName, _ := url.QueryUnescape(name)
+			unescapedValue, _ := url.QueryUnescape(value)
+			if isSecretParam(unescapedName, unescapedValue) {
+				removed = append(removed, unescapedName)
+				continue
+			}
+			kept = append(kept, pair)
+		}
+		u.RawQuery = strings.Join(kept, "&")
+	}
+
+	if len(removed) == 0 {
+		return link, nil
+	}
+	sort.Strings(removed)
+	return u.String(), removed
+}
+
+// outbound returns the link as it may be sent to an archive service: not at
+// all for sensitive links, and without its secrets in privacy mode.
+func (c *providerChain) outbound(link string) (string, error) {
+	if err := c.permit(link); err != nil {
+		return "", err
+	}
+	if c.privacy {
+		link, _ = stripSecrets(link)
+	}
+	return link, nil
+}
+
+// checkSecrets records a bookmark whose link carries secrets and, with
+// --sanitize-links, rewrites the link without them.
+func checkSecrets(lock *LockFile, bookmark *BookmarkFile, run *RunRecord, opts runOptions, ex *explainer) {
+	clean, removed := stripSecrets(bookmark.Link)
+	if len(removed) == 0 {
+		return
+	}
+	ex.logf("link carries secrets (%s); they are stripped before any archive request", strings.Join(removed, ", "))
+	record := &SecretRecord{File: bookmark.Path, URL: clean, Removed: removed}
+	run.Secrets = append(run.Secrets, record)
+	fmt.Printf("\nLink carries credentials or tokens (%s): %s\n", strings.Join(removed, ", "), bookmark.Path)
+
+	if !opts.SanitizeLinks {
+		return
+	}
+	if err := lock.rewriteBookmark(bookmark, clean); err != nil {
+		fmt.Fprintf(os.Stderr, "\nError updating %s: %v\n", bookmark.Path, err)
+		run.recordError(bookmark.Path, err)
+		return
+	}
+	record.Sanitized = true
+	bookmark.Link, bookmark.Written = clean, ""
+	fmt.Printf("%s Removed them from the link\n", console.mark())
+}
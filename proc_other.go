@@ -0,0 +1,16 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// processAlive reports whether a process with this PID exists. On Windows
+// FindProcess fails for processes that are gone.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// maxBodyBytes caps how much of a page body is read for heuristics.
+const maxBodyBytes = 64 * 1024
+
+// headRejected are the statuses servers wrongly answer HEAD requests with
+// for pages they serve to GET: they do not implement HEAD, or their bot
+// protection or router only knows GET. A HEAD check that gets one is asked
+// again with GET before the link is judged.
+var headRejected = map[int]bool{
+	http.StatusBadRequest:       true,
+	http.StatusForbidden:        true,
+	http.StatusNotFound:         true,
+	http.StatusMethodNotAllowed: true,
+	http.StatusNotImplemented:   true,
+}
+
+// runProfile selects how much work is done per link.
+type runProfile struct {
+	Name string
+	// GetBodies checks links with GET instead of HEAD
+	GetBodies bool
+	// Soft404 treats "200 OK" pages that look like error pages as dead
+	Soft404 bool
+	// VerifySnapshot fetches the chosen snapshot before using it
+	VerifySnapshot bool
+	// VerifyReplacement re-reads the file after rewriting it
+	VerifyReplacement bool
+}
+
+var runProfiles = map[string]runProfile{
+	"fast": {Name: "fast"},
+	"thorough": {
+		Name:              "thorough",
+		GetBodies:         true,
+		Soft404:           true,
+		VerifySnapshot:    true,
+		VerifyReplacement: true,
+	},
+}
+
+func (p *runProfile) String() string {
+	return p.Name
+}
+
+func (p *runProfile) Set(name string) error {
+	profile, ok := runProfiles[name]
+	if !ok {
+		return fmt.Errorf("unknown profile %q (want fast or thorough)", name)
+	}
+	*p = profile
+	return nil
+}
+
+// checkLink reports whether a link is dead according to the profile, along
+// with the HTTP status seen (0 if the server could not be reached).
+func (opts *runOptions) checkLink(client *http.Client, urlStr string, profile runProfile) (bool, int, error) {
+	verdict, err := opts.diagnoseLink(client, urlStr, profile)
+	return verdict.Dead, verdict.Status, err
+}
+
+// linkVerdict is the outcome of a link check and the reason for it, for
+// --explain, with the redirect chain that led to the final response.
+type linkVerdict struct {
+	Dead   bool
+	Status int
+	Method string
+	Reason string
+
+	Chain     []string
+	CrossHost bool
+	Downgrade bool
+	Trap      string // the errorKind of a redirect chain that never ends
+
+	// Unresolved is set when the host name did not resolve
+	Unresolved bool
+
+	// Validators are the final response's ETag and Last-Modified, for the
+	// next conditional check; NotModified is set when that check got a 304
+	Validators  linkValidators
+	NotModified bool
+
+	// Lifetime is how long the response said it stays fresh
+	Lifetime      time.Duration
+	LifetimeKnown bool
+
+	// Transient is set when the check failed in a way a retry may fix: a
+	// timeout, an unresolved or refused host, or a server error; RetryAfter
+	// is when the server asked to be tried again
+	Transient  bool
+	RetryAfter time.Duration
+}
+
+func (opts *runOptions) diagnoseLink(client *http.Client, urlStr string, profile runProfile) (linkVerdict, error) {
+	return opts.diagnoseLinkSince(client, urlStr, profile, nil)
+}
+
+// diagnoseLinkSince is diagnoseLink as a conditional request: with the
+// validators from an earlier check, a 304 Not Modified means alive. A check
+// that failed transiently is retried as opts.RetryPolicy says first, unless
+// the run is asked to stop while it waits, in which case the link is judged
+// on the attempts so far.
+func (opts *runOptions) diagnoseLinkSince(client *http.Client, urlStr string, profile runProfile, known *linkValidators) (linkVerdict, error) {
+	verdict, err := opts.checkLinkOnce(client, urlStr, profile, known)
+	attempts := 1
+retries:
+	for ; err == nil && verdict.Transient && attempts <= opts.RetryPolicy.Max; attempts++ {
+		select {
+		case <-opts.clock().After(opts.RetryPolicy.delay(attempts, verdict.RetryAfter)):
+		case <-opts.Stop:
+			break retries
+		}
+		verdict, err = opts.checkLinkOnce(client, urlStr, profile, known)
+	}
+	if attempts > 1 {
+		verdict.Reason += fmt.Sprintf(" (after %d attempts)", attempts)
+	}
+	return verdict, err
+}
+
+// checkLinkOnce is one attempt at diagnoseLinkSince.
+func (opts *runOptions) checkLinkOnce(client *http.Client, urlStr string, profile runProfile, known *linkValidators) (linkVerdict, error) {
+	verdict := linkVerdict{Method: "HEAD"}
+	if profile.GetBodies {
+		verdict.Method = "GET"
+	}
+
+	req, err := newCheckRequest(verdict.Method, urlStr, known)
+	if err != nil {
+		return verdict, err
+	}
+
+	resp, err := client.Do(req)
+	answered := verdict.Method
+	if err == nil && verdict.Method == "HEAD" && headRejected[resp.StatusCode] {
+		get, _ := newCheckRequest("GET", urlStr, known)
+		// Only the first byte is asked for; the server may send it all
+		get.Header.Set("Range", "bytes=0-0")
+		if got, getErr := client.Do(get); getErr == nil {
+			resp.Body.Close()
+			answered = fmt.Sprintf("HEAD returned %d, ranged GET", resp.StatusCode)
+			verdict.Method, resp = "GET", got
+		}
+	}
+	var trap *redirectTrapError
+	if errors.As(err, &trap) {
+		trapVerdict(&verdict, trap)
+		return verdict, nil
+	}
+	if err != nil {
+		// If we can't connect, treat as 404
+		kind := errorKind(classifyError("check", urlStr, err))
+		verdict.Dead, verdict.Unresolved = true, kind == "dns"
+		verdict.Transient = kind == "dns" || kind == "timeout" || kind == "refused"
+		verdict.Reason = fmt.Sprintf("could not connect (%s): %v", kind, err)
+		return verdict, nil
+	}
+	defer resp.Body.Close()
+	verdict.Status = resp.StatusCode
+	if transientStatus(resp.StatusCode) {
+		verdict.Transient = true
+		verdict.RetryAfter, _ = retryAfter(resp.Header.Get("Retry-After"), opts.now())
+	}
+	if resp.Request != nil && resp.Request.URL.String() != urlStr {
+		answered += " redirected to " + resp.Request.URL.String() + " and"
+	}
+	if opts.Redirects.inspect(&verdict, resp) {
+		verdict.Dead = true
+		return verdict, nil
+	}
+	verdict.Validators = linkValidators{ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}
+	verdict.Lifetime, verdict.LifetimeKnown = cacheLifetime(resp.Header, opts.now())
+
+	if resp.StatusCode == http.StatusNotModified && known != nil {
+		verdict.NotModified = true
+		verdict.Validators = *known
+		verdict.Reason = fmt.Sprintf("%s returned 304 Not Modified: unchanged since the last check", answered)
+		return verdict, nil
+	}
+
+	// Consider 404 and 410 as "not found"
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		verdict.Dead = true
+		verdict.Reason = fmt.Sprintf("%s returned %d", answered, resp.StatusCode)
+		return verdict, nil
+	}
+
+	if profile.Soft404 && resp.StatusCode == http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxBodyBytes))
+		if why := soft404Reason(urlStr, resp, body); why != "" {
+			verdict.Dead = true
+			verdict.Reason = "200 OK but looks like an error page: " + why
+			return verdict, nil
+		}
+		verdict.Reason = "200 OK and no sign of a soft 404"
+		return verdict, nil
+	}
+
+	verdict.Reason = fmt.Sprintf("%s returned %d; only 404, 410 and unreachable hosts count as dead", answered, resp.StatusCode)
+	return verdict, nil
+}
+
+// newCheckRequest is a check request, conditional with the validators from
+// an earlier check.
+func newCheckRequest(method, urlStr string, known *linkValidators) (*http.Request, error) {
+	req, err := http.NewRequest(method, wireURL(urlStr), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	known.apply(req)
+	return req, nil
+}
+
+var (
+	titlePattern   = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	soft404Phrases = []string{
+		"404",
+		"not found",
+		"does not exist",
+		"doesn't exist",
+		"no longer available",
+		"has been removed",
+		"cannot be found",
+		"can't be found",
+	}
+)
+
+// soft404Reason guesses whether a 200 response is really an error page:
+// either its title reads like one, or a deep link was redirected to the site
+// root. It says why, or returns "" for a real page.
+func soft404Reason(original string, resp *http.Response, body []byte) string {
+	if m := titlePattern.FindSubmatch(body); m != nil {
+		title := strings.ToLower(strings.TrimSpace(string(m[1])))
+		for _, phrase := range soft404Phrases {
+			if strings.Contains(title, phrase) {
+				return fmt.Sprintf("title %q contains %q", title, phrase)
+			}
+		}
+	}
+
+	orig, err := url.Parse(wireURL(original))
+	if err != nil || resp.Request == nil {
+		return ""
+	}
+	final := resp.Request.URL
+	deepLink := strings.Trim(orig.Path, "/") != ""
+	atRoot := strings.Trim(final.Path, "/") == "" && final.RawQuery == ""
+	if deepLink && atRoot && strings.EqualFold(strings.TrimPrefix(final.Host, "www."), strings.TrimPrefix(orig.Host, "www.")) {
+		return "deep link redirected to the site root " + final.String()
+	}
+	return ""
+}
+
+// verifySnapshot makes sure an archived URL actually replays.
+func verifySnapshot(client *http.Client, snapshotURL string) error {
+	req, err := http.NewRequest("GET", snapshotURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return classifyError("snapshot verification", snapshotURL, err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxBodyBytes))
+
+	if err := statusError("snapshot verification", snapshotURL, resp.StatusCode); err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("snapshot %s returned status %d", snapshotURL, resp.StatusCode)
+	}
+	return nil
+}
+
+// verifyReplacement re-parses a rewritten file and checks the new link landed.
+func verifyReplacement(filePath, newURL string) error {
+	bookmark, err := parseBookmarkFile(filePath)
+	if err != nil {
+		return err
+	}
+	if bookmark.Link != newURL {
+		return fmt.Errorf("link is %q after rewrite, expected %q", bookmark.Link, newURL)
+	}
+	return nil
+}
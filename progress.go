@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressRedraw is how often the live display is redrawn when nothing else
+// is printed, so elapsed times keep counting on a hanging request.
+const progressRedraw = 500 * time.Millisecond
+
+// progressBoard is the live display on a terminal: one status line per
+// worker (current URL, phase and how long it has been on it) above the
+// aggregate progress line. Everything else the run prints to stdout or
+// stderr is captured and written above the display, so the two never
+// overwrite each other.
+type progressBoard struct {
+	mu      sync.Mutex
+	term    *os.File
+	workers []*workerStatus
+	summary string
+	drawn   bool // the display is on screen below the cursor
+	fresh   bool // nothing has been printed above it since it was drawn
+
+	restore []func()
+	readers sync.WaitGroup
+	stop    chan struct{}
+	ticker  sync.WaitGroup
+}
+
+// workerStatus is one worker's line on the board; since is when it started
+// on its current URL. A nil workerStatus ignores updates, so the pipeline
+// can report phases without knowing whether a board is shown.
+type workerStatus struct {
+	board *progressBoard
+	id    int
+	url   string
+	phase string
+	since time.Time
+}
+
+// startProgressBoard takes over the terminal until finish is called. It
+// returns nil when stdout is not a terminal or in ASCII mode, where the
+// line-per-update progress is used instead.
+func startProgressBoard() *progressBoard {
+	if console.ASCII || !isTerminal(os.Stdout) {
+		return nil
+	}
+	b := &progressBoard{term: os.Stdout, stop: make(chan struct{})}
+	for _, stream := range []**os.File{&os.Stdout, &os.Stderr} {
+		if err := b.capture(stream); err != nil {
+			b.finish()
+			return nil
+		}
+	}
+	console.board = b
+
+	b.ticker.Add(1)
+	go func() {
+		defer b.ticker.Done()
+		tick := time.NewTicker(progressRedraw)
+		defer tick.Stop()
+		for {
+			select {
+			case <-b.stop:
+				return
+			case <-tick.C:
+				b.mu.Lock()
+				b.draw()
+				b.mu.Unlock()
+			}
+		}
+	}()
+	return b
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// capture replaces *stream with a pipe whose complete lines are printed
+// above the display.
+func (b *progressBoard) capture(stream **os.File) error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	dst := *stream
+	*stream = w
+	b.restore = append(b.restore, func() {
+		*stream = dst
+		w.Close()
+	})
+
+	b.readers.Add(1)
+	go func() {
+		defer b.readers.Done()
+		defer r.Close()
+		var pending []byte
+		buf := make([]byte, 4096)
+		for {
+			n, err := r.Read(buf)
+			pending = append(pending, buf[:n]...)
+			if i := bytes.LastIndexByte(pending, '\n'); i >= 0 {
+				b.print(dst, pending[:i+1])
+				pending = append(pending[:0], pending[i+1:]...)
+			}
+			if err != nil {
+				if len(pending) > 0 {
+					b.print(dst, append(pending, '\n'))
+				}
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// print writes complete lines above the display. Output written for the old
+// in-place progress line starts with a newline to get off it; that newline
+// is dropped right after the display is drawn.
+func (b *progressBoard) print(dst *os.File, text []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.clear()
+	if b.fresh && text[0] == '\n' {
+		text = text[1:]
+	}
+	for _, line := range strings.SplitAfter(string(text), "\n") {
+		// Carriage returns would land on the display's lines
+		if i := strings.LastIndexByte(strings.TrimSuffix(line, "\n"), '\r'); i >= 0 {
+			line = line[i+1:]
+		}
+		dst.WriteString(line)
+	}
+	b.fresh = false
+	b.draw()
+}
+
+// clear erases the display, leaving the cursor where it started.
+func (b *progressBoard) clear() {
+	if b.drawn {
+		b.term.WriteString("\r\x1b[J")
+		b.drawn = false
+	}
+}
+
+// draw prints the display below the cursor and moves the cursor back to its
+// first line. Lines are cut to the terminal width so none of them wraps.
+func (b *progressBoard) draw() {
+	b.clear()
+	width := terminalWidth()
+	var out strings.Builder
+	lines := 0
+	now := time.Now()
+	for _, w := range b.workers {
+		out.WriteString(cutLine(w.line(now), width) + "\n")
+		lines++
+	}
+	if b.summary != "" {
+		out.WriteString(cutLine(b.summary, width) + "\n")
+		lines++
+	}
+	if lines == 0 {
+		return
+	}
+	fmt.Fprintf(&out, "\x1b[%dA", lines)
+	b.term.WriteString(out.String())
+	b.drawn = true
+	b.fresh = true
+}
+
+func terminalWidth() int {
+	if n, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && n > 0 {
+		return n
+	}
+	return 80
+}
+
+func cutLine(s string, width int) string {
+	if r := []rune(s); len(r) >= width {
+		return string(r[:width-1])
+	}
+	return s
+}
+
+// setProgress updates the aggregate line while item i of total is worked on:
+// a bar for the items before it, then text.
+func (b *progressBoard) setProgress(i, total int, text string) {
+	const barWidth = 20
+	filled := barWidth
+	if total > 0 {
+		filled = barWidth * max(i-1, 0) / total
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.summary = "[" + strings.Repeat("#", filled) + strings.Repeat("-", barWidth-filled) + "] " + text
+	b.draw()
+}
+
+// worker adds a status line for a new worker.
+func (b *progressBoard) worker() *workerStatus {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	w := &workerStatus{board: b, id: len(b.workers) + 1}
+	b.workers = append(b.workers, w)
+	return w
+}
+
+// finish removes the display and gives the terminal back.
+func (b *progressBoard) finish() {
+	if b == nil {
+		return
+	}
+	close(b.stop)
+	b.ticker.Wait()
+	for i := len(b.restore) - 1; i >= 0; i-- {
+		b.restore[i]()
+	}
+	b.readers.Wait()
+
+	b.mu.Lock()
+	b.clear()
+	b.mu.Unlock()
+	if console.board == b {
+		console.board = nil
+	}
+}
+
+// start puts the worker on a new URL.
+func (w *workerStatus) start(url string) {
+	if w == nil {
+		return
+	}
+	w.board.mu.Lock()
+	w.url, w.phase, w.since = url, "starting", time.Now()
+	w.board.mu.Unlock()
+}
+
+// setPhase reports what the worker is doing with its URL.
+func (w *workerStatus) setPhase(phase string) {
+	if w == nil {
+		return
+	}
+	w.board.mu.Lock()
+	w.phase = phase
+	w.board.draw()
+	w.board.mu.Unlock()
+}
+
+// idle marks the worker as between URLs.
+func (w *workerStatus) idle() {
+	if w == nil {
+		return
+	}
+	w.board.mu.Lock()
+	w.url, w.phase = "", ""
+	w.board.mu.Unlock()
+}
+
+func (w *workerStatus) line(now time.Time) string {
+	if w.url == "" {
+		return fmt.Sprintf("  worker %d: idle", w.id)
+	}
+	return fmt.Sprintf("  worker %d: %-10s %5s  %s", w.id, w.phase, now.Sub(w.since).Truncate(time.Second), w.url)
+}
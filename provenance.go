@@ -0,0 +1,100 @@
+package main
+
+import (
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// provenanceField is the frontmatter block --provenance records a
+// replacement in:
+//
+//	archive_tool:
+//	  original: https://example.com/article
+//	  status: 404
+//	  reason: HEAD returned 404, ranged GET returned 404
+//	  url: https://web.archive.org/web/20190312081500/https://example.com/article
+//	  snapshot: 20190312081500
+//	  provider: wayback
+//	  run: 20261014T075416.318Z
+//	  version: v1.4.0
+//
+// A later run finds in it what the replacement was, without the lock file.
+const provenanceField = "archive_tool"
+
+// toolVersion is the version of this build: the module version it was
+// installed at, or else the revision it was built from.
+func toolVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "devel"
+	}
+	if v := info.Main.Version; v != "" && v != "(devel)" {
+		return v
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" && len(setting.Value) >= 12 {
+			return setting.Value[:12]
+		}
+	}
+	return "devel"
+}
+
+// provenanceBlock is the frontmatter block recording a replacement of the
+// link original, found dead with verdict, by the copy chosen in run.
+func provenanceBlock(original string, verdict linkVerdict, archivedURL string, chosen *snapshotCandidate, run *RunRecord) frontmatterField {
+	block := []frontmatterField{{Key: "original", Value: original}}
+	if verdict.Status != 0 {
+		block = append(block, frontmatterField{Key: "status", Value: strconv.Itoa(verdict.Status)})
+	}
+	if verdict.Reason != "" {
+		block = append(block, frontmatterField{Key: "reason", Value: verdict.Reason})
+	}
+	block = append(block, frontmatterField{Key: "url", Value: archivedURL})
+	if !chosen.Captured.IsZero() {
+		block = append(block, frontmatterField{Key: "snapshot", Value: chosen.Captured.UTC().Format("20060102150405")})
+	}
+	block = append(block,
+		frontmatterField{Key: "provider", Value: chosen.Provider},
+		frontmatterField{Key: "run", Value: run.ID},
+		frontmatterField{Key: "version", Value: toolVersion()},
+	)
+	return frontmatterField{Key: provenanceField, Map: block}
+}
+
+// setFrontmatterMap sets key in the frontmatter of data to a block of the
+// fields, replacing the key and its block where it exists.
+func setFrontmatterMap(data []byte, key string, fields []frontmatterField) []byte {
+	block := make([]string, len(fields))
+	for i, field := range fields {
+		// A reason like "could not connect (dns): ..." would read as a map
+		raw := ""
+		if strings.Contains(field.Value, ": ") {
+			raw = `"`
+		}
+		block[i] = "  " + field.Key + ": " + quoteYAMLLike(raw, field.Value)
+	}
+	return setFrontmatterBlock(data, key, block)
+}
+
+// parseProvenance reads the fields of a provenance block from the lines
+// that follow its key, as far as they are indented.
+func parseProvenance(lines []string) map[string]string {
+	fields := make(map[string]string)
+	for _, line := range lines {
+		line = strings.TrimSuffix(line, "\r")
+		if !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "\t") {
+			break
+		}
+		if key, _, ok := strings.Cut(strings.TrimSpace(line), ":"); ok {
+			fields[key] = extractYAMLValue(strings.TrimSpace(line))
+		}
+	}
+	return fields
+}
+
+// replacedHere reports whether the bookmark's link is the copy its
+// provenance block says this tool replaced it with.
+func (b *BookmarkFile) replacedHere() bool {
+	return b.Provenance["url"] != "" && b.Provenance["url"] == b.Link
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultProviderTimeout bounds a single provider's lookup.
+const defaultProviderTimeout = 60 * time.Second
+
+// archiveProvider finds archived copies of a URL near a bookmark date. No
+// candidates with a nil error means the provider has no copy. endpoint is a
+// URL that `archive_tool doctor` requests to check connectivity.
+type archiveProvider interface {
+	name() string
+	endpoint() string
+	lookup(ctx context.Context, client *http.Client, link, date string, now time.Time) ([]*snapshotCandidate, error)
+}
+
+type waybackProvider struct{}
+
+func (waybackProvider) name() string { return "wayback" }
+
+func (waybackProvider) endpoint() string { return "https://web.archive.org/" }
+
+// lookup offers the capture closest to the bookmark date and, as an
+// alternative, the most recent capture. They are chosen among the clean
+// captures the CDX API lists; when it has none, or does not answer, the
+// Availability API and the replay service pick them, redirects and all.
+func (waybackProvider) lookup(ctx context.Context, client *http.Client, link, date string, now time.Time) ([]*snapshotCandidate, error) {
+	candidates, err := cdxCandidates(ctx, client, link, parseDateToTimestamp(date, now))
+	if err == nil && len(candidates) > 0 || ctx.Err() != nil {
+		return candidates, err
+	}
+
+	closest, err := findArchivedVersion(ctx, client, link, date, now)
+	if err != nil || closest == "" {
+		return nil, err
+	}
+	candidates = []*snapshotCandidate{newWaybackCandidate(closest)}
+
+	latest, err := availableSnapshot(ctx, client, link, now.Format("20060102"))
+	if errors.Is(err, errAvailabilityDown) {
+		latest, err = headSnapshot(ctx, client, fmt.Sprintf("%s/%s/%s", waybackAPI, now.Format("20060102"), link))
+	}
+	if err == nil && latest != "" && latest != closest {
+		candidates = append(candidates, newWaybackCandidate(latest))
+	}
+	return candidates, nil
+}
+
+// cdxClosestLimit is how many captures around the bookmark date a CDX lookup
+// lists.
+const cdxClosestLimit = 10
+
+// cleanCaptures runs a CDX search for originalURL restricted to clean
+// captures: a 200 serving HTML, rather than a redirect, an error page or a
+// file kept at the time. The server filters already; the rows are checked
+// again so a mirror that ignores filters cannot slip one through.
+func cleanCaptures(ctx context.Context, client *http.Client, originalURL string, q url.Values) ([]time.Time, error) {
+	q.Set("url", wireURL(originalURL))
+	q.Set("fl", "timestamp,statuscode,mimetype")
+	q.Add("filter", "statuscode:200")
+	q.Add("filter", "mimetype:text/html")
+	rows, err := cdxQueryContext(ctx, client, q)
+	if err != nil {
+		return nil, err
+	}
+	var captures []time.Time
+	for _, row := range rows {
+		if len(row) < 3 || row[1] != "200" || row[2] != "text/html" {
+			continue
+		}
+		if t, err := time.Parse("20060102150405", row[0]); err == nil {
+			captures = append(captures, t)
+		}
+	}
+	return captures, nil
+}
+
+// cdxCandidates offers the clean capture of originalURL closest to
+// timestamp and, as an alternative, the most recent clean one. None means
+// the CDX API has no clean capture, though there may be others.
+func cdxCandidates(ctx context.Context, client *http.Client, originalURL, timestamp string) ([]*snapshotCandidate, error) {
+	want, err := time.Parse("20060102150405", (timestamp + "000000")[:14])
+	if err != nil {
+		return nil, err
+	}
+	q := url.Values{}
+	q.Set("closest", want.Format("20060102150405"))
+	q.Set("sort", "closest")
+	q.Set("limit", fmt.Sprint(cdxClosestLimit))
+	captures, err := cleanCaptures(ctx, client, originalURL, q)
+	if err != nil || len(captures) == 0 {
+		return nil, err
+	}
+	distance := func(t time.Time) time.Duration {
+		if d := t.Sub(want); d > 0 {
+			return d
+		}
+		return want.Sub(t)
+	}
+	closest := captures[0]
+	for _, t := range captures[1:] {
+		if distance(t) < distance(closest) {
+			closest = t
+		}
+	}
+	snapshot := func(t time.Time) *snapshotCandidate {
+		return newWaybackCandidate(fmt.Sprintf("%s/%s/%s", waybackAPI, t.Format("20060102150405"), originalURL))
+	}
+	candidates := []*snapshotCandidate{snapshot(closest)}
+
+	q = url.Values{}
+	q.Set("limit", "-1")
+	if latest, err := cleanCaptures(ctx, client, originalURL, q); err == nil && len(latest) > 0 {
+		last := latest[0]
+		for _, t := range latest[1:] {
+			if t.After(last) {
+				last = t
+			}
+		}
+		if !last.Equal(closest) {
+			candidates = append(candidates, snapshot(last))
+		}
+	}
+	return candidates, nil
+}
+
+// availabilityAPI is the Wayback Machine's Availability API, which names the
+// capture closest to a timestamp.
+const availabilityAPI = "https://archive.org/wayback/available"
+
+// errAvailabilityDown means the Availability API gave no usable answer, so
+// the caller should find the capture another way.
+var errAvailabilityDown = errors.New("availability API unavailable")
+
+// availableSnapshot asks the Availability API for the capture of
+// originalURL closest to timestamp, and returns its canonical replay URL, or
+// "" if the URL was never captured. A capture of a redirect is followed to
+// the capture it replays as.
+func availableSnapshot(ctx context.Context, client *http.Client, originalURL, timestamp string) (string, error) {
+	q := url.Values{}
+	q.Set("url", originalURL)
+	q.Set("timestamp", timestamp)
+	req, err := http.NewRequestWithContext(ctx, "GET", availabilityAPI+"?"+q.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", archiveUserAgent)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", classifyError("wayback lookup", availabilityAPI, err)
+		}
+		return "", fmt.Errorf("%w: %v", errAvailabilityDown, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%w: status %d", errAvailabilityDown, resp.StatusCode)
+	}
+
+	var answer struct {
+		Snapshots struct {
+			Closest *struct {
+				Available bool   `json:"available"`
+				URL       string `json:"url"`
+				Timestamp string `json:"timestamp"`
+				Status    string `json:"status"`
+			} `json:"closest"`
+		} `json:"archived_snapshots"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return "", fmt.Errorf("%w: %v", errAvailabilityDown, err)
+	}
+	closest := answer.Snapshots.Closest
+	if closest == nil || !closest.Available {
+		return "", nil
+	}
+	snapshotURL := closest.URL
+	if canonical := canonicalWayback(snapshotURL); canonical != "" {
+		snapshotURL = canonical
+	}
+	switch {
+	case strings.HasPrefix(closest.Status, "2"):
+		return snapshotURL, nil
+	case strings.HasPrefix(closest.Status, "3"):
+		return headSnapshot(ctx, client, snapshotURL)
+	}
+	// A capture of an error page; the replay service may know a better one
+	return "", fmt.Errorf("%w: closest capture has status %s", errAvailabilityDown, closest.Status)
+}
+
+// archiveProviders holds every provider that can be named in the config.
+var archiveProviders = map[string]archiveProvider{
+	"wayback":       waybackProvider{},
+	"archive_today": archiveTodayProvider{},
+	"memento":       mementoProvider{},
+}
+
+// providerChain queries the configured providers in parallel and collects
+// their candidates for scoring. Links covered by sensitive never reach them;
+// in privacy mode, links reach them without their secrets. A preferred
+// provider, such as a Pinboard account, is asked first, and the others only
+// when it has no copy. Fallbacks are asked last, one after another, when no
+// provider has a copy.
+type providerChain struct {
+	providers []archiveProvider
+	preferred archiveProvider
+	fallbacks []archiveProvider
+	timeouts  map[string]time.Duration
+	sensitive *sensitivePolicy
+	privacy   bool
+}
+
+func newProviderChain(names string, timeouts map[string]time.Duration) (*providerChain, error) {
+	if strings.TrimSpace(names) == "" {
+		names = "wayback"
+	}
+
+	providers, err := parseProviders(names)
+	if err != nil {
+		return nil, err
+	}
+	return &providerChain{providers: providers, timeouts: timeouts}, nil
+}
+
+// parseProviders looks up a comma-separated list of provider names.
+func parseProviders(names string) ([]archiveProvider, error) {
+	var providers []archiveProvider
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		provider, ok := archiveProviders[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown archive provider %q", name)
+		}
+		providers = append(providers, provider)
+	}
+	return providers, nil
+}
+
+func (c *providerChain) timeout(name string) time.Duration {
+	if d, ok := c.timeouts[name]; ok && d > 0 {
+		return d
+	}
+	return defaultProviderTimeout
+}
+
+type providerResult struct {
+	rank       int
+	candidates []*snapshotCandidate
+	err        error
+}
+
+// count is the number of providers lookup ranks the candidates for link
+// among, for scoring them.
+func (c *providerChain) count(link string) int {
+	return len(paywallSettings.order(link, c.providers))
+}
+
+// lookup runs every provider concurrently, each bounded by its own timeout,
+// and returns the candidates of all that answer in time, tagged with their
+// provider's preference rank, for scoring against each other. An error is
+// only returned if no provider had a candidate.
+func (c *providerChain) lookup(client *http.Client, link, date string, now time.Time) ([]*snapshotCandidate, error) {
+	link, err := c.outbound(link)
+	if err != nil {
+		return nil, err
+	}
+	link = wireURL(link)
+
+	var preferredErr error
+	if c.preferred != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeout(c.preferred.name()))
+		candidates, err := c.preferred.lookup(ctx, client, link, date, now)
+		cancel()
+		if err == nil && len(candidates) > 0 {
+			for _, candidate := range candidates {
+				candidate.Provider = c.preferred.name()
+				candidate.ID = candidateID(candidate.URL)
+			}
+			return candidates, nil
+		}
+		if err != nil {
+			preferredErr = fmt.Errorf("%s: %w", c.preferred.name(), err)
+		}
+	}
+
+	// A paywalled link is asked of the provider that gets past paywalls first
+	providers := paywallSettings.order(link, c.providers)
+	results := make(chan providerResult, len(providers))
+	for rank, provider := range providers {
+		go func(rank int, provider archiveProvider) {
+			// A panicking provider fails its lookup, not the whole process
+			defer func() {
+				if v := recover(); v != nil {
+					results <- providerResult{rank: rank, err: recovered("looking up "+link+" in "+provider.name(), v)}
+				}
+			}()
+			ctx, cancel := context.WithTimeout(context.Background(), c.timeout(provider.name()))
+			defer cancel()
+			candidates, err := provider.lookup(ctx, client, link, date, now)
+			results <- providerResult{rank: rank, candidates: candidates, err: err}
+		}(rank, provider)
+	}
+
+	var candidates []*snapshotCandidate
+	var errs providerErrors
+	for range providers {
+		res := <-results
+		if res.err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", providers[res.rank].name(), res.err))
+			continue
+		}
+		for _, candidate := range res.candidates {
+			candidate.Provider = providers[res.rank].name()
+			candidate.rank = res.rank
+			candidate.ID = candidateID(candidate.URL)
+			candidates = append(candidates, candidate)
+		}
+	}
+	if len(candidates) > 0 {
+		// In order of preference, whichever provider answered first
+		sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].rank < candidates[j].rank })
+		return candidates, nil
+	}
+
+	found, err := c.lookupFallbacks(client, link, date, now)
+	if len(found) > 0 {
+		return found, nil
+	}
+	switch {
+	case err == nil:
+	case preferredErr == nil:
+		// Not "no snapshot" while a fallback may still have one
+		preferredErr = err
+	default:
+		preferredErr = providerErrors{preferredErr, err}
+	}
+
+	if len(errs) == len(providers) {
+		if preferredErr != nil {
+			errs = append(errs, preferredErr)
+		}
+		return nil, errs
+	}
+	// Not "no snapshot" while the preferred provider may still have one
+	if preferredErr != nil {
+		return nil, append(errs, preferredErr)
+	}
+	return nil, &LinkError{Op: "archive lookup", URL: link, Kind: ErrNoSnapshot}
+}
+
+// lookupFallbacks asks the fallbacks in order and returns the candidates of
+// the first that has a copy.
+func (c *providerChain) lookupFallbacks(client *http.Client, link, date string, now time.Time) ([]*snapshotCandidate, error) {
+	var errs providerErrors
+	for _, provider := range c.fallbacks {
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeout(provider.name()))
+		candidates, err := provider.lookup(ctx, client, link, date, now)
+		cancel()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", provider.name(), err))
+			continue
+		}
+		if len(candidates) > 0 {
+			for _, candidate := range candidates {
+				candidate.Provider = provider.name()
+				candidate.ID = candidateID(candidate.URL)
+			}
+			return candidates, nil
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return nil, nil
+}
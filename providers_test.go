@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// stubProvider answers every lookup with its snapshots, or holds it until
+// its timeout when slow.
+type stubProvider struct {
+	label     string
+	snapshots []string
+	slow      bool
+}
+
+func (p stubProvider) name() string     { return p.label }
+func (p stubProvider) endpoint() string { return "" }
+
+func (p stubProvider) lookup(ctx context.Context, client *http.Client, link, date string, now time.Time) ([]*snapshotCandidate, error) {
+	if p.slow {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	var candidates []*snapshotCandidate
+	for _, snapshot := range p.snapshots {
+		candidates = append(candidates, &snapshotCandidate{URL: snapshot})
+	}
+	return candidates, nil
+}
+
+func TestProviderChainScoresEveryProvider(t *testing.T) {
+	chain := &providerChain{
+		providers: []archiveProvider{
+			stubProvider{label: "first", snapshots: []string{"https://first.example/1"}},
+			stubProvider{label: "slow", slow: true},
+			stubProvider{label: "second", snapshots: []string{"https://second.example/1", "https://second.example/2"}},
+		},
+		timeouts: map[string]time.Duration{"slow": 50 * time.Millisecond},
+	}
+
+	candidates, err := chain.lookup(http.DefaultClient, "https://example.com/", "", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range candidates {
+		got = append(got, c.Provider)
+	}
+	if len(got) != 3 || got[0] != "first" || got[1] != "second" || got[2] != "second" {
+		t.Fatalf("candidates from %v, want first, second, second", got)
+	}
+	if candidates[0].rank != 0 || candidates[1].rank != 2 {
+		t.Errorf("ranks %d and %d, want 0 and 2", candidates[0].rank, candidates[1].rank)
+	}
+}
+
+func TestProviderChainCountsThePaywallProvider(t *testing.T) {
+	saved := paywallSettings
+	t.Cleanup(func() { paywallSettings = saved })
+	paywallSettings = paywallPolicy{Hosts: hostSet{"paywalled.example": true}, Prefer: "archive_today"}
+
+	chain := &providerChain{providers: []archiveProvider{waybackProvider{}}}
+	if n := chain.count("https://example.com/"); n != 1 {
+		t.Errorf("count for an open link = %d, want 1", n)
+	}
+	if n := chain.count("https://paywalled.example/story"); n != 2 {
+		t.Errorf("count for a paywalled link = %d, want 2", n)
+	}
+
+	// Ranked first, the paywall provider's snapshot beats an otherwise equal one
+	target := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	score := func(provider string, rank int) float64 {
+		c := &snapshotCandidate{Provider: provider, rank: rank, Status: http.StatusOK, Captured: target, paywalled: true}
+		return scoreCandidate(c, target, 2)
+	}
+	if past, wayback := score("archive_today", 0), score("wayback", 1); past <= wayback {
+		t.Errorf("paywall provider scored %v, wayback %v", past, wayback)
+	}
+}
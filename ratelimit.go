@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateBudget is the request budget of one archive service endpoint, as its
+// operators document or enforce it. Requests matching Hosts (by sameSite)
+// and the Path prefix share it, the first matching budget wins.
+type rateBudget struct {
+	Name      string
+	Hosts     []string
+	Path      string
+	PerMinute int
+	Burst     int // requests that may go at once after a quiet spell
+
+	// Host is set for the budget of a bookmarked host, whose requests wait
+	// for their slot rather than fail as rate limited
+	Host bool
+}
+
+var archiveTodayHosts = []string{"archive.today", "archive.ph", "archive.is", "archive.li", "archive.vn", "archive.fo", "archive.md"}
+
+// defaultRateBudgets are the built-in budgets. The Internet Archive allows
+// about 60 CDX and availability queries a minute and blocks clients that
+// keep going over; Save Page Now takes about 12 captures a minute on an
+// account, status checks being cheaper; archive.today publishes no limit,
+// but answers captchas to anything faster than a few requests a minute;
+// Pinboard's API allows one call every three seconds; crt.sh and the Memento
+// aggregator are shared services whose answers are slow to compute.
+var defaultRateBudgets = []rateBudget{
+	{Name: "cdx", Hosts: []string{"web.archive.org"}, Path: "/cdx/", PerMinute: 60, Burst: 5},
+	{Name: "availability", Hosts: []string{"archive.org"}, Path: "/wayback/available", PerMinute: 60, Burst: 5},
+	{Name: "spn_status", Hosts: []string{"web.archive.org"}, Path: "/save/status", PerMinute: 120, Burst: 10},
+	{Name: "spn", Hosts: []string{"web.archive.org"}, Path: "/save", PerMinute: 12, Burst: 1},
+	{Name: "wayback", Hosts: []string{"web.archive.org"}, Path: "/web/", PerMinute: 120, Burst: 10},
+	{Name: "archive_today", Hosts: archiveTodayHosts, PerMinute: 6, Burst: 1},
+	{Name: "pinboard", Hosts: []string{"api.pinboard.in"}, PerMinute: 20, Burst: 1},
+	{Name: "crtsh", Hosts: []string{"crt.sh"}, PerMinute: 6, Burst: 1},
+	{Name: "memento", Hosts: []string{"timetravel.mementoweb.org"}, PerMinute: 20, Burst: 2},
+}
+
+// rateLimits holds the [rate_limits] section: budget name -> requests per
+// minute, 0 to lift a budget.
+type rateLimits map[string]int
+
+func (l *rateLimits) set(key, value string) error {
+	known := false
+	for _, b := range defaultRateBudgets {
+		known = known || b.Name == key
+	}
+	if !known {
+		return fmt.Errorf("unknown [rate_limits] key %q", key)
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(value), "/min"))
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid rate limit %q for %s: want requests per minute", value, key)
+	}
+	if *l == nil {
+		*l = make(rateLimits)
+	}
+	(*l)[key] = n
+	return nil
+}
+
+// hostRates is the [host_rates] section, which paces requests to the
+// bookmarked sites themselves:
+//
+//	[host_rates]
+//	per_second = 2          # requests a second to any one host, 0 for no limit
+//	burst = 4
+//	slow.example.org = 0.2  # a host, and its subdomains, that needs more care
+//
+// Each host has its own budget, shared by every worker, so a collection with
+// thousands of bookmarks on one site does not hit it in a tight loop. Hosts
+// with an archive budget keep that one.
+type hostRates struct {
+	PerSecond float64
+	Burst     int
+	Hosts     map[string]float64
+}
+
+var defaultHostRates = hostRates{PerSecond: 2, Burst: 4}
+
+func (r *hostRates) set(key, value string) error {
+	switch key {
+	case "burst":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid burst %q", value)
+		}
+		r.Burst = n
+		return nil
+	case "per_second":
+	default:
+		if !strings.Contains(key, ".") {
+			return fmt.Errorf("unknown [host_rates] key %q", key)
+		}
+	}
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil || rate < 0 {
+		return fmt.Errorf("invalid rate %q for %s: want requests per second", value, key)
+	}
+	if key == "per_second" {
+		r.PerSecond = rate
+		return nil
+	}
+	if r.Hosts == nil {
+		r.Hosts = make(map[string]float64)
+	}
+	r.Hosts[strings.ToLower(key)] = rate
+	return nil
+}
+
+// perMinute is the budget of host in requests a minute, 0 for none: that of
+// the host or the closest domain above it that has one, or the default.
+func (r hostRates) perMinute(host string) int {
+	rate := r.PerSecond
+	for name := strings.ToLower(host); name != ""; {
+		if hostRate, ok := r.Hosts[name]; ok {
+			rate = hostRate
+			break
+		}
+		_, parent, ok := strings.Cut(name, ".")
+		if !ok {
+			break
+		}
+		name = parent
+	}
+	if rate <= 0 {
+		return 0
+	}
+	return max(int(math.Round(rate*60)), 1)
+}
+
+// maxRatePause caps how long a Retry-After answer pauses a budget.
+const maxRatePause = 10 * time.Minute
+
+// budgetState schedules one budget's requests evenly, like a token bucket:
+// next is when the next request may go, and it may lag behind the present
+// by Burst requests' worth of time.
+type budgetState struct {
+	rateBudget
+	mu       sync.Mutex
+	next     time.Time
+	paused   time.Time // until a Retry-After from the service ends
+	waited   time.Duration
+	requests int
+}
+
+func (b *budgetState) interval() time.Duration {
+	return time.Minute / time.Duration(b.PerMinute)
+}
+
+// reserve books a slot and returns when it is. With a deadline, a slot
+// past it is not booked and reserve reports false.
+func (b *budgetState) reserve(now, deadline time.Time) (time.Time, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if earliest := now.Add(-time.Duration(b.Burst-1) * b.interval()); b.next.Before(earliest) {
+		b.next = earliest
+	}
+	if b.next.Before(b.paused) {
+		b.next = b.paused
+	}
+	at := b.next
+	if at.Before(now) {
+		at = now
+	}
+	if !deadline.IsZero() && at.After(deadline) {
+		return at, false
+	}
+	b.next = b.next.Add(b.interval())
+	b.waited += at.Sub(now)
+	b.requests++
+	return at, true
+}
+
+// pause holds the budget's requests back until the service says it will
+// take them again.
+func (b *budgetState) pause(until time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if until.After(b.paused) {
+		b.paused = until
+	}
+}
+
+// rateScheduler paces every request to an archive service under its
+// endpoint's budget, and every other request under its host's, whichever
+// code path makes it. It is shared by all the clients of a process, so
+// concurrent workers, lookups and submissions draw on the same budgets.
+type rateScheduler struct {
+	budgets []*budgetState
+	clock   Clock
+
+	hostRates hostRates
+	mu        sync.Mutex
+	hosts     map[string]*budgetState
+}
+
+func newRateScheduler(limits rateLimits, hosts hostRates, clock Clock) *rateScheduler {
+	s := &rateScheduler{clock: clock, hostRates: hosts, hosts: make(map[string]*budgetState)}
+	for _, b := range defaultRateBudgets {
+		if n, ok := limits[b.Name]; ok {
+			b.PerMinute = n
+		}
+		state := &budgetState{rateBudget: b}
+		state.Burst = max(min(state.Burst, state.PerMinute), 1)
+		s.budgets = append(s.budgets, state)
+	}
+	return s
+}
+
+// budget returns the budget a request draws on, nil if it has none.
+func (s *rateScheduler) budget(req *http.Request) *budgetState {
+	if s == nil {
+		return nil
+	}
+	for _, b := range s.budgets {
+		if !strings.HasPrefix(req.URL.Path, b.Path) {
+			continue
+		}
+		for _, host := range b.Hosts {
+			if sameSite(req.URL.Hostname(), host) {
+				if b.PerMinute <= 0 {
+					return nil
+				}
+				return b
+			}
+		}
+	}
+	return s.hostBudget(req.URL.Hostname())
+}
+
+// hostBudget returns the budget of a host with no archive budget, made on
+// its first request.
+func (s *rateScheduler) hostBudget(host string) *budgetState {
+	host = strings.ToLower(host)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.hosts[host]
+	if !ok {
+		if perMinute := s.hostRates.perMinute(host); perMinute > 0 {
+			b = &budgetState{rateBudget: rateBudget{Name: host, Hosts: []string{host}, PerMinute: perMinute, Host: true}}
+			b.Burst = max(min(s.hostRates.Burst, perMinute), 1)
+		}
+		s.hosts[host] = b
+	}
+	return b
+}
+
+// allBudgets lists the archive budgets, then the hosts' by name.
+func (s *rateScheduler) allBudgets() []*budgetState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	budgets := append([]*budgetState(nil), s.budgets...)
+	var hosts []*budgetState
+	for _, b := range s.hosts {
+		if b != nil {
+			hosts = append(hosts, b)
+		}
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Name < hosts[j].Name })
+	return append(budgets, hosts...)
+}
+
+// setRate changes a budget, e.g. from a command's own flag.
+func (s *rateScheduler) setRate(name string, perMinute int) {
+	if s == nil {
+		return
+	}
+	for _, b := range s.budgets {
+		if b.Name == name {
+			b.mu.Lock()
+			b.PerMinute = perMinute
+			b.Burst = max(min(b.Burst, perMinute), 1)
+			b.mu.Unlock()
+		}
+	}
+}
+
+// scheduledKey marks a request whose slot was booked by wait, so the
+// transport does not book another.
+type scheduledKey struct{}
+
+// wait blocks until req may be sent, however long that takes, and returns
+// it marked as scheduled. It is for callers that would rather wait than
+// fail, such as the Save Page Now queue; the transport only waits while a
+// request's deadline allows.
+func (s *rateScheduler) wait(req *http.Request) *http.Request {
+	b := s.budget(req)
+	if b == nil {
+		return req
+	}
+	now := s.clock.Now()
+	at, _ := b.reserve(now, time.Time{})
+	s.clock.Sleep(at.Sub(now))
+	return req.WithContext(context.WithValue(req.Context(), scheduledKey{}, true))
+}
+
+// rateWait is how long a run's requests to one budget waited.
+type rateWait struct {
+	Name     string
+	Waited   time.Duration
+	Requests int
+}
+
+// takeWaits returns the budgets requests waited for since the last call.
+func (s *rateScheduler) takeWaits() []rateWait {
+	if s == nil {
+		return nil
+	}
+	var waits []rateWait
+	for _, b := range s.allBudgets() {
+		b.mu.Lock()
+		if b.waited >= time.Second {
+			waits = append(waits, rateWait{Name: b.Name, Waited: b.waited, Requests: b.requests})
+		}
+		b.waited, b.requests = 0, 0
+		b.mu.Unlock()
+	}
+	sort.Slice(waits, func(i, j int) bool { return waits[i].Waited > waits[j].Waited })
+	return waits
+}
+
+func printRateWaits(waits []rateWait) {
+	if len(waits) == 0 {
+		return
+	}
+	parts := make([]string, len(waits))
+	for i, w := range waits {
+		parts[i] = fmt.Sprintf("%s %s over %d request(s)", w.Name, w.Waited.Round(time.Second), w.Requests)
+	}
+	fmt.Printf("Waited for rate limits: %s\n", strings.Join(parts, ", "))
+}
+
+// rateTransport holds requests to archive services back until their budget
+// has room, and pauses a budget when the service answers 429 or 503 with a
+// Retry-After. A request whose deadline would pass while waiting fails at
+// once as rate limited, like a 429 would, so it is retried later instead.
+type rateTransport struct {
+	base      http.RoundTripper
+	scheduler *rateScheduler
+}
+
+func (t rateTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	b := t.scheduler.budget(req)
+	if b == nil {
+		return base.RoundTrip(req)
+	}
+
+	clock := t.scheduler.clock
+	if req.Context().Value(scheduledKey{}) == nil {
+		deadline, _ := req.Context().Deadline()
+		if b.Host {
+			// A check that runs out of time waiting times out, and is
+			// retried, rather than counting against the link
+			deadline = time.Time{}
+		}
+		now := clock.Now()
+		at, ok := b.reserve(now, deadline)
+		if !ok {
+			return nil, &LinkError{Op: "archive request", URL: req.URL.String(), Kind: ErrRateLimited,
+				Err: fmt.Errorf("%s budget has no room before the deadline", b.Name)}
+		}
+		if wait := at.Sub(now); wait > 0 {
+			select {
+			case <-clock.After(wait):
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			}
+		}
+	}
+
+	resp, err := base.RoundTrip(req)
+	if err == nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+		now := clock.Now()
+		if d, ok := retryAfter(resp.Header.Get("Retry-After"), now); ok {
+			b.pause(now.Add(min(d, maxRatePause)))
+		} else if resp.StatusCode == http.StatusTooManyRequests {
+			b.pause(now.Add(time.Minute))
+		}
+	}
+	return resp, err
+}
+
+// retryAfter parses a Retry-After header: seconds, or an HTTP date.
+func retryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(at.Sub(now), 0), true
+	}
+	return 0, false
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rdapBootstrapURL is IANA's registry of the RDAP service of each TLD.
+const rdapBootstrapURL = "https://data.iana.org/rdap/dns.json"
+
+// rdapPolicy enables RDAP lookups for links whose host does not resolve:
+//
+//	[rdap]
+//	enabled = true
+//	grace = "720h"
+//
+// A registered, unexpired domain that does not resolve is most likely a
+// broken DNS setup its owner may fix, so its links are rechecked instead of
+// replaced, for up to grace after they died.
+type rdapPolicy struct {
+	Enabled bool
+	Grace   time.Duration
+}
+
+var defaultRDAPPolicy = rdapPolicy{Grace: 30 * 24 * time.Hour}
+
+func (p *rdapPolicy) set(key, value string) error {
+	switch key {
+	case "enabled":
+		p.Enabled = value == "true"
+	case "grace":
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid grace %q", value)
+		}
+		p.Grace = d
+	default:
+		return fmt.Errorf("unknown [rdap] key %q", key)
+	}
+	return nil
+}
+
+// Registration states of the domain of an unresolvable host.
+const (
+	domainUnregistered = "unregistered" // no registry knows it: expired and released
+	domainExpired      = "expired"      // past its expiry, or held or being deleted
+	domainParked       = "parked"       // delegated to a parking service
+	domainRegistered   = "registered"   // active: a DNS misconfiguration
+	domainUnknown      = "unknown"      // RDAP could not tell
+)
+
+// RDAPRecord is what RDAP said about the domain of a host that did not
+// resolve, and what was done with its links.
+type RDAPRecord struct {
+	Host        string    `json:"host"`
+	Domain      string    `json:"domain,omitempty"`
+	Status      string    `json:"status"`
+	Expires     time.Time `json:"expires,omitempty"`
+	Nameservers []string  `json:"nameservers,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	Decision    string    `json:"decision,omitempty"` // replace or recheck
+}
+
+// dead reports whether the domain is gone for good, so its links can be
+// replaced at once.
+func (r *RDAPRecord) dead() bool {
+	return r.Status == domainUnregistered || r.Status == domainExpired || r.Status == domainParked
+}
+
+// parkingNameservers are the name server domains of common parking
+// services.
+var parkingNameservers = []string{
+	"sedoparking.com", "parkingcrew.net", "bodis.com", "above.com", "dan.com",
+	"afternic.com", "parklogic.com", "namebrightdns.com", "domaincontrol-parking.com",
+}
+
+// rdapResolver looks domains up by RDAP, once per host and run.
+type rdapResolver struct {
+	mu       sync.Mutex
+	servers  map[string][]string // TLD -> RDAP base URLs
+	bootErr  error
+	booted   bool
+	byHost   map[string]*RDAPRecord
+	reported map[string]bool
+}
+
+func newRDAPResolver() *rdapResolver {
+	return &rdapResolver{byHost: make(map[string]*RDAPRecord), reported: make(map[string]bool)}
+}
+
+// bootstrap loads IANA's TLD registry the first time it is needed.
+func (r *rdapResolver) bootstrap(client *http.Client) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.booted {
+		return r.bootErr
+	}
+	r.booted = true
+
+	var answer struct {
+		Services [][][]string `json:"services"` // [TLDs, URLs]
+	}
+	if r.bootErr = rdapGet(client, rdapBootstrapURL, &answer); r.bootErr != nil {
+		return r.bootErr
+	}
+	r.servers = make(map[string][]string)
+	for _, service := range answer.Services {
+		if len(service) != 2 {
+			continue
+		}
+		for _, tld := range service[0] {
+			r.servers[strings.ToLower(tld)] = service[1]
+		}
+	}
+	return nil
+}
+
+// lookup returns the registration state of the domain of host. The
+// registrable domain is not known without a public suffix list, so the
+// shortest parent the registry knows is taken: example.com before
+// www.example.com, and example.co.uk after co.uk is not found.
+func (r *rdapResolver) lookup(client *http.Client, host string, now time.Time) *RDAPRecord {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	r.mu.Lock()
+	record, ok := r.byHost[host]
+	r.mu.Unlock()
+	if ok {
+		return record
+	}
+
+	record = &RDAPRecord{Host: host, Status: domainUnknown}
+	defer func() {
+		r.mu.Lock()
+		r.byHost[host] = record
+		r.mu.Unlock()
+	}()
+	if err := r.bootstrap(client); err != nil {
+		record.Error = err.Error()
+		return record
+	}
+	labels := strings.Split(host, ".")
+	r.mu.Lock()
+	servers := r.servers[labels[len(labels)-1]]
+	r.mu.Unlock()
+	if len(servers) == 0 || len(labels) < 2 {
+		record.Error = "no RDAP service for the ." + labels[len(labels)-1] + " domains"
+		return record
+	}
+	base := strings.TrimSuffix(servers[0], "/") + "/domain/"
+
+	for n := 2; n <= len(labels); n++ {
+		domain := strings.Join(labels[len(labels)-n:], ".")
+		var answer rdapDomain
+		err := rdapGet(client, base+domain, &answer)
+		if err == errRDAPNotFound {
+			continue
+		}
+		if err != nil {
+			record.Error = err.Error()
+			return record
+		}
+		record.Domain = domain
+		answer.classify(record, now)
+		return record
+	}
+	record.Domain = strings.Join(labels[len(labels)-2:], ".")
+	record.Status = domainUnregistered
+	return record
+}
+
+// firstReport reports whether the record of host is yet to be added to the
+// run, which happens once.
+func (r *rdapResolver) firstReport(host string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.reported[host] {
+		return false
+	}
+	r.reported[host] = true
+	return true
+}
+
+// rdapDomain is the part of an RDAP domain object that tells whether it is
+// still in service.
+type rdapDomain struct {
+	Status []string `json:"status"`
+	Events []struct {
+		Action string    `json:"eventAction"`
+		Date   time.Time `json:"eventDate"`
+	} `json:"events"`
+	Nameservers []struct {
+		Name string `json:"ldhName"`
+	} `json:"nameservers"`
+}
+
+func (d *rdapDomain) classify(record *RDAPRecord, now time.Time) {
+	for _, e := range d.Events {
+		if e.Action == "expiration" {
+			record.Expires = e.Date
+		}
+	}
+	for _, ns := range d.Nameservers {
+		record.Nameservers = append(record.Nameservers, strings.ToLower(strings.TrimSuffix(ns.Name, ".")))
+	}
+
+	record.Status = domainRegistered
+	if !record.Expires.IsZero() && record.Expires.Before(now) {
+		record.Status = domainExpired
+	}
+	for _, status := range d.Status {
+		status = strings.ToLower(status)
+		if strings.Contains(status, "redemption") || strings.Contains(status, "pending delete") ||
+			strings.Contains(status, "hold") || strings.Contains(status, "inactive") {
+			record.Status = domainExpired
+		}
+	}
+	if record.Status != domainRegistered {
+		return
+	}
+	for _, ns := range record.Nameservers {
+		for _, parking := range parkingNameservers {
+			if ns == parking || strings.HasSuffix(ns, "."+parking) {
+				record.Status = domainParked
+				return
+			}
+		}
+	}
+}
+
+var errRDAPNotFound = fmt.Errorf("rdap: not found")
+
+func rdapGet(client *http.Client, endpoint string, v interface{}) error {
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/rdap+json, application/json")
+	req.Header.Set("User-Agent", archiveUserAgent)
+	resp, err := client.Do(req)
+	if err != nil {
+		return classifyError("rdap", endpoint, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errRDAPNotFound
+	}
+	if err := statusError("rdap", endpoint, resp.StatusCode); err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("rdap: %s: status %d", endpoint, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// deferUnresolved decides, for a dead link whose host did not resolve,
+// whether to replace it now. It returns true when the link should be
+// rechecked instead, because the domain is still registered and the link
+// has been failing for less than the grace period.
+func deferUnresolved(client *http.Client, lock *LockFile, bookmark *BookmarkFile, target string, run *RunRecord, opts runOptions, ex *explainer) bool {
+	host := coverageHost(target)
+	var record *RDAPRecord
+	opts.unlocked(func() { record = opts.RDAP.lookup(client, host, opts.now()) })
+
+	decision := "replace"
+	if record.Status == domainRegistered {
+		life, _ := lock.urlLife(bookmark.Link)
+		if life.Died.IsZero() || opts.now().Sub(life.Died) < opts.RDAPPolicy.Grace {
+			decision = "recheck"
+		}
+	}
+	if opts.RDAP.firstReport(host) {
+		reported := *record
+		reported.Decision = decision
+		run.RDAP = append(run.RDAP, &reported)
+	}
+
+	switch {
+	case record.Status == domainUnknown:
+		ex.logf("host does not resolve; RDAP could not tell about its domain: %s", record.Error)
+	case record.dead():
+		ex.logf("host does not resolve and %s is %s", record.Domain, record.Status)
+	case decision == "recheck":
+		ex.logf("host does not resolve but %s is registered; a DNS problem, rechecking next run", record.Domain)
+		fmt.Printf("\nDNS failure but %s is still registered, checking again next run: %s\n", record.Domain, bookmark.Link)
+		run.Pending++
+		return true
+	default:
+		ex.logf("host does not resolve though %s is registered, but the link has been dead for longer than %s", record.Domain, opts.RDAPPolicy.Grace)
+	}
+	return false
+}
+
+// printRDAPRecords lists the domains of a run's unresolvable hosts.
+func printRDAPRecords(records []*RDAPRecord) {
+	if len(records) == 0 {
+		return
+	}
+	fmt.Println("Hosts that did not resolve, by RDAP:")
+	for _, r := range records {
+		line := fmt.Sprintf("  %s: %s", r.Host, r.Status)
+		if r.Domain != "" && r.Domain != r.Host {
+			line = fmt.Sprintf("  %s: %s %s", r.Host, r.Domain, r.Status)
+		}
+		if !r.Expires.IsZero() {
+			line += ", expires " + r.Expires.Format("2006-01-02")
+		}
+		if r.Error != "" {
+			line += " (" + r.Error + ")"
+		}
+		fmt.Printf("%s -> %s\n", line, r.Decision)
+	}
+}
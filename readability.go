@@ -0,0 +1,786 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"math"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// readingCopyField is the frontmatter field --reading-copy records the page a
+// bookmark's reading copy was made from in. The copy itself, the page's
+// article in markdown, ends the body between readingCopyStart and
+// readingCopyEnd, so the notes above it are left as they are.
+const (
+	readingCopyField = "reading_copy"
+	readingCopyStart = "<!-- archive_tool: reading copy -->"
+	readingCopyEnd   = "<!-- archive_tool: end of reading copy -->"
+)
+
+// minReadingCopyChars is how much text an article must have to be kept as a
+// reading copy. Less is an index page, a paywall or an error page.
+const minReadingCopyChars = 250
+
+var errNoArticle = errors.New("no article found")
+
+// htmlNode is an element of a parsed page, or a text node when Tag is "".
+type htmlNode struct {
+	Tag      string
+	Attrs    map[string]string
+	Text     string
+	Parent   *htmlNode
+	Children []*htmlNode
+}
+
+var (
+	htmlTokenPattern = regexp.MustCompile(`(?s)<!--.*?-->|<![^>]*>|<\?[^>]*>|<(/?)([A-Za-z][A-Za-z0-9:-]*)((?:[^>"']|"[^"]*"|'[^']*')*)>`)
+	htmlAttrPattern  = regexp.MustCompile(`([^\s=/"'>]+)(?:\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+)))?`)
+	spacePattern     = regexp.MustCompile(`\s+`)
+
+	// unlikelyContent and likelyContent are the class names and ids of page
+	// furniture and of articles, after Readability's
+	unlikelyContent = regexp.MustCompile(`(?i)-ad-|advert|banner|breadcrumb|comment|community|cookie|disqus|footer|gdpr|menu|modal|newsletter|pager|pagination|popup|promo|related|replies|share|shoutbox|sidebar|skyscraper|social|sponsor|subscribe|widget`)
+	likelyContent   = regexp.MustCompile(`(?i)article|body|column|content|entry|main|post|story|text`)
+	negativeContent = regexp.MustCompile(`(?i)-ad-|banner|comment|contact|foot|masthead|media|meta|outbrain|promo|related|scroll|share|sidebar|sponsor|shopping|tags|tool|widget`)
+	positiveContent = regexp.MustCompile(`(?i)article|body|content|entry|hentry|h-entry|main|page|post|text|blog|story`)
+)
+
+var (
+	// rawTextElements are skipped with their content, which is not markup
+	rawTextElements = setOf("script", "style", "noscript", "template", "svg", "math", "iframe", "object", "textarea", "select", "canvas")
+	voidElements    = setOf("area", "base", "br", "col", "embed", "hr", "img", "input", "link", "meta", "param", "source", "track", "wbr")
+	blockElements   = setOf("address", "article", "aside", "blockquote", "dd", "details", "dialog", "div", "dl", "dt", "fieldset", "figcaption", "figure", "footer", "form", "h1", "h2", "h3", "h4", "h5", "h6", "header", "hr", "li", "main", "nav", "ol", "p", "pre", "section", "table", "tbody", "td", "tfoot", "th", "thead", "tr", "ul")
+	// furnitureElements never hold the article
+	furnitureElements = setOf("nav", "aside", "footer", "form", "button", "input", "dialog", "head")
+)
+
+func setOf(items ...string) map[string]bool {
+	set := make(map[string]bool, len(items))
+	for _, item := range items {
+		set[item] = true
+	}
+	return set
+}
+
+// parseHTML parses a page into a tree as forgiving as a browser's, if less
+// thorough: unclosed elements end with their parent, and paragraphs, list
+// items and table cells end where the next one starts.
+func parseHTML(page string) *htmlNode {
+	root := &htmlNode{Tag: "#root"}
+	current := root
+	text := func(s string) {
+		if s != "" {
+			current.Children = append(current.Children, &htmlNode{Text: html.UnescapeString(s), Parent: current})
+		}
+	}
+
+	for pos := 0; pos < len(page); {
+		loc := htmlTokenPattern.FindStringSubmatchIndex(page[pos:])
+		if loc == nil {
+			text(page[pos:])
+			break
+		}
+		text(page[pos : pos+loc[0]])
+		token := page[pos+loc[0] : pos+loc[1]]
+		if loc[4] < 0 {
+			// A comment or a doctype
+			pos += loc[1]
+			continue
+		}
+		closing := loc[3] > loc[2]
+		tag := strings.ToLower(page[pos+loc[4] : pos+loc[5]])
+		attrs := page[pos+loc[6] : pos+loc[7]]
+		pos += loc[1]
+
+		if closing {
+			for n := current; n != root; n = n.Parent {
+				if n.Tag == tag {
+					current = n.Parent
+					break
+				}
+			}
+			continue
+		}
+		if rawTextElements[tag] && !strings.HasSuffix(token, "/>") {
+			if i := indexClosingTag(page[pos:], tag); i >= 0 {
+				pos += i
+				if j := strings.IndexByte(page[pos:], '>'); j >= 0 {
+					pos += j + 1
+				}
+			} else {
+				pos = len(page)
+			}
+			continue
+		}
+
+		current = closeImplied(current, tag)
+		node := &htmlNode{Tag: tag, Attrs: parseAttrs(attrs), Parent: current}
+		current.Children = append(current.Children, node)
+		if !voidElements[tag] && !strings.HasSuffix(token, "/>") {
+			current = node
+		}
+	}
+	return root
+}
+
+// indexClosingTag finds the closing tag of a raw text element in s.
+func indexClosingTag(s, tag string) int {
+	for i := 0; ; {
+		j := strings.Index(s[i:], "</")
+		if j < 0 {
+			return -1
+		}
+		i += j
+		if len(s) >= i+2+len(tag) && strings.EqualFold(s[i+2:i+2+len(tag)], tag) {
+			return i
+		}
+		i += 2
+	}
+}
+
+func parseAttrs(s string) map[string]string {
+	var attrs map[string]string
+	for _, m := range htmlAttrPattern.FindAllStringSubmatch(s, -1) {
+		if attrs == nil {
+			attrs = make(map[string]string)
+		}
+		attrs[strings.ToLower(m[1])] = html.UnescapeString(m[2] + m[3] + m[4])
+	}
+	return attrs
+}
+
+// closeImplied closes the elements that an opening tag ends without their
+// closing tag: a paragraph at the next block, a list item at the next item,
+// a row or cell at the next one.
+func closeImplied(current *htmlNode, tag string) *htmlNode {
+	closeTo := func(ended, boundary map[string]bool) *htmlNode {
+		for n := current; n.Parent != nil && !boundary[n.Tag]; n = n.Parent {
+			if ended[n.Tag] {
+				return n.Parent
+			}
+		}
+		return current
+	}
+	switch {
+	case tag == "li":
+		return closeTo(setOf("li", "p"), setOf("ul", "ol", "table"))
+	case tag == "dt" || tag == "dd":
+		return closeTo(setOf("dt", "dd", "p"), setOf("dl", "table"))
+	case tag == "tr":
+		return closeTo(setOf("tr", "td", "th", "p"), setOf("table", "tbody", "thead", "tfoot"))
+	case tag == "td" || tag == "th":
+		return closeTo(setOf("td", "th", "p"), setOf("tr", "table"))
+	case blockElements[tag]:
+		return closeTo(setOf("p"), blockElements)
+	}
+	return current
+}
+
+// readingCopy extracts the article of a fetched page as markdown.
+func readingCopy(page *fetchedPage) (string, error) {
+	if !page.html() {
+		return "", fmt.Errorf("reading copy %s: not an HTML page (%s)", page.URI, page.Header.Get("Content-Type"))
+	}
+	article := articleNode(parseHTML(string(page.Body)))
+	if article == nil || len(innerText(article)) < minReadingCopyChars {
+		return "", errNoArticle
+	}
+	base, err := url.Parse(page.URI)
+	if err != nil {
+		return "", err
+	}
+	c := markdownConverter{base: base}
+	markdown := strings.Join(c.blocks(article), "\n\n")
+	if markdown == "" {
+		return "", errNoArticle
+	}
+	return markdown, nil
+}
+
+// articleNode finds the element holding a page's article, as Readability
+// does: page furniture is removed, every paragraph adds to the score of its
+// parent and grandparent by its length and commas, scores are weighed by
+// class names and lessened by the share of link text, and the best element
+// wins, with the siblings that look like more of it.
+func articleNode(root *htmlNode) *htmlNode {
+	prune(root)
+	body := findElement(root, "body")
+	if body == nil {
+		body = root
+	}
+
+	scores := make(map[*htmlNode]float64)
+	var candidates []*htmlNode
+	addScore := func(n *htmlNode, score float64) {
+		if n == nil || n.Tag == "" {
+			return
+		}
+		if _, ok := scores[n]; !ok {
+			scores[n] = baseScore(n)
+			candidates = append(candidates, n)
+		}
+		scores[n] += score
+	}
+	walkElements(body, func(n *htmlNode) {
+		if n.Tag != "p" && n.Tag != "pre" && n.Tag != "td" && !(n.Tag == "div" && !hasBlockChild(n)) {
+			return
+		}
+		text := strings.TrimSpace(innerText(n))
+		if len(text) < 25 {
+			return
+		}
+		score := 1 + float64(strings.Count(text, ",")) + math.Min(float64(len(text))/100, 3)
+		addScore(n.Parent, score)
+		if n.Parent != nil {
+			addScore(n.Parent.Parent, score/2)
+		}
+	})
+
+	var top *htmlNode
+	for _, n := range candidates {
+		scores[n] *= 1 - linkDensity(n)
+		if top == nil || scores[n] > scores[top] {
+			top = n
+		}
+	}
+	if top == nil {
+		return body
+	}
+
+	// The article may be split among siblings, as where a figure or an ad
+	// slot sits between two parts. A page that is only the article, without
+	// even a body, has nothing besides.
+	if top.Parent == nil {
+		cleanArticle(top)
+		return top
+	}
+	threshold := math.Max(10, scores[top]*0.2)
+	article := &htmlNode{Tag: "div"}
+	for _, sibling := range top.Parent.Children {
+		include := sibling == top
+		if !include && sibling.Tag != "" {
+			if score, ok := scores[sibling]; ok && score >= threshold {
+				include = true
+			} else if sibling.Tag == "p" {
+				text := strings.TrimSpace(innerText(sibling))
+				density := linkDensity(sibling)
+				include = len(text) > 80 && density < 0.25 ||
+					len(text) > 0 && density == 0 && strings.ContainsAny(text, ".!?")
+			}
+		}
+		if include {
+			article.Children = append(article.Children, sibling)
+		}
+	}
+	cleanArticle(article)
+	return article
+}
+
+// prune removes the elements that are hidden or page furniture by their tag
+// or class names.
+func prune(n *htmlNode) {
+	kept := n.Children[:0]
+	for _, c := range n.Children {
+		if c.Tag != "" && unwanted(c) {
+			continue
+		}
+		prune(c)
+		kept = append(kept, c)
+	}
+	n.Children = kept
+}
+
+func unwanted(n *htmlNode) bool {
+	if furnitureElements[n.Tag] {
+		return true
+	}
+	if _, hidden := n.Attrs["hidden"]; hidden || n.Attrs["aria-hidden"] == "true" {
+		return true
+	}
+	if style := strings.ReplaceAll(strings.ToLower(n.Attrs["style"]), " ", ""); strings.Contains(style, "display:none") || strings.Contains(style, "visibility:hidden") {
+		return true
+	}
+	switch n.Tag {
+	case "html", "body", "article", "main", "a", "table", "tbody", "tr", "td", "th", "pre", "code":
+		return false
+	}
+	names := n.Attrs["class"] + " " + n.Attrs["id"] + " " + n.Attrs["role"]
+	return unlikelyContent.MatchString(names) && !likelyContent.MatchString(names)
+}
+
+// cleanArticle removes what is left of lists of links, empty blocks and
+// blocks whose class names count against them.
+func cleanArticle(n *htmlNode) {
+	kept := n.Children[:0]
+	for _, c := range n.Children {
+		if c.Tag != "" && doubtful(c) {
+			continue
+		}
+		cleanArticle(c)
+		kept = append(kept, c)
+	}
+	n.Children = kept
+}
+
+func doubtful(n *htmlNode) bool {
+	switch n.Tag {
+	case "div", "section", "ul", "ol", "table":
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		return classWeight(n) < 0
+	default:
+		return false
+	}
+	if findElement(n, "pre") != nil || classWeight(n) >= 0 && hasHeading(n) {
+		return false
+	}
+	if classWeight(n) < 0 {
+		return true
+	}
+	text := strings.TrimSpace(innerText(n))
+	if strings.Count(text, ",") >= 10 {
+		return false
+	}
+	if len(text) < 25 && (n.Tag == "div" || n.Tag == "section") && findElement(n, "img") == nil {
+		return true
+	}
+	return linkDensity(n) > 0.5
+}
+
+// baseScore is what an element scores before its paragraphs: something by
+// its tag and its class names.
+func baseScore(n *htmlNode) float64 {
+	score := float64(classWeight(n))
+	switch n.Tag {
+	case "div", "article", "main":
+		score += 5
+	case "pre", "td", "blockquote":
+		score += 3
+	case "address", "ol", "ul", "dl", "dd", "dt", "li", "form":
+		score -= 3
+	case "h1", "h2", "h3", "h4", "h5", "h6", "th":
+		score -= 5
+	}
+	return score
+}
+
+// classWeight counts an element's class name and id for or against it
+// holding the article.
+func classWeight(n *htmlNode) int {
+	weight := 0
+	for _, name := range []string{n.Attrs["class"], n.Attrs["id"]} {
+		if name == "" {
+			continue
+		}
+		if negativeContent.MatchString(name) {
+			weight -= 25
+		}
+		if positiveContent.MatchString(name) {
+			weight += 25
+		}
+	}
+	return weight
+}
+
+// linkDensity is the share of an element's text that is link text.
+func linkDensity(n *htmlNode) float64 {
+	total := len(strings.TrimSpace(innerText(n)))
+	if total == 0 {
+		return 0
+	}
+	links := 0
+	walkElements(n, func(c *htmlNode) {
+		if c.Tag == "a" {
+			links += len(strings.TrimSpace(innerText(c)))
+		}
+	})
+	return math.Min(float64(links)/float64(total), 1)
+}
+
+func hasBlockChild(n *htmlNode) bool {
+	for _, c := range n.Children {
+		if blockElements[c.Tag] {
+			return true
+		}
+	}
+	return false
+}
+
+// innerText is the text of an element, its whitespace collapsed.
+func innerText(n *htmlNode) string {
+	var b strings.Builder
+	var walk func(*htmlNode)
+	walk = func(n *htmlNode) {
+		if n.Tag == "" {
+			b.WriteString(n.Text)
+			return
+		}
+		for _, c := range n.Children {
+			walk(c)
+		}
+		if blockElements[n.Tag] || n.Tag == "br" {
+			b.WriteByte(' ')
+		}
+	}
+	walk(n)
+	return spacePattern.ReplaceAllString(b.String(), " ")
+}
+
+// walkElements calls fn for every element under n, n included, parents
+// before children.
+func walkElements(n *htmlNode, fn func(*htmlNode)) {
+	if n.Tag == "" {
+		return
+	}
+	fn(n)
+	for _, c := range n.Children {
+		walkElements(c, fn)
+	}
+}
+
+func hasHeading(n *htmlNode) bool {
+	for _, tag := range []string{"h1", "h2", "h3", "h4", "h5", "h6"} {
+		if findElement(n, tag) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func findElement(n *htmlNode, tag string) *htmlNode {
+	var found *htmlNode
+	walkElements(n, func(c *htmlNode) {
+		if found == nil && c.Tag == tag {
+			found = c
+		}
+	})
+	return found
+}
+
+// markdownConverter writes an article as markdown, with its links and
+// images made absolute against base.
+type markdownConverter struct {
+	base *url.URL
+}
+
+// blocks renders the children of n as markdown blocks: paragraphs from its
+// runs of text and inline elements, and headings, lists, quotes, code and
+// tables from its block elements.
+func (c markdownConverter) blocks(n *htmlNode) []string {
+	var blocks []string
+	var para strings.Builder
+	flush := func() {
+		if text := hardBreaks(para.String()); text != "" {
+			blocks = append(blocks, text)
+		}
+		para.Reset()
+	}
+	for _, child := range n.Children {
+		if child.Tag == "" || !blockElements[child.Tag] {
+			c.inline(child, &para)
+			continue
+		}
+		flush()
+		if block := c.block(child); block != "" {
+			blocks = append(blocks, block)
+		}
+	}
+	flush()
+	return blocks
+}
+
+func (c markdownConverter) block(n *htmlNode) string {
+	switch n.Tag {
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		text := strings.Join(strings.Fields(c.inlineText(n)), " ")
+		if text == "" {
+			return ""
+		}
+		level, _ := strconv.Atoi(n.Tag[1:])
+		return strings.Repeat("#", level) + " " + text
+	case "hr":
+		return "* * *"
+	case "pre":
+		code := strings.Trim(rawText(n), "\n")
+		if strings.TrimSpace(code) == "" {
+			return ""
+		}
+		fence := "```"
+		if strings.Contains(code, fence) {
+			fence = "~~~"
+		}
+		return fence + codeLanguage(n) + "\n" + code + "\n" + fence
+	case "ul", "ol":
+		return c.list(n)
+	case "blockquote":
+		quoted := strings.Join(c.blocks(n), "\n\n")
+		if quoted == "" {
+			return ""
+		}
+		lines := strings.Split(quoted, "\n")
+		for i, line := range lines {
+			lines[i] = strings.TrimRight("> "+line, " ")
+		}
+		return strings.Join(lines, "\n")
+	case "table":
+		return c.table(n)
+	case "figcaption":
+		if text := strings.TrimSpace(c.inlineText(n)); text != "" {
+			return "*" + text + "*"
+		}
+		return ""
+	case "dt":
+		if text := strings.TrimSpace(c.inlineText(n)); text != "" {
+			return "**" + text + "**"
+		}
+		return ""
+	}
+	return strings.Join(c.blocks(n), "\n\n")
+}
+
+// list renders a list tightly, its items' further lines and nested lists
+// indented under them.
+func (c markdownConverter) list(n *htmlNode) string {
+	var items []string
+	number := 1
+	if start, err := strconv.Atoi(n.Attrs["start"]); err == nil {
+		number = start
+	}
+	for _, li := range n.Children {
+		if li.Tag != "li" {
+			continue
+		}
+		blocks := c.blocks(li)
+		if len(blocks) == 0 {
+			continue
+		}
+		marker := "- "
+		if n.Tag == "ol" {
+			marker = strconv.Itoa(number) + ". "
+			number++
+		}
+		lines := strings.Split(strings.Join(blocks, "\n"), "\n")
+		for i := range lines {
+			if i == 0 {
+				lines[i] = marker + lines[i]
+			} else if lines[i] != "" {
+				lines[i] = strings.Repeat(" ", len(marker)) + lines[i]
+			}
+		}
+		items = append(items, strings.Join(lines, "\n"))
+	}
+	return strings.Join(items, "\n")
+}
+
+// table renders a table of text as a markdown table, its first row the
+// header. A table laying out a page is rendered as the blocks of its cells.
+func (c markdownConverter) table(n *htmlNode) string {
+	var rows [][]*htmlNode
+	walkElements(n, func(e *htmlNode) {
+		if e.Tag != "tr" {
+			return
+		}
+		var cells []*htmlNode
+		for _, cell := range e.Children {
+			if cell.Tag == "td" || cell.Tag == "th" {
+				cells = append(cells, cell)
+			}
+		}
+		if len(cells) > 0 {
+			rows = append(rows, cells)
+		}
+	})
+	layout := len(rows) == 0
+	for _, row := range rows {
+		for _, cell := range row {
+			if hasBlockChild(cell) {
+				layout = true
+			}
+		}
+	}
+	if layout {
+		var blocks []string
+		for _, row := range rows {
+			for _, cell := range row {
+				blocks = append(blocks, c.blocks(cell)...)
+			}
+		}
+		return strings.Join(blocks, "\n\n")
+	}
+
+	columns := 0
+	for _, row := range rows {
+		if len(row) > columns {
+			columns = len(row)
+		}
+	}
+	var lines []string
+	for i, row := range rows {
+		cells := make([]string, columns)
+		for j, cell := range row {
+			text := strings.Join(strings.Fields(c.inlineText(cell)), " ")
+			cells[j] = strings.ReplaceAll(text, "|", `\|`)
+		}
+		lines = append(lines, "| "+strings.Join(cells, " | ")+" |")
+		if i == 0 {
+			lines = append(lines, "|"+strings.Repeat(" --- |", columns))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (c markdownConverter) inlineText(n *htmlNode) string {
+	var b strings.Builder
+	for _, child := range n.Children {
+		c.inline(child, &b)
+	}
+	return b.String()
+}
+
+// inline renders text and inline elements. Whitespace is collapsed as a
+// browser would, except for line breaks, which hardBreaks keeps.
+func (c markdownConverter) inline(n *htmlNode, b *strings.Builder) {
+	if n.Tag == "" {
+		b.WriteString(escapeMarkdown(spacePattern.ReplaceAllString(n.Text, " ")))
+		return
+	}
+	switch n.Tag {
+	case "br":
+		b.WriteString("\n")
+	case "img":
+		src := n.Attrs["src"]
+		if src == "" || strings.HasPrefix(src, "data:") {
+			src = n.Attrs["data-src"]
+		}
+		if link := c.resolve(src); link != "" {
+			fmt.Fprintf(b, "![%s](%s)", markdownText(strings.TrimSpace(n.Attrs["alt"])), link)
+		}
+	case "a":
+		text := c.inlineText(n)
+		link := c.resolve(n.Attrs["href"])
+		if strings.TrimSpace(text) == "" || link == "" {
+			b.WriteString(text)
+			return
+		}
+		wrap(b, text, "[", "]("+link+")")
+	case "strong", "b":
+		wrap(b, c.inlineText(n), "**", "**")
+	case "em", "i", "cite":
+		wrap(b, c.inlineText(n), "*", "*")
+	case "del", "s", "strike":
+		wrap(b, c.inlineText(n), "~~", "~~")
+	case "code", "kbd", "samp", "tt":
+		code := strings.TrimSpace(spacePattern.ReplaceAllString(rawText(n), " "))
+		if code == "" {
+			return
+		}
+		if strings.Contains(code, "`") {
+			b.WriteString("`` " + code + " ``")
+		} else {
+			b.WriteString("`" + code + "`")
+		}
+	default:
+		for _, child := range n.Children {
+			c.inline(child, b)
+		}
+		if blockElements[n.Tag] {
+			b.WriteString(" ")
+		}
+	}
+}
+
+// wrap writes text between open and close, leaving its outer spaces
+// outside, where markdown wants them.
+func wrap(b *strings.Builder, text, open, close string) {
+	trimmed := strings.TrimSpace(text)
+	if trimmed == "" {
+		b.WriteString(text)
+		return
+	}
+	if text[0] == ' ' {
+		b.WriteString(" ")
+	}
+	b.WriteString(open + trimmed + close)
+	if text[len(text)-1] == ' ' {
+		b.WriteString(" ")
+	}
+}
+
+// resolve makes a link absolute, or returns "" for one that is no use in a
+// reading copy, such as a script or a link within the page.
+func (c markdownConverter) resolve(ref string) string {
+	ref = strings.TrimSpace(ref)
+	if ref == "" || strings.HasPrefix(ref, "#") {
+		return ""
+	}
+	u, err := c.base.Parse(ref)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "mailto" {
+		return ""
+	}
+	return strings.NewReplacer("(", "%28", ")", "%29", " ", "%20").Replace(u.String())
+}
+
+// hardBreaks trims the lines of a paragraph and joins them with markdown's
+// hard line breaks.
+func hardBreaks(text string) string {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "  \n")
+}
+
+// rawText is the text of an element as it is, for code.
+func rawText(n *htmlNode) string {
+	if n.Tag == "" {
+		return n.Text
+	}
+	var b strings.Builder
+	for _, c := range n.Children {
+		b.WriteString(rawText(c))
+	}
+	if n.Tag == "br" {
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// codeLanguage is the language a code block's class names give it, as
+// "language-go" does.
+func codeLanguage(pre *htmlNode) string {
+	names := pre.Attrs["class"]
+	if code := findElement(pre, "code"); code != nil {
+		names += " " + code.Attrs["class"]
+	}
+	for _, name := range strings.Fields(names) {
+		for _, prefix := range []string{"language-", "lang-"} {
+			if strings.HasPrefix(name, prefix) {
+				return strings.TrimPrefix(name, prefix)
+			}
+		}
+	}
+	return ""
+}
+
+func escapeMarkdown(text string) string {
+	return strings.NewReplacer(`\`, `\\`, "*", `\*`, "_", `\_`, "`", "\\`", "[", `\[`, "]", `\]`, "<", `\<`).Replace(text)
+}
+
+// setReadingCopy puts a reading copy at the end of the body of data, in
+// place of the one it has.
+func setReadingCopy(data []byte, markdown string) []byte {
+	content := string(data)
+	block := readingCopyStart + "\n\n" + markdown + "\n\n" + readingCopyEnd + "\n"
+	if i := strings.Index(content, readingCopyStart); i >= 0 {
+		if j := strings.Index(content[i:], readingCopyEnd); j >= 0 {
+			rest := strings.TrimLeft(content[i+j+len(readingCopyEnd):], "\r\n")
+			return []byte(content[:i] + block + rest)
+		}
+	}
+	return []byte(strings.TrimRight(content, "\r\n") + "\n\n" + block)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// defaultMaxRedirects is how many redirect hops are followed when the config
+// does not say.
+const defaultMaxRedirects = 5
+
+// Redirect actions for cross-host redirects and HTTPS to HTTP downgrades.
+const (
+	redirectFollow = "follow" // follow silently
+	redirectFlag   = "flag"   // follow, but record the chain in the run history
+	redirectDead   = "dead"   // treat the original content as gone
+)
+
+// redirectPolicy decides how link checks treat redirects, from the
+// [redirects] config section.
+type redirectPolicy struct {
+	MaxHops   int
+	CrossHost string
+	Downgrade string
+}
+
+var defaultRedirectPolicy = redirectPolicy{MaxHops: defaultMaxRedirects, CrossHost: redirectFlag, Downgrade: redirectFlag}
+
+// set applies one key of the [redirects] section.
+func (p *redirectPolicy) set(key, value string) error {
+	switch key {
+	case "max_hops":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid max_hops %q", value)
+		}
+		p.MaxHops = n
+	case "cross_host", "downgrade":
+		if value != redirectFollow && value != redirectFlag && value != redirectDead {
+			return fmt.Errorf("invalid %s %q (want follow, flag or dead)", key, value)
+		}
+		if key == "cross_host" {
+			p.CrossHost = value
+		} else {
+			p.Downgrade = value
+		}
+	default:
+		return fmt.Errorf("unknown [redirects] key %q", key)
+	}
+	return nil
+}
+
+// RedirectRecord is a flagged redirect chain, kept with the run. Trap names
+// the kind of a chain that would never have ended (redirect_loop, crawl_trap
+// or cookie_gate).
+type RedirectRecord struct {
+	File      string   `json:"file,omitempty"`
+	Chain     []string `json:"chain"`
+	Status    int      `json:"status"`
+	CrossHost bool     `json:"cross_host,omitempty"`
+	Downgrade bool     `json:"downgrade,omitempty"`
+	Trap      string   `json:"trap,omitempty"`
+}
+
+// httpClient returns the client for checks and lookups, following at most
+// the configured number of redirect hops. Every request is bounded by the
+// request ceiling and timed for the slow-host report.
+func (opts *runOptions) httpClient() *http.Client {
+	ceiling := opts.RequestCeiling
+	if ceiling <= 0 {
+		ceiling = defaultRequestCeiling
+	}
+	base := opts.Transport
+	if opts.UserAgents != nil {
+		base = userAgentTransport{base: base, policy: opts.UserAgents}
+	}
+	var transport http.RoundTripper = watchdogTransport{base: base, ceiling: ceiling, tracker: opts.Latency}
+	if opts.RateLimits != nil {
+		// Outside the watchdog, so time spent waiting for a budget is not
+		// taken for a slow host
+		transport = rateTransport{base: transport, scheduler: opts.RateLimits}
+	}
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = defaultClientTimeout
+	}
+	return newHTTPClient(transport, opts.maxRedirects(), timeout)
+}
+
+func (opts *runOptions) maxRedirects() int {
+	if opts.Redirects == (redirectPolicy{}) {
+		// Options built without a config, e.g. by tests
+		return defaultMaxRedirects
+	}
+	return opts.Redirects.MaxHops
+}
+
+// redirectChain lists the URLs a response was reached through, starting with
+// the one requested.
+func redirectChain(resp *http.Response) []string {
+	var chain []string
+	for req := resp.Request; req != nil; {
+		chain = append([]string{req.URL.String()}, chain...)
+		if req.Response == nil {
+			break
+		}
+		req = req.Response.Request
+	}
+	return chain
+}
+
+// sameSite reports whether two hosts belong to the same site: equal after
+// dropping "www.", or one a subdomain of the other.
+func sameSite(a, b string) bool {
+	a = strings.TrimPrefix(strings.ToLower(a), "www.")
+	b = strings.TrimPrefix(strings.ToLower(b), "www.")
+	return a == b || strings.HasSuffix(a, "."+b) || strings.HasSuffix(b, "."+a)
+}
+
+// inspect fills in the chain and flags of a verdict and applies the
+// policy. It returns true if the policy declares the link dead.
+func (p redirectPolicy) inspect(verdict *linkVerdict, resp *http.Response) bool {
+	verdict.Chain = redirectChain(resp)
+	if len(verdict.Chain) < 2 {
+		return false
+	}
+
+	first, err := url.Parse(verdict.Chain[0])
+	if err != nil {
+		return false
+	}
+	prev := first
+	for _, hop := range verdict.Chain[1:] {
+		next, err := url.Parse(hop)
+		if err != nil {
+			break
+		}
+		if prev.Scheme == "https" && next.Scheme == "http" {
+			verdict.Downgrade = true
+		}
+		prev = next
+	}
+	verdict.CrossHost = !sameSite(first.Hostname(), prev.Hostname())
+
+	if verdict.CrossHost && p.CrossHost == redirectDead {
+		verdict.Reason = fmt.Sprintf("redirected to another site (%s); cross_host = dead treats that as moved content", prev.Hostname())
+		return true
+	}
+	if verdict.Downgrade && p.Downgrade == redirectDead {
+		verdict.Reason = "redirect downgraded HTTPS to HTTP; downgrade = dead"
+		return true
+	}
+	return false
+}
+
+// flagged reports whether a verdict's redirect chain should be recorded.
+func (p redirectPolicy) flagged(verdict linkVerdict) bool {
+	return verdict.Trap != "" || (verdict.CrossHost && p.CrossHost != redirectFollow) || (verdict.Downgrade && p.Downgrade != redirectFollow)
+}
+
+// redirectTrapError stops a redirect chain that can never end: Kind is
+// ErrRedirectLoop, ErrCrawlTrap or ErrCookieGate.
+type redirectTrapError struct {
+	Kind  error
+	Chain []string
+}
+
+func (e *redirectTrapError) Error() string {
+	return fmt.Sprintf("%s after %d hops", e.Kind, len(e.Chain)-1)
+}
+
+func (e *redirectTrapError) Unwrap() error { return e.Kind }
+
+// crawlTrapHops is how many URLs in a row may differ only in their query
+// before the chain counts as a crawl trap. One such hop is common, e.g. a
+// page adding ?lang=en.
+const crawlTrapHops = 3
+
+// redirectTrap inspects the chain so far before req is followed. A chain
+// that comes back to a URL it has been to is a loop, one that keeps sending
+// the client to the same page with a new query is a crawl trap, and either
+// is a cookie gate if the redirects set cookies: without a cookie jar the
+// gate never lets the client through, but a browser would get past it.
+func redirectTrap(req *http.Request, via []*http.Request) error {
+	chain := make([]string, 0, len(via)+1)
+	for _, r := range via {
+		chain = append(chain, r.URL.String())
+	}
+	chain = append(chain, req.URL.String())
+
+	var kind error
+	next := req.URL.String()
+	for _, r := range via {
+		if r.URL.String() == next {
+			kind = ErrRedirectLoop
+			break
+		}
+	}
+	if kind == nil && len(chain) >= crawlTrapHops {
+		page := func(u *url.URL) string { return u.Scheme + "://" + strings.ToLower(u.Host) + u.EscapedPath() }
+		samePage := true
+		for _, r := range via[len(via)-(crawlTrapHops-1):] {
+			samePage = samePage && page(r.URL) == page(req.URL)
+		}
+		if samePage {
+			kind = ErrCrawlTrap
+		}
+	}
+	if kind == nil {
+		return nil
+	}
+
+	// Each request after the first carries the redirect that led to it
+	for _, r := range via[1:] {
+		if len(r.Response.Header.Values("Set-Cookie")) > 0 {
+			kind = ErrCookieGate
+		}
+	}
+	if req.Response != nil && len(req.Response.Header.Values("Set-Cookie")) > 0 {
+		kind = ErrCookieGate
+	}
+	return &redirectTrapError{Kind: kind, Chain: chain}
+}
+
+// trapVerdict judges a link whose redirects never end. Loops and crawl traps
+// defeat browsers too, so the link is dead. A cookie gate only defeats a
+// client without cookies; the link is left alone, with the chain recorded
+// for a human to look at.
+func trapVerdict(verdict *linkVerdict, trap *redirectTrapError) {
+	verdict.Chain = trap.Chain
+	verdict.Trap = errorKind(trap)
+	verdict.Dead = trap.Kind != ErrCookieGate
+	verdict.Reason = trap.Error()
+	if !verdict.Dead {
+		verdict.Reason += "; a browser would get through, so it is not treated as dead"
+	}
+}
+
+// redirectTraps lists the run's redirect chains that never ended.
+func (run *RunRecord) redirectTraps() []*RedirectRecord {
+	var traps []*RedirectRecord
+	for _, r := range run.Redirects {
+		if r.Trap != "" {
+			traps = append(traps, r)
+		}
+	}
+	return traps
+}
+
+// trapKinds counts redirect traps by kind.
+func trapKinds(traps []*RedirectRecord) map[string]int {
+	kinds := make(map[string]int)
+	for _, r := range traps {
+		kinds[r.Trap]++
+	}
+	return kinds
+}
@@ -0,0 +1,576 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// reportData is the data model passed to report templates. It is documented
+// in the README; keep the two in sync.
+type reportData struct {
+	Lang         string
+	TextVersion  string
+	Generated    time.Time
+	Runs         []*RunRecord
+	Totals       reportTotals
+	Replacements []reportReplacement
+	Secrets      []reportSecret
+	Traps        []reportTrap
+	BodyLinks    []reportBodyLink
+
+	// Collection is the collection profile, with --collection
+	Collection *collectionProfile
+}
+
+type reportTotals struct {
+	Runs     int
+	Checked  int
+	Replaced int
+	Errors   int
+	Flaky    int
+
+	// ErrorKinds sums RunRecord.ErrorKinds
+	ErrorKinds map[string]int
+}
+
+type reportReplacement struct {
+	RunID string
+	*Replacement
+}
+
+type reportSecret struct {
+	RunID string
+	*SecretRecord
+}
+
+type reportBodyLink struct {
+	RunID string
+	*BodyLinkRecord
+}
+
+type reportTrap struct {
+	RunID string
+	*RedirectRecord
+}
+
+func newReportData(runs []*RunRecord, loc *locale) reportData {
+	data := reportData{Lang: loc.Tag, Generated: time.Now(), Runs: runs}
+	for _, run := range runs {
+		data.Totals.Runs++
+		data.Totals.Checked += run.Checked
+		data.Totals.Replaced += run.Replaced
+		data.Totals.Errors += run.Errors
+		data.Totals.Flaky += run.Flaky
+		for kind, n := range run.ErrorKinds {
+			if data.Totals.ErrorKinds == nil {
+				data.Totals.ErrorKinds = make(map[string]int)
+			}
+			data.Totals.ErrorKinds[kind] += n
+		}
+		for _, r := range run.Replacements {
+			data.Replacements = append(data.Replacements, reportReplacement{RunID: run.ID, Replacement: r})
+		}
+		for _, s := range run.Secrets {
+			data.Secrets = append(data.Secrets, reportSecret{RunID: run.ID, SecretRecord: s})
+		}
+		for _, l := range run.BodyLinks {
+			data.BodyLinks = append(data.BodyLinks, reportBodyLink{RunID: run.ID, BodyLinkRecord: l})
+		}
+		for _, r := range run.redirectTraps() {
+			data.Traps = append(data.Traps, reportTrap{RunID: run.ID, RedirectRecord: r})
+		}
+	}
+	return data
+}
+
+// reportFuncs returns the template helpers, formatting for the given locale.
+func reportFuncs(loc *locale) map[string]interface{} {
+	return map[string]interface{}{
+		"date": loc.Date,
+		"num":  loc.Num,
+		"float": func(f float64) string {
+			return loc.Float(f, 2)
+		},
+		"percent": func(f float64) string {
+			return loc.Float(100*f, 0) + " %"
+		},
+		"t": loc.T,
+		"html_time": func(t time.Time) htmltemplate.HTML {
+			if t.IsZero() {
+				return ""
+			}
+			return htmltemplate.HTML(`<time datetime="` + t.Format(time.RFC3339) + `">` +
+				htmltemplate.HTMLEscapeString(loc.Date(t)) + `</time>`)
+		},
+		"duration": func(run *RunRecord) string {
+			return run.Finished.Sub(run.Started).Round(time.Second).String()
+		},
+		"join": strings.Join,
+	}
+}
+
+const textReportTemplate = `{{t "report.title"}} ({{date .Generated}})
+
+{{t "report.runs"}}: {{num .Totals.Runs}}  {{t "report.checked"}}: {{num .Totals.Checked}}  {{t "report.replaced"}}: {{num .Totals.Replaced}}  {{t "report.errors"}}: {{num .Totals.Errors}}  {{t "report.flaky"}}: {{num .Totals.Flaky}}
+{{- if .Totals.ErrorKinds}}
+{{t "report.error_kinds"}}:{{range $kind, $n := .Totals.ErrorKinds}} {{$kind}} {{num $n}}{{end}}
+{{- end}}
+{{range .Runs}}
+{{.ID}}  {{.Trigger}}/{{.Status}}  {{date .Started}} ({{duration .}})  {{t "report.checked"}} {{num .Checked}}, {{t "report.replaced"}} {{num .Replaced}}, {{t "report.errors"}} {{num .Errors}}
+{{- end}}
+{{if .Replacements}}
+{{t "report.replacements"}}:
+{{- range .Replacements}}
+  {{.File}}
+    {{.Original}}
+    -> {{.URL}}
+{{- if .Suspicious}}
+    {{t "report.suspicious"}}: {{.Suspicious}}
+{{- end}}
+{{- if .TextMatch}}
+    {{t "report.text_match"}}: {{percent .TextMatch}}
+{{- end}}
+{{- end}}
+{{end}}
+{{- if .Secrets}}
+{{t "report.secrets"}}:
+{{- range .Secrets}}
+  {{.File}}: {{join .Removed ", "}}{{if .Sanitized}} ({{t "report.sanitized"}}){{end}}
+{{- end}}
+{{end}}
+{{- if .BodyLinks}}
+{{t "report.body_links"}}:
+{{- range .BodyLinks}}
+  {{.File}}
+    {{.Original}} ({{.Reason}})
+    -> {{if .URL}}{{.URL}}{{if .Queued}} ({{t "report.queued"}}){{end}}{{else}}{{t "report.no_archive"}}{{end}}
+{{- end}}
+{{end}}
+{{- if .Traps}}
+{{t "report.traps"}}:
+{{- range .Traps}}
+  {{.File}} ({{.Trap}})
+{{- range .Chain}}
+    {{.}}
+{{- end}}
+{{- end}}
+{{end}}
+{{- with .Collection}}
+{{t "report.collection"}} ({{.Dir}})
+{{t "report.files"}}: {{num .Files}}  {{t "report.with_link"}}: {{num .WithLink}}  {{t "report.archived_links"}}: {{num .Archived}}  {{t "report.processed"}}: {{num .Processed}}  {{t "report.average_size"}}: {{num .AverageBytes}} B
+{{t "report.schemes"}}:{{range .Schemes}} {{.Name}} {{num .Count}}{{end}}
+{{t "report.ages"}}:
+{{- range .Ages}}
+  {{t .Name}}: {{num .Count}}
+{{- end}}
+{{t "report.domains" (num .DomainCount)}}:
+{{- range .Domains}}
+  {{.Name}}: {{num .Count}}
+{{- end}}
+{{- if .Survival}}
+{{t "report.survival"}}:
+{{- range .Survival}}
+  {{.Year}}: {{t "report.survival_links" (num .Links)}}, {{t "report.survival_now"}} {{percent .AliveNow}}
+{{- range .Milestones}}{{if .Known}}, {{t "report.survival_after" (num .Years)}} {{percent .Alive}}{{end}}{{end}}
+{{- end}}
+{{- end}}
+{{end}}`
+
+const markdownReportTemplate = `# {{t "report.title"}}
+
+{{t "report.generated" (date .Generated)}}
+
+| {{t "report.runs"}} | {{t "report.checked"}} | {{t "report.replaced"}} | {{t "report.errors"}} | {{t "report.flaky"}} |
+|---|---|---|---|---|
+| {{num .Totals.Runs}} | {{num .Totals.Checked}} | {{num .Totals.Replaced}} | {{num .Totals.Errors}} | {{num .Totals.Flaky}} |
+{{- if .Totals.ErrorKinds}}
+
+{{t "report.error_kinds"}}:{{range $kind, $n := .Totals.ErrorKinds}} {{$kind}} {{num $n}}{{end}}
+{{- end}}
+
+## {{t "report.runs"}}
+
+| {{t "report.run"}} | {{t "report.trigger"}} | {{t "report.status"}} | {{t "report.started"}} | {{t "report.checked"}} | {{t "report.replaced"}} | {{t "report.errors"}} |
+|---|---|---|---|---|---|---|
+{{- range .Runs}}
+| {{.ID}} | {{.Trigger}} | {{.Status}} | {{date .Started}} | {{num .Checked}} | {{num .Replaced}} | {{num .Errors}} |
+{{- end}}
+{{if .Replacements}}
+## {{t "report.replacements"}}
+{{range .Replacements}}
+- ` + "`{{.File}}`" + `: <{{.Original}}> → <{{.URL}}>{{if .Suspicious}} **{{t "report.suspicious"}}:** {{.Suspicious}}{{end}}{{if .TextMatch}} ({{t "report.text_match"}}: {{percent .TextMatch}}){{end}}
+{{- end}}
+{{end}}
+{{- if .Secrets}}
+## {{t "report.secrets"}}
+{{range .Secrets}}
+- ` + "`{{.File}}`" + `: {{join .Removed ", "}}{{if .Sanitized}} ({{t "report.sanitized"}}){{end}}
+{{- end}}
+{{end}}
+{{- if .BodyLinks}}
+## {{t "report.body_links"}}
+{{range .BodyLinks}}
+- ` + "`{{.File}}`" + `: <{{.Original}}> ({{.Reason}}) → {{if .URL}}<{{.URL}}>{{if .Queued}} ({{t "report.queued"}}){{end}}{{else}}{{t "report.no_archive"}}{{end}}
+{{- end}}
+{{end}}
+{{- if .Traps}}
+## {{t "report.traps"}}
+{{range .Traps}}
+- ` + "`{{.File}}`" + ` ({{.Trap}}):{{range .Chain}} <{{.}}>{{end}}
+{{- end}}
+{{end}}
+{{- with .Collection}}
+## {{t "report.collection"}}
+
+| {{t "report.files"}} | {{t "report.with_link"}} | {{t "report.archived_links"}} | {{t "report.processed"}} | {{t "report.average_size"}} |
+|---|---|---|---|---|
+| {{num .Files}} | {{num .WithLink}} | {{num .Archived}} | {{num .Processed}} | {{num .AverageBytes}} B |
+
+{{t "report.schemes"}}:{{range .Schemes}} {{.Name}} {{num .Count}}{{end}}
+
+| {{t "report.ages"}} | |
+|---|---|
+{{- range .Ages}}
+| {{t .Name}} | {{num .Count}} |
+{{- end}}
+
+| {{t "report.domains" (num .DomainCount)}} | |
+|---|---|
+{{- range .Domains}}
+| {{.Name}} | {{num .Count}} |
+{{- end}}
+{{- if .Survival}}
+
+### {{t "report.survival"}}
+
+| {{t "report.survival_year"}} | {{t "report.survival_count"}} | {{t "report.survival_now"}} |{{range (index .Survival 0).Milestones}} {{t "report.survival_after" (num .Years)}} |{{end}}
+|---|---|---|{{range (index .Survival 0).Milestones}}---|{{end}}
+{{- range .Survival}}
+| {{.Year}} | {{num .Links}} | {{percent .AliveNow}} |{{range .Milestones}} {{if .Known}}{{percent .Alive}}{{end}} |{{end}}
+{{- end}}
+{{- end}}
+{{end}}`
+
+// htmlReportTemplate uses semantic markup (landmarks, captioned tables with
+// header scopes, definition lists) and a high-contrast theme that follows the
+// reader's dark mode preference.
+const htmlReportTemplate = `<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{t "report.title"}}</title>
+<style>
+:root { color-scheme: light dark; --fg: #000; --bg: #fff; --link: #0000ee; --rule: #000; }
+@media (prefers-color-scheme: dark) {
+  :root { --fg: #fff; --bg: #000; --link: #ffff00; --rule: #fff; }
+}
+body { font-family: system-ui, sans-serif; font-size: 1.1rem; line-height: 1.5; margin: 2em; color: var(--fg); background: var(--bg); }
+a { color: var(--link); text-decoration: underline; }
+a:focus { outline: 3px solid var(--link); outline-offset: 2px; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+caption { text-align: left; font-weight: bold; padding-bottom: 0.3em; }
+th, td { border: 1px solid var(--rule); padding: 0.3em 0.6em; text-align: left; }
+dl { display: grid; grid-template-columns: max-content auto; gap: 0.2em 1em; }
+dt { font-weight: bold; }
+dd { margin: 0; }
+svg.survival { max-width: 40em; font-size: 14px; }
+.swatch { display: inline-block; width: 1em; height: 1em; border: 1px solid var(--rule); vertical-align: middle; }
+</style>
+</head>
+<body>
+<header>
+<h1>{{t "report.title"}}</h1>
+<p>{{t "report.generated" (date .Generated)}}</p>
+{{- if .TextVersion}}
+<p><a href="{{.TextVersion}}">{{t "report.text_version"}}</a></p>
+{{- end}}
+</header>
+<main>
+<section aria-labelledby="totals">
+<h2 id="totals">{{t "report.totals"}}</h2>
+<dl>
+<dt>{{t "report.runs"}}</dt><dd>{{num .Totals.Runs}}</dd>
+<dt>{{t "report.checked"}}</dt><dd>{{num .Totals.Checked}}</dd>
+<dt>{{t "report.replaced"}}</dt><dd>{{num .Totals.Replaced}}</dd>
+<dt>{{t "report.errors"}}</dt><dd>{{num .Totals.Errors}}</dd>
+<dt>{{t "report.flaky"}}</dt><dd>{{num .Totals.Flaky}}</dd>
+{{- range $kind, $n := .Totals.ErrorKinds}}
+<dt>{{t "report.error_kinds"}}: {{$kind}}</dt><dd>{{num $n}}</dd>
+{{- end}}
+</dl>
+</section>
+<section aria-labelledby="runs">
+<h2 id="runs">{{t "report.runs"}}</h2>
+<table>
+<caption>{{t "report.runs"}}: {{num .Totals.Runs}}</caption>
+<thead>
+<tr><th scope="col">{{t "report.run"}}</th><th scope="col">{{t "report.trigger"}}</th><th scope="col">{{t "report.status"}}</th><th scope="col">{{t "report.started"}}</th><th scope="col">{{t "report.checked"}}</th><th scope="col">{{t "report.replaced"}}</th><th scope="col">{{t "report.errors"}}</th></tr>
+</thead>
+<tbody>
+{{- range .Runs}}
+<tr><th scope="row">{{.ID}}</th><td>{{.Trigger}}</td><td>{{.Status}}</td><td>{{html_time .Started}}</td><td>{{num .Checked}}</td><td>{{num .Replaced}}</td><td>{{num .Errors}}</td></tr>
+{{- end}}
+</tbody>
+</table>
+</section>
+{{- if .Replacements}}
+<section aria-labelledby="replacements">
+<h2 id="replacements">{{t "report.replacements"}}</h2>
+<table>
+<caption>{{t "report.replacements"}}: {{num (len .Replacements)}}</caption>
+<thead>
+<tr><th scope="col">{{t "report.file"}}</th><th scope="col">{{t "report.original"}}</th><th scope="col">{{t "report.archived"}}</th></tr>
+</thead>
+<tbody>
+{{- range .Replacements}}
+<tr><th scope="row"><code>{{.File}}</code></th><td><a href="{{.Original}}">{{.Original}}</a></td><td><a href="{{.URL}}">{{.URL}}</a>{{if .Suspicious}}<br><strong>{{t "report.suspicious"}}:</strong> {{.Suspicious}}{{end}}{{if .TextMatch}}<br>{{t "report.text_match"}}: {{percent .TextMatch}}{{end}}</td></tr>
+{{- end}}
+</tbody>
+</table>
+</section>
+{{- end}}
+{{- if .Secrets}}
+<section aria-labelledby="secrets">
+<h2 id="secrets">{{t "report.secrets"}}</h2>
+<ul>
+{{- range .Secrets}}
+<li><code>{{.File}}</code>: {{join .Removed ", "}}{{if .Sanitized}} ({{t "report.sanitized"}}){{end}}</li>
+{{- end}}
+</ul>
+</section>
+{{- end}}
+{{- if .BodyLinks}}
+<section aria-labelledby="body-links">
+<h2 id="body-links">{{t "report.body_links"}}</h2>
+<table>
+<caption>{{t "report.body_links"}}: {{num (len .BodyLinks)}}</caption>
+<thead>
+<tr><th scope="col">{{t "report.file"}}</th><th scope="col">{{t "report.original"}}</th><th scope="col">{{t "report.archived"}}</th></tr>
+</thead>
+<tbody>
+{{- range .BodyLinks}}
+<tr><th scope="row"><code>{{.File}}</code></th><td><a href="{{.Original}}">{{.Original}}</a><br>{{.Reason}}</td><td>{{if .URL}}<a href="{{.URL}}">{{.URL}}</a>{{if .Queued}} ({{t "report.queued"}}){{end}}{{else}}{{t "report.no_archive"}}{{end}}</td></tr>
+{{- end}}
+</tbody>
+</table>
+</section>
+{{- end}}
+{{- if .Traps}}
+<section aria-labelledby="traps">
+<h2 id="traps">{{t "report.traps"}}</h2>
+{{- range .Traps}}
+<h3><code>{{.File}}</code> ({{.Trap}})</h3>
+<ol>
+{{- range .Chain}}
+<li><a href="{{.}}">{{.}}</a></li>
+{{- end}}
+</ol>
+{{- end}}
+</section>
+{{- end}}
+{{- with .Collection}}
+<section aria-labelledby="collection">
+<h2 id="collection">{{t "report.collection"}}</h2>
+<dl>
+<dt>{{t "report.files"}}</dt><dd>{{num .Files}}</dd>
+<dt>{{t "report.with_link"}}</dt><dd>{{num .WithLink}}</dd>
+<dt>{{t "report.archived_links"}}</dt><dd>{{num .Archived}}</dd>
+<dt>{{t "report.processed"}}</dt><dd>{{num .Processed}}</dd>
+<dt>{{t "report.average_size"}}</dt><dd>{{num .AverageBytes}} B</dd>
+{{- range .Schemes}}
+<dt>{{t "report.schemes"}}: {{.Name}}</dt><dd>{{num .Count}}</dd>
+{{- end}}
+</dl>
+<table>
+<caption>{{t "report.ages"}}</caption>
+<tbody>
+{{- range .Ages}}
+<tr><th scope="row">{{t .Name}}</th><td>{{num .Count}}</td></tr>
+{{- end}}
+</tbody>
+</table>
+<table>
+<caption>{{t "report.domains" (num .DomainCount)}}</caption>
+<tbody>
+{{- range .Domains}}
+<tr><th scope="row">{{.Name}}</th><td>{{num .Count}}</td></tr>
+{{- end}}
+</tbody>
+</table>
+{{- if .Survival}}
+<figure>
+<svg class="survival" viewBox="-40 -10 660 340" role="img" aria-labelledby="survival-title">
+<title id="survival-title">{{t "report.survival"}}</title>
+<line x1="0" y1="300" x2="600" y2="300" stroke="currentColor"/>
+<line x1="0" y1="0" x2="0" y2="300" stroke="currentColor"/>
+<text x="-8" y="5" text-anchor="end" fill="currentColor">100 %</text>
+<text x="-8" y="300" text-anchor="end" fill="currentColor">0 %</text>
+<text x="300" y="325" text-anchor="middle" fill="currentColor">{{t "report.survival_axis"}}</text>
+{{- range .Survival}}
+<polyline points="{{.Points}}" fill="none" stroke="{{.Color}}" stroke-width="3"><title>{{.Year}}</title></polyline>
+{{- end}}
+</svg>
+</figure>
+<table>
+<caption>{{t "report.survival"}}</caption>
+<thead>
+<tr><th scope="col">{{t "report.survival_year"}}</th><th scope="col">{{t "report.survival_count"}}</th><th scope="col">{{t "report.survival_now"}}</th>{{range (index .Survival 0).Milestones}}<th scope="col">{{t "report.survival_after" (num .Years)}}</th>{{end}}</tr>
+</thead>
+<tbody>
+{{- range .Survival}}
+<tr><th scope="row"><span class="swatch" style="background: {{.Color}}"></span> {{.Year}}</th><td>{{num .Links}}</td><td>{{percent .AliveNow}}</td>{{range .Milestones}}<td>{{if .Known}}{{percent .Alive}}{{end}}</td>{{end}}</tr>
+{{- end}}
+</tbody>
+</table>
+{{- end}}
+</section>
+{{- end}}
+</main>
+</body>
+</html>
+`
+
+// renderReport executes a built-in format or a user template. Templates whose
+// file name ends in .html or .htm are rendered with html/template escaping.
+func renderReport(w io.Writer, data reportData, loc *locale, format, templatePath string) error {
+	if templatePath != "" {
+		src, err := os.ReadFile(templatePath)
+		if err != nil {
+			return err
+		}
+		ext := strings.ToLower(filepath.Ext(templatePath))
+		if ext == ".html" || ext == ".htm" {
+			format = "html"
+		} else {
+			format = "text"
+		}
+		return executeReportTemplate(w, data, loc, format, filepath.Base(templatePath), string(src))
+	}
+
+	switch format {
+	case "text":
+		return executeReportTemplate(w, data, loc, format, "text", textReportTemplate)
+	case "markdown", "md":
+		return executeReportTemplate(w, data, loc, "text", "markdown", markdownReportTemplate)
+	case "html":
+		return executeReportTemplate(w, data, loc, format, "html", htmlReportTemplate)
+	}
+	return fmt.Errorf("unknown report format %q (want text, markdown or html)", format)
+}
+
+func executeReportTemplate(w io.Writer, data reportData, loc *locale, format, name, src string) error {
+	if format == "html" {
+		tmpl, err := htmltemplate.New(name).Funcs(reportFuncs(loc)).Parse(src)
+		if err != nil {
+			return err
+		}
+		return tmpl.Execute(w, data)
+	}
+
+	tmpl, err := template.New(name).Funcs(reportFuncs(loc)).Parse(src)
+	if err != nil {
+		return err
+	}
+	return tmpl.Execute(w, data)
+}
+
+// runReport implements `archive_tool report`.
+func runReport(args []string) {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	format := fs.String("format", "text", "built-in report format: text, markdown or html")
+	templatePath := fs.String("template", "", "render with a custom Go template `file` instead")
+	output := fs.String("output", "", "write the report to `file` instead of stdout")
+	runID := fs.String("run", "", "only report on the run with this `id`")
+	last := fs.Int("last", 10, "report on the last `N` runs")
+	lang := fs.String("locale", "", "language for labels, numbers and dates, e.g. de (default: config or $LANG)")
+	collection := fs.Bool("collection", false, "add a profile of the collection (domains, bookmark ages, schemes, file sizes), computed locally")
+	fs.Parse(args)
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		os.Exit(1)
+	}
+	if *lang == "" {
+		*lang = cfg.Locale
+	}
+	loc := loadLocale(detectLocale(*lang))
+
+	lock, err := loadLockFile(false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading lock file: %v\n", err)
+		os.Exit(1)
+	}
+
+	runs := lock.Runs
+	if *runID != "" {
+		runs = nil
+		for _, run := range lock.Runs {
+			if run.ID == *runID {
+				runs = append(runs, run)
+			}
+		}
+		if len(runs) == 0 {
+			fmt.Fprintf(os.Stderr, "Error: run %s not found\n", *runID)
+			os.Exit(1)
+		}
+	} else if *last > 0 && len(runs) > *last {
+		runs = runs[len(runs)-*last:]
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating %s: %v\n", *output, err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		w = file
+	}
+
+	data := newReportData(runs, loc)
+	if *collection {
+		dir := defaultBookmarksDir()
+		if cfg.Dir != "" {
+			dir = cfg.Dir
+		}
+		if fs.NArg() > 0 {
+			dir = fs.Arg(0)
+		}
+		if data.Collection, err = profileCollection(dir, lock, time.Now()); err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", dir, err)
+			os.Exit(1)
+		}
+	}
+
+	// Built-in HTML reports written to a file get a plain-text equivalent
+	// next to them, linked from the page.
+	if *format == "html" && *templatePath == "" && *output != "" {
+		textPath := strings.TrimSuffix(*output, filepath.Ext(*output)) + ".txt"
+		var buf bytes.Buffer
+		if err := renderReport(&buf, data, loc, "text", ""); err != nil {
+			fmt.Fprintf(os.Stderr, "Error rendering report: %v\n", err)
+			os.Exit(1)
+		}
+		if err := os.WriteFile(textPath, buf.Bytes(), 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing %s: %v\n", textPath, err)
+			os.Exit(1)
+		}
+		data.TextVersion = filepath.Base(textPath)
+	}
+
+	if err := renderReport(w, data, loc, *format, *templatePath); err != nil {
+		fmt.Fprintf(os.Stderr, "Error rendering report: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// retryPolicy is the [retries] section:
+//
+//	[retries]
+//	max = 2             # retries after the first attempt; 0 turns them off
+//	backoff = "1s"      # the wait before the first retry, doubled for each next one
+//	max_backoff = "30s"
+//	jitter = 0.5        # up to this fraction of each wait is added at random
+//
+// A check that timed out, did not resolve, was refused or got a server error
+// is tried again before the link is judged, so a network blip during a run
+// does not count towards its death. The jitter keeps the retries of links on
+// one struggling host from arriving together.
+type retryPolicy struct {
+	Max        int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	Jitter     float64
+}
+
+var defaultRetryPolicy = retryPolicy{Max: 2, Backoff: time.Second, MaxBackoff: 30 * time.Second, Jitter: 0.5}
+
+func (p *retryPolicy) set(key, value string) error {
+	switch key {
+	case "max":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid max %q", value)
+		}
+		p.Max = n
+	case "backoff", "max_backoff":
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid %s %q", key, value)
+		}
+		if key == "backoff" {
+			p.Backoff = d
+		} else {
+			p.MaxBackoff = d
+		}
+	case "jitter":
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || f < 0 || f > 1 {
+			return fmt.Errorf("invalid jitter %q (want 0 to 1)", value)
+		}
+		p.Jitter = f
+	default:
+		return fmt.Errorf("unknown [retries] key %q", key)
+	}
+	return nil
+}
+
+// delay is how long to wait before retry n, counting from 1. A server that
+// said when to come back with Retry-After is waited for instead, if that is
+// within max_backoff.
+func (p retryPolicy) delay(n int, after time.Duration) time.Duration {
+	if after > 0 && after <= p.MaxBackoff {
+		return after
+	}
+	d := p.Backoff << (n - 1)
+	if d > p.MaxBackoff || d < p.Backoff {
+		d = p.MaxBackoff
+	}
+	if p.Jitter > 0 && d > 0 {
+		d += time.Duration(rand.Int63n(int64(float64(d)*p.Jitter) + 1))
+	}
+	return d
+}
+
+// transientStatus reports whether a status may be gone on the next try: a
+// server error, other than a server saying it does not implement the method.
+func transientStatus(status int) bool {
+	return status >= 500 && status != http.StatusNotImplemented
+}
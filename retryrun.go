@@ -0,0 +1,112 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// fileSet is a set of bookmark files, by absolute path, so files found under
+// a relative directory match those recorded under an absolute one.
+type fileSet map[string]bool
+
+func newFileSet(files []string) fileSet {
+	set := make(fileSet, len(files))
+	for _, file := range files {
+		if abs, err := filepath.Abs(file); err == nil {
+			set[abs] = true
+		}
+	}
+	return set
+}
+
+// filter keeps the files in the set, in order.
+func (s fileSet) filter(files []string) []string {
+	var kept []string
+	for _, file := range files {
+		if abs, err := filepath.Abs(file); err == nil && s[abs] {
+			kept = append(kept, file)
+		}
+	}
+	return kept
+}
+
+// failedRun finds the run to retry: the one with id, or without one the
+// latest run with errors.
+func (lock *LockFile) failedRun(id string) (*RunRecord, error) {
+	for i := len(lock.Runs) - 1; i >= 0; i-- {
+		run := lock.Runs[i]
+		if id == "" && len(run.Failed) > 0 || id != "" && run.ID == id {
+			return run, nil
+		}
+	}
+	if id == "" {
+		return nil, fmt.Errorf("no run in the history had errors")
+	}
+	return nil, fmt.Errorf("run %s not found", id)
+}
+
+// runRetry implements `archive_tool retry`: a run over only the files that
+// had errors in an earlier run, such as one hit by a DNS outage or an
+// archive's bad hour, instead of the whole collection. Files that were
+// processed since, by another run, are skipped as usual.
+func runRetry(args []string) {
+	fs := flag.NewFlagSet("retry", flag.ExitOnError)
+	opts := runOptions{Trigger: "retry", Profile: runProfiles["fast"]}
+	opts.register(fs)
+	runID := fs.String("run", "", "retry the files that had errors in the run with this `id` (default: the latest run with errors)")
+	fs.IntVar(&opts.Concurrency, "concurrency", 0, "check `N` files at once (default 4)")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "check links and look up archives, but only report the replacements; no file is written")
+	fs.Parse(args)
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		os.Exit(1)
+	}
+	if err := opts.finish(cfg, fs.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "Error %v\n", err)
+		os.Exit(1)
+	}
+
+	lock, err := loadLockFile(false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading lock file: %v\n", err)
+		os.Exit(1)
+	}
+	failed, err := lock.failedRun(*runID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error %v\n", err)
+		os.Exit(1)
+	}
+	if len(failed.Failed) == 0 {
+		fmt.Printf("Run %s had no files with errors. Nothing to retry.\n", failed.ID)
+		return
+	}
+	fmt.Printf("Retrying %d files with errors in run %s\n", len(failed.Failed), failed.ID)
+	for _, file := range failed.Failed {
+		if _, err := os.Stat(file); err != nil {
+			fmt.Printf("  no longer there: %s\n", file)
+		}
+	}
+	opts.Only = newFileSet(failed.Failed)
+	opts.RetryOf = failed.ID
+
+	ctl := newController()
+	ctl.stopOnSignal()
+	if listener, err := ctl.listen(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: control socket unavailable: %v\n", err)
+	} else {
+		defer listener.Close()
+	}
+
+	record, err := runCheck(opts, ctl)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error %v\n", err)
+		os.Exit(1)
+	}
+	if !opts.DryRun {
+		notifyRunDone(opts.httpClient(), cfg, record)
+	}
+}
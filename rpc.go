@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JSON-RPC 2.0 error codes.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+	rpcServerError    = -32000
+)
+
+const (
+	// rpcCacheTTL is how long a check or lookup result is reused.
+	rpcCacheTTL = 10 * time.Minute
+	// rpcWorkers bounds the requests handled at once.
+	rpcWorkers = 4
+	// rpcMaxMessage bounds the Content-Length of a framed message.
+	rpcMaxMessage = 16 << 20
+)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (e *rpcError) Error() string { return e.Message }
+
+// rpcFailure turns a lookup or check error into a server error carrying its
+// error kind, so plugins can tell "no network" from "rate limited".
+func rpcFailure(err error) *rpcError {
+	return &rpcError{Code: rpcServerError, Message: err.Error(), Data: map[string]string{"kind": errorKind(err)}}
+}
+
+type rpcCacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+// rpcServer answers editor requests over stdin/stdout. Results are cached
+// for rpcCacheTTL and shared by all requests, so an editor asking about the
+// same link on every keystroke does not hit the network each time.
+type rpcServer struct {
+	opts   runOptions
+	client *http.Client
+	lock   *LockFile // read-only: runs own the state file
+
+	mu    sync.Mutex
+	cache map[string]rpcCacheEntry
+
+	out      *bufio.Writer
+	outMu    sync.Mutex
+	framed   bool // LSP-style Content-Length headers instead of one message per line
+	shutdown bool
+}
+
+type rpcLinkParams struct {
+	URL     string `json:"url"`
+	Date    string `json:"date,omitempty"`
+	Profile string `json:"profile,omitempty"`
+}
+
+type rpcFileParams struct {
+	Path    string `json:"path"`
+	Profile string `json:"profile,omitempty"`
+}
+
+type rpcLinkStatus struct {
+	URL       string    `json:"url"`
+	Dead      bool      `json:"dead"`
+	Status    int       `json:"status"`
+	Checked   time.Time `json:"checked"`
+	Flaky     bool      `json:"flaky,omitempty"`
+	History   int       `json:"history,omitempty"` // checks recorded by earlier runs
+	IsArchive bool      `json:"is_archive,omitempty"`
+	Date      string    `json:"date,omitempty"` // bookmark date, for checkFile
+	Path      string    `json:"path,omitempty"`
+}
+
+// runRPC implements `archive_tool rpc`: a long-lived JSON-RPC 2.0 server on
+// stdin/stdout for editor plugins. Messages are either one JSON object per
+// line or framed with Content-Length headers as in LSP; the first message
+// decides which, and replies use the same framing.
+func runRPC(args []string) {
+	fs := flag.NewFlagSet("rpc", flag.ExitOnError)
+	opts := runOptions{Profile: runProfiles["fast"]}
+	opts.register(fs)
+	fs.Parse(args)
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		os.Exit(1)
+	}
+	if err := opts.finish(cfg, fs.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "Error %v\n", err)
+		os.Exit(1)
+	}
+	lock, err := loadLockFile(false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading lock file: %v\n", err)
+		os.Exit(1)
+	}
+
+	s := &rpcServer{
+		opts:   opts,
+		client: opts.httpClient(),
+		lock:   lock,
+		cache:  make(map[string]rpcCacheEntry),
+		out:    bufio.NewWriter(os.Stdout),
+	}
+	if err := s.serve(os.Stdin); err != nil {
+		fmt.Fprintf(os.Stderr, "Error %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func (s *rpcServer) serve(r io.Reader) error {
+	in := bufio.NewReader(r)
+	first, err := in.Peek(1)
+	if err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	s.framed = first[0] != '{' && first[0] != '['
+
+	sem := make(chan struct{}, rpcWorkers)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		msg, err := s.readMessage(in)
+		if err == io.EOF {
+			return nil
+		}
+		var rerr *rpcError
+		if errors.As(err, &rerr) {
+			s.reply(rpcResponse{ID: json.RawMessage("null"), Error: rerr})
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if len(strings.TrimSpace(string(msg))) == 0 {
+			continue
+		}
+
+		var req rpcRequest
+		if err := json.Unmarshal(msg, &req); err != nil {
+			s.reply(rpcResponse{ID: json.RawMessage("null"), Error: &rpcError{Code: rpcParseError, Message: err.Error()}})
+			continue
+		}
+		if req.JSONRPC != "2.0" || req.Method == "" {
+			s.reply(rpcResponse{ID: orNull(req.ID), Error: &rpcError{Code: rpcInvalidRequest, Message: "not a JSON-RPC 2.0 request"}})
+			continue
+		}
+
+		switch req.Method {
+		case "exit":
+			return nil
+		case "shutdown", "initialize":
+			// Answered in order, before any request that follows them
+			s.handle(req)
+			continue
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(req rpcRequest) {
+			defer func() { <-sem; wg.Done() }()
+			s.handle(req)
+		}(req)
+	}
+}
+
+// readMessage reads one message in the framing chosen by serve.
+func (s *rpcServer) readMessage(in *bufio.Reader) ([]byte, error) {
+	if !s.framed {
+		line, err := in.ReadBytes('\n')
+		if err == io.EOF && len(line) > 0 {
+			return line, nil
+		}
+		return line, err
+	}
+
+	length := -1
+	for {
+		line, err := in.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(name), "Content-Length") {
+			if length, err = strconv.Atoi(strings.TrimSpace(value)); err != nil {
+				return nil, fmt.Errorf("bad Content-Length %q", value)
+			}
+		}
+	}
+	if length < 0 {
+		return nil, errors.New("message without Content-Length")
+	}
+	if length > rpcMaxMessage {
+		// Skipped unread, so the stream stays in step; a short one ends
+		// at the next read
+		io.CopyN(io.Discard, in, int64(length))
+		return nil, &rpcError{Code: rpcParseError, Message: fmt.Sprintf("message of %d bytes is over the limit of %d", length, rpcMaxMessage)}
+	}
+	msg := make([]byte, length)
+	_, err := io.ReadFull(in, msg)
+	return msg, err
+}
+
+func (s *rpcServer) reply(resp rpcResponse) {
+	resp.JSONRPC = "2.0"
+	data, err := json.Marshal(resp)
+	if err != nil {
+		data, _ = json.Marshal(rpcResponse{JSONRPC: "2.0", ID: resp.ID, Error: &rpcError{Code: rpcServerError, Message: err.Error()}})
+	}
+
+	s.outMu.Lock()
+	defer s.outMu.Unlock()
+	if s.framed {
+		fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n", len(data))
+		s.out.Write(data)
+	} else {
+		s.out.Write(append(data, '\n'))
+	}
+	s.out.Flush()
+}
+
+func orNull(id json.RawMessage) json.RawMessage {
+	if len(id) == 0 {
+		return json.RawMessage("null")
+	}
+	return id
+}
+
+// handle runs a request and replies unless it is a notification.
+func (s *rpcServer) handle(req rpcRequest) {
+	// A panicking request gets an internal error, and the server goes on
+	defer func() {
+		v := recover()
+		if v == nil {
+			return
+		}
+		err := recovered("handling "+req.Method, v)
+		if len(req.ID) > 0 {
+			s.reply(rpcResponse{ID: req.ID, Error: &rpcError{Code: rpcInternalError, Message: err.Error(), Data: map[string]string{"kind": "panic", "stack": err.Stack}}})
+		}
+	}()
+	result, err := s.dispatch(req)
+	if len(req.ID) == 0 {
+		return
+	}
+	resp := rpcResponse{ID: req.ID, Result: result}
+	if err != nil {
+		var rerr *rpcError
+		if !errors.As(err, &rerr) {
+			rerr = rpcFailure(err)
+		}
+		resp.Result, resp.Error = nil, rerr
+	}
+	s.reply(resp)
+}
+
+func (s *rpcServer) dispatch(req rpcRequest) (interface{}, error) {
+	s.mu.Lock()
+	shutdown := s.shutdown
+	s.mu.Unlock()
+	if shutdown && req.Method != "shutdown" {
+		return nil, &rpcError{Code: rpcInvalidRequest, Message: "server is shutting down"}
+	}
+
+	switch req.Method {
+	case "initialize":
+		return map[string]interface{}{
+			"name":      "archive_tool",
+			"methods":   []string{"checkLink", "findArchive", "checkFile", "history", "shutdown", "exit"},
+			"providers": s.providerNames(),
+		}, nil
+	case "shutdown":
+		s.mu.Lock()
+		s.shutdown = true
+		s.mu.Unlock()
+		return map[string]bool{"ok": true}, nil
+	case "checkLink":
+		var p rpcLinkParams
+		if err := decodeParams(req.Params, &p); err != nil {
+			return nil, err
+		}
+		return s.checkLink(p.URL, p.Profile)
+	case "findArchive":
+		var p rpcLinkParams
+		if err := decodeParams(req.Params, &p); err != nil {
+			return nil, err
+		}
+		return s.findArchive(p.URL, p.Date)
+	case "checkFile":
+		var p rpcFileParams
+		if err := decodeParams(req.Params, &p); err != nil {
+			return nil, err
+		}
+		return s.checkFile(p.Path, p.Profile)
+	case "history":
+		var p rpcLinkParams
+		if err := decodeParams(req.Params, &p); err != nil {
+			return nil, err
+		}
+		history := s.lock.statusHistory(p.URL)
+		if history == nil {
+			history = []StatusEntry{}
+		}
+		return map[string]interface{}{"url": p.URL, "history": history}, nil
+	}
+	return nil, &rpcError{Code: rpcMethodNotFound, Message: "unknown method " + req.Method}
+}
+
+func decodeParams(raw json.RawMessage, v interface{}) error {
+	if len(raw) == 0 {
+		return &rpcError{Code: rpcInvalidParams, Message: "missing params"}
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+	}
+	return nil
+}
+
+func (s *rpcServer) providerNames() []string {
+	names := make([]string, len(s.opts.Providers.providers))
+	for i, p := range s.opts.Providers.providers {
+		names[i] = p.name()
+	}
+	return names
+}
+
+// cached returns the result stored under key, or computes and stores it.
+// Errors are not cached.
+func (s *rpcServer) cached(key string, fn func() (interface{}, error)) (interface{}, error) {
+	s.mu.Lock()
+	entry, ok := s.cache[key]
+	s.mu.Unlock()
+	if ok && s.opts.now().Before(entry.expires) {
+		return entry.value, nil
+	}
+
+	value, err := fn()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.cache[key] = rpcCacheEntry{value: value, expires: s.opts.now().Add(rpcCacheTTL)}
+	s.mu.Unlock()
+	return value, nil
+}
+
+func (s *rpcServer) profile(name string) (runProfile, error) {
+	if name == "" {
+		return s.opts.Profile, nil
+	}
+	profile, ok := runProfiles[name]
+	if !ok {
+		return runProfile{}, &rpcError{Code: rpcInvalidParams, Message: fmt.Sprintf("unknown profile %q", name)}
+	}
+	return profile, nil
+}
+
+func (s *rpcServer) checkLink(link, profileName string) (*rpcLinkStatus, error) {
+	if link == "" {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: "url is required"}
+	}
+	profile, err := s.profile(profileName)
+	if err != nil {
+		return nil, err
+	}
+	if isWaybackURL(link) {
+		return &rpcLinkStatus{URL: link, IsArchive: true, Checked: s.opts.now()}, nil
+	}
+
+	value, err := s.cached("check "+profile.Name+" "+link, func() (interface{}, error) {
+		dead, status, err := s.opts.checkLink(s.client, link, profile)
+		if err != nil {
+			return nil, classifyError("check", link, err)
+		}
+		history := s.lock.statusHistory(link)
+		return &rpcLinkStatus{
+			URL:     link,
+			Dead:    dead,
+			Status:  status,
+			Checked: s.opts.now(),
+			Flaky:   s.opts.Flaky.classify(history) == linkFlaky,
+			History: len(history),
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(*rpcLinkStatus), nil
+}
+
+func (s *rpcServer) findArchive(link, date string) (interface{}, error) {
+	if link == "" {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: "url is required"}
+	}
+	return s.cached("archive "+date+" "+link, func() (interface{}, error) {
+		candidates, err := s.opts.Providers.lookup(s.client, link, date, s.opts.now())
+		if errors.Is(err, ErrNoSnapshot) {
+			return map[string]interface{}{"url": link, "candidates": []*snapshotCandidate{}}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		bookmark := &BookmarkFile{Link: link, Date: date}
+		chosen := selectCandidate(s.client, candidates, bookmark, s.opts.Providers.count(link))
+		return map[string]interface{}{"url": link, "best": chosen, "candidates": candidates}, nil
+	})
+}
+
+// checkFile checks the link in a bookmark file's frontmatter. It reads the
+// file from disk, so editors should send it after saving.
+func (s *rpcServer) checkFile(path, profileName string) (*rpcLinkStatus, error) {
+	bookmark, err := parseBookmarkFile(path)
+	if err != nil {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+	}
+	if bookmark.Link == "" {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: path + " has no link in its frontmatter"}
+	}
+	status, err := s.checkLink(bookmark.Link, profileName)
+	if err != nil {
+		return nil, err
+	}
+	result := *status
+	result.Path = path
+	result.Date = bookmark.Date
+	return &result, nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Store keeps blobs in an S3 bucket, or any service speaking the S3 API,
+// signing requests with AWS Signature Version 4.
+type s3Store struct {
+	profile storageProfile
+	access  string
+	secret  string
+	client  *http.Client
+}
+
+func (s *s3Store) name() string { return "s3://" + s.profile.Bucket + "/" + s.profile.Prefix }
+
+// objectURL is the URL of a key, or of the bucket for "".
+func (s *s3Store) objectURL(key string) string {
+	endpoint, err := url.Parse(s.profile.Endpoint)
+	if err != nil {
+		return s.profile.Endpoint
+	}
+	path := ""
+	if key != "" {
+		path = "/" + (&url.URL{Path: s.profile.Prefix + key}).EscapedPath()
+	}
+	if s.profile.PathStyle {
+		return fmt.Sprintf("%s://%s/%s%s", endpoint.Scheme, endpoint.Host, s.profile.Bucket, path)
+	}
+	return fmt.Sprintf("%s://%s.%s%s", endpoint.Scheme, s.profile.Bucket, endpoint.Host, path)
+}
+
+func (s *s3Store) do(method, target string, body []byte, contentType string) (*http.Response, error) {
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	s.sign(req, body, time.Now().UTC())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, classifyError("storage", target, err)
+	}
+	return resp, nil
+}
+
+// sign adds the Signature Version 4 headers for the request.
+func (s *s3Store) sign(req *http.Request, body []byte, now time.Time) {
+	region := defaultString(s.profile.Region, "us-east-1")
+	payload := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(payload[:])
+	stamp := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// Only these are signed: others, such as the User-Agent, may still be
+	// changed on the way out
+	var names []string
+	for name := range req.Header {
+		if name = strings.ToLower(name); name == "host" || name == "content-type" || strings.HasPrefix(name, "x-amz-") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var headers strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&headers, "%s:%s\n", name, strings.TrimSpace(req.Header.Get(name)))
+	}
+	signed := strings.Join(names, ";")
+
+	// The canonical query sorts the parameters and encodes spaces as %20
+	query := strings.ReplaceAll(req.URL.Query().Encode(), "+", "%20")
+	canonical := strings.Join([]string{req.Method, req.URL.EscapedPath(), query, headers.String(), signed, payloadHash}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	scope := day + "/" + region + "/s3/aws4_request"
+	toSign := strings.Join([]string{"AWS4-HMAC-SHA256", stamp, scope, hex.EncodeToString(canonicalHash[:])}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secret), day)
+	for _, part := range []string{region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.access, scope, signed, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// storageError describes a failed storage request, with the service's own
+// error message if it sent one.
+func storageError(op string, resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	var answer struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if xml.Unmarshal(body, &answer) == nil && answer.Code != "" {
+		return fmt.Errorf("%s: %d %s: %s", op, resp.StatusCode, answer.Code, answer.Message)
+	}
+	return fmt.Errorf("%s: status %d", op, resp.StatusCode)
+}
+
+func (s *s3Store) put(key string, data []byte, contentType string) error {
+	resp, err := s.do("PUT", s.objectURL(key), data, contentType)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return storageError("put "+key, resp)
+	}
+	return nil
+}
+
+func (s *s3Store) get(key string) ([]byte, error) {
+	resp, err := s.do("GET", s.objectURL(key), nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errBlobNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, storageError("get "+key, resp)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (s *s3Store) has(key string) (bool, error) {
+	resp, err := s.do("HEAD", s.objectURL(key), nil, "")
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("head %s: status %d", key, resp.StatusCode)
+}
+
+func (s *s3Store) remove(key string) error {
+	resp, err := s.do("DELETE", s.objectURL(key), nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return storageError("delete "+key, resp)
+	}
+	return nil
+}
+
+// list pages through ListObjectsV2 under the prefix.
+func (s *s3Store) list() ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {s.profile.Prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := s.do("GET", s.objectURL("")+"/?"+q.Encode(), nil, "")
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err := storageError("list", resp)
+			resp.Body.Close()
+			return nil, err
+		}
+		var page struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("list: %w", err)
+		}
+		for _, object := range page.Contents {
+			if key := strings.TrimPrefix(object.Key, s.profile.Prefix); key != "" && !strings.Contains(key, "/") {
+				keys = append(keys, key)
+			}
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			break
+		}
+		token = page.NextContinuationToken
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *s3Store) url(key string) string { return publicBlobURL(s.profile.PublicURL, key) }
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+)
+
+// runSample checks a random sample of bookmarks without touching any files
+// and extrapolates the collection-wide dead-link rate.
+func runSample(opts runOptions, ctl *controller) (*RunRecord, error) {
+	ctl.setPhase("scanning")
+	defer ctl.setPhase("idle")
+
+	fmt.Printf("Scanning directory: %s\n", opts.Dir)
+
+	files, err := findMarkdownFiles(opts.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading directory: %w", err)
+	}
+	if opts.Shard.Count > 1 {
+		files = opts.Shard.filter(opts.Dir, files)
+	}
+
+	lock, err := loadLockFile(false)
+	if err != nil {
+		return nil, fmt.Errorf("loading lock file: %w", err)
+	}
+
+	run := &RunRecord{
+		ID:      newRunID(opts.now()),
+		Trigger: opts.Trigger,
+		Shard:   opts.Shard.String(),
+		Profile: opts.Profile.Name,
+		Started: opts.now(),
+		Status:  "completed",
+	}
+
+	sample := make([]string, len(files))
+	copy(sample, files)
+	rand.Shuffle(len(sample), func(i, j int) { sample[i], sample[j] = sample[j], sample[i] })
+	if opts.Sample < len(sample) {
+		sample = sample[:opts.Sample]
+	}
+
+	fmt.Printf("Sampling %d of %d markdown files\n", len(sample), len(files))
+
+	client := opts.httpClient()
+	wd := newWatchdog()
+	ctl.setPhase("sampling")
+
+	dead := 0
+	for i, filePath := range sample {
+		wd.ping()
+		if !ctl.checkpoint() {
+			run.Status = "stopped"
+			break
+		}
+		ctl.setProgress(i, len(sample), filePath)
+		console.progress(i+1, len(sample), "Sampling [%d/%d] - Checked: %d, Dead: %d, Errors: %d", i+1, len(sample), run.Checked, dead, run.Errors)
+
+		bookmark, err := parseBookmarkFile(filePath)
+		if err != nil {
+			run.recordError(filePath, err)
+			continue
+		}
+		if bookmark.Link == "" || !opts.Filter.allows(bookmark.Link) || !opts.Tags.matches(bookmark.Tags) {
+			continue
+		}
+		if validateLink(bookmark.Link) != nil {
+			run.Invalid++
+			continue
+		}
+
+		run.Checked++
+		isDead, status, err := opts.checkLink(client, bookmark.Link, opts.Profile)
+		if err != nil {
+			run.recordError(filePath, err)
+			continue
+		}
+		lock.recordStatus(bookmark.Link, status, isDead, opts.now())
+		if isDead {
+			dead++
+		}
+	}
+
+	run.Finished = opts.now()
+	run.Sample = &SampleEstimate{
+		Population: len(files),
+		Checked:    run.Checked,
+		Dead:       dead,
+	}
+	run.Sample.estimate()
+	lock.addRun(run)
+
+	if err := saveLockFile(lock); err != nil {
+		fmt.Fprintf(os.Stderr, "\nError saving lock file: %v\n", err)
+	}
+
+	s := run.Sample
+	fmt.Printf("\n\nSample: %d links checked, %d dead (%.1f%%)\n", s.Checked, s.Dead, 100*s.DeadRate)
+	fmt.Printf("95%% confidence interval: %.1f%% - %.1f%%\n", 100*s.RateLow, 100*s.RateHigh)
+	fmt.Printf("Estimated dead links in collection: ~%d (between %d and %d of %d files)\n",
+		s.EstimatedDead, s.EstimatedLow, s.EstimatedHigh, s.Population)
+
+	return run, nil
+}
+
+// SampleEstimate is the extrapolated result of a --sample run.
+type SampleEstimate struct {
+	Population    int     `json:"population"`
+	Checked       int     `json:"checked"`
+	Dead          int     `json:"dead"`
+	DeadRate      float64 `json:"dead_rate"`
+	RateLow       float64 `json:"rate_low"`
+	RateHigh      float64 `json:"rate_high"`
+	EstimatedDead int     `json:"estimated_dead"`
+	EstimatedLow  int     `json:"estimated_low"`
+	EstimatedHigh int     `json:"estimated_high"`
+}
+
+// estimate fills in the dead rate with a 95% Wilson score interval, which
+// behaves well for small samples and rates close to 0 or 1.
+func (s *SampleEstimate) estimate() {
+	if s.Checked == 0 {
+		return
+	}
+
+	const z = 1.96
+	n := float64(s.Checked)
+	p := float64(s.Dead) / n
+
+	denom := 1 + z*z/n
+	center := (p + z*z/(2*n)) / denom
+	margin := z * math.Sqrt(p*(1-p)/n+z*z/(4*n*n)) / denom
+
+	s.DeadRate = p
+	s.RateLow = math.Max(0, center-margin)
+	s.RateHigh = math.Min(1, center+margin)
+
+	population := float64(s.Population)
+	s.EstimatedDead = int(math.Round(p * population))
+	s.EstimatedLow = int(math.Round(s.RateLow * population))
+	s.EstimatedHigh = int(math.Round(s.RateHigh * population))
+}
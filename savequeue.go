@@ -0,0 +1,563 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// spn2API is Save Page Now 2: POST a URL to it for a job ID, then poll
+// status/<job ID> until the capture is done.
+const spn2API = "https://web.archive.org/save"
+
+// snapshotField is the frontmatter field a bookmark's fresh capture is
+// recorded in; the link itself is still alive and stays as it is.
+const snapshotField = "snapshot"
+
+// Save job states.
+const (
+	saveQueued  = "queued"  // waiting to be submitted, or resubmitted at NextTry
+	savePending = "pending" // submitted, the capture is in progress
+	saveDone    = "success"
+	saveFailed  = "failed" // a permanent error, or out of attempts
+)
+
+// saveJob is a URL in the Save Page Now queue, kept in the lock file so the
+// queue survives restarts.
+type saveJob struct {
+	URL        string    `json:"url"`
+	Status     string    `json:"status"`
+	JobID      string    `json:"job_id,omitempty"`
+	Attempts   int       `json:"attempts,omitempty"`
+	Queued     time.Time `json:"queued"`
+	Submitted  time.Time `json:"submitted,omitempty"`
+	NextTry    time.Time `json:"next_try,omitempty"`
+	Snapshot   string    `json:"snapshot,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Reconciled bool      `json:"reconciled,omitempty"`
+}
+
+// savePolicy is the [save] config section. How many submissions go a
+// minute is the spn budget of [rate_limits].
+type savePolicy struct {
+	Concurrency int // requests in flight
+	MaxAttempts int
+}
+
+var defaultSavePolicy = savePolicy{Concurrency: 4, MaxAttempts: 5}
+
+func (p *savePolicy) set(key, value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return fmt.Errorf("invalid %s %q: want a positive number", key, value)
+	}
+	switch key {
+	case "concurrency":
+		p.Concurrency = n
+	case "max_attempts":
+		p.MaxAttempts = n
+	default:
+		return fmt.Errorf("unknown [save] key %q", key)
+	}
+	return nil
+}
+
+// permanentSaveErrors are SPN2 error codes that resubmitting cannot fix.
+var permanentSaveErrors = map[string]bool{
+	"error:blocked-url":        true,
+	"error:invalid-url-syntax": true,
+	"error:no-access":          true,
+	"error:not-implemented":    true,
+	"error:method-not-allowed": true,
+	"error:filesize-limit":     true,
+	"error:too-many-redirects": true,
+	"error:bad-request":        true,
+	"error:unauthorized":       true,
+}
+
+// enqueueSave adds a URL to the queue. A URL already queued, pending or
+// done is left alone; a failed one is queued again with fresh attempts.
+func (lock *LockFile) enqueueSave(link string, now time.Time) bool {
+	if lock.SaveJobs == nil {
+		lock.SaveJobs = make(map[string]*saveJob)
+	}
+	if job, ok := lock.SaveJobs[link]; ok && job.Status != saveFailed {
+		return false
+	}
+	lock.SaveJobs[link] = &saveJob{URL: link, Status: saveQueued, Queued: now}
+	return true
+}
+
+// retry puts a job back in the queue with exponential backoff, or gives up.
+func (job *saveJob) retry(reason string, permanent bool, policy savePolicy, now time.Time) {
+	job.Error = reason
+	job.JobID = ""
+	if permanent || job.Attempts >= policy.MaxAttempts {
+		job.Status = saveFailed
+		return
+	}
+	job.Status = saveQueued
+	job.NextTry = now.Add(time.Duration(1<<min(job.Attempts, 6)) * time.Minute)
+}
+
+// spn2Client talks to Save Page Now 2 with an archive.org S3-style key
+// pair, "access:secret". Submissions wait for the spn budget of rates for as
+// long as it takes, rather than failing when the client would time out.
+type spn2Client struct {
+	client *http.Client
+	keys   string
+	rates  *rateScheduler
+}
+
+// spn2Response is the shape of every SPN2 answer; which fields are set
+// depends on the call.
+type spn2Response struct {
+	URL        string `json:"url"`
+	JobID      string `json:"job_id"`
+	Status     string `json:"status"`
+	StatusExt  string `json:"status_ext"`
+	Message    string `json:"message"`
+	Timestamp  string `json:"timestamp"`
+	Original   string `json:"original_url"`
+	Available  *int   `json:"available"`
+	Processing int    `json:"processing"`
+}
+
+func (c spn2Client) do(method, endpoint string, form url.Values) (*spn2Response, error) {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequest(method, endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", archiveUserAgent)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "LOW "+c.keys)
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = c.rates.wait(req)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, classifyError("save page now", endpoint, err)
+	}
+	defer resp.Body.Close()
+	if err := statusError("save page now", endpoint, resp.StatusCode); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxBodyBytes))
+	if err != nil {
+		return nil, err
+	}
+	var answer spn2Response
+	if err := json.Unmarshal(data, &answer); err != nil {
+		return nil, fmt.Errorf("save page now: status %d, unexpected answer: %.100q", resp.StatusCode, data)
+	}
+	return &answer, nil
+}
+
+// submit asks for a capture of link and returns its job ID.
+func (c spn2Client) submit(link string) (*spn2Response, error) {
+	return c.do("POST", spn2API, url.Values{"url": {wireURL(link)}})
+}
+
+func (c spn2Client) status(jobID string) (*spn2Response, error) {
+	return c.do("GET", spn2API+"/status/"+url.PathEscape(jobID), nil)
+}
+
+// available is how many more captures the account may have in progress.
+func (c spn2Client) available() (int, error) {
+	answer, err := c.do("GET", spn2API+"/status/user", nil)
+	if err != nil {
+		return 0, err
+	}
+	if answer.Available == nil {
+		return 0, fmt.Errorf("save page now: no capture limit in the user status")
+	}
+	return *answer.Available, nil
+}
+
+// saveQueue works through the lock file's jobs.
+type saveQueue struct {
+	lock      *LockFile
+	spn       spn2Client
+	providers *providerChain
+	policy    savePolicy
+	mu        sync.Mutex // guards the jobs while workers update them
+}
+
+// jobs lists the URLs of jobs in state, oldest first.
+func (q *saveQueue) jobs(state string, due time.Time) []string {
+	var links []string
+	for link, job := range q.lock.SaveJobs {
+		if job.Status == state && (due.IsZero() || !job.NextTry.After(due)) {
+			links = append(links, link)
+		}
+	}
+	sort.Slice(links, func(i, j int) bool {
+		return q.lock.SaveJobs[links[i]].Queued.Before(q.lock.SaveJobs[links[j]].Queued)
+	})
+	return links
+}
+
+// poll asks for the status of every pending job.
+func (q *saveQueue) poll() {
+	runPool(q.jobs(savePending, time.Time{}), q.policy.Concurrency, func(link string) {
+		job := q.lock.SaveJobs[link]
+		answer, err := q.spn.status(job.JobID)
+
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		switch {
+		case err != nil:
+			// The job may still finish; ask again next time
+			fmt.Fprintf(os.Stderr, "Error polling %s: %v\n", link, err)
+		case answer.Status == "success":
+			job.Status = saveDone
+			job.Error = ""
+			job.Snapshot = fmt.Sprintf("%s/%s/%s", waybackAPI, answer.Timestamp, answer.Original)
+			fmt.Printf("%s Captured %s\n  -> %s\n", console.mark(), link, job.Snapshot)
+		case answer.Status == "error":
+			job.retry(answer.StatusExt+": "+answer.Message, permanentSaveErrors[answer.StatusExt], q.policy, q.lock.now())
+			fmt.Printf("Capture of %s failed (%s), %s\n", link, answer.StatusExt, job.Status)
+		}
+	})
+}
+
+// submit sends the due queued jobs, as many as the account has capture
+// slots for, within the spn budget. It stops early when rate limited.
+func (q *saveQueue) submit() {
+	due := q.jobs(saveQueued, q.lock.now())
+	if len(due) == 0 {
+		return
+	}
+	slots, err := q.spn.available()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading the capture limit, submitting %d: %v\n", q.policy.Concurrency, err)
+		slots = q.policy.Concurrency
+	}
+	if slots < len(due) {
+		due = due[:max(slots, 0)]
+	}
+
+	limited := false
+	runPool(due, q.policy.Concurrency, func(link string) {
+		q.mu.Lock()
+		stop := limited
+		q.mu.Unlock()
+		if stop {
+			return
+		}
+
+		job := q.lock.SaveJobs[link]
+		outbound, err := q.providers.outbound(link)
+		if err != nil {
+			q.mu.Lock()
+			job.retry(err.Error(), true, q.policy, q.lock.now())
+			q.mu.Unlock()
+			return
+		}
+		answer, err := q.spn.submit(outbound)
+
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		job.Attempts++
+		job.Submitted = q.lock.now()
+		switch {
+		case errorKind(err) == "rate_limited":
+			limited = true
+			job.retry(err.Error(), false, q.policy, q.lock.now())
+		case err != nil:
+			job.retry(err.Error(), false, q.policy, q.lock.now())
+			fmt.Fprintf(os.Stderr, "Error submitting %s: %v\n", link, err)
+		case answer.JobID == "":
+			job.retry(answer.StatusExt+": "+answer.Message, permanentSaveErrors[answer.StatusExt], q.policy, q.lock.now())
+			fmt.Printf("Submission of %s refused (%s), %s\n", link, answer.StatusExt, job.Status)
+		default:
+			job.Status = savePending
+			job.JobID = answer.JobID
+			job.Error = ""
+		}
+	})
+	if limited {
+		fmt.Fprintln(os.Stderr, "Save Page Now is rate limiting; the rest of the queue waits for the next pass")
+	}
+}
+
+// counts tallies the jobs by state.
+func (lock *LockFile) saveCounts() map[string]int {
+	counts := make(map[string]int)
+	for _, job := range lock.SaveJobs {
+		counts[job.Status]++
+	}
+	return counts
+}
+
+// reconcileSaveJobs records the capture of every finished job in the
+// frontmatter of the bookmarks linking to its URL, and returns how many
+// bookmarks it updated. Each job is reconciled once.
+func reconcileSaveJobs(lock *LockFile, dir string) (int, error) {
+	done := make(map[string]*saveJob)
+	for link, job := range lock.SaveJobs {
+		if job.Status == saveDone && !job.Reconciled {
+			done[link] = job
+		}
+	}
+	if len(done) == 0 {
+		return 0, nil
+	}
+
+	files, err := findMarkdownFiles(dir)
+	if err != nil {
+		return 0, err
+	}
+	updated := 0
+	for _, filePath := range files {
+		bookmark, err := parseBookmarkFile(filePath)
+		if err != nil {
+			continue
+		}
+		job, ok := done[bookmark.Link]
+		if !ok {
+			continue
+		}
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			return updated, err
+		}
+		changed := setFrontmatterField(data, snapshotField, job.Snapshot)
+		if string(changed) == string(data) {
+			continue
+		}
+		// The link did not change, so a processed file stays processed
+		processed := isFileProcessed(lock, filePath)
+		if err := lock.writeRewrite(filePath, data, changed, job.Snapshot); err != nil {
+			return updated, err
+		}
+		if processed {
+			if err := markFileProcessed(lock, filePath); err != nil {
+				return updated, err
+			}
+		}
+		updated++
+	}
+	for _, job := range done {
+		job.Reconciled = true
+	}
+	return updated, nil
+}
+
+// readURLList reads one URL per line, skipping blanks and '#' comments.
+func readURLList(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var links []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			links = append(links, line)
+		}
+	}
+	return links, scanner.Err()
+}
+
+// runSave implements `archive_tool save`: it queues URLs for Save Page Now,
+// submits them in parallel within the account's limits, tracks the capture
+// jobs across runs and records finished captures in the bookmarks.
+func runSave(args []string) {
+	fs := flag.NewFlagSet("save", flag.ExitOnError)
+	opts := runOptions{Profile: runProfiles["fast"]}
+	opts.register(fs)
+	urlsPath := fs.String("urls", "", "queue the URLs in this `file`, one per line (e.g. from coverage --output)")
+	bookmarks := fs.Bool("bookmarks", false, "queue the link of every bookmark without a snapshot")
+	wait := fs.Bool("wait", false, "keep going until no job is queued or pending")
+	statusOnly := fs.Bool("status", false, "only show the queue")
+	perMinute := fs.Int("per-minute", 0, "submit at most `N` URLs a minute (default: [rate_limits] spn, 12)")
+	fs.Parse(args)
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		os.Exit(1)
+	}
+	if err := opts.finish(cfg, fs.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	policy := cfg.Save
+	if *perMinute > 0 {
+		opts.RateLimits.setRate("spn", *perMinute)
+	}
+	lock, err := loadLockFile(false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading lock file: %v\n", err)
+		os.Exit(1)
+	}
+
+	var links []string
+	if *urlsPath != "" {
+		if links, err = readURLList(*urlsPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", *urlsPath, err)
+			os.Exit(1)
+		}
+	}
+	if *bookmarks {
+		files, err := findMarkdownFiles(opts.Dir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading directory: %v\n", err)
+			os.Exit(1)
+		}
+		opts.Providers.sensitive.scan(files)
+		for _, filePath := range files {
+			bookmark, err := parseBookmarkFile(filePath)
+			if err != nil || bookmark.Link == "" || isWaybackURL(bookmark.Link) || validateLink(bookmark.Link) != nil {
+				continue
+			}
+			if _, ok := bookmark.Headers[snapshotField]; ok {
+				continue
+			}
+			if opts.Filter.allows(bookmark.Link) && opts.Tags.matches(bookmark.Tags) {
+				links = append(links, bookmark.Link)
+			}
+		}
+	}
+	queued, sensitive := 0, 0
+	for _, link := range links {
+		if opts.Providers.permit(link) != nil {
+			sensitive++
+			continue
+		}
+		if lock.enqueueSave(link, lock.now()) {
+			queued++
+		}
+	}
+	if len(links) > 0 {
+		fmt.Printf("Queued %d new URLs for Save Page Now", queued)
+		if sensitive > 0 {
+			fmt.Printf(", skipped %d sensitive", sensitive)
+		}
+		fmt.Println()
+	}
+
+	if !*statusOnly {
+		keys, err := cfg.Secrets.get("archive_org_keys")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Save Page Now needs archive.org keys: %v\n", err)
+			saveLockFile(lock)
+			os.Exit(1)
+		}
+		queue := &saveQueue{
+			lock:      lock,
+			spn:       spn2Client{client: opts.httpClient(), keys: keys, rates: opts.RateLimits},
+			providers: opts.Providers,
+			policy:    policy,
+		}
+		for {
+			queue.poll()
+			queue.submit()
+			// Every pass is saved, so an interrupted queue resumes where it was
+			if err := saveLockFile(lock); err != nil {
+				fmt.Fprintf(os.Stderr, "Error saving lock file: %v\n", err)
+			}
+			counts := lock.saveCounts()
+			if !*wait || counts[saveQueued]+counts[savePending] == 0 {
+				break
+			}
+			time.Sleep(saveWaitInterval)
+		}
+	}
+
+	updated, err := reconcileSaveJobs(lock, opts.Dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error recording captures: %v\n", err)
+	}
+	if updated > 0 {
+		fmt.Printf("Recorded %d captures in bookmark frontmatter\n", updated)
+	}
+	if err := saveLockFile(lock); err != nil {
+		fmt.Fprintf(os.Stderr, "Error saving lock file: %v\n", err)
+	}
+
+	counts := lock.saveCounts()
+	fmt.Printf("Save Page Now queue: %d queued, %d pending, %d captured, %d failed\n",
+		counts[saveQueued], counts[savePending], counts[saveDone], counts[saveFailed])
+	if *statusOnly {
+		for _, link := range queueOrder(lock) {
+			job := lock.SaveJobs[link]
+			if job.Status == saveDone {
+				continue
+			}
+			fmt.Printf("  %-8s %s", job.Status, link)
+			if job.Error != "" {
+				fmt.Printf(" (attempt %d: %s)", job.Attempts, job.Error)
+			}
+			fmt.Println()
+		}
+	}
+}
+
+// saveWaitInterval is how long --wait sleeps between passes.
+const saveWaitInterval = 20 * time.Second
+
+func queueOrder(lock *LockFile) []string {
+	links := make([]string, 0, len(lock.SaveJobs))
+	for link := range lock.SaveJobs {
+		links = append(links, link)
+	}
+	sort.Strings(links)
+	return links
+}
+
+// queueLiveCapture queues the alive link of a bookmark for Save Page Now,
+// unless the bookmark has a snapshot already, so a copy exists before the
+// page dies.
+func queueLiveCapture(lock *LockFile, bookmark *BookmarkFile, run *RunRecord, opts runOptions, ex *explainer) {
+	if _, ok := bookmark.Headers[snapshotField]; ok || isWaybackURL(bookmark.Link) {
+		return
+	}
+	if err := opts.Providers.permit(bookmark.Link); err != nil {
+		ex.logf("not queued for Save Page Now: %v", err)
+		return
+	}
+	if lock.enqueueSave(bookmark.Link, opts.now()) {
+		ex.logf("alive without a snapshot; queued for Save Page Now")
+		run.Saving++
+	}
+}
+
+// saveLiveCaptures makes one pass over the Save Page Now queue after an
+// --archive-live run and records the captures finished since the last one.
+// Jobs still pending are asked about again by the next run.
+func saveLiveCaptures(client *http.Client, lock *LockFile, opts runOptions) {
+	queue := &saveQueue{
+		lock:      lock,
+		spn:       spn2Client{client: client, keys: opts.SaveKeys, rates: opts.RateLimits},
+		providers: opts.Providers,
+		policy:    opts.Save,
+	}
+	queue.poll()
+	queue.submit()
+	if updated, err := reconcileSaveJobs(lock, opts.Dir); err != nil {
+		fmt.Fprintf(os.Stderr, "\nError recording Save Page Now captures: %v\n", err)
+	} else if updated > 0 {
+		fmt.Printf("\nRecorded %d Save Page Now captures in bookmark frontmatter\n", updated)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// maxSnapshotBytes caps how much of a snapshot is read when scoring it.
+const maxSnapshotBytes = 512 * 1024
+
+// snapshotCandidate is one archived copy offered by a provider.
+type snapshotCandidate struct {
+	ID         string    `json:"id"`
+	Provider   string    `json:"provider"`
+	URL        string    `json:"url"`
+	Captured   time.Time `json:"captured,omitempty"`
+	Status     int       `json:"status,omitempty"`
+	Length     int       `json:"length,omitempty"`
+	Similarity float64   `json:"similarity,omitempty"`
+	TextMatch  float64   `json:"text_match,omitempty"` // share of the saved full text
+	Score      float64   `json:"score"`
+
+	rank      int  // provider preference, 0 is most preferred
+	paywalled bool // the bookmark is on a [paywalls] host
+}
+
+var waybackTimestampPattern = regexp.MustCompile(`/web/(\d{14})`)
+
+// candidateID derives a short, stable ID from the snapshot URL, so that
+// `archive_tool apply --use <id>` works without naming the run or file.
+func candidateID(snapshotURL string) string {
+	sum := sha256.Sum256([]byte(snapshotURL))
+	return fmt.Sprintf("%x", sum[:4])
+}
+
+func newWaybackCandidate(snapshotURL string) *snapshotCandidate {
+	candidate := &snapshotCandidate{URL: snapshotURL}
+	if m := waybackTimestampPattern.FindStringSubmatch(snapshotURL); m != nil {
+		if t, err := time.Parse("20060102150405", m[1]); err == nil {
+			candidate.Captured = t
+		}
+	}
+	return candidate
+}
+
+// selectCandidate scores the candidates and returns the best one. Snapshots
+// are only fetched for scoring when there is an actual choice to make, or
+// when the bookmark saved the page's text, so the report can say how much of
+// it the snapshot has.
+func selectCandidate(client *http.Client, candidates []*snapshotCandidate, bookmark *BookmarkFile, providerCount int) *snapshotCandidate {
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	saved := shingles(savedText(bookmark.Content))
+	if len(candidates) > 1 || len(saved) > 0 {
+		notes := textTokens(bookmark.Content)
+		for _, candidate := range candidates {
+			inspectCandidate(client, candidate, notes, saved)
+		}
+	}
+
+	target := parseDate(bookmark.Date)
+	paywalled := paywallSettings.covers(bookmark.Link)
+	var best *snapshotCandidate
+	for _, candidate := range candidates {
+		candidate.paywalled = paywalled
+		candidate.Score = scoreCandidate(candidate, target, providerCount)
+		if best == nil || candidate.Score > best.Score {
+			best = candidate
+		}
+	}
+	return best
+}
+
+// scoreCandidate weighs replay status, closeness to the bookmark date,
+// content size, similarity to the saved notes, the paywall preference and
+// provider preference.
+func scoreCandidate(c *snapshotCandidate, target time.Time, providerCount int) float64 {
+	score := 0.0
+	for _, part := range scoreParts(c, target, providerCount) {
+		score += part.value
+	}
+	return math.Round(score*1000) / 1000
+}
+
+// scorePart is one term of a candidate's score, named for --explain.
+type scorePart struct {
+	name  string
+	value float64
+}
+
+func scoreParts(c *snapshotCandidate, target time.Time, providerCount int) []scorePart {
+	var parts []scorePart
+
+	switch {
+	case c.Status == http.StatusOK:
+		parts = append(parts, scorePart{"replay 200", 3})
+	case c.Status != 0:
+		parts = append(parts, scorePart{fmt.Sprintf("replay %d", c.Status), -5})
+	}
+
+	if !c.Captured.IsZero() && !target.IsZero() {
+		days := math.Abs(c.Captured.Sub(target).Hours() / 24)
+		parts = append(parts, scorePart{fmt.Sprintf("%.0f days from bookmark date", days), 2 / (1 + days/180)})
+	}
+
+	if c.Length > 0 {
+		parts = append(parts, scorePart{fmt.Sprintf("%d bytes", c.Length), math.Min(1, float64(c.Length)/20000)})
+	}
+
+	if c.Similarity > 0 {
+		parts = append(parts, scorePart{fmt.Sprintf("%.0f%% of note words", c.Similarity*100), 3 * c.Similarity})
+	}
+
+	// The saved text is the page as it was bookmarked, so it outweighs
+	// everything but a failed replay
+	if c.TextMatch > 0 {
+		parts = append(parts, scorePart{fmt.Sprintf("%.0f%% of saved text", c.TextMatch*100), 6 * c.TextMatch})
+	}
+
+	if c.paywalled && c.Provider == paywallSettings.Prefer {
+		parts = append(parts, scorePart{"past the paywall on " + c.Provider, paywallBonus})
+	}
+
+	if providerCount > 1 {
+		parts = append(parts, scorePart{fmt.Sprintf("provider preference %d", c.rank+1), 1 - float64(c.rank)/float64(providerCount)})
+	}
+
+	return parts
+}
+
+// inspectCandidate fetches a snapshot to record its status, size and how
+// much of its text overlaps with the bookmark's notes, or matches its saved
+// text when it has one.
+func inspectCandidate(client *http.Client, c *snapshotCandidate, notes, saved map[string]bool) {
+	req, err := http.NewRequest("GET", c.URL, nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("User-Agent", archiveUserAgent)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	c.Status = resp.StatusCode
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxSnapshotBytes))
+	c.Length = len(body)
+
+	text := stripTags(waybackToolbarPattern.ReplaceAllString(string(body), " "))
+	switch {
+	case len(saved) > 0:
+		c.TextMatch = tokenOverlap(saved, shingles(wordPattern.FindAllString(strings.ToLower(text), -1)))
+	case len(notes) > 0:
+		c.Similarity = tokenOverlap(notes, textTokens(text))
+	}
+}
+
+var (
+	tagPattern  = regexp.MustCompile(`(?s)<script.*?</script>|<style.*?</style>|<[^>]*>`)
+	wordPattern = regexp.MustCompile(`[\pL\pN]{3,}`)
+
+	// waybackToolbarPattern matches the banner the Wayback Machine adds to
+	// replays, which is not part of the page
+	waybackToolbarPattern = regexp.MustCompile(`(?s)<!-- BEGIN WAYBACK TOOLBAR INSERT -->.*?<!-- END WAYBACK TOOLBAR INSERT -->`)
+)
+
+// savedTextMinWords is how long a bookmark body must be to be taken for the
+// page's saved text, as some Pinboard exports keep it, rather than notes.
+const savedTextMinWords = 150
+
+// savedText returns the words of a bookmark body holding the page's text,
+// or nil for an ordinary body.
+func savedText(content string) []string {
+	words := wordPattern.FindAllString(strings.ToLower(stripTags(content)), -1)
+	if len(words) < savedTextMinWords {
+		return nil
+	}
+	return words
+}
+
+// shingles are the runs of three words of a text. Comparing them rather
+// than words tells a page from one that shares its vocabulary, as a diff
+// would, without having to align the texts.
+func shingles(words []string) map[string]bool {
+	if len(words) < 3 {
+		return nil
+	}
+	runs := make(map[string]bool, len(words)-2)
+	for i := 0; i+3 <= len(words); i++ {
+		runs[strings.Join(words[i:i+3], " ")] = true
+	}
+	return runs
+}
+
+func stripTags(html string) string {
+	return tagPattern.ReplaceAllString(html, " ")
+}
+
+func textTokens(text string) map[string]bool {
+	tokens := make(map[string]bool)
+	for _, word := range wordPattern.FindAllString(strings.ToLower(text), -1) {
+		tokens[word] = true
+	}
+	return tokens
+}
+
+// tokenOverlap is the share of note words, or saved text shingles, that also
+// appear in the snapshot.
+func tokenOverlap(notes, snapshot map[string]bool) float64 {
+	if len(notes) == 0 {
+		return 0
+	}
+	shared := 0
+	for word := range notes {
+		if snapshot[word] {
+			shared++
+		}
+	}
+	return math.Round(float64(shared)/float64(len(notes))*1000) / 1000
+}
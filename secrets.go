@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// Secrets such as API tokens are configured as references in the [secrets]
+// section of the config file rather than stored in plaintext:
+//
+//	[secrets]
+//	pinboard_token = "cmd:pass show web/pinboard"
+//	archive_org_keys = "keyring:archive_tool/archive.org"
+//	webhook_secret = "env:WEBHOOK_SECRET"
+//
+// Every secret can also be overridden by an ARCHIVE_TOOL_<NAME> environment
+// variable, e.g. ARCHIVE_TOOL_PINBOARD_TOKEN.
+type secretStore struct {
+	mu       sync.Mutex
+	refs     map[string]string
+	resolved map[string]string
+}
+
+func (s *secretStore) setRef(name, ref string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.refs == nil {
+		s.refs = make(map[string]string)
+	}
+	s.refs[name] = ref
+}
+
+// get resolves a secret by name. Resolution happens at most once per process,
+// so password managers are not prompted repeatedly.
+func (s *secretStore) get(name string) (string, error) {
+	if value := os.Getenv("ARCHIVE_TOOL_" + strings.ToUpper(name)); value != "" {
+		return value, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if value, ok := s.resolved[name]; ok {
+		return value, nil
+	}
+
+	ref, ok := s.refs[name]
+	if !ok {
+		return "", fmt.Errorf("secret %q is not configured (add it to [secrets] in %s or set ARCHIVE_TOOL_%s)",
+			name, getConfigPath(), strings.ToUpper(name))
+	}
+
+	value, err := resolveSecretRef(ref)
+	if err != nil {
+		return "", fmt.Errorf("secret %q: %w", name, err)
+	}
+
+	if s.resolved == nil {
+		s.resolved = make(map[string]string)
+	}
+	s.resolved[name] = value
+	return value, nil
+}
+
+func (s *secretStore) names() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.refs {
+		names = append(names, name)
+	}
+	return names
+}
+
+// resolveSecretRef looks up a reference of the form env:NAME, cmd:COMMAND,
+// keyring:SERVICE/ACCOUNT or file:PATH.
+func resolveSecretRef(ref string) (string, error) {
+	kind, arg, ok := strings.Cut(ref, ":")
+	if !ok {
+		return "", fmt.Errorf("invalid reference %q (want env:, cmd:, keyring: or file:)", ref)
+	}
+
+	switch kind {
+	case "env":
+		value := os.Getenv(arg)
+		if value == "" {
+			return "", fmt.Errorf("environment variable %s is not set", arg)
+		}
+		return value, nil
+	case "cmd":
+		return runSecretCommand("sh", "-c", arg)
+	case "keyring":
+		service, account, ok := strings.Cut(arg, "/")
+		if !ok {
+			return "", fmt.Errorf("keyring reference %q needs SERVICE/ACCOUNT", arg)
+		}
+		return keyringLookup(service, account)
+	case "file":
+		data, err := os.ReadFile(expandHome(arg))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	return "", fmt.Errorf("unknown reference type %q", kind)
+}
+
+// keyringLookup reads a password from the OS keychain via its command line
+// tool: security(1) on macOS, secret-tool(1) from libsecret elsewhere.
+func keyringLookup(service, account string) (string, error) {
+	if runtime.GOOS == "darwin" {
+		return runSecretCommand("security", "find-generic-password", "-s", service, "-a", account, "-w")
+	}
+	return runSecretCommand("secret-tool", "lookup", "service", service, "account", account)
+}
+
+// runSecretCommand runs a command and returns the first line of its output.
+func runSecretCommand(name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	cmd.Stdin = os.Stdin
+
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%s: %v: %s", name, err, msg)
+		}
+		return "", fmt.Errorf("%s: %v", name, err)
+	}
+
+	// pass(1) and friends print the secret on the first line
+	value, _, _ := strings.Cut(string(out), "\n")
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", fmt.Errorf("%s returned an empty secret", name)
+	}
+	return value, nil
+}
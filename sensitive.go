@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// deadField is the frontmatter field a dead sensitive link is annotated
+// with, since it cannot be replaced by an archived copy.
+const deadField = "dead"
+
+// sensitivePolicy keeps sensitive links away from third-party archive
+// services. A link is sensitive if its domain is in the sensitive list, or if
+// it belongs to a bookmark with a tag whose policy is "sensitive"; such
+// links are only checked and annotated locally. The provider chain enforces
+// it, so every lookup, capture request and CDX query goes through covers.
+type sensitivePolicy struct {
+	mu      sync.Mutex
+	path    string
+	modTime time.Time
+	rules   []string
+	tags    tagPolicies
+	links   map[string]bool // links of bookmarks with a sensitive tag
+}
+
+func newSensitivePolicy(path string, tags tagPolicies) (*sensitivePolicy, error) {
+	p := &sensitivePolicy{path: expandHome(path), tags: tags, links: make(map[string]bool)}
+	if err := p.refresh(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// refresh reloads the sensitive list if it has changed.
+func (p *sensitivePolicy) refresh() error {
+	if p == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := reloadRuleFile(p.path, &p.modTime, &p.rules); err != nil {
+		return fmt.Errorf("sensitive list: %w", err)
+	}
+	return nil
+}
+
+// markBookmark reports whether a bookmark is sensitive. The link and the
+// assets of one with a sensitive tag are remembered, so later requests about
+// them are refused even where the bookmark itself is not at hand.
+func (p *sensitivePolicy) markBookmark(bookmark *BookmarkFile) bool {
+	if p == nil {
+		return false
+	}
+	if !p.tags.sensitive(bookmark.Tags) {
+		return p.covers(bookmark.Link)
+	}
+	p.mark(bookmark.Link)
+	p.mark(embeddedURLs(bookmark.Content)...)
+	return true
+}
+
+// scan marks the links of every bookmark with a sensitive tag before a run,
+// so a URL one such bookmark links to is safe even in the bookmarks checked
+// before it.
+func (p *sensitivePolicy) scan(files []string) {
+	if p == nil || !p.tags.hasSensitive() {
+		return
+	}
+	for _, filePath := range files {
+		if bookmark, err := parseBookmarkFile(filePath); err == nil {
+			p.markBookmark(bookmark)
+		}
+	}
+}
+
+// mark remembers links as sensitive, e.g. the destination a sensitive short
+// link resolves to.
+func (p *sensitivePolicy) mark(links ...string) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, link := range links {
+		p.links[wireURL(link)] = true
+	}
+}
+
+// covers reports whether link must not be sent to an archive service.
+func (p *sensitivePolicy) covers(link string) bool {
+	if p == nil {
+		return false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.links[wireURL(link)] || matchesAnyRule(p.rules, link)
+}
+
+// permit returns an ErrSensitive error if link must not be sent to an
+// archive service. Everything that contacts one about a bookmarked URL asks
+// first, through outbound.
+func (c *providerChain) permit(link string) error {
+	if c.sensitive.covers(link) {
+		return &LinkError{Op: "archive lookup", URL: link, Kind: ErrSensitive}
+	}
+	return nil
+}
+
+// annotateDead records in the frontmatter when a sensitive link was first
+// found dead, the only change made to such a bookmark.
+func annotateDead(lock *LockFile, bookmark *BookmarkFile, now time.Time) error {
+	if _, ok := bookmark.Headers[deadField]; ok {
+		return nil
+	}
+	data, err := os.ReadFile(bookmark.Path)
+	if err != nil {
+		return err
+	}
+	updated := setFrontmatterField(data, deadField, now.Format("2006-01-02"))
+	return lock.writeRewrite(bookmark.Path, data, updated, bookmark.Link)
+}
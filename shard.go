@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// shardSpec selects slice Index (1-based) of Count, as given by --shard K/N.
+type shardSpec struct {
+	Index int
+	Count int
+}
+
+func (s *shardSpec) String() string {
+	if s.Count <= 1 {
+		return ""
+	}
+	return fmt.Sprintf("%d/%d", s.Index, s.Count)
+}
+
+func (s *shardSpec) Set(value string) error {
+	k, n, ok := strings.Cut(value, "/")
+	if !ok {
+		return fmt.Errorf("expected K/N, got %q", value)
+	}
+
+	index, err := strconv.Atoi(k)
+	if err != nil {
+		return fmt.Errorf("invalid shard index %q", k)
+	}
+	count, err := strconv.Atoi(n)
+	if err != nil {
+		return fmt.Errorf("invalid shard count %q", n)
+	}
+	if count < 1 || index < 1 || index > count {
+		return fmt.Errorf("shard %q out of range: need 1 <= K <= N", value)
+	}
+
+	s.Index, s.Count = index, count
+	return nil
+}
+
+// contains reports whether the file belongs to this shard. Files are assigned
+// by hashing their path relative to the collection root, so every machine
+// computes the same split regardless of where the collection is mounted.
+func (s *shardSpec) contains(dir, filePath string) bool {
+	if s.Count <= 1 {
+		return true
+	}
+	return shardIndex(dir, filePath, s.Count) == s.Index-1
+}
+
+// shardIndex is the slice, from 0, of count slices a file is in.
+func shardIndex(dir, filePath string, count int) int {
+	key := filePath
+	if rel, err := filepath.Rel(dir, filePath); err == nil {
+		key = filepath.ToSlash(rel)
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(count))
+}
+
+func (s *shardSpec) filter(dir string, files []string) []string {
+	var selected []string
+	for _, filePath := range files {
+		if s.contains(dir, filePath) {
+			selected = append(selected, filePath)
+		}
+	}
+	return selected
+}
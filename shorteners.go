@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// knownShorteners are hosts whose links only redirect somewhere else.
+var knownShorteners = func() shortenerSet {
+	var s shortenerSet
+	s.add("bit.ly, bitly.com, j.mp, t.co, goo.gl, tinyurl.com, tiny.cc, ow.ly, buff.ly, dlvr.it, " +
+		"is.gd, v.gd, fb.me, lnkd.in, amzn.to, youtu.be, rebrand.ly, cutt.ly, shorturl.at, " +
+		"bl.ink, rb.gy, trib.al, su.pr, wp.me")
+	return s
+}()
+
+// dyingShorteners are shortening services that have stopped or announced
+// they will stop resolving links. Destinations behind them are submitted to
+// Save Page Now while they can still be found.
+var dyingShorteners = map[string]bool{
+	"goo.gl": true,
+}
+
+// shortenerSet is the built-in shorteners plus any named in the config.
+type shortenerSet map[string]bool
+
+func (s shortenerSet) matches(link string) bool {
+	u, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	return knownShorteners[host] || s[host]
+}
+
+func (s *shortenerSet) add(hosts string) {
+	for _, host := range strings.Split(hosts, ",") {
+		host = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(host)), "www.")
+		if host == "" {
+			continue
+		}
+		if *s == nil {
+			*s = make(shortenerSet)
+		}
+		(*s)[host] = true
+	}
+}
+
+func isDyingShortener(link string) bool {
+	u, err := url.Parse(link)
+	return err == nil && dyingShorteners[strings.ToLower(u.Hostname())]
+}
+
+var metaRefreshPattern = regexp.MustCompile(`(?is)<meta[^>]+http-equiv=["']?refresh["']?[^>]+content=["']?\s*\d+\s*;\s*url=([^"'>\s]+)`)
+
+// resolveShortener follows a short link hop by hop, without visiting the
+// destination, until it leaves the shorteners. Some shorteners answer
+// browsers with a meta refresh page instead of a redirect; that is followed
+// too.
+func resolveShortener(client *http.Client, link string, shorteners shortenerSet, maxHops int) (string, error) {
+	noFollow := *client
+	noFollow.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	current := link
+	for hop := 0; hop <= maxHops; hop++ {
+		if !shorteners.matches(current) {
+			return current, nil
+		}
+		next, err := shortenerHop(&noFollow, current)
+		if err != nil {
+			return "", err
+		}
+		current = next
+	}
+	return "", fmt.Errorf("%s: more than %d shortener hops", link, maxHops)
+}
+
+func shortenerHop(client *http.Client, link string) (string, error) {
+	req, err := http.NewRequest("GET", wireURL(link), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", classifyError("resolving short link", link, err)
+	}
+	defer resp.Body.Close()
+
+	var target string
+	switch {
+	case resp.StatusCode >= 300 && resp.StatusCode < 400:
+		target = resp.Header.Get("Location")
+	case resp.StatusCode == http.StatusOK:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxBodyBytes))
+		if m := metaRefreshPattern.FindSubmatch(body); m != nil {
+			target = string(m[1])
+		}
+	default:
+		if err := statusError("resolving short link", link, resp.StatusCode); err != nil {
+			return "", err
+		}
+	}
+	if target == "" {
+		return "", fmt.Errorf("resolving short link %s: status %d without a destination", link, resp.StatusCode)
+	}
+
+	base := req.URL
+	next, err := base.Parse(target)
+	if err != nil {
+		return "", fmt.Errorf("resolving short link %s: bad destination %q", link, target)
+	}
+	return next.String(), nil
+}
+
+// savePageNow asks the Wayback Machine to capture a URL.
+func savePageNow(client *http.Client, link string) error {
+	endpoint := strings.TrimSuffix(waybackAPI, "/web") + "/save/" + wireURL(link)
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", archiveUserAgent)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return classifyError("save page now", link, err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxBodyBytes))
+	if err := statusError("save page now", link, resp.StatusCode); err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("save page now %s: status %d", link, resp.StatusCode)
+	}
+	return nil
+}
+
+// expandShortLink handles a short link whose destination is alive: the
+// destination of a dying shortener is submitted to Save Page Now, and with
+// --expand-shorteners the bookmark is rewritten (or queued for review) to
+// point at the destination directly.
+func expandShortLink(client *http.Client, lock *LockFile, bookmark *BookmarkFile, dest string, run *RunRecord, opts runOptions, ex *explainer) {
+	if isDyingShortener(bookmark.Link) {
+		if outbound, err := opts.Providers.outbound(dest); err != nil {
+			ex.logf("%s is shutting down, but %s is sensitive and not submitted to Save Page Now", bookmark.Link, dest)
+		} else if opts.unlocked(func() { err = savePageNow(client, outbound) }); err != nil {
+			fmt.Fprintf(os.Stderr, "\nError saving %s behind %s: %v\n", dest, bookmark.Link, err)
+		} else {
+			ex.logf("%s is shutting down; submitted %s to Save Page Now", bookmark.Link, dest)
+			fmt.Printf("\nSaved destination of dying short link: %s\n  -> %s\n", bookmark.Link, dest)
+		}
+	}
+	if !opts.ExpandShorteners {
+		return
+	}
+
+	if opts.Queue {
+		opts.Pending.add(&pendingItem{File: relativeTo(opts.Dir, bookmark.Path), Original: bookmark.Link, URL: dest})
+		run.Queued++
+		fmt.Printf("\nQueued for review: %s\n  -> %s (expanded)\n", bookmark.Link, dest)
+		return
+	}
+	if err := lock.rewriteBookmark(bookmark, dest); err != nil {
+		fmt.Fprintf(os.Stderr, "\nError updating %s: %v\n", bookmark.Path, err)
+		run.recordError(bookmark.Path, err)
+		return
+	}
+	run.Expanded++
+	ex.logf("rewrote the short link to its destination")
+	fmt.Printf("\n%s Expanded: %s\n  -> %s\n", console.mark(), bookmark.Link, dest)
+}
+
+// waybackReplayPattern splits a replay URL into its timestamp (with any
+// flags such as id_) and the original URL.
+var waybackReplayPattern = regexp.MustCompile(`^(?:https?://(?:web\.)?archive\.org)?/web/(\d{1,14})([a-z_]*)/(.+)$`)
+
+// recoverShortLink finds where a short link used to point when the
+// shortener itself no longer answers: it looks for an archived capture of
+// the short URL and reads the redirect (or meta refresh) that was captured.
+func recoverShortLink(client *http.Client, link string) (string, error) {
+	link = wireURL(link)
+	q := url.Values{}
+	q.Set("url", link)
+	q.Set("fl", "timestamp,statuscode")
+	q.Set("limit", "20")
+	rows, err := cdxQuery(client, q)
+	if err != nil {
+		return "", err
+	}
+
+	// Captured redirects first; a 200 may be a meta refresh page
+	var timestamps []string
+	for _, want := range []string{"3", "2"} {
+		for _, row := range rows {
+			if len(row) == 2 && strings.HasPrefix(row[1], want) {
+				timestamps = append(timestamps, row[0])
+			}
+		}
+	}
+	if len(timestamps) == 0 {
+		return "", &LinkError{Op: "recovering short link", URL: link, Kind: ErrNoSnapshot}
+	}
+
+	noFollow := *client
+	noFollow.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	var lastErr error
+	for _, ts := range timestamps {
+		// id_ replays the capture as it was recorded, without the toolbar
+		target, err := shortenerHop(&noFollow, fmt.Sprintf("%s/%sid_/%s", waybackAPI, ts, link))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if m := waybackReplayPattern.FindStringSubmatch(target); m != nil {
+			target = m[3]
+		}
+		if target != link {
+			return target, nil
+		}
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("recovering short link %s: captures do not redirect anywhere", link)
+	}
+	return "", lastErr
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// generatedMarker marks a directory of pages written by archive_tool. Such
+// directories are never scanned for bookmarks, and stale pages in them are
+// removed when the indexes are regenerated.
+const generatedMarker = ".archive_tool-generated"
+
+// sitePolicy configures the published-collection indexes, from the [site]
+// section: the sitemap needs URL, the base the collection is served from.
+type sitePolicy struct {
+	URL        string
+	TagsDir    string // relative to the collection
+	PageSuffix string // replaces .md in page URLs, e.g. ".html" or "/"
+	OmitDead   bool   // leave dead, unarchived links out of the tag pages
+
+	configured bool
+}
+
+var defaultSitePolicy = sitePolicy{TagsDir: "tags", PageSuffix: ".html"}
+
+func (p *sitePolicy) set(key, value string) error {
+	switch key {
+	case "url":
+		p.URL = value
+	case "tags_dir":
+		if clean := filepath.Clean(value); clean == "." || filepath.IsAbs(clean) || strings.HasPrefix(clean, "..") {
+			return fmt.Errorf("invalid tags_dir %q: must be a directory inside the collection", value)
+		}
+		p.TagsDir = value
+	case "page_suffix":
+		p.PageSuffix = value
+	case "dead":
+		switch value {
+		case "mark":
+			p.OmitDead = false
+		case "omit":
+			p.OmitDead = true
+		default:
+			return fmt.Errorf("invalid dead %q (want mark or omit)", value)
+		}
+	default:
+		return fmt.Errorf("unknown [site] key %q", key)
+	}
+	p.configured = true
+	return nil
+}
+
+// sitePage is a bookmark as the indexes list it.
+type sitePage struct {
+	rel     string // path relative to the collection, with forward slashes
+	title   string
+	date    string
+	tags    []string
+	status  string // as in the bookmark index
+	link    string // where the link points now
+	lastMod string
+}
+
+// pageURL is where a collection file is served, relative to the site root.
+func (p sitePolicy) pageURL(rel string) string {
+	segments := strings.Split(strings.TrimSuffix(rel, ".md"), "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/") + p.PageSuffix
+}
+
+// generateSite writes the tag index pages and, with a site URL, sitemap.xml
+// into the collection.
+func generateSite(dir string, lock *LockFile, policy sitePolicy) error {
+	files, err := findMarkdownFiles(dir)
+	if err != nil {
+		return err
+	}
+	var pages []sitePage
+	for _, filePath := range files {
+		bookmark, err := parseBookmarkFile(filePath)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(dir, filePath)
+		if err != nil {
+			continue
+		}
+		row := indexRow(bookmark, lock)
+		page := sitePage{
+			rel:    filepath.ToSlash(rel),
+			title:  row.title,
+			date:   row.date,
+			tags:   bookmark.Tags,
+			status: row.status,
+			link:   bookmark.Link,
+		}
+		if page.title == "" {
+			page.title = strings.TrimSuffix(filepath.Base(filePath), ".md")
+		}
+		if info, err := os.Stat(filePath); err == nil {
+			page.lastMod = info.ModTime().UTC().Format("2006-01-02")
+		}
+		pages = append(pages, page)
+	}
+	sort.Slice(pages, func(i, j int) bool {
+		if pages[i].date != pages[j].date {
+			return pages[i].date > pages[j].date
+		}
+		return pages[i].rel < pages[j].rel
+	})
+
+	tagPages, err := writeTagPages(dir, pages, policy)
+	if err != nil {
+		return err
+	}
+	if policy.URL == "" {
+		return nil
+	}
+	return writeSitemap(dir, pages, tagPages, policy)
+}
+
+// tagSlug turns a tag into a file name.
+func tagSlug(tag string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(tag) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_', r > 127:
+			b.WriteRune(r)
+		default:
+			b.WriteByte('-')
+		}
+	}
+	return strings.Trim(b.String(), "-")
+}
+
+// writeTagPages writes one page per tag plus index.md listing the tags, and
+// returns the pages it wrote relative to the collection.
+func writeTagPages(dir string, pages []sitePage, policy sitePolicy) ([]string, error) {
+	tagsDir := filepath.Join(dir, policy.TagsDir)
+	if err := os.MkdirAll(tagsDir, 0755); err != nil {
+		return nil, err
+	}
+	marker := filepath.Join(tagsDir, generatedMarker)
+	if _, err := os.Stat(marker); os.IsNotExist(err) {
+		entries, _ := os.ReadDir(tagsDir)
+		if len(entries) > 0 {
+			return nil, fmt.Errorf("%s already exists and was not written by archive_tool; set tags_dir in [site] to another directory", tagsDir)
+		}
+		if err := os.WriteFile(marker, []byte("Pages in this directory are generated by archive_tool and overwritten on every run.\n"), 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	byTag := make(map[string][]sitePage)
+	names := make(map[string]string) // slug -> the tag as first written
+	for _, page := range pages {
+		if page.status == "none" || (policy.OmitDead && page.status == "dead") {
+			continue
+		}
+		for _, tag := range page.tags {
+			slug := tagSlug(tag)
+			if slug == "" {
+				continue
+			}
+			if _, ok := names[slug]; !ok {
+				names[slug] = tag
+			}
+			byTag[slug] = append(byTag[slug], page)
+		}
+	}
+	slugs := make([]string, 0, len(byTag))
+	for slug := range byTag {
+		slugs = append(slugs, slug)
+	}
+	sort.Strings(slugs)
+
+	// Links on tag pages are relative, so the pages work under any base URL
+	up := strings.Repeat("../", strings.Count(filepath.ToSlash(filepath.Clean(policy.TagsDir)), "/")+1)
+	written := make(map[string]bool)
+	var index bytes.Buffer
+	index.WriteString("---\ntitle: \"Tags\"\ngenerated: archive_tool\n---\n\n# Tags\n\n")
+	for _, slug := range slugs {
+		tag := names[slug]
+		tagged := byTag[slug]
+		fmt.Fprintf(&index, "- [%s](%s) (%d)\n", markdownText(tag), policy.pageURL(slug+".md"), len(tagged))
+
+		var page bytes.Buffer
+		fmt.Fprintf(&page, "---\ntitle: %q\ntag: %q\ngenerated: archive_tool\n---\n\n# %s\n\n", "Bookmarks tagged "+tag, tag, markdownText(tag))
+		for _, p := range tagged {
+			page.WriteString(tagPageItem(p, up, policy) + "\n")
+		}
+		name := slug + ".md"
+		if err := writeIfChanged(filepath.Join(tagsDir, name), page.Bytes()); err != nil {
+			return nil, err
+		}
+		written[name] = true
+	}
+	if err := writeIfChanged(filepath.Join(tagsDir, "index.md"), index.Bytes()); err != nil {
+		return nil, err
+	}
+	written["index.md"] = true
+
+	// Tags no longer in use lose their page
+	entries, err := os.ReadDir(tagsDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".md") && !written[entry.Name()] {
+			os.Remove(filepath.Join(tagsDir, entry.Name()))
+		}
+	}
+
+	var rels []string
+	for name := range written {
+		rels = append(rels, path.Join(filepath.ToSlash(policy.TagsDir), name))
+	}
+	sort.Strings(rels)
+	return rels, nil
+}
+
+// tagPageItem lists one bookmark: its page, then where the link goes and
+// whether it still works.
+func tagPageItem(p sitePage, up string, policy sitePolicy) string {
+	item := fmt.Sprintf("- [%s](%s%s)", markdownText(p.title), up, policy.pageURL(p.rel))
+	if p.date != "" {
+		item += " " + p.date
+	}
+	switch p.status {
+	case "archived":
+		item += fmt.Sprintf(" · [archived copy](%s)", p.link)
+	case "dead":
+		item += " · ~~link~~ (dead)"
+	default:
+		item += fmt.Sprintf(" · [link](%s)", p.link)
+	}
+	return item
+}
+
+// markdownText escapes the characters that would end a link text.
+func markdownText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `[`, `\[`, `]`, `\]`).Replace(s)
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+// writeSitemap lists the bookmark and tag pages in sitemap.xml. Bookmarks
+// whose link is dead and not archived are left out: their page points
+// nowhere useful.
+func writeSitemap(dir string, pages []sitePage, tagPages []string, policy sitePolicy) error {
+	base := strings.TrimSuffix(policy.URL, "/") + "/"
+	set := sitemapURLSet{XMLNS: "http://www.sitemaps.org/schemas/sitemap/0.9"}
+	for _, p := range pages {
+		if p.status == "dead" {
+			continue
+		}
+		set.URLs = append(set.URLs, sitemapURL{Loc: base + policy.pageURL(p.rel), LastMod: p.lastMod})
+	}
+	for _, rel := range tagPages {
+		u := sitemapURL{Loc: base + policy.pageURL(rel)}
+		if info, err := os.Stat(filepath.Join(dir, filepath.FromSlash(rel))); err == nil {
+			u.LastMod = info.ModTime().UTC().Format("2006-01-02")
+		}
+		set.URLs = append(set.URLs, u)
+	}
+
+	data, err := xml.MarshalIndent(set, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeIfChanged(filepath.Join(dir, "sitemap.xml"), append([]byte(xml.Header), append(data, '\n')...))
+}
+
+// writeIfChanged leaves unchanged files alone, so their modification time
+// stays a useful lastmod.
+func writeIfChanged(path string, data []byte) error {
+	if old, err := os.ReadFile(path); err == nil && bytes.Equal(old, data) {
+		return nil
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// runSite implements `archive_tool site`.
+func runSite(args []string) {
+	fs := flag.NewFlagSet("site", flag.ExitOnError)
+	siteURL := fs.String("url", "", "base `URL` the collection is published at, for sitemap.xml (default: [site] url)")
+	tagsDir := fs.String("tags-dir", "", "write tag pages to this `directory` in the collection (default: tags)")
+	fs.Parse(args)
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		os.Exit(1)
+	}
+	policy := cfg.Site
+	if *siteURL != "" {
+		policy.URL = *siteURL
+	}
+	if *tagsDir != "" {
+		if err := policy.set("tags_dir", *tagsDir); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	lock, err := loadLockFile(false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading lock file: %v\n", err)
+		os.Exit(1)
+	}
+
+	dir := indexDir(cfg, fs.Args())
+	if err := generateSite(dir, lock, policy); err != nil {
+		fmt.Fprintf(os.Stderr, "Error generating indexes: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Wrote tag pages to %s\n", filepath.Join(dir, policy.TagsDir))
+	if policy.URL == "" {
+		fmt.Println("No site URL set (--url or [site] url), so no sitemap.xml was written")
+	} else {
+		fmt.Printf("Wrote %s\n", filepath.Join(dir, "sitemap.xml"))
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultRequestCeiling bounds a single request, headers and body, when the
+// config does not say. The client timeout (30s) covers a whole redirect
+// chain; the ceiling stops any one hop from taking most of that, or a
+// server dripping out a body from holding a worker indefinitely.
+const defaultRequestCeiling = 15 * time.Second
+
+// slowHostsReported is how many of the slowest hosts a run reports, among
+// those with a request slower than slowHostThreshold.
+const (
+	slowHostsReported = 5
+	slowHostThreshold = time.Second
+)
+
+// HostLatency sums up the requests made to one host during a run.
+type HostLatency struct {
+	Host     string        `json:"host"`
+	Requests int           `json:"requests"`
+	Total    time.Duration `json:"total"`
+	Max      time.Duration `json:"max"`
+	Aborted  int           `json:"aborted,omitempty"`
+}
+
+// Mean is the average time to response headers.
+func (h *HostLatency) Mean() time.Duration {
+	if h.Requests == 0 {
+		return 0
+	}
+	return h.Total / time.Duration(h.Requests)
+}
+
+// latencyTracker records request latency per host for the slow-host report.
+type latencyTracker struct {
+	mu    sync.Mutex
+	hosts map[string]*HostLatency
+}
+
+func newLatencyTracker() *latencyTracker {
+	return &latencyTracker{hosts: make(map[string]*HostLatency)}
+}
+
+func (t *latencyTracker) record(host string, elapsed time.Duration, aborted bool) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h := t.hosts[host]
+	if h == nil {
+		h = &HostLatency{Host: host}
+		t.hosts[host] = h
+	}
+	h.Requests++
+	h.Total += elapsed
+	h.Max = max(h.Max, elapsed)
+	if aborted {
+		h.Aborted++
+	}
+}
+
+// slowest returns up to n hosts, slowest single request first.
+func (t *latencyTracker) slowest(n int) []*HostLatency {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	hosts := make([]*HostLatency, 0, len(t.hosts))
+	for _, h := range t.hosts {
+		if h.Max < slowHostThreshold {
+			continue
+		}
+		copied := *h
+		hosts = append(hosts, &copied)
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		if hosts[i].Max != hosts[j].Max {
+			return hosts[i].Max > hosts[j].Max
+		}
+		return hosts[i].Host < hosts[j].Host
+	})
+	if len(hosts) > n {
+		hosts = hosts[:n]
+	}
+	return hosts
+}
+
+// watchdogTransport aborts each request that runs past the ceiling and
+// records how long every host took to answer.
+type watchdogTransport struct {
+	base    http.RoundTripper
+	ceiling time.Duration
+	tracker *latencyTracker
+}
+
+func (t watchdogTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), t.ceiling)
+	start := time.Now()
+	resp, err := base.RoundTrip(req.WithContext(ctx))
+	elapsed := time.Since(start)
+	host := strings.ToLower(req.URL.Hostname())
+	if err != nil {
+		aborted := ctx.Err() == context.DeadlineExceeded && req.Context().Err() == nil
+		cancel()
+		t.tracker.record(host, elapsed, aborted)
+		if aborted {
+			return nil, fmt.Errorf("%s did not answer within the %s request ceiling: %w", host, t.ceiling, context.DeadlineExceeded)
+		}
+		return nil, err
+	}
+	t.tracker.record(host, elapsed, false)
+	resp.Body = &watchedBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// watchedBody keeps the ceiling running while the body is read.
+type watchedBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *watchedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// printSlowHosts lists the hosts that took longest to answer.
+func printSlowHosts(hosts []*HostLatency) {
+	if len(hosts) == 0 {
+		return
+	}
+	fmt.Println("Slowest hosts:")
+	for _, h := range hosts {
+		line := fmt.Sprintf("  %-30s max %s, mean %s over %d request(s)", h.Host,
+			h.Max.Round(time.Millisecond), h.Mean().Round(time.Millisecond), h.Requests)
+		if h.Aborted > 0 {
+			line += fmt.Sprintf(", %d aborted at the ceiling", h.Aborted)
+		}
+		fmt.Println(line)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// maxStateBackups is how many previous versions of the state file are kept,
+// as <lock>.bak.1 (newest) to <lock>.bak.N.
+const maxStateBackups = 5
+
+func stateBackupPath(lockPath string, n int) string {
+	return fmt.Sprintf("%s.bak.%d", lockPath, n)
+}
+
+// decodeLockFile parses state file contents.
+func decodeLockFile(data []byte) (*LockFile, error) {
+	var lock LockFile
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, err
+	}
+	if lock.ProcessedFiles == nil {
+		lock.ProcessedFiles = make(map[string]string)
+	}
+	return &lock, nil
+}
+
+// collectionRoot is the collection the current command works on, once its
+// options are final. The state file is saved with paths relative to it.
+var collectionRoot string
+
+// mapPaths replaces every bookmark path the state holds with fn(path).
+func (lock *LockFile) mapPaths(fn func(string) string) {
+	processed := make(map[string]string, len(lock.ProcessedFiles))
+	for path, hash := range lock.ProcessedFiles {
+		processed[fn(path)] = hash
+	}
+	lock.ProcessedFiles = processed
+	for _, run := range lock.Runs {
+		for _, r := range run.Replacements {
+			r.File = fn(r.File)
+		}
+		for _, r := range run.Secrets {
+			r.File = fn(r.File)
+		}
+		for _, r := range run.BodyLinks {
+			r.File = fn(r.File)
+		}
+		for _, r := range run.Panics {
+			r.File = fn(r.File)
+		}
+		for _, r := range run.Restored {
+			r.File = fn(r.File)
+		}
+		for i, file := range run.Failed {
+			run.Failed[i] = fn(file)
+		}
+		for _, r := range run.Redirects {
+			if r.File != "" {
+				r.File = fn(r.File)
+			}
+		}
+	}
+}
+
+// encodeLockFile encodes the state with bookmark paths relative to the
+// collection root, and the root relative to the state file. A collection
+// synced to machines with different home directories, together with its
+// state file or under each home, then shares one state file. Paths outside
+// the root, from runs over other directories, are saved absolute.
+func encodeLockFile(lock *LockFile, lockPath string) ([]byte, error) {
+	root := collectionRoot
+	if root == "" {
+		root = lock.root
+	}
+	if root == "" {
+		return json.MarshalIndent(lock, "", "  ")
+	}
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	// Relative paths go into a copy; the running command keeps its own
+	data, err := json.Marshal(lock)
+	if err != nil {
+		return nil, err
+	}
+	var saved LockFile
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, err
+	}
+	saved.Root = filepath.ToSlash(absRoot)
+	if absLock, err := filepath.Abs(lockPath); err == nil {
+		if rel, err := filepath.Rel(filepath.Dir(absLock), absRoot); err == nil {
+			saved.Root = filepath.ToSlash(rel)
+		}
+	}
+	saved.mapPaths(func(path string) string {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return path
+		}
+		rel, err := filepath.Rel(absRoot, abs)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return abs
+		}
+		return filepath.ToSlash(rel)
+	})
+	return json.MarshalIndent(&saved, "", "  ")
+}
+
+// resolvePaths turns the relative paths of a decoded state file back into
+// paths of this machine. They are joined to the collection root as the
+// command names it, so they match the paths its scan finds. State files
+// written before paths were relative have no root and are left alone.
+func (lock *LockFile) resolvePaths(lockPath string) {
+	if lock.Root == "" {
+		return
+	}
+	root := filepath.FromSlash(lock.Root)
+	if !filepath.IsAbs(root) {
+		absLock, err := filepath.Abs(lockPath)
+		if err != nil {
+			return
+		}
+		root = filepath.Join(filepath.Dir(absLock), root)
+	}
+	lock.root = root
+	base := root
+	if collectionRoot != "" {
+		if abs, err := filepath.Abs(collectionRoot); err == nil && abs == root {
+			base = collectionRoot
+		}
+	}
+	lock.mapPaths(func(path string) string {
+		if path == "" || filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(base, filepath.FromSlash(path))
+	})
+}
+
+// rotateStateBackups shifts the backups down by one and copies the current
+// state file to .bak.1. A current file that does not parse is not rotated in,
+// so corruption never pushes good backups out.
+func rotateStateBackups(lockPath string) error {
+	data, err := os.ReadFile(lockPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := decodeLockFile(data); err != nil {
+		return nil
+	}
+
+	os.Remove(stateBackupPath(lockPath, maxStateBackups))
+	for i := maxStateBackups - 1; i >= 1; i-- {
+		if err := os.Rename(stateBackupPath(lockPath, i), stateBackupPath(lockPath, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return writeFileAtomic(stateBackupPath(lockPath, 1), data, 0644)
+}
+
+// recoverLockFile handles a state file that failed to parse: the damaged file
+// is moved aside for inspection and the newest backup that parses is used
+// instead and written back in place. What happened is printed to stderr. In
+// a dry run the damaged file stays where it is and nothing is written.
+func recoverLockFile(lockPath string, parseErr error, dryRun bool) *LockFile {
+	if dryRun {
+		fmt.Fprintf(os.Stderr, "Warning: state file %s is corrupt (%v); left in place for the dry run\n", lockPath, parseErr)
+	} else {
+		corruptPath := fmt.Sprintf("%s.corrupt-%s", lockPath, time.Now().UTC().Format("20060102T150405Z"))
+		if err := os.Rename(lockPath, corruptPath); err != nil {
+			corruptPath = lockPath
+		}
+		fmt.Fprintf(os.Stderr, "Warning: state file %s is corrupt (%v); kept it as %s\n", lockPath, parseErr, corruptPath)
+	}
+
+	for i := 1; i <= maxStateBackups; i++ {
+		backup := stateBackupPath(lockPath, i)
+		data, err := os.ReadFile(backup)
+		if err != nil {
+			continue
+		}
+		lock, err := decodeLockFile(data)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: backup %s is corrupt too (%v)\n", backup, err)
+			continue
+		}
+		if !dryRun {
+			if err := writeFileAtomic(lockPath, data, 0644); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: could not write restored state to %s: %v\n", lockPath, err)
+			}
+		}
+		fmt.Fprintf(os.Stderr, "Restored state from %s, saved %s; files processed since then will be checked again\n",
+			backup, lock.LastRun.Format(time.RFC3339))
+		return lock
+	}
+
+	fmt.Fprintf(os.Stderr, "No usable backup found; starting with empty state, so every file will be checked again\n")
+	return &LockFile{ProcessedFiles: make(map[string]string), LastRun: time.Now()}
+}
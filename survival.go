@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// URLLife is when a URL was first checked and, if its latest run of checks
+// is dead, when that run began. Unlike URLHistory it is never trimmed, so
+// survival analysis can go back as far as the lock file does.
+type URLLife struct {
+	FirstSeen time.Time `json:"first_seen"`
+	Died      time.Time `json:"died,omitempty"`
+}
+
+// lifeFromHistory derives a URLLife from check history, for URLs checked
+// before lives were recorded.
+func lifeFromHistory(history []StatusEntry) URLLife {
+	var life URLLife
+	if len(history) == 0 {
+		return life
+	}
+	life.FirstSeen = history[0].Time
+	for i := len(history) - 1; i >= 0 && history[i].Dead; i-- {
+		life.Died = history[i].Time
+	}
+	return life
+}
+
+// updateLife folds a new check into the URL's life.
+func (lock *LockFile) updateLife(link string, entry StatusEntry) {
+	if lock.URLLives == nil {
+		lock.URLLives = make(map[string]URLLife)
+	}
+	life, ok := lock.URLLives[link]
+	if !ok {
+		life = lifeFromHistory(lock.URLHistory[link])
+		if life.FirstSeen.IsZero() {
+			life.FirstSeen = entry.Time
+		}
+	}
+	switch {
+	case !entry.Dead:
+		life.Died = time.Time{}
+	case life.Died.IsZero():
+		life.Died = entry.Time
+	}
+	lock.URLLives[link] = life
+}
+
+// urlLife returns what is known about a URL's life.
+func (lock *LockFile) urlLife(link string) (URLLife, bool) {
+	if life, ok := lock.URLLives[link]; ok {
+		return life, true
+	}
+	life := lifeFromHistory(lock.URLHistory[link])
+	return life, !life.FirstSeen.IsZero()
+}
+
+// survivalAges are the ages, in years, the survival summaries report.
+var survivalAges = []int{1, 5, 10}
+
+// survivalCohort is the survival curve of the links bookmarked in one year.
+type survivalCohort struct {
+	Year  int
+	Links int
+	Alive int // alive at the latest check
+
+	// Curve[k] is the fraction of links still alive k years after they
+	// were bookmarked, among those bookmarked at least k years ago; it ends
+	// at the cohort's age
+	Curve []float64
+
+	// Points and Color draw the curve in the report's SVG chart
+	Points string
+	Color  string
+}
+
+// AliveNow is the fraction of the cohort alive at its latest check.
+func (c survivalCohort) AliveNow() float64 {
+	if c.Links == 0 {
+		return 0
+	}
+	return float64(c.Alive) / float64(c.Links)
+}
+
+// At returns the survival fraction at age years, and false if the cohort is
+// not that old yet.
+func (c survivalCohort) At(years int) (float64, bool) {
+	if years >= len(c.Curve) {
+		return 0, false
+	}
+	return c.Curve[years], true
+}
+
+// survivalMilestone is the survival fraction at one of survivalAges; Known
+// is false while the cohort is younger than that.
+type survivalMilestone struct {
+	Years int
+	Alive float64
+	Known bool
+}
+
+// Milestones returns the survival fraction at each of survivalAges.
+func (c survivalCohort) Milestones() []survivalMilestone {
+	var ms []survivalMilestone
+	for _, age := range survivalAges {
+		f, ok := c.At(age)
+		ms = append(ms, survivalMilestone{Years: age, Alive: f, Known: ok})
+	}
+	return ms
+}
+
+// survivalLink is one checked bookmark: when it was saved and, if dead, when
+// it was first found dead.
+type survivalLink struct {
+	saved time.Time
+	died  time.Time
+}
+
+// survivalChart is the size of the chart's drawing area, in SVG units.
+const (
+	survivalChartWidth  = 600
+	survivalChartHeight = 300
+)
+
+// survivalPalette colours cohorts in the chart; it repeats for long
+// collections. The colours keep contrast on both light and dark themes.
+var survivalPalette = []string{"#1f77b4", "#d62728", "#2ca02c", "#ff7f0e", "#9467bd", "#8c564b", "#e377c2", "#17becf"}
+
+// survivalCohorts builds survival curves per bookmark year. A link's age at
+// death is measured from its bookmark date to the first check that found it
+// dead, so links that died before they were ever checked count as dying at
+// their first check. Links never checked are left out.
+func survivalCohorts(links []survivalLink, now time.Time) []survivalCohort {
+	byYear := make(map[int][]survivalLink)
+	for _, l := range links {
+		byYear[l.saved.Year()] = append(byYear[l.saved.Year()], l)
+	}
+
+	var cohorts []survivalCohort
+	maxAge := 0
+	for year, members := range byYear {
+		c := survivalCohort{Year: year, Links: len(members)}
+		for k := 0; k <= now.Year()-year; k++ {
+			atRisk, alive := 0, 0
+			for _, l := range members {
+				// Only links old enough to have reached age k say anything
+				if l.saved.AddDate(k, 0, 0).After(now) {
+					continue
+				}
+				atRisk++
+				if l.died.IsZero() || l.died.After(l.saved.AddDate(k, 0, 0)) {
+					alive++
+				}
+			}
+			if atRisk == 0 {
+				break
+			}
+			c.Curve = append(c.Curve, float64(alive)/float64(atRisk))
+		}
+		for _, l := range members {
+			if l.died.IsZero() {
+				c.Alive++
+			}
+		}
+		maxAge = max(maxAge, len(c.Curve)-1)
+		cohorts = append(cohorts, c)
+	}
+	sort.Slice(cohorts, func(i, j int) bool { return cohorts[i].Year < cohorts[j].Year })
+
+	for i := range cohorts {
+		cohorts[i].Color = survivalPalette[i%len(survivalPalette)]
+		var points []string
+		for k, f := range cohorts[i].Curve {
+			x := 0.0
+			if maxAge > 0 {
+				x = float64(k) * survivalChartWidth / float64(maxAge)
+			}
+			points = append(points, fmt.Sprintf("%.1f,%.1f", x, (1-f)*survivalChartHeight))
+		}
+		cohorts[i].Points = strings.Join(points, " ")
+	}
+	return cohorts
+}
+
+// survivalLinkFor looks up the life of a bookmark's original URL; links
+// already replaced with a Wayback snapshot are traced back to the URL they
+// replaced.
+func survivalLinkFor(lock *LockFile, link string, saved time.Time) (survivalLink, bool) {
+	if m := waybackReplayPattern.FindStringSubmatch(link); m != nil {
+		link = m[3]
+	}
+	life, ok := lock.urlLife(link)
+	if !ok {
+		return survivalLink{}, false
+	}
+	return survivalLink{saved: saved, died: life.Died}, true
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket activation.
+const listenFDsStart = 3
+
+// sdNotify sends a state string such as "READY=1" to the systemd notification
+// socket. It is a no-op when the process is not running under a Type=notify unit.
+func sdNotify(state string) error {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return nil
+	}
+
+	// Abstract namespace sockets are announced with a leading '@'
+	if strings.HasPrefix(socketPath, "@") {
+		socketPath = "\x00" + socketPath[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdWatchdogInterval returns how often WATCHDOG=1 should be sent, or zero if
+// the watchdog is not enabled for this process.
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	// Ping at half the deadline, as recommended by sd_watchdog_enabled(3)
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// watchdog pings systemd at most once per watchdog interval.
+type watchdog struct {
+	interval time.Duration
+	last     time.Time
+}
+
+func newWatchdog() *watchdog {
+	return &watchdog{interval: sdWatchdogInterval(), last: time.Now()}
+}
+
+func (w *watchdog) ping() {
+	if w.interval == 0 || time.Since(w.last) < w.interval {
+		return
+	}
+	w.last = time.Now()
+	sdNotify("WATCHDOG=1")
+}
+
+// sdListeners returns listeners for any sockets passed in via systemd socket
+// activation, so serve mode can be started on demand by a .socket unit.
+func sdListeners() ([]net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	var listeners []net.Listener
+	for fd := listenFDsStart; fd < listenFDsStart+count; fd++ {
+		file := os.NewFile(uintptr(fd), fmt.Sprintf("LISTEN_FD_%d", fd))
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket activation fd %d: %w", fd, err)
+		}
+		listeners = append(listeners, listener)
+	}
+
+	return listeners, nil
+}
+
+func runSystemd(args []string) {
+	if len(args) == 0 || args[0] != "install" {
+		fmt.Fprintln(os.Stderr, "Usage: archive_tool systemd install [options] [directory]")
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("systemd install", flag.ExitOnError)
+	system := fs.Bool("system", false, "install system-wide units in /etc/systemd/system instead of user units")
+	onCalendar := fs.String("on-calendar", "daily", "systemd OnCalendar expression for the timer")
+	unitDir := fs.String("unit-dir", "", "directory to write the units to (overrides --system)")
+	fs.Parse(args[1:])
+
+	dir := defaultBookmarksDir()
+	if fs.NArg() > 0 {
+		dir = fs.Arg(0)
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error resolving directory: %v\n", err)
+		os.Exit(1)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error locating executable: %v\n", err)
+		os.Exit(1)
+	}
+
+	target := *unitDir
+	if target == "" {
+		target = systemdUnitDir(*system)
+	}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating unit directory: %v\n", err)
+		os.Exit(1)
+	}
+
+	units := map[string]string{
+		"archive_tool.service": serviceUnit(exe, dir),
+		"archive_tool.timer":   timerUnit(*onCalendar),
+	}
+	for name, content := range units {
+		path := filepath.Join(target, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing %s: %v\n", path, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Wrote %s\n", path)
+	}
+
+	systemctl := "systemctl --user"
+	if *system {
+		systemctl = "systemctl"
+	}
+	fmt.Println("")
+	fmt.Println("Enable scheduled runs with:")
+	fmt.Printf("  %s daemon-reload\n", systemctl)
+	fmt.Printf("  %s enable --now archive_tool.timer\n", systemctl)
+}
+
+func systemdUnitDir(system bool) string {
+	if system {
+		return "/etc/systemd/system"
+	}
+	if configHome := os.Getenv("XDG_CONFIG_HOME"); configHome != "" {
+		return filepath.Join(configHome, "systemd", "user")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(".config", "systemd", "user")
+	}
+	return filepath.Join(home, ".config", "systemd", "user")
+}
+
+func serviceUnit(exe, dir string) string {
+	return fmt.Sprintf(`[Unit]
+Description=Check bookmark links and replace dead ones with archived versions
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=notify
+ExecStart=%s %s
+WatchdogSec=5min
+Nice=10
+`, systemdQuote(exe), systemdQuote(dir))
+}
+
+func timerUnit(onCalendar string) string {
+	return fmt.Sprintf(`[Unit]
+Description=Scheduled archive_tool run
+
+[Timer]
+OnCalendar=%s
+Persistent=true
+RandomizedDelaySec=15min
+
+[Install]
+WantedBy=timers.target
+`, onCalendar)
+}
+
+// systemdQuote quotes a path for use in an Exec line when it contains spaces.
+func systemdQuote(s string) string {
+	if !strings.ContainsAny(s, " \t\"\\") {
+		return s
+	}
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// parseTagList splits an inline frontmatter tags value. It accepts YAML flow
+// lists ("[a, b]"), comma-separated and Pinboard-style space-separated tags.
+func parseTagList(value string) []string {
+	value = strings.TrimSpace(value)
+	value = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+	if value == "" {
+		return nil
+	}
+
+	sep := func(r rune) bool { return r == ',' }
+	if !strings.Contains(value, ",") {
+		sep = func(r rune) bool { return r == ' ' || r == '\t' }
+	}
+
+	var tags []string
+	for _, tag := range strings.FieldsFunc(value, sep) {
+		tag = strings.Trim(strings.TrimSpace(tag), `"'`)
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// stringList is a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// tagSelection restricts a run to bookmarks by tag (--tag / --not-tag).
+type tagSelection struct {
+	Include stringList
+	Exclude stringList
+}
+
+func hasTag(tags []string, want string) bool {
+	for _, tag := range tags {
+		if strings.EqualFold(tag, want) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether a bookmark with these tags should be processed: it
+// must carry every --tag and none of the --not-tag tags.
+func (s tagSelection) matches(tags []string) bool {
+	for _, want := range s.Include {
+		if !hasTag(tags, want) {
+			return false
+		}
+	}
+	for _, unwanted := range s.Exclude {
+		if hasTag(tags, unwanted) {
+			return false
+		}
+	}
+	return true
+}
+
+// tagPolicies maps tags to per-tag handling, configured as
+//
+//	[tag_policies]
+//	nsfw = "skip"
+//	private = "sensitive"
+//	archive-now = "thorough"
+type tagPolicies map[string]string
+
+func (p *tagPolicies) add(tag, policy string) error {
+	if policy != "skip" && policy != "sensitive" {
+		if _, ok := runProfiles[policy]; !ok {
+			return fmt.Errorf("tag %q: unknown policy %q (want skip, sensitive or a profile name)", tag, policy)
+		}
+	}
+	if *p == nil {
+		*p = make(tagPolicies)
+	}
+	(*p)[strings.ToLower(tag)] = policy
+	return nil
+}
+
+// apply returns the profile to use for a bookmark with these tags, and
+// whether it should be skipped. "skip" wins over everything; a profile policy
+// overrides the run's profile, with thorough winning when tags disagree.
+func (p tagPolicies) apply(tags []string, profile runProfile) (runProfile, bool) {
+	chosen := ""
+	for _, tag := range tags {
+		policy, ok := p[strings.ToLower(tag)]
+		if !ok {
+			continue
+		}
+		if policy == "skip" {
+			return profile, true
+		}
+		if policy == "sensitive" {
+			continue
+		}
+		if chosen != "thorough" {
+			chosen = policy
+		}
+	}
+
+	if chosen != "" {
+		profile = runProfiles[chosen]
+	}
+	return profile, false
+}
+
+// hasSensitive reports whether any tag has the "sensitive" policy.
+func (p tagPolicies) hasSensitive() bool {
+	for _, policy := range p {
+		if policy == "sensitive" {
+			return true
+		}
+	}
+	return false
+}
+
+// sensitive reports whether any of the tags has the "sensitive" policy.
+func (p tagPolicies) sensitive(tags []string) bool {
+	for _, tag := range tags {
+		if p[strings.ToLower(tag)] == "sensitive" {
+			return true
+		}
+	}
+	return false
+}
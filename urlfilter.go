@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// urlFilter decides which links may be touched, based on a blocklist of
+// URLs/domains that are never checked and an optional allowlist that, when
+// set, restricts processing to the listed domains. Both files are re-read
+// whenever they change, so a running daemon picks up edits without a restart.
+type urlFilter struct {
+	mu        sync.Mutex
+	blockPath string
+	allowPath string
+	blockMod  time.Time
+	allowMod  time.Time
+	block     []string
+	allow     []string
+}
+
+func newURLFilter(blockPath, allowPath string) (*urlFilter, error) {
+	f := &urlFilter{blockPath: expandHome(blockPath), allowPath: expandHome(allowPath)}
+	if err := f.refresh(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// refresh reloads any list file whose modification time has changed.
+func (f *urlFilter) refresh() error {
+	if f == nil {
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := reloadRuleFile(f.blockPath, &f.blockMod, &f.block); err != nil {
+		return fmt.Errorf("blocklist: %w", err)
+	}
+	if err := reloadRuleFile(f.allowPath, &f.allowMod, &f.allow); err != nil {
+		return fmt.Errorf("allowlist: %w", err)
+	}
+	return nil
+}
+
+func reloadRuleFile(path string, modTime *time.Time, rules *[]string) error {
+	if path == "" {
+		return nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(*modTime) {
+		return nil
+	}
+
+	loaded, err := loadRules(path)
+	if err != nil {
+		return err
+	}
+
+	*rules = loaded
+	*modTime = info.ModTime()
+	return nil
+}
+
+// loadRules reads one domain or URL prefix per line, skipping blanks and
+// '#' comments.
+func loadRules(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var rules []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if idx := strings.Index(line, "#"); idx != -1 {
+			line = line[:idx]
+		}
+		line = strings.ToLower(strings.TrimSpace(line))
+		if line != "" {
+			rules = append(rules, line)
+		}
+	}
+	return rules, scanner.Err()
+}
+
+// allows reports whether the link may be checked and rewritten.
+func (f *urlFilter) allows(link string) bool {
+	if f == nil {
+		return true
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if matchesAnyRule(f.block, link) {
+		return false
+	}
+	if f.allowPath != "" {
+		return matchesAnyRule(f.allow, link)
+	}
+	return true
+}
+
+// matchesAnyRule matches rules containing "://" as URL prefixes and all other
+// rules as domains, including their subdomains.
+func matchesAnyRule(rules []string, link string) bool {
+	lower := strings.ToLower(link)
+
+	host := ""
+	if u, err := url.Parse(link); err == nil {
+		host = strings.ToLower(u.Hostname())
+	}
+
+	for _, rule := range rules {
+		if strings.Contains(rule, "://") {
+			if strings.HasPrefix(lower, rule) {
+				return true
+			}
+			continue
+		}
+
+		domain := strings.TrimPrefix(rule, "*.")
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
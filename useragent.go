@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+)
+
+// archiveUserAgent identifies the tool to archive services, so their
+// operators can tell its traffic apart and know where to report problems.
+const archiveUserAgent = "archive_tool (+https://github.com/btbytes/archive_tool)"
+
+// userAgentPolicy picks the User-Agent of every request, from the
+// [user_agents] section:
+//
+//	[user_agents]
+//	site = "Mozilla/5.0 (X11; Linux x86_64) ..."   # repeatable, rotated
+//	rotate = "host"                                # or "request"
+//	archive = "archive_tool (+mailto:me@example.org)"
+//	wayback = "..."                                # per provider
+//
+// Bookmarked sites get one of the site agents; archive services get their
+// provider's agent, or the archive agent.
+type userAgentPolicy struct {
+	Sites      []string
+	PerRequest bool // rotate on every request instead of per host
+	Archive    string
+	Providers  map[string]string
+
+	next *atomic.Uint64
+}
+
+func (p *userAgentPolicy) set(key, value string) error {
+	switch key {
+	case "site":
+		p.Sites = append(p.Sites, value)
+	case "rotate":
+		switch value {
+		case "host":
+			p.PerRequest = false
+		case "request":
+			p.PerRequest = true
+		default:
+			return fmt.Errorf("invalid rotate %q (want host or request)", value)
+		}
+	case "archive":
+		p.Archive = value
+	default:
+		if _, ok := archiveProviders[key]; !ok {
+			return fmt.Errorf("unknown [user_agents] key %q (want site, rotate, archive or a provider name)", key)
+		}
+		if p.Providers == nil {
+			p.Providers = make(map[string]string)
+		}
+		p.Providers[key] = value
+	}
+	return nil
+}
+
+// forHost returns the User-Agent for a request to host.
+func (p *userAgentPolicy) forHost(host string) string {
+	for name, provider := range archiveProviders {
+		endpoint, err := url.Parse(provider.endpoint())
+		if err != nil || !sameSite(host, endpoint.Hostname()) {
+			continue
+		}
+		if agent := p.Providers[name]; agent != "" {
+			return agent
+		}
+		if p.Archive != "" {
+			return p.Archive
+		}
+		return archiveUserAgent
+	}
+	// Pinboard is not in archiveProviders, but is an archive service all the same
+	if sameSite(host, "api.pinboard.in") {
+		if p.Archive != "" {
+			return p.Archive
+		}
+		return archiveUserAgent
+	}
+
+	switch {
+	case len(p.Sites) == 0:
+		return userAgent
+	case len(p.Sites) == 1:
+		return p.Sites[0]
+	case p.PerRequest && p.next != nil:
+		return p.Sites[(p.next.Add(1)-1)%uint64(len(p.Sites))]
+	}
+	// The same agent for every request to a host, so a site sees one
+	// consistent client
+	h := fnv.New32a()
+	h.Write([]byte(strings.ToLower(host)))
+	return p.Sites[h.Sum32()%uint32(len(p.Sites))]
+}
+
+// userAgentTransport sets each request's User-Agent from the policy.
+type userAgentTransport struct {
+	base   http.RoundTripper
+	policy *userAgentPolicy
+}
+
+func (t userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.policy.forHost(req.URL.Hostname()))
+	return base.RoundTrip(req)
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// warcPolicy is the [warc] section, or --warc and its flags:
+//
+//	[warc]
+//	dir = "warcs"      # relative to the collection
+//	split = "domain"   # one WARC per run (the default) or per run and domain
+//	assets = true      # also the images, stylesheets and scripts of pages
+type warcPolicy struct {
+	Dir    string
+	Split  string
+	Assets bool
+}
+
+var defaultWARCPolicy = warcPolicy{Split: "run"}
+
+// maxWARCAssets bounds how many assets of a page are written with it.
+const maxWARCAssets = 50
+
+func (p *warcPolicy) set(key, value string) error {
+	switch key {
+	case "dir":
+		p.Dir = value
+	case "split":
+		if value != "run" && value != "domain" {
+			return fmt.Errorf("invalid split %q (want run or domain)", value)
+		}
+		p.Split = value
+	case "assets":
+		p.Assets = value == "true"
+	default:
+		return fmt.Errorf("unknown [warc] key %q", key)
+	}
+	return nil
+}
+
+// warcArchive writes the pages a run keeps as WARC 1.1 records, each record
+// its own gzip member, and indexes them in a CDXJ file when the run ends, as
+// pywb and ArchiveBox read them.
+type warcArchive struct {
+	policy warcPolicy
+	runID  string
+	clock  Clock
+
+	mu    sync.Mutex
+	files map[string]*warcFile // by file name
+	index []string             // CDXJ lines
+	seen  map[string]bool      // URI and date of every response written
+}
+
+type warcFile struct {
+	f      *os.File
+	offset int64
+}
+
+func newWARCArchive(policy warcPolicy, runID string, clock Clock) *warcArchive {
+	return &warcArchive{policy: policy, runID: runID, clock: clock, files: make(map[string]*warcFile), seen: make(map[string]bool)}
+}
+
+// fileFor returns the WARC a page goes to, created with its warcinfo record
+// when it is first needed.
+func (a *warcArchive) fileFor(uri string) (*warcFile, string, error) {
+	name := a.runID + ".warc.gz"
+	if a.policy.Split == "domain" {
+		name = a.runID + "-" + strings.ReplaceAll(coverageHost(uri), ":", "_") + ".warc.gz"
+	}
+	if w, ok := a.files[name]; ok {
+		return w, name, nil
+	}
+	if err := os.MkdirAll(a.policy.Dir, 0755); err != nil {
+		return nil, "", err
+	}
+	f, err := os.OpenFile(filepath.Join(a.policy.Dir, name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, "", err
+	}
+	w := &warcFile{f: f}
+	a.files[name] = w
+	info := fmt.Sprintf("software: archive_tool %s\r\nformat: WARC File Format 1.1\r\nrun: %s\r\n", toolVersion(), a.runID)
+	_, _, err = w.write(newRecordID(), [][2]string{
+		{"WARC-Type", "warcinfo"},
+		{"WARC-Date", a.clock.Now().UTC().Format(time.RFC3339)},
+		{"WARC-Filename", name},
+		{"Content-Type", "application/warc-fields"},
+	}, []byte(info))
+	return w, name, err
+}
+
+// write appends the record id as one gzip member and returns where it
+// starts and how long it is compressed, for the index.
+func (w *warcFile) write(id string, headers [][2]string, block []byte) (int64, int64, error) {
+	var record bytes.Buffer
+	record.WriteString("WARC/1.1\r\n")
+	record.WriteString("WARC-Record-ID: " + id + "\r\n")
+	for _, h := range headers {
+		record.WriteString(h[0] + ": " + h[1] + "\r\n")
+	}
+	record.WriteString("WARC-Block-Digest: " + warcDigest(block) + "\r\n")
+	record.WriteString("Content-Length: " + strconv.Itoa(len(block)) + "\r\n\r\n")
+	record.Write(block)
+	record.WriteString("\r\n\r\n")
+
+	var member bytes.Buffer
+	zw := gzip.NewWriter(&member)
+	zw.Write(record.Bytes())
+	if err := zw.Close(); err != nil {
+		return 0, 0, err
+	}
+	offset := w.offset
+	n, err := w.f.Write(member.Bytes())
+	w.offset += int64(n)
+	return offset, int64(n), err
+}
+
+// capture writes a page's request and response, and with assets those of
+// the images, stylesheets and scripts it loads, taken from the same archive
+// capture for an archived page.
+func (a *warcArchive) capture(client *http.Client, page *fetchedPage) error {
+	if err := a.record(page); err != nil {
+		return err
+	}
+	if !a.policy.Assets || !page.html() {
+		return nil
+	}
+	for _, asset := range pageAssets(page) {
+		link := asset
+		if page.Archived {
+			link = fmt.Sprintf("%s/%s/%s", waybackAPI, page.Date.Format("20060102150405"), asset)
+		}
+		fetched, err := fetchPage(client, link, page.Date)
+		if err != nil {
+			continue
+		}
+		if err := a.record(fetched); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// record writes the request and response of one fetched URL, once per run.
+func (a *warcArchive) record(page *fetchedPage) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	date := page.Date.UTC().Format("20060102150405")
+	if a.seen[page.URI+" "+date] {
+		return nil
+	}
+	w, name, err := a.fileFor(page.URI)
+	if err != nil {
+		return err
+	}
+
+	response := httpResponseBlock(page)
+	responseID := newRecordID()
+	warcDate := page.Date.UTC().Format(time.RFC3339)
+	digest := warcDigest(page.Body)
+	offset, length, err := w.write(responseID, [][2]string{
+		{"WARC-Type", "response"},
+		{"WARC-Target-URI", page.URI},
+		{"WARC-Date", warcDate},
+		{"WARC-Payload-Digest", digest},
+		{"Content-Type", "application/http; msgtype=response"},
+	}, response)
+	if err != nil {
+		return err
+	}
+	if page.Request != nil {
+		_, _, err = w.write(newRecordID(), [][2]string{
+			{"WARC-Type", "request"},
+			{"WARC-Concurrent-To", responseID},
+			{"WARC-Target-URI", page.URI},
+			{"WARC-Date", warcDate},
+			{"Content-Type", "application/http; msgtype=request"},
+		}, httpRequestBlock(page))
+		if err != nil {
+			return err
+		}
+	}
+	a.seen[page.URI+" "+date] = true
+
+	mediaType := strings.TrimSpace(strings.Split(page.Header.Get("Content-Type"), ";")[0])
+	fields, _ := json.Marshal(map[string]string{
+		"url":      page.URI,
+		"mime":     mediaType,
+		"status":   strconv.Itoa(page.Status),
+		"digest":   strings.TrimPrefix(digest, "sha1:"),
+		"length":   strconv.FormatInt(length, 10),
+		"offset":   strconv.FormatInt(offset, 10),
+		"filename": name,
+	})
+	a.index = append(a.index, surtKey(page.URI)+" "+date+" "+string(fields))
+	return nil
+}
+
+// close closes the WARCs of the run and writes their index next to them. It
+// returns the files written.
+func (a *warcArchive) close() ([]string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var names []string
+	var firstErr error
+	for name, w := range a.files {
+		if err := w.f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(a.index) == 0 {
+		return names, firstErr
+	}
+	sort.Strings(a.index)
+	index := a.runID + ".cdxj"
+	if err := writeFileAtomic(filepath.Join(a.policy.Dir, index), []byte(strings.Join(a.index, "\n")+"\n"), 0644); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return append(names, index), firstErr
+}
+
+// httpResponseBlock is a response as it came over the wire. A body the
+// client decompressed has lost its Content-Encoding already, and any body
+// may have been cut at maxLocalCopyBytes, so its length is set to what is
+// recorded.
+func httpResponseBlock(page *fetchedPage) []byte {
+	var block bytes.Buffer
+	fmt.Fprintf(&block, "HTTP/1.1 %d %s\r\n", page.Status, http.StatusText(page.Status))
+	header := page.Header.Clone()
+	header.Del("Transfer-Encoding")
+	header.Set("Content-Length", strconv.Itoa(len(page.Body)))
+	header.Write(&block)
+	block.WriteString("\r\n")
+	block.Write(page.Body)
+	return block.Bytes()
+}
+
+// httpRequestBlock is the request for a page, as sent for the URL it stands
+// for.
+func httpRequestBlock(page *fetchedPage) []byte {
+	var block bytes.Buffer
+	target := "/"
+	host := ""
+	if u, err := url.Parse(page.URI); err == nil {
+		target, host = u.RequestURI(), u.Host
+	}
+	fmt.Fprintf(&block, "GET %s HTTP/1.1\r\nHost: %s\r\n", target, host)
+	page.Request.Header.Write(&block)
+	block.WriteString("\r\n")
+	return block.Bytes()
+}
+
+// warcDigest is the SHA-1 digest WARC records and CDX indexes carry.
+func warcDigest(data []byte) string {
+	sum := sha1.Sum(data)
+	return "sha1:" + base32.StdEncoding.EncodeToString(sum[:])
+}
+
+func newRecordID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// surtKey is a URL's sort key in CDX indexes: the host name reversed,
+// without "www.", then the path and query, lowercased.
+func surtKey(link string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return strings.ToLower(link)
+	}
+	key := strings.ToLower(u.Hostname())
+	if net.ParseIP(key) == nil {
+		labels := strings.Split(strings.TrimPrefix(key, "www."), ".")
+		for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+		key = strings.Join(labels, ",")
+	}
+	if port := u.Port(); port != "" && port != "80" && port != "443" {
+		key += ":" + port
+	}
+	return key + ")" + strings.ToLower(u.RequestURI())
+}
+
+var (
+	pageSrcPattern        = regexp.MustCompile(`(?is)<(?:img|script|source|video|audio|embed)\b[^>]*?\ssrc\s*=\s*["']([^"']+)["']`)
+	pageStylesheetPattern = regexp.MustCompile(`(?is)<link\b[^>]*\brel\s*=\s*["']?stylesheet\b[^>]*>`)
+)
+
+// pageAssets lists the images, stylesheets and scripts an HTML page loads,
+// absolute and each once.
+func pageAssets(page *fetchedPage) []string {
+	base, err := url.Parse(page.URI)
+	if err != nil {
+		return nil
+	}
+	html := string(page.Body)
+	var refs []string
+	for _, m := range pageSrcPattern.FindAllStringSubmatch(html, -1) {
+		refs = append(refs, m[1])
+	}
+	for _, tag := range pageStylesheetPattern.FindAllString(html, -1) {
+		if h := hrefPattern.FindStringSubmatch(tag); h != nil {
+			refs = append(refs, h[1])
+		}
+	}
+
+	seen := make(map[string]bool)
+	var assets []string
+	for _, ref := range refs {
+		u, err := base.Parse(strings.TrimSpace(ref))
+		if err != nil || u.Scheme != "http" && u.Scheme != "https" {
+			continue
+		}
+		u.Fragment = ""
+		if asset := u.String(); !seen[asset] && len(assets) < maxWARCAssets {
+			seen[asset] = true
+			assets = append(assets, asset)
+		}
+	}
+	return assets
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// legacyWaybackPattern matches every form Wayback links have taken: hosts
+// archive.org, www., web. and wayback.archive.org, http or https, short
+// timestamps, "*" and replay modifiers such as if_ and id_. Group 1 is the
+// timestamp, 2 the wildcard, 3 the modifier and 4 the original URL.
+var legacyWaybackPattern = regexp.MustCompile(`(?i)^https?://(?:web\.|www\.|wayback\.|web-beta\.)?archive\.org/web/(\d{0,14})(\*?)([a-z]{2}_)?/(.+)$`)
+
+// canonicalWayback is the current form of a Wayback link: https, host
+// web.archive.org, the full timestamp and no replay modifier. It returns ""
+// for a link whose form does not name a single capture, such as a short or
+// wildcard timestamp, which only the archive can complete.
+func canonicalWayback(link string) string {
+	m := legacyWaybackPattern.FindStringSubmatch(link)
+	if m == nil || len(m[1]) != 14 || m[2] != "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/%s/%s", waybackAPI, m[1], fixCollapsedScheme(m[4]))
+}
+
+// fixCollapsedScheme restores the double slash some tools collapse in the
+// original URL of a replay path, as in /web/2015.../http:/example.com.
+func fixCollapsedScheme(original string) string {
+	for _, scheme := range []string{"http:/", "https:/"} {
+		if strings.HasPrefix(original, scheme) && !strings.HasPrefix(original, scheme+"/") {
+			return scheme + "/" + original[len(scheme):]
+		}
+	}
+	return original
+}
+
+// Outcomes of verifying one archived link.
+const (
+	archivedOK       = "ok"
+	archivedRefresh  = "refreshed" // the same capture, in the canonical form
+	archivedMoved    = "moved"     // replays, but from another capture
+	archivedReplaced = "replaced"  // no longer replays; another capture does
+	archivedBroken   = "broken"    // no capture of the original replays
+	archivedSkipped  = "skipped"   // not checked: sensitive, or not a capture
+	archivedError    = "error"
+)
+
+type archivedResult struct {
+	File    string
+	Link    string
+	Outcome string
+	NewURL  string
+	Err     error
+}
+
+// verifyArchived replays a bookmark's Wayback link and works out the link it
+// should have: the canonical form of the capture it replays, or of the
+// capture closest to it when it no longer replays.
+func verifyArchived(client *http.Client, providers *providerChain, link string) (string, string, error) {
+	m := legacyWaybackPattern.FindStringSubmatch(link)
+	if m == nil {
+		return archivedSkipped, "", nil
+	}
+	original := fixCollapsedScheme(m[4])
+	if err := providers.permit(original); err != nil {
+		return archivedSkipped, "", nil
+	}
+
+	ts := m[1]
+	if ts == "" || m[2] != "" {
+		// A wildcard asks for the calendar, not a capture; the latest is
+		// closest to what it meant
+		ts = "2"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultProviderTimeout)
+	defer cancel()
+	final, err := headSnapshot(ctx, client, fmt.Sprintf("%s/%s/%s", waybackAPI, ts, original))
+	if err != nil {
+		return archivedError, "", err
+	}
+	if final != "" {
+		canonical := canonicalWayback(final)
+		if canonical == "" {
+			canonical = final
+		}
+		switch {
+		case canonical == link:
+			return archivedOK, "", nil
+		case canonicalWayback(link) != "" && canonicalWayback(link) != canonical:
+			return archivedMoved, canonical, nil
+		}
+		return archivedRefresh, canonical, nil
+	}
+
+	// The capture is gone, e.g. excluded since; take the closest that is not
+	q := url.Values{}
+	q.Set("url", wireURL(original))
+	q.Set("fl", "timestamp,original")
+	q.Set("closest", m[1])
+	q.Set("sort", "closest")
+	q.Set("limit", "1")
+	rows, err := cdxQuery(client, q)
+	if err != nil {
+		return archivedError, "", err
+	}
+	if len(rows) == 0 || len(rows[0]) < 2 {
+		return archivedBroken, "", nil
+	}
+	// The row names the capture, but it has to replay too
+	replacement := fmt.Sprintf("%s/%s/%s", waybackAPI, rows[0][0], rows[0][1])
+	if final, err = headSnapshot(ctx, client, replacement); err != nil {
+		return archivedError, "", err
+	}
+	if final == "" {
+		return archivedBroken, "", nil
+	}
+	if canonical := canonicalWayback(final); canonical != "" {
+		final = canonical
+	}
+	return archivedReplaced, final, nil
+}
+
+// runVerifyArchived implements `archive_tool verify-archived`: it checks
+// that the bookmarks already pointing into the Wayback Machine still replay,
+// and rewrites links in deprecated forms, or to captures that are gone, to
+// the canonical URL of a capture that replays.
+func runVerifyArchived(args []string) {
+	fs := flag.NewFlagSet("verify-archived", flag.ExitOnError)
+	opts := runOptions{Profile: runProfiles["fast"]}
+	opts.register(fs)
+	concurrency := fs.Int("concurrency", 4, "snapshots verified at once")
+	checkOnly := fs.Bool("check-only", false, "only report; never rewrite a bookmark")
+	fs.Parse(args)
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		os.Exit(1)
+	}
+	if err := opts.finish(cfg, fs.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	lock, err := loadLockFile(false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading lock file: %v\n", err)
+		os.Exit(1)
+	}
+	files, err := findMarkdownFiles(opts.Dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading directory: %v\n", err)
+		os.Exit(1)
+	}
+	if opts.Shard.Count > 1 {
+		files = opts.Shard.filter(opts.Dir, files)
+	}
+	opts.Providers.sensitive.scan(files)
+
+	bookmarks := make(map[string]*BookmarkFile)
+	var paths []string
+	for _, filePath := range files {
+		bookmark, err := parseBookmarkFile(filePath)
+		if err != nil || !isWaybackURL(bookmark.Link) || !opts.Tags.matches(bookmark.Tags) {
+			continue
+		}
+		if opts.Providers.sensitive.markBookmark(bookmark) {
+			continue
+		}
+		bookmarks[filePath] = bookmark
+		paths = append(paths, filePath)
+	}
+	fmt.Printf("Verifying %d archived links\n", len(paths))
+
+	client := opts.httpClient()
+	var mu sync.Mutex
+	var results []archivedResult
+	runPool(paths, *concurrency, func(filePath string) {
+		bookmark := bookmarks[filePath]
+		outcome, newURL, err := verifyArchived(client, opts.Providers, bookmark.Link)
+		mu.Lock()
+		defer mu.Unlock()
+		results = append(results, archivedResult{File: filePath, Link: bookmark.Link, Outcome: outcome, NewURL: newURL, Err: err})
+	})
+	sort.Slice(results, func(i, j int) bool { return results[i].File < results[j].File })
+
+	counts := make(map[string]int)
+	rewritten, failed := 0, 0
+	for _, r := range results {
+		counts[r.Outcome]++
+		switch r.Outcome {
+		case archivedError:
+			fmt.Fprintf(os.Stderr, "Error verifying %s: %v\n", r.Link, r.Err)
+			continue
+		case archivedBroken:
+			fmt.Printf("\nNo capture replays any more: %s\n  %s\n", r.File, r.Link)
+			continue
+		case archivedOK, archivedSkipped:
+			continue
+		}
+
+		fmt.Printf("\n%s (%s): %s\n  -> %s\n", r.File, r.Outcome, r.Link, r.NewURL)
+		if *checkOnly {
+			continue
+		}
+		// Only the form changed, or the link points at another copy of the
+		// same page: a processed file stays processed
+		processed := isFileProcessed(lock, r.File)
+		if err := lock.rewriteBookmark(bookmarks[r.File], r.NewURL); err != nil {
+			fmt.Fprintf(os.Stderr, "Error updating %s: %v\n", r.File, err)
+			failed++
+			continue
+		}
+		if processed {
+			if err := markFileProcessed(lock, r.File); err != nil {
+				fmt.Fprintf(os.Stderr, "Error updating the lock file for %s: %v\n", r.File, err)
+			}
+		}
+		rewritten++
+	}
+
+	if rewritten > 0 {
+		if err := saveLockFile(lock); err != nil {
+			fmt.Fprintf(os.Stderr, "Error saving lock file: %v\n", err)
+		}
+	}
+	fmt.Printf("\nArchived links: %d replay as they are, %d refreshed to the canonical form, %d moved to the capture they replay, %d replaced by another capture, %d broken, %d not verified",
+		counts[archivedOK], counts[archivedRefresh], counts[archivedMoved], counts[archivedReplaced], counts[archivedBroken], counts[archivedError])
+	if *checkOnly {
+		fmt.Print(" (check only, nothing rewritten)")
+	} else {
+		fmt.Printf("; rewrote %d bookmark(s)", rewritten)
+	}
+	fmt.Println()
+	if failed > 0 || counts[archivedError] > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// webdavStore keeps blobs as files in a WebDAV collection, such as a
+// Nextcloud folder, with basic authentication.
+type webdavStore struct {
+	profile  storageProfile
+	password string
+	client   *http.Client
+
+	mkcolOnce sync.Once
+	mkcolErr  error
+}
+
+func (s *webdavStore) name() string { return s.collectionURL() }
+
+// collectionURL is the collection blobs go in, with a trailing slash.
+func (s *webdavStore) collectionURL() string {
+	return strings.TrimSuffix(s.profile.Endpoint+"/"+strings.Trim(s.profile.Prefix, "/"), "/") + "/"
+}
+
+func (s *webdavStore) blobURL(key string) string {
+	return s.collectionURL() + url.PathEscape(key)
+}
+
+func (s *webdavStore) do(method, target string, body []byte, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if s.profile.User != "" {
+		req.SetBasicAuth(s.profile.User, s.password)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, classifyError("storage", target, err)
+	}
+	return resp, nil
+}
+
+// ensureCollection creates the collection blobs go in, once per process.
+// A 405 means it exists already.
+func (s *webdavStore) ensureCollection() error {
+	s.mkcolOnce.Do(func() {
+		resp, err := s.do("MKCOL", s.collectionURL(), nil, nil)
+		if err != nil {
+			s.mkcolErr = err
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusMethodNotAllowed {
+			s.mkcolErr = fmt.Errorf("creating %s: status %d", s.collectionURL(), resp.StatusCode)
+		}
+	})
+	return s.mkcolErr
+}
+
+func (s *webdavStore) put(key string, data []byte, contentType string) error {
+	if err := s.ensureCollection(); err != nil {
+		return err
+	}
+	header := http.Header{}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	resp, err := s.do("PUT", s.blobURL(key), data, header)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("put %s: status %d", key, resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *webdavStore) get(key string) ([]byte, error) {
+	resp, err := s.do("GET", s.blobURL(key), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errBlobNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get %s: status %d", key, resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (s *webdavStore) has(key string) (bool, error) {
+	resp, err := s.do("HEAD", s.blobURL(key), nil, nil)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("head %s: status %d", key, resp.StatusCode)
+}
+
+func (s *webdavStore) remove(key string) error {
+	resp, err := s.do("DELETE", s.blobURL(key), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("delete %s: status %d", key, resp.StatusCode)
+	}
+	return nil
+}
+
+// list reads the collection with a depth-1 PROPFIND, keeping its files.
+func (s *webdavStore) list() ([]string, error) {
+	header := http.Header{"Depth": {"1"}, "Content-Type": {"application/xml"}}
+	body := []byte(`<?xml version="1.0"?><propfind xmlns="DAV:"><prop><resourcetype/></prop></propfind>`)
+	resp, err := s.do("PROPFIND", s.collectionURL(), body, header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, fmt.Errorf("list %s: status %d", s.collectionURL(), resp.StatusCode)
+	}
+
+	var answer struct {
+		Responses []struct {
+			Href       string `xml:"href"`
+			Collection *struct {
+			} `xml:"propstat>prop>resourcetype>collection"`
+		} `xml:"response"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return nil, fmt.Errorf("list %s: %w", s.collectionURL(), err)
+	}
+	var keys []string
+	for _, r := range answer.Responses {
+		if r.Collection != nil {
+			continue
+		}
+		href, err := url.PathUnescape(r.Href)
+		if err != nil {
+			continue
+		}
+		if key := path.Base(href); key != "" && !strings.HasPrefix(key, ".") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *webdavStore) url(key string) string { return publicBlobURL(s.profile.PublicURL, key) }